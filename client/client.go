@@ -1,45 +1,55 @@
 package client
 
 import (
-    "bufio"
     "context"
     "encoding/binary"
     "flag"
     "fmt"
-    "log"
     "math/rand"
     "net"
     "os"
-
-    "github.com/natanbc/ssc0904-nat-traversal/stun"
+    "os/signal"
+    "strings"
+    "syscall"
 
     "github.com/peterbourgon/ff/v3/ffcli"
 )
 
 var (
-    coordinationServer string
-    stunServer         string
+    outputFormat string
+    controlAddr  string
 )
 
 var fs = (func() *flag.FlagSet {
     fs := flag.NewFlagSet("client", flag.ExitOnError)
-    fs.StringVar(&coordinationServer, "coordination-server", "https://ssc0904-coord.natanbc.net", "Coordination server to use")
-    fs.StringVar(&stunServer,         "stun-server",         "stun.l.google.com:19302",           "STUN server to use")
+    addSessionFlags(fs)
+    fs.StringVar(&outputFormat, "format",  "text", "Input and output format, text for people or jsonl for programs")
+    fs.StringVar(&controlAddr,  "control", "",     "Serves the control API on a unix socket or loopback address, e.g. " + defaultControlAddr)
     return fs
 })()
 
 const magicData uint64 = 0x4441544144415441 //DATADATA
 const magicPing uint64 = 0x50494e4750494e47 //PINGPING
-
-func makeDataMessage(data []byte) []byte {
+const magicDHT  uint64 = 0x4448544e4448544e //DHTNDHTN
+const magicIPv4 uint64 = 0x4950563449505634 //IPV4IPV4
+const magicStream uint64 = 0x5354524d5354524d //STRMSTRM
+const magicMessage uint64 = 0x4d5347534d534753 //MSGSMSGS
+const magicEcho uint64 = 0x4543484f4543484f //ECHOECHO
+const magicTopic uint64 = 0x544f5043544f5043 //TOPCTOPC
+
+func makeMessage(magic uint64, data []byte) []byte {
     b := make([]byte, len(data) + 128)
     //for some godforsaken reason my NAT drops small UDP packets
     _, _  = rand.Read(b[:128])
     copy(b[128:], data)
-    binary.BigEndian.PutUint64(b[:8], magicData)
+    binary.BigEndian.PutUint64(b[:8], magic)
     return b
 }
 
+func makeDataMessage(data []byte) []byte {
+    return makeMessage(magicData, data)
+}
+
 func makePingMessage() []byte {
     b := make([]byte, 128)
     //for some godforsaken reason my NAT drops small UDP packets
@@ -53,87 +63,178 @@ func parseMessage(msg []byte) ([]byte, uint64, error) {
         return nil, 0, fmt.Errorf("Message too small")
     }
     magic := binary.BigEndian.Uint64(msg[:8])
-    if magic == magicData {
-        return msg[128:], magic, nil
-    }
     if magic == magicPing {
         return nil, magic, nil
     }
-    return nil, 0, fmt.Errorf("Unknown magic %X", magic)
+    if len(msg) < 128 {
+        return nil, 0, fmt.Errorf("Message too small")
+    }
+    return msg[128:], magic, nil
+}
+
+//wraps a packet of a topic joined alongside others: the topic tag, the magic of the
+//packet then its payload, without the padding
+func makeTopicMessage(tag uint64, msg []byte) []byte {
+    b := make([]byte, 16, 16 + len(msg) - 8)
+    binary.BigEndian.PutUint64(b[:8], tag)
+    copy(b[8:16], msg[:8])
+    if len(msg) > 128 {
+        b = append(b, msg[128:]...)
+    }
+    return makeMessage(magicTopic, b)
+}
+
+func parseTopicMessage(data []byte) (uint64, uint64, []byte, error) {
+    if len(data) < 16 {
+        return 0, 0, nil, fmt.Errorf("Topic message too small")
+    }
+    tag := binary.BigEndian.Uint64(data[:8])
+    magic := binary.BigEndian.Uint64(data[8:16])
+    if magic == magicTopic {
+        return 0, 0, nil, fmt.Errorf("Nested topic message")
+    }
+    return tag, magic, data[16:], nil
+}
+
+//splits a comma separated list, ignoring empty items
+func splitList(list string) []string {
+    res := []string(nil)
+    for _, v := range strings.Split(list, ",") {
+        if v = strings.TrimSpace(v); v != "" {
+            res = append(res, v)
+        }
+    }
+    return res
+}
+
+func parseAddrList(list string) ([]*net.UDPAddr, error) {
+    res := []*net.UDPAddr(nil)
+    for _, v := range strings.Split(list, ",") {
+        if v = strings.TrimSpace(v); v == "" {
+            continue
+        }
+        addr, err := net.ResolveUDPAddr("udp4", v)
+        if err != nil {
+            return nil, fmt.Errorf("Unable to resolve '%s': %w", v, err)
+        }
+        res = append(res, addr)
+    }
+    return res, nil
+}
+
+//splits a comma separated list of topics, which must not repeat
+func parseTopicList(list string) ([]string, error) {
+    res := []string(nil)
+    seen := make(map[string]struct{})
+    for _, v := range strings.Split(list, ",") {
+        if v = strings.TrimSpace(v); v == "" {
+            continue
+        }
+        if _, ok := seen[v]; ok {
+            return nil, fmt.Errorf("Topic '%s' given more than once", v)
+        }
+        seen[v] = struct{}{}
+        res = append(res, v)
+    }
+    if len(res) == 0 {
+        return nil, fmt.Errorf("No topic given")
+    }
+    return res, nil
+}
+
+//receives SIGINT and SIGTERM, so returning on them runs the deferred cleanup, like
+//deleting the port mapping
+func interrupted() <-chan os.Signal {
+    c := make(chan os.Signal, 1)
+    signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+    return c
 }
 
 var Command = &ffcli.Command {
     Name:       "client",
-    ShortUsage: "client [flags] <topic> <name>",
-    ShortHelp:  "Starts a client and connects to other clients on the same topic",
+    ShortUsage: "client [flags] <topic[,topic...]> <name>",
+    ShortHelp:  "Starts a client and connects to other clients on the same topics",
+    LongHelp:   "Starts a client and connects to other clients on the same topics. Every topic is joined " +
+                "over the same socket, the first one is used by default.",
     FlagSet:    fs,
+    Subcommands: []*ffcli.Command {
+        vpnCommand,
+        forwardCommand,
+        socksCommand,
+        sendFileCommand,
+        receiveFilesCommand,
+        pipeCommand,
+        ctlCommand,
+    },
     Exec:       func(ctx context.Context, args []string) error {
         if len(args) != 2 {
             return flag.ErrHelp
         }
-        topic := args[0]
-        name  := args[1]
-
-        s, err := stun.New(stunServer)
+        topics, err := parseTopicList(args[0])
         if err != nil {
             return err
         }
-        log.Printf("Local address:  %s", s.Conn.LocalAddr().String())
-        log.Printf("Public address: %s", s.PublicAddr().String())
-
-        ping := func(addr *net.UDPAddr) {
-            s.Conn.WriteTo(makePingMessage(), addr)
+        name := args[1]
+        if outputFormat != "text" && outputFormat != "jsonl" {
+            return fmt.Errorf("Unknown format '%s'", outputFormat)
         }
 
-        peers, err := newPeerRegistry(coordinationServer, topic, name, s.PublicAddr(), ping)
+        h, err := newHost(ctx, topics, name)
         if err != nil {
             return err
         }
-
-        go func() {
-            reader := bufio.NewReader(os.Stdin)
-            for {
-                text, err := reader.ReadBytes('\n')
-                if err != nil {
-                    log.Printf("Input closed")
-                    return
-                }
-                if len(text) > 0 && text[len(text) - 1] == '\n' {
-                    text = text[:len(text) - 1]
-                }
-                if len(text) > 0 && text[len(text) - 1] == '\r' {
-                    text = text[:len(text) - 1]
-                }
-                if len(text) == 0 {
-                    continue
-                }
-                log.Printf("Sending message '%s'", string(text))
-                msg := makeDataMessage(text)
-                peers.forEachPeerAddress(func(addr *net.UDPAddr) {
-                    log.Printf("Sending data packet to %v", addr)
-                    s.Conn.WriteTo(msg, addr)
-                })
+        defer h.close()
+        sessions := h.getSessions()
+        interrupt := interrupted()
+        errs := make(chan error, 1)
+
+        //the control API shares the messengers of the frontend
+        var ctl *controlServer
+        defer func() {
+            if ctl != nil {
+                ctl.close()
             }
         }()
+        startControl := func(t topicList) error {
+            if controlAddr == "" {
+                return nil
+            }
+            ctl, err = newControlServer(t, controlAddr)
+            return err
+        }
 
-        for {
-            msg, sender, err := s.Read()
-            if err != nil {
+        if outputFormat == "jsonl" {
+            f := newJsonlFrontend(sessions, os.Stdout)
+            if err := startControl(f.topics); err != nil {
                 return err
             }
-            peerName := peers.peerName(sender)
-
-            data, typ, err := parseMessage(msg)
-            if err != nil {
-                log.Printf("[%s aka %s]: %v", sender.String(), peerName, err)
-                continue
+            for _, s := range sessions {
+                go s.measureRTT(nil)
             }
-            if typ == magicPing {
-                peers.onPing(sender)
-                continue
+            go f.run(os.Stdin)
+            go func() { errs <- h.run() }()
+            select {
+                case err := <-errs:
+                    return err
+                case <-interrupt:
+                    return nil
             }
-            log.Printf("[%s aka %s]: %s", sender.String(), peerName, string(data))
+        }
+
+        c := newConsole(sessions)
+        if err := startControl(c.topics); err != nil {
+            return err
+        }
+        go c.run()
+
+        go func() { errs <- h.run() }()
+        select {
+            case err := <-errs:
+                return err
+            case <-c.quitted():
+                return nil
+            case <-interrupt:
+                return nil
         }
     },
 }
-
@@ -0,0 +1,57 @@
+package client
+
+import (
+    "testing"
+)
+
+//tagged packets built whole and built from a session header parse the same
+func TestTopicMessageEncoding(t *testing.T) {
+    tag := topicTag("t1")
+    if tag == topicTag("t2") {
+        t.Fatal("Topics share a tag")
+    }
+
+    s := &session {
+        host: &host { tagged: true },
+        tag:  tag,
+    }
+    header := s.header(make([]byte, 128 + 16), magicData)
+    packets := map[string][]byte {
+        "wrapped": makeTopicMessage(tag, makeDataMessage([]byte("hello"))),
+        "header":  append(header, "hello"...),
+    }
+    for how, msg := range packets {
+        data, typ, err := parseMessage(msg)
+        if err != nil || typ != magicTopic {
+            t.Fatalf("Parsed %s packet as %x: %v", how, typ, err)
+        }
+        gotTag, inner, payload, err := parseTopicMessage(data)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if gotTag != tag || inner != magicData || string(payload) != "hello" {
+            t.Fatalf("Parsed %s packet as tag %x, magic %x, '%s'", how, gotTag, inner, payload)
+        }
+    }
+
+    //pings have no payload past the padding
+    data, _, _ := parseMessage(makeTopicMessage(tag, makePingMessage()))
+    if _, inner, payload, err := parseTopicMessage(data); err != nil || inner != magicPing || len(payload) != 0 {
+        t.Fatalf("Parsed ping as magic %x, %d bytes: %v", inner, len(payload), err)
+    }
+
+    //untagged sessions send plain packets
+    s.host.tagged = false
+    if _, typ, _ := parseMessage(append(s.header(make([]byte, 128), magicData), "x"...)); typ != magicData {
+        t.Fatalf("Untagged packet parsed as %x", typ)
+    }
+
+    nested := makeTopicMessage(tag, makeTopicMessage(tag, makeDataMessage(nil)))
+    data, _, _ = parseMessage(nested)
+    if _, _, _, err := parseTopicMessage(data); err == nil {
+        t.Fatal("Parsed a nested topic message")
+    }
+    if _, _, _, err := parseTopicMessage(make([]byte, 15)); err == nil {
+        t.Fatal("Parsed a truncated topic message")
+    }
+}
@@ -0,0 +1,445 @@
+package client
+
+import (
+    "bufio"
+    "context"
+    "encoding/binary"
+    "fmt"
+    "io"
+    "log"
+    "os"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+
+    "golang.org/x/term"
+)
+
+const (
+    consolePingTimeout  = 3 * time.Second
+    //pings sent at once by /punch
+    consolePunchBurst   = 10
+)
+
+type consoleCommand struct {
+    name  string
+    usage string
+    help  string
+    //whether the arguments are peer names, for tab completion
+    peers bool
+    run   func(c *console, arg string) error
+}
+
+var consoleCommands []*consoleCommand
+
+//filled in init since /help refers to the list itself
+func init() {
+    consoleCommands = []*consoleCommand {
+        { name: "/help",  usage: "/help",                          help: "Lists the commands",                                   run: (*console).help },
+        { name: "/peers", usage: "/peers",                         help: "Lists the peers with their state, RTT and address",    run: (*console).peers },
+        { name: "/msg",   usage: "/msg name[,name...] text",       help: "Sends a message to the listed peers only",             run: (*console).msg, peers: true },
+        { name: "/join",  usage: "/join channel",                  help: "Joins a channel and sends the next messages to it",    run: (*console).join },
+        { name: "/leave", usage: "/leave [channel]",               help: "Leaves a channel, the current one by default",         run: (*console).leave },
+        { name: "/topic", usage: "/topic [topic]",                 help: "Lists the topics, or sends the next messages to one",  run: (*console).topic },
+        { name: "/ping",  usage: "/ping name",                     help: "Measures the round trip time to a peer",               run: (*console).ping, peers: true },
+        { name: "/punch", usage: "/punch name",                    help: "Punches the path to a peer again",                     run: (*console).punch, peers: true },
+        { name: "/stats", usage: "/stats",                         help: "Shows packet counters and time to connect to peers",  run: (*console).stats },
+        { name: "/nick",  usage: "/nick name",                     help: "Changes the name we're known by in the current topic", run: (*console).nick },
+        { name: "/quit",  usage: "/quit",                          help: "Leaves the topic and exits",                           run: (*console).quit },
+    }
+}
+
+func findConsoleCommand(name string) *consoleCommand {
+    for _, cmd := range consoleCommands {
+        if cmd.name == name {
+            return cmd
+        }
+    }
+    return nil
+}
+
+//console reads lines typed by the user, dispatching those starting with a slash to
+//their command and sending anything else to the current channel of the current topic
+type console struct {
+    topics   topicList
+
+    mu       sync.Mutex
+    current  *messenger
+    channel  string
+    quitting bool
+
+    done     chan struct{}
+}
+
+func newConsole(sessions []*session) *console {
+    c := &console {
+        channel: defaultChannel,
+        done:    make(chan struct{}),
+    }
+    for _, s := range sessions {
+        c.topics = append(c.topics, newMessenger(s, func(msg chatMessage) {
+            line := formatChatMessage(msg)
+            if len(sessions) > 1 {
+                line = "[" + msg.topic + "] " + line
+            }
+            log.Print(line)
+        }))
+    }
+    c.current = c.topics[0]
+    return c
+}
+
+//the messenger and session of the topic messages are sent to
+func (c *console) messenger() *messenger {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return c.current
+}
+
+func (c *console) session() *session {
+    return c.messenger().s
+}
+
+func (c *console) currentChannel() string {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return c.channel
+}
+
+func (c *console) setChannel(channel string) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.channel = channel
+}
+
+//closed once the user quit and the terminal was restored
+func (c *console) quitted() <-chan struct{} {
+    return c.done
+}
+
+func (c *console) shouldQuit() bool {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return c.quitting
+}
+
+func (c *console) dispatch(line string) error {
+    if !strings.HasPrefix(line, "/") || strings.HasPrefix(line, "//") {
+        line = strings.TrimPrefix(line, "/")
+        log.Printf("Sending message '%s'", line)
+        return c.messenger().broadcast(c.currentChannel(), []byte(line))
+    }
+
+    name, arg, _ := strings.Cut(line, " ")
+    cmd := findConsoleCommand(name)
+    if cmd == nil {
+        return fmt.Errorf("Unknown command %s, see /help. Messages starting with / must be sent as //", name)
+    }
+    return cmd.run(c, strings.TrimSpace(arg))
+}
+
+func (c *console) help(arg string) error {
+    for _, cmd := range consoleCommands {
+        log.Printf("%-28s %s", cmd.usage, cmd.help)
+    }
+    return nil
+}
+
+func (c *console) peers(arg string) error {
+    infos := c.session().peers.peerInfos()
+    if len(infos) == 0 {
+        log.Printf("No peers")
+        return nil
+    }
+    for _, info := range infos {
+        rtt := "-"
+        if info.rtt > 0 {
+            rtt = info.rtt.Round(10 * time.Microsecond).String()
+        }
+        log.Printf("%-16s %-10s %-10s %s", info.peer.Name, info.state(), rtt, info.peer.IPPort().String())
+    }
+    return nil
+}
+
+func (c *console) msg(arg string) error {
+    to, text, ok := strings.Cut(arg, " ")
+    if !ok || text == "" {
+        return fmt.Errorf("Usage: /msg name[,name...] text")
+    }
+    log.Printf("Sending message '%s' to %s", text, to)
+    return c.messenger().sendTo(parseRecipients(to), c.currentChannel(), []byte(text))
+}
+
+func (c *console) join(arg string) error {
+    if arg == "" {
+        return fmt.Errorf("Usage: /join channel")
+    }
+    if err := c.messenger().join(arg); err != nil {
+        return err
+    }
+    c.setChannel(arg)
+    log.Printf("Sending to channel #%s", arg)
+    return nil
+}
+
+func (c *console) leave(arg string) error {
+    current := c.currentChannel()
+    if arg == "" {
+        arg = current
+    }
+    c.messenger().leave(arg)
+    if arg == current {
+        c.setChannel(defaultChannel)
+        log.Printf("Sending to the whole topic")
+    }
+    return nil
+}
+
+func (c *console) topic(arg string) error {
+    if arg == "" {
+        current := c.messenger()
+        for _, m := range c.topics {
+            mark := " "
+            if m == current {
+                mark = "*"
+            }
+            log.Printf("%s %s (as %s)", mark, m.s.topic, m.s.getName())
+        }
+        return nil
+    }
+    m, err := c.topics.find(arg)
+    if err != nil {
+        return err
+    }
+    c.mu.Lock()
+    c.current = m
+    c.channel = defaultChannel
+    c.mu.Unlock()
+    log.Printf("Sending to topic %s", arg)
+    return nil
+}
+
+func (c *console) ping(arg string) error {
+    addr, ok := c.session().peers.peerAddr(arg)
+    if !ok {
+        return fmt.Errorf("Unknown peer '%s'", arg)
+    }
+    ctx, cancel := context.WithTimeout(context.Background(), consolePingTimeout)
+    defer cancel()
+
+    rtt, err := c.session().echo(ctx, addr)
+    if err != nil {
+        return fmt.Errorf("No reply from %s: %w", arg, err)
+    }
+    log.Printf("Reply from %s (%s): %v", arg, addr.String(), rtt)
+    return nil
+}
+
+func (c *console) punch(arg string) error {
+    addr, ok := c.session().peers.peerAddr(arg)
+    if !ok || !c.session().peers.resetPunch(arg) {
+        return fmt.Errorf("Unknown peer '%s'", arg)
+    }
+    log.Printf("Punching %s (%s)", arg, addr.String())
+    for i := 0; i < consolePunchBurst; i++ {
+        if err := c.session().write(makePingMessage(), addr); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+//names magic values by their ASCII form when printable
+func magicName(magic uint64) string {
+    var b [8]byte
+    binary.BigEndian.PutUint64(b[:], magic)
+    for _, v := range b {
+        if v < 0x20 || v > 0x7E {
+            return fmt.Sprintf("%016X", magic)
+        }
+    }
+    return string(b[:])
+}
+
+func (c *console) stats(arg string) error {
+    stats := c.session().getStats()
+    log.Printf("Sent %d packets (%d bytes), received %d packets (%d bytes)",
+        stats.packetsSent, stats.bytesSent, stats.packetsReceived, stats.bytesReceived)
+
+    magics := make([]uint64, 0, len(stats.received))
+    for k := range stats.received {
+        magics = append(magics, k)
+    }
+    sort.Slice(magics, func(i, j int) bool {
+        return magics[i] < magics[j]
+    })
+    for _, k := range magics {
+        log.Printf("  %-16s %d packets", magicName(k), stats.received[k])
+    }
+
+    connected := 0
+    infos := c.session().peers.peerInfos()
+    for _, info := range infos {
+        if info.state() == "connected" {
+            connected++
+        }
+    }
+    log.Printf("%d peers, %d connected", len(infos), connected)
+
+    times := c.session().peers.connectStats()
+    for _, strategy := range sortedStrategies(times) {
+        t := times[strategy]
+        log.Printf("  %-16s %d peers connected in %v on average (%v to %v)", strategy, t.peers,
+            t.mean().Round(time.Millisecond), t.min.Round(time.Millisecond), t.max.Round(time.Millisecond))
+    }
+    return nil
+}
+
+func (c *console) nick(arg string) error {
+    if arg == "" || strings.ContainsAny(arg, " ,") {
+        return fmt.Errorf("Usage: /nick name, names can't contain spaces or commas")
+    }
+    if err := c.session().rename(arg); err != nil {
+        return fmt.Errorf("Unable to change name: %w", err)
+    }
+    log.Printf("Now known as %s", arg)
+    return nil
+}
+
+func (c *console) quit(arg string) error {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.quitting = true
+    return nil
+}
+
+//completes command names, and peer names for the commands taking them
+func (c *console) complete(line string, pos int, key rune) (string, int, bool) {
+    if key != '\t' {
+        return "", 0, false
+    }
+    head := line[:pos]
+
+    var candidates []string
+    start := strings.LastIndexAny(head, " ,") + 1
+    word := head[start:]
+    if start == 0 {
+        if !strings.HasPrefix(word, "/") {
+            return "", 0, false
+        }
+        for _, cmd := range consoleCommands {
+            candidates = append(candidates, cmd.name)
+        }
+    } else {
+        name, _, _ := strings.Cut(head, " ")
+        cmd := findConsoleCommand(name)
+        //only the first argument of /msg is a list of names
+        if cmd == nil || !cmd.peers || strings.Count(head, " ") > 1 {
+            return "", 0, false
+        }
+        for _, info := range c.session().peers.peerInfos() {
+            candidates = append(candidates, info.peer.Name)
+        }
+    }
+
+    matches := []string(nil)
+    for _, v := range candidates {
+        if strings.HasPrefix(v, word) {
+            matches = append(matches, v)
+        }
+    }
+    if len(matches) == 0 {
+        return "", 0, false
+    }
+
+    completion := matches[0]
+    for _, v := range matches[1:] {
+        for !strings.HasPrefix(v, completion) {
+            completion = completion[:len(completion) - 1]
+        }
+    }
+    if len(matches) == 1 {
+        completion += " "
+    } else if completion == word {
+        log.Printf("%s", strings.Join(matches, "  "))
+        return "", 0, false
+    }
+
+    newLine := head[:start] + completion + line[pos:]
+    return newLine, start + len(completion), true
+}
+
+//reads input until the user quits. Terminals get line editing and completion, other
+//inputs are read line by line and closing them leaves the client running.
+func (c *console) run() {
+    //deferred first so it runs after the terminal is restored
+    defer func() {
+        if c.shouldQuit() {
+            close(c.done)
+        }
+    }()
+    for _, m := range c.topics {
+        go m.s.measureRTT(c.done)
+    }
+
+    fd := int(os.Stdin.Fd())
+    if !term.IsTerminal(fd) {
+        c.readLines(os.Stdin)
+        return
+    }
+
+    state, err := term.MakeRaw(fd)
+    if err != nil {
+        log.Printf("Unable to configure terminal: %v", err)
+        c.readLines(os.Stdin)
+        return
+    }
+    defer term.Restore(fd, state)
+
+    t := term.NewTerminal(struct {
+        io.Reader
+        io.Writer
+    } { os.Stdin, os.Stdout }, "> ")
+    t.AutoCompleteCallback = c.complete
+    log.SetOutput(t)
+    defer log.SetOutput(os.Stderr)
+
+    for {
+        line, err := t.ReadLine()
+        if err != nil {
+            //^C or ^D
+            c.quit("")
+            return
+        }
+        c.handleLine(line)
+        if c.shouldQuit() {
+            return
+        }
+    }
+}
+
+func (c *console) readLines(r io.Reader) {
+    reader := bufio.NewReader(r)
+    for {
+        text, err := reader.ReadString('\n')
+        if err != nil {
+            log.Printf("Input closed")
+            return
+        }
+        c.handleLine(text)
+        if c.shouldQuit() {
+            return
+        }
+    }
+}
+
+func (c *console) handleLine(line string) {
+    line = strings.TrimRight(line, "\r\n")
+    if len(line) == 0 {
+        return
+    }
+    if err := c.dispatch(line); err != nil {
+        log.Printf("%v", err)
+    }
+}
@@ -0,0 +1,75 @@
+package client
+
+import (
+    "net"
+    "testing"
+    "time"
+
+    "github.com/natanbc/ssc0904-nat-traversal/coord"
+    "github.com/natanbc/ssc0904-nat-traversal/netsim"
+)
+
+func TestConsoleCompletion(t *testing.T) {
+    w := newTestWorld(t, netsim.Config { Latency: time.Millisecond })
+    h := startPeer(t, w.peerHost(nil), "fixed", "alice")
+    peers := []coord.Peer(nil)
+    for i, name := range []string { "albert", "alfred", "bob" } {
+        peers = append(peers, coord.Peer {
+            Name: name,
+            IP:   net.IPv4(203, 0, 113, 99).To4(),
+            Port: uint16(9000 + i),
+        })
+    }
+    h.sessions[0].peers.updatePeers("test", peers)
+    c := newConsole(h.sessions)
+
+    cases := []struct {
+        line string
+        //where the cursor is, the end of the line if negative
+        pos  int
+        want string
+    } {
+        { "/he", -1, "/help " },
+        { "/pi", -1, "/ping " },
+        { "/pi bob", 3, "/ping  bob" },
+        { "/msg b", -1, "/msg bob " },
+        { "/msg alb", -1, "/msg albert " },
+        { "/msg bob,alf", -1, "/msg bob,alfred " },
+        { "/punch b", -1, "/punch bob " },
+        //ambiguous, listed instead of completed
+        { "/p", -1, "" },
+        { "/msg al", -1, "" },
+        //we aren't one of our peers
+        { "/msg ali", -1, "" },
+        //messages, the text of /msg and commands not taking names aren't completed
+        { "hel", -1, "" },
+        { "/msg bob b", -1, "" },
+        { "/join b", -1, "" },
+        { "/msg carol", -1, "" },
+        { "/x", -1, "" },
+    }
+    for _, tc := range cases {
+        pos := tc.pos
+        if pos < 0 {
+            pos = len(tc.line)
+        }
+        line, newPos, ok := c.complete(tc.line, pos, '\t')
+        if tc.want == "" {
+            if ok {
+                t.Errorf("Completed '%s' to '%s'", tc.line, line)
+            }
+            continue
+        }
+        if !ok || line != tc.want {
+            t.Errorf("Completed '%s' to '%s' instead of '%s'", tc.line, line, tc.want)
+            continue
+        }
+        if wantPos := pos + len(tc.want) - len(tc.line); newPos != wantPos {
+            t.Errorf("Completing '%s' left the cursor at %d instead of %d", tc.line, newPos, wantPos)
+        }
+    }
+
+    if _, _, ok := c.complete("/he", 3, 'a'); ok {
+        t.Error("Completed on a key other than tab")
+    }
+}
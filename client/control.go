@@ -0,0 +1,535 @@
+package client
+
+import (
+    "bufio"
+    "context"
+    "encoding/json"
+    "errors"
+    "flag"
+    "fmt"
+    "io"
+    "log"
+    "mime"
+    "net"
+    "net/http"
+    "net/url"
+    "os"
+    "path/filepath"
+    "strings"
+    "time"
+
+    "github.com/peterbourgon/ff/v3/ffcli"
+)
+
+//the control API lets local programs share a running client: it's HTTP, served on a
+//unix socket or on a loopback TCP address
+
+var defaultControlAddr = "unix:" + filepath.Join(os.TempDir(), "nat-client.sock")
+
+//events queued for a slow /events reader before new ones are dropped
+const controlEventBuffer = 256
+
+//parses unix:/path or host:port, refusing addresses reachable from other hosts
+func controlListen(addr string) (net.Listener, error) {
+    if path := strings.TrimPrefix(addr, "unix:"); path != addr {
+        //a socket left behind by a client that didn't exit cleanly
+        if fi, err := os.Stat(path); err == nil && fi.Mode() & os.ModeSocket != 0 {
+            if c, err := net.Dial("unix", path); err == nil {
+                c.Close()
+                return nil, fmt.Errorf("Control socket %s is in use", path)
+            }
+            os.Remove(path)
+        }
+        l, err := net.Listen("unix", path)
+        if err != nil {
+            return nil, err
+        }
+        if err := os.Chmod(path, 0600); err != nil {
+            l.Close()
+            return nil, err
+        }
+        return l, nil
+    }
+
+    host, _, err := net.SplitHostPort(addr)
+    if err != nil {
+        return nil, fmt.Errorf("Invalid control address '%s': %w", addr, err)
+    }
+    if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+        return nil, fmt.Errorf("Control address must be a unix socket or a loopback address")
+    }
+    return net.Listen("tcp", addr)
+}
+
+func controlDial(addr string) func(ctx context.Context, network, _ string) (net.Conn, error) {
+    return func(ctx context.Context, network, _ string) (net.Conn, error) {
+        var d net.Dialer
+        if path := strings.TrimPrefix(addr, "unix:"); path != addr {
+            return d.DialContext(ctx, "unix", path)
+        }
+        return d.DialContext(ctx, "tcp", addr)
+    }
+}
+
+type controlState struct {
+    Topic      string   `json:"topic"`
+    //every topic joined over the socket
+    Topics     []string `json:"topics"`
+    Name       string   `json:"name"`
+    PublicAddr string   `json:"public_addr"`
+    LocalAddr  string   `json:"local_addr"`
+    //the STUN server keeping the NAT mapping alive
+    StunServer string   `json:"stun_server"`
+    Symmetric  bool     `json:"symmetric_nat"`
+    //forwarded by the gateway with -portmap
+    MappedAddr string   `json:"mapped_addr,omitempty"`
+    Mapping    string   `json:"mapping_protocol,omitempty"`
+}
+
+type controlStats struct {
+    PacketsSent     uint64                         `json:"packets_sent"`
+    BytesSent       uint64                         `json:"bytes_sent"`
+    PacketsReceived uint64                         `json:"packets_received"`
+    BytesReceived   uint64                         `json:"bytes_received"`
+    //packets received by type
+    Received        map[string]uint64              `json:"received"`
+    //how long peers took to connect, by hole punching strategy
+    TimeToConnect   map[string]controlConnectStats `json:"time_to_connect"`
+}
+
+type controlConnectStats struct {
+    Peers  int     `json:"peers"`
+    MeanMs float64 `json:"mean_ms"`
+    MinMs  float64 `json:"min_ms"`
+    MaxMs  float64 `json:"max_ms"`
+}
+
+func millis(d time.Duration) float64 {
+    return float64(d) / float64(time.Millisecond)
+}
+
+type controlSend struct {
+    //the first topic joined if empty
+    Topic   string   `json:"topic,omitempty"`
+    //broadcast to the whole topic if empty
+    To      []string `json:"to,omitempty"`
+    Channel string   `json:"channel,omitempty"`
+    Data    []byte   `json:"data"`
+}
+
+type controlError struct {
+    Error string `json:"error"`
+}
+
+//controlServer serves the control API of the topics joined. Endpoints about a single
+//topic take it as the topic query parameter, defaulting to the first one.
+type controlServer struct {
+    topics topicList
+    l      net.Listener
+    srv    *http.Server
+}
+
+func newControlServer(topics topicList, addr string) (*controlServer, error) {
+    l, err := controlListen(addr)
+    if err != nil {
+        return nil, fmt.Errorf("Unable to listen for control connections: %w", err)
+    }
+    c := &controlServer {
+        topics: topics,
+        l:      l,
+    }
+
+    _, tcp := l.(*net.TCPListener)
+    c.srv = &http.Server {
+        Handler: c.handler(tcp),
+    }
+
+    go func() {
+        if err := c.srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+            log.Printf("Control API stopped: %v", err)
+        }
+    }()
+    log.Printf("Control API listening on %s", addr)
+    return c, nil
+}
+
+//the endpoints of the API. Over TCP only requests naming a loopback host are served:
+//any web page can make the browser send requests to a loopback address, and read the
+//answers once DNS rebinding points the page's own name there.
+func (c *controlServer) handler(tcp bool) http.Handler {
+    mux := http.NewServeMux()
+    mux.HandleFunc("/state", c.handleState)
+    mux.HandleFunc("/peers", c.handlePeers)
+    mux.HandleFunc("/peers/", c.handlePeer)
+    mux.HandleFunc("/stats", c.handleStats)
+    mux.HandleFunc("/send", c.handleSend)
+    mux.HandleFunc("/events", c.handleEvents)
+    if !tcp {
+        return mux
+    }
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if !loopbackHost(r.Host) {
+            writeError(w, http.StatusForbidden, fmt.Errorf("Host '%s' not allowed", r.Host))
+            return
+        }
+        mux.ServeHTTP(w, r)
+    })
+}
+
+//whether the Host header of a request names a loopback address
+func loopbackHost(host string) bool {
+    if h, _, err := net.SplitHostPort(host); err == nil {
+        host = h
+    }
+    host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+    ip := net.ParseIP(host)
+    return strings.EqualFold(host, "localhost") || (ip != nil && ip.IsLoopback())
+}
+
+func (c *controlServer) close() error {
+    return c.srv.Close()
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(status)
+    json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+    writeJSON(w, status, controlError {
+        Error: err.Error(),
+    })
+}
+
+func requireMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+    if r.Method != method {
+        writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("Method %s not allowed", r.Method))
+        return false
+    }
+    return true
+}
+
+//the messenger of the topic requested, writing the error if there's no such topic
+func (c *controlServer) topic(w http.ResponseWriter, topic string) (*messenger, bool) {
+    m, err := c.topics.find(topic)
+    if err != nil {
+        writeError(w, http.StatusNotFound, err)
+        return nil, false
+    }
+    return m, true
+}
+
+func (c *controlServer) handleState(w http.ResponseWriter, r *http.Request) {
+    if !requireMethod(w, r, http.MethodGet) {
+        return
+    }
+    m, ok := c.topic(w, r.URL.Query().Get("topic"))
+    if !ok {
+        return
+    }
+    topics := []string(nil)
+    for _, v := range c.topics {
+        topics = append(topics, v.s.topic)
+    }
+    socket := m.s.host.socket
+    state := controlState {
+        Topic:      m.s.topic,
+        Topics:     topics,
+        Name:       m.s.getName(),
+        PublicAddr: socket.PublicAddr().String(),
+        LocalAddr:  socket.Conn.LocalAddr().String(),
+        StunServer: socket.KeepAliveServer(),
+        Symmetric:  socket.SymmetricNAT(),
+    }
+    if pm := m.s.host.mapper; pm != nil {
+        mapping := pm.Mapping()
+        state.MappedAddr = mapping.External.String()
+        state.Mapping = mapping.Protocol
+    }
+    writeJSON(w, http.StatusOK, state)
+}
+
+func (c *controlServer) handlePeers(w http.ResponseWriter, r *http.Request) {
+    if !requireMethod(w, r, http.MethodGet) {
+        return
+    }
+    m, ok := c.topic(w, r.URL.Query().Get("topic"))
+    if !ok {
+        return
+    }
+    writeJSON(w, http.StatusOK, jsonlPeers(m.s.peers))
+}
+
+func (c *controlServer) handlePeer(w http.ResponseWriter, r *http.Request) {
+    if !requireMethod(w, r, http.MethodGet) {
+        return
+    }
+    m, ok := c.topic(w, r.URL.Query().Get("topic"))
+    if !ok {
+        return
+    }
+    name := strings.TrimPrefix(r.URL.Path, "/peers/")
+    for _, peer := range jsonlPeers(m.s.peers) {
+        if peer.Name == name {
+            writeJSON(w, http.StatusOK, peer)
+            return
+        }
+    }
+    writeError(w, http.StatusNotFound, fmt.Errorf("Unknown peer '%s'", name))
+}
+
+func (c *controlServer) handleStats(w http.ResponseWriter, r *http.Request) {
+    if !requireMethod(w, r, http.MethodGet) {
+        return
+    }
+    sess := c.topics[0].s
+    stats := sess.getStats()
+    received := make(map[string]uint64, len(stats.received))
+    for k, v := range stats.received {
+        received[magicName(k)] = v
+    }
+    times := make(map[string]controlConnectStats)
+    for k, v := range sess.peers.connectStats() {
+        times[k] = controlConnectStats {
+            Peers:  v.peers,
+            MeanMs: millis(v.mean()),
+            MinMs:  millis(v.min),
+            MaxMs:  millis(v.max),
+        }
+    }
+    writeJSON(w, http.StatusOK, controlStats {
+        PacketsSent:     stats.packetsSent,
+        BytesSent:       stats.bytesSent,
+        PacketsReceived: stats.packetsReceived,
+        BytesReceived:   stats.bytesReceived,
+        Received:        received,
+        TimeToConnect:   times,
+    })
+}
+
+func (c *controlServer) handleSend(w http.ResponseWriter, r *http.Request) {
+    if !requireMethod(w, r, http.MethodPost) {
+        return
+    }
+    //browsers send forms and text/plain anywhere without asking, but not JSON
+    if mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mt != "application/json" {
+        writeError(w, http.StatusUnsupportedMediaType, fmt.Errorf("Content-Type must be application/json"))
+        return
+    }
+    var req controlSend
+    if err := json.NewDecoder(io.LimitReader(r.Body, 1 << 20)).Decode(&req); err != nil {
+        writeError(w, http.StatusBadRequest, fmt.Errorf("Malformed request: %w", err))
+        return
+    }
+
+    m, ok := c.topic(w, req.Topic)
+    if !ok {
+        return
+    }
+
+    var err error
+    if len(req.To) == 0 {
+        err = m.broadcast(req.Channel, req.Data)
+    } else {
+        err = m.sendTo(req.To, req.Channel, req.Data)
+    }
+    if err != nil {
+        writeError(w, http.StatusBadRequest, err)
+        return
+    }
+    w.WriteHeader(http.StatusNoContent)
+}
+
+//streams the events of every topic as JSON lines, in the format of -format jsonl.
+//?type=a,b only sends events of the given types.
+func (c *controlServer) handleEvents(w http.ResponseWriter, r *http.Request) {
+    if !requireMethod(w, r, http.MethodGet) {
+        return
+    }
+    flusher, ok := w.(http.Flusher)
+    if !ok {
+        writeError(w, http.StatusInternalServerError, fmt.Errorf("Streaming not supported"))
+        return
+    }
+
+    types := make(map[string]struct{})
+    for _, v := range strings.Split(r.URL.Query().Get("type"), ",") {
+        if v = strings.TrimSpace(v); v != "" {
+            types[v] = struct{}{}
+        }
+    }
+    wanted := func(event string) bool {
+        _, ok := types[event]
+        return len(types) == 0 || ok
+    }
+
+    events := make(chan interface{}, controlEventBuffer)
+    queue := func(event interface{}) {
+        select {
+            case events <- event:
+            default:
+                //a reader too slow to keep up loses events instead of stalling the client
+        }
+    }
+
+    for _, m := range c.topics {
+        topic := m.s.topic
+        unsubscribePeers := m.s.peers.subscribe(func(e peerEvent) {
+            if name := peerEventNames[e.kind]; wanted(name) {
+                queue(newJsonlPeerEvent(topic, e))
+            }
+        })
+        defer unsubscribePeers()
+        unsubscribeMessages := m.subscribe(func(msg chatMessage) {
+            if wanted("message") {
+                queue(newJsonlMessageEvent(msg))
+            }
+        })
+        defer unsubscribeMessages()
+    }
+
+    w.Header().Set("Content-Type", "application/x-ndjson")
+    w.WriteHeader(http.StatusOK)
+    flusher.Flush()
+
+    enc := json.NewEncoder(w)
+    for {
+        select {
+            case e := <-events:
+                if err := enc.Encode(e); err != nil {
+                    return
+                }
+                flusher.Flush()
+            case <-r.Context().Done():
+                return
+        }
+    }
+}
+
+var (
+    ctlAddr    string
+    ctlTopic   string
+    ctlTo      string
+    ctlChannel string
+)
+
+var ctlFs = (func() *flag.FlagSet {
+    fs := flag.NewFlagSet("ctl", flag.ExitOnError)
+    fs.StringVar(&ctlAddr,    "control", defaultControlAddr, "Control address of the running client")
+    fs.StringVar(&ctlTopic,   "topic",   "",                 "Topic to query or send to, the first one joined if empty")
+    fs.StringVar(&ctlTo,      "to",      "",                 "Comma separated peers to send to, everyone if empty")
+    fs.StringVar(&ctlChannel, "channel", "",                 "Channel to send to")
+    return fs
+})()
+
+//requests are always sent to the control address, the host only has to be one the
+//server accepts
+const ctlBaseUrl = "http://localhost"
+
+func ctlRequest(ctx context.Context, client *http.Client, method, path string, body io.Reader) (*http.Response, error) {
+    req, err := http.NewRequestWithContext(ctx, method, ctlBaseUrl + path, body)
+    if err != nil {
+        return nil, err
+    }
+    if body != nil {
+        req.Header.Set("Content-Type", "application/json")
+    }
+    res, err := client.Do(req)
+    if err != nil {
+        return nil, fmt.Errorf("Unable to reach the client at %s: %w", ctlAddr, err)
+    }
+    if res.StatusCode >= 400 {
+        defer res.Body.Close()
+        var e controlError
+        if err := json.NewDecoder(res.Body).Decode(&e); err != nil || e.Error == "" {
+            return nil, fmt.Errorf("Request failed: %s", res.Status)
+        }
+        return nil, errors.New(e.Error)
+    }
+    return res, nil
+}
+
+var ctlCommand = &ffcli.Command {
+    Name:       "ctl",
+    ShortUsage: "client ctl [flags] <state|peers|peer name|stats|send text|events [types]>",
+    ShortHelp:  "Talks to the control API of a running client",
+    LongHelp:   "Talks to the control API of a running client started with -control. send reads the message " +
+                "from stdin when the text is -, events streams events until interrupted.",
+    FlagSet:    ctlFs,
+    Exec:       func(ctx context.Context, args []string) error {
+        if len(args) == 0 {
+            return flag.ErrHelp
+        }
+        client := &http.Client {
+            Transport: &http.Transport {
+                DialContext: controlDial(ctlAddr),
+            },
+        }
+
+        query := ""
+        if ctlTopic != "" {
+            query = "?topic=" + url.QueryEscape(ctlTopic)
+        }
+
+        var res *http.Response
+        var err error
+        switch {
+            case args[0] == "state" && len(args) == 1:
+                res, err = ctlRequest(ctx, client, http.MethodGet, "/state" + query, nil)
+            case args[0] == "peers" && len(args) == 1:
+                res, err = ctlRequest(ctx, client, http.MethodGet, "/peers" + query, nil)
+            case args[0] == "peer" && len(args) == 2:
+                res, err = ctlRequest(ctx, client, http.MethodGet, "/peers/" + url.PathEscape(args[1]) + query, nil)
+            case args[0] == "stats" && len(args) == 1:
+                res, err = ctlRequest(ctx, client, http.MethodGet, "/stats", nil)
+            case args[0] == "send" && len(args) >= 2:
+                data := []byte(strings.Join(args[1:], " "))
+                if len(args) == 2 && args[1] == "-" {
+                    if data, err = io.ReadAll(os.Stdin); err != nil {
+                        return err
+                    }
+                }
+                body, err := json.Marshal(controlSend {
+                    Topic:   ctlTopic,
+                    To:      parseRecipients(ctlTo),
+                    Channel: ctlChannel,
+                    Data:    data,
+                })
+                if err != nil {
+                    return err
+                }
+                res, err = ctlRequest(ctx, client, http.MethodPost, "/send", strings.NewReader(string(body)))
+                if err != nil {
+                    return err
+                }
+                res.Body.Close()
+                return nil
+            case args[0] == "events" && len(args) <= 2:
+                path := "/events"
+                if len(args) == 2 {
+                    path += "?type=" + url.QueryEscape(args[1])
+                }
+                res, err = ctlRequest(ctx, client, http.MethodGet, path, nil)
+            default:
+                return flag.ErrHelp
+        }
+        if err != nil {
+            return err
+        }
+        defer res.Body.Close()
+
+        //copied line by line so events show up as they arrive
+        r := bufio.NewReader(res.Body)
+        for {
+            line, err := r.ReadBytes('\n')
+            os.Stdout.Write(line)
+            if err == io.EOF {
+                return nil
+            }
+            if err != nil {
+                return err
+            }
+        }
+    },
+}
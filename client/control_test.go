@@ -0,0 +1,45 @@
+package client
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+)
+
+func controlStatus(h http.Handler, method, host, contentType string) int {
+    req := httptest.NewRequest(method, "http://" + host + "/send", strings.NewReader(`{"data":""}`))
+    if contentType != "" {
+        req.Header.Set("Content-Type", contentType)
+    }
+    w := httptest.NewRecorder()
+    h.ServeHTTP(w, req)
+    return w.Code
+}
+
+func TestControlRejectsForeignHost(t *testing.T) {
+    h := (&controlServer {}).handler(true)
+    for _, host := range []string { "evil.example", "evil.example:8080", "192.0.2.1:8080" } {
+        if code := controlStatus(h, http.MethodGet, host, ""); code != http.StatusForbidden {
+            t.Fatalf("Host %s got status %d", host, code)
+        }
+    }
+    for _, host := range []string { "localhost:8080", "127.0.0.1:8080", "[::1]:8080", "localhost" } {
+        if code := controlStatus(h, http.MethodGet, host, ""); code != http.StatusMethodNotAllowed {
+            t.Fatalf("Host %s got status %d", host, code)
+        }
+    }
+    //unix sockets are protected by their permissions instead
+    if code := controlStatus((&controlServer {}).handler(false), http.MethodGet, "evil.example", ""); code != http.StatusMethodNotAllowed {
+        t.Fatalf("Unix socket request got status %d", code)
+    }
+}
+
+func TestControlSendRequiresJSON(t *testing.T) {
+    h := (&controlServer {}).handler(true)
+    for _, ct := range []string { "", "text/plain", "application/x-www-form-urlencoded", "multipart/form-data; boundary=x" } {
+        if code := controlStatus(h, http.MethodPost, "localhost:8080", ct); code != http.StatusUnsupportedMediaType {
+            t.Fatalf("Content-Type %q got status %d", ct, code)
+        }
+    }
+}
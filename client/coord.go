@@ -0,0 +1,293 @@
+package client
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "net"
+    "net/url"
+    "path"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/natanbc/ssc0904-nat-traversal/coord"
+
+    "github.com/gorilla/websocket"
+)
+
+//bounds of the delay between attempts to reconnect to the coordination server
+const (
+    coordRetryMin = time.Second
+    coordRetryMax = 30 * time.Second
+)
+
+//coordDiscovery registers with a coordination server and receives the peer list from it
+type coordDiscovery struct {
+    baseUrl *url.URL
+    token   string
+    dialer  websocket.Dialer
+
+    mu      sync.Mutex
+    socket  *websocket.Conn
+    stopped bool
+}
+
+//dial opens the connections to the server
+func newCoordDiscovery(baseUrl, token string, dial func(ctx context.Context, network, addr string) (net.Conn, error)) (*coordDiscovery, error) {
+    base, err := url.Parse(baseUrl)
+    if err != nil {
+        return nil, fmt.Errorf("Unable to parse base url: %w", err)
+    }
+    dialer := *websocket.DefaultDialer
+    dialer.NetDialContext = dial
+    return &coordDiscovery {
+        baseUrl: base,
+        token:   token,
+        dialer:  dialer,
+    }, nil
+}
+
+//connects to the server, or keeps trying in the background while it's unreachable so
+//other sources like LAN discovery work meanwhile. Fails if the server refused us.
+func (c *coordDiscovery) start(p *peerRegistry) error {
+    ws, err := c.connect(p, p.self().Name)
+    var rejected *coordRejection
+    if errors.As(err, &rejected) {
+        return err
+    }
+    if err != nil {
+        log.Printf("Unable to reach coordination server, retrying in the background: %v", err)
+        go c.reconnect(p, nil)
+        return nil
+    }
+    c.run(p, ws)
+    return nil
+}
+
+//registers again under the new name, the old registration is only dropped if the
+//server accepted the new one
+func (c *coordDiscovery) rename(p *peerRegistry, name string) error {
+    ws, err := c.connect(p, name)
+    if err != nil {
+        return err
+    }
+    c.run(p, ws)
+    return nil
+}
+
+//registers again with the new mapped address. The server only lets the name go once
+//the connection closes, so this reconnects instead of registering next to it.
+func (c *coordDiscovery) update(p *peerRegistry) {
+    c.mu.Lock()
+    ws := c.socket
+    c.mu.Unlock()
+    if ws != nil {
+        ws.Close()
+    }
+}
+
+//closes the connection, so the server drops us from the peer list right away
+func (c *coordDiscovery) stop() {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.stopped = true
+    if c.socket != nil {
+        c.socket.Close()
+        c.socket = nil
+    }
+}
+
+//whether ws was replaced by a newer connection
+func (c *coordDiscovery) replaced(ws *websocket.Conn) bool {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return c.socket != ws
+}
+
+func (c *coordDiscovery) run(p *peerRegistry, ws *websocket.Conn) {
+    c.mu.Lock()
+    if c.stopped {
+        c.mu.Unlock()
+        ws.Close()
+        return
+    }
+    old := c.socket
+    c.socket = ws
+    c.mu.Unlock()
+    if old != nil {
+        old.Close()
+    }
+    c.serve(p, ws)
+}
+
+//reconnects after the connection to the server dropped, or connects if ws is nil,
+//backing off between attempts, until it succeeds, ws is replaced by a rename or the
+//client stops. A restarted server
+//keeps listing its peers for a while, so reconnecting in time keeps our place.
+func (c *coordDiscovery) reconnect(p *peerRegistry, ws *websocket.Conn) {
+    delay := coordRetryMin
+    for {
+        time.Sleep(delay)
+        if p.shouldStop() || c.replaced(ws) {
+            return
+        }
+        next, err := c.connect(p, p.self().Name)
+        if err == nil {
+            c.mu.Lock()
+            current := c.socket == ws && !c.stopped
+            if current {
+                c.socket = next
+            }
+            c.mu.Unlock()
+            if !current {
+                next.Close()
+                return
+            }
+            log.Printf("Connected to coordination server")
+            c.serve(p, next)
+            return
+        }
+
+        delay *= 2
+        if delay > coordRetryMax {
+            delay = coordRetryMax
+        }
+        log.Printf("Failed to reconnect to coordination server, retrying in %v: %v", delay, err)
+    }
+}
+
+//receives peer lists from ws and keeps it alive, reconnecting when it drops
+func (c *coordDiscovery) serve(p *peerRegistry, ws *websocket.Conn) {
+    //other discovery sources and already punched peers keep working without the server
+    stop := func() {
+        ws.Close()
+    }
+    //closed when reading stops, so pings stop with it
+    done := make(chan struct{})
+
+    go func() {
+        t := time.NewTicker(5 * time.Second)
+        defer t.Stop()
+
+        for {
+            select {
+                case <-t.C:
+                case <-done:
+                    return
+            }
+            if p.shouldStop() || c.replaced(ws) {
+                stop()
+                return
+            }
+            if err := ws.WriteMessage(websocket.PingMessage, []byte{}); err != nil {
+                log.Printf("Failed to send ping message to server: %v", err)
+                stop()
+                return
+            }
+        }
+    }()
+    go func() {
+        defer close(done)
+        for {
+            if p.shouldStop() {
+                break
+            }
+            mt, message, err := ws.ReadMessage()
+            if err != nil {
+                if c.replaced(ws) {
+                    break
+                }
+                log.Printf("Failed to read message from server: %v", err)
+                stop()
+                if !p.shouldStop() {
+                    go c.reconnect(p, ws)
+                }
+                break
+            }
+
+            if mt == websocket.TextMessage {
+                if err := c.handlePeerList(p, message); err != nil {
+                    log.Printf("Failed to update peer list: %v", err)
+                }
+            }
+        }
+    }()
+}
+
+func (c *coordDiscovery) connect(p *peerRegistry, name string) (*websocket.Conn, error) {
+    self := p.self()
+    query := map[string]string {
+        "topic": p.topic,
+        "name":  name,
+        "ip":    self.IP.String(),
+        "port":  fmt.Sprintf("%d", self.Port),
+        "key":   self.PublicKey,
+    }
+    if self.Mapped != nil {
+        query["mapped"] = self.Mapped.String()
+    }
+    if c.token != "" {
+        query["token"] = c.token
+    }
+    u := c.makeUrl("websocket", query)
+
+    ws, resp, err := c.dialer.Dial(u, nil)
+    if err != nil {
+        //the server explains rejections, like a name that is already taken, in the body
+        if resp != nil {
+            body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+            msg := strings.TrimSpace(string(body))
+            if msg == "" {
+                msg = resp.Status
+            }
+            return nil, &coordRejection { msg: msg }
+        }
+        return nil, fmt.Errorf("Unable to establish websocket connection: %w", err)
+    }
+    return ws, nil
+}
+
+//coordRejection is the server answering the registration with an error, which
+//trying again won't change
+type coordRejection struct {
+    msg string
+}
+
+func (e *coordRejection) Error() string {
+    return "Unable to establish websocket connection: " + e.msg
+}
+
+func (c *coordDiscovery) handlePeerList(p *peerRegistry, raw []byte) error {
+    var r coord.PeerList
+
+    if err := json.Unmarshal(raw, &r); err != nil {
+        return fmt.Errorf("Malformed response: %w", err)
+    }
+
+    p.updatePeers("coord", r.Peers)
+    return nil
+}
+
+func (c *coordDiscovery) makeUrl(reqPath string, query map[string]string) string {
+    url := *c.baseUrl
+    if url.Scheme == "http" {
+        url.Scheme = "ws"
+    } else if url.Scheme == "https" {
+        url.Scheme = "wss"
+    }
+
+    url.Path = path.Join(url.Path, reqPath)
+
+    q := url.Query()
+    for k, v := range query {
+        q.Set(k, v)
+    }
+    url.RawQuery = q.Encode()
+
+    return url.String()
+}
+
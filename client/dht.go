@@ -0,0 +1,700 @@
+package client
+
+import (
+    "bytes"
+    "crypto/ed25519"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/binary"
+    "encoding/json"
+    "fmt"
+    "log"
+    "math/bits"
+    "net"
+    "sort"
+    "sync"
+    "time"
+
+    "github.com/natanbc/ssc0904-nat-traversal/coord"
+)
+
+const (
+    //contacts per bucket, and how many nodes store each record
+    dhtK            = 8
+    //parallel requests during lookups
+    dhtAlpha        = 3
+    dhtTimeout      = 2 * time.Second
+    dhtAnnounce     = 15 * time.Second
+    dhtRecordTTL    = 60 * time.Second
+    //messages are kept under a path MTU most networks carry without fragmenting
+    dhtMaxPacket    = 1200
+    //records stored under each key
+    dhtMaxStored    = 64
+    //record pages requested from each node during a lookup, enough for a full key
+    //at the two or three records that fit a page
+    dhtMaxPages     = dhtMaxStored / 2
+    //packets waiting for a worker, more are dropped like a full socket buffer would
+    dhtQueue        = 256
+    dhtWorkers      = 4
+)
+
+type dhtID [sha256.Size]byte
+
+func (a dhtID) xor(b dhtID) dhtID {
+    var d dhtID
+    for i := range a {
+        d[i] = a[i] ^ b[i]
+    }
+    return d
+}
+
+//index of the bucket b falls into, relative to a
+func (a dhtID) bucket(b dhtID) int {
+    d := a.xor(b)
+    for i, v := range d {
+        if v != 0 {
+            return i * 8 + bits.LeadingZeros8(v)
+        }
+    }
+    return len(d) * 8 - 1
+}
+
+func topicKey(topic string) dhtID {
+    return sha256.Sum256([]byte("topic:" + topic))
+}
+
+//dhtRecord announces membership of a topic, signed by the key of the announcing peer.
+//Anyone can announce any name, so records only bind the name to the check key: checks
+//prove the peer holds it, and readers stick to the first check key seen for a name.
+type dhtRecord struct {
+    Topic    string `json:"topic"`
+    Name     string `json:"name"`
+    IP       string `json:"ip"`
+    Port     uint16 `json:"port"`
+    Expires  int64  `json:"expires"`
+    //hex X25519 public key connectivity checks with the peer are signed with a key
+    //derived from, like the one peers give coord
+    CheckKey string `json:"check_key,omitempty"`
+    //port the gateway of the peer forwards to it, if any
+    Mapped   string `json:"mapped,omitempty"`
+    Key      []byte `json:"key"`
+    Sig      []byte `json:"sig"`
+}
+
+func (r *dhtRecord) signedData() []byte {
+    var b bytes.Buffer
+    fmt.Fprintf(&b, "%s\x00%s\x00%s\x00%d\x00%d\x00%s\x00%s\x00", r.Topic, r.Name, r.IP, r.Port, r.Expires, r.CheckKey, r.Mapped)
+    b.Write(r.Key)
+    return b.Bytes()
+}
+
+func (r *dhtRecord) valid(now time.Time) bool {
+    if len(r.Key) != ed25519.PublicKeySize || net.ParseIP(r.IP) == nil || r.Port == 0 || r.CheckKey == "" {
+        return false
+    }
+    if r.Mapped != "" {
+        if _, err := coord.ParseMapped(r.Mapped); err != nil {
+            return false
+        }
+    }
+    if time.UnixMilli(r.Expires).Before(now) || time.UnixMilli(r.Expires).After(now.Add(2 * dhtRecordTTL)) {
+        return false
+    }
+    return ed25519.Verify(r.Key, r.signedData(), r.Sig)
+}
+
+//records are stored by announcer, so nobody can take a name or check key by storing
+//its record first
+func (r *dhtRecord) storeKey() string {
+    return r.Name + "\x00" + r.CheckKey + "\x00" + string(r.Key)
+}
+
+func (r *dhtRecord) peer() coord.Peer {
+    ip := net.ParseIP(r.IP)
+    if ip4 := ip.To4(); ip4 != nil {
+        ip = ip4
+    }
+    p := coord.Peer {
+        Name:      r.Name,
+        IP:        ip,
+        Port:      r.Port,
+        LastSeen:  time.UnixMilli(r.Expires).Add(-dhtRecordTTL),
+        PublicKey: r.CheckKey,
+    }
+    //checked by valid
+    p.Mapped, _ = coord.ParseMapped(r.Mapped)
+    return p
+}
+
+type dhtContact struct {
+    ID   []byte `json:"id"`
+    IP   string `json:"ip"`
+    Port uint16 `json:"port"`
+}
+
+func (c *dhtContact) addr() *net.UDPAddr {
+    return &net.UDPAddr {
+        IP:   net.ParseIP(c.IP),
+        Port: int(c.Port),
+    }
+}
+
+func (c *dhtContact) id() (dhtID, bool) {
+    var id dhtID
+    if len(c.ID) != len(id) {
+        return id, false
+    }
+    copy(id[:], c.ID)
+    return id, true
+}
+
+type dhtMessage struct {
+    Type     string       `json:"type"`
+    Tx       uint64       `json:"tx"`
+    Response bool         `json:"response,omitempty"`
+    From     []byte       `json:"from"`
+    Target   []byte       `json:"target,omitempty"`
+    Record   *dhtRecord   `json:"record,omitempty"`
+    Records  []dhtRecord  `json:"records,omitempty"`
+    Nodes    []dhtContact `json:"nodes,omitempty"`
+    //index of the first record wanted by find_value
+    Offset   int          `json:"offset,omitempty"`
+    //records after the ones in a find_value response didn't fit in it
+    More     bool         `json:"more,omitempty"`
+}
+
+type dhtEntry struct {
+    contact  dhtContact
+    lastSeen time.Time
+}
+
+//dht is a small Kademlia-style DHT running over the punched socket. Peers store
+//signed records announcing their membership under the hash of the topic, so they
+//can find each other without a coordination server.
+type dht struct {
+    write     func([]byte, *net.UDPAddr)
+    bootstrap []*net.UDPAddr
+    key       ed25519.PrivateKey
+    self      dhtID
+    //between announcements, contacts silent for two of them may be replaced
+    interval  time.Duration
+    //packets received, handled by a fixed number of workers
+    inbox     chan dhtPacket
+    done      chan struct{}
+    closeOnce sync.Once
+
+    mu        sync.Mutex
+    buckets   [len(dhtID{}) * 8][]dhtEntry
+    //records stored on this node, keyed by record key then storeKey
+    records   map[dhtID]map[string]dhtRecord
+    pending   map[uint64]chan dhtMessage
+    //check key each name of each topic is bound to, keyed by topic then name
+    pins      map[string]map[string]dhtPin
+}
+
+type dhtPin struct {
+    checkKey string
+    //when a record with the key was last found
+    seen     time.Time
+}
+
+type dhtPacket struct {
+    data []byte
+    addr *net.UDPAddr
+}
+
+//interval is how often records are announced, dhtAnnounce if 0
+func newDHT(write func([]byte, *net.UDPAddr), bootstrap []*net.UDPAddr, interval time.Duration) (*dht, error) {
+    _, key, err := ed25519.GenerateKey(rand.Reader)
+    if err != nil {
+        return nil, fmt.Errorf("Unable to generate DHT key: %w", err)
+    }
+    if interval <= 0 {
+        interval = dhtAnnounce
+    }
+    d := &dht {
+        write:     write,
+        bootstrap: bootstrap,
+        key:       key,
+        self:      sha256.Sum256(key.Public().(ed25519.PublicKey)),
+        interval:  interval,
+        inbox:     make(chan dhtPacket, dhtQueue),
+        done:      make(chan struct{}),
+        records:   make(map[dhtID]map[string]dhtRecord),
+        pending:   make(map[uint64]chan dhtMessage),
+        pins:      make(map[string]map[string]dhtPin),
+    }
+    for i := 0; i < dhtWorkers; i++ {
+        go d.work()
+    }
+    return d, nil
+}
+
+func (d *dht) work() {
+    for {
+        select {
+            case p := <-d.inbox:
+                d.handle(p.data, p.addr)
+            case <-d.done:
+                return
+        }
+    }
+}
+
+//queues a DHT packet received from addr, copying it as the buffer is reused. Packets
+//are dropped while every worker is busy and the queue is full.
+func (d *dht) queue(data []byte, addr *net.UDPAddr) {
+    select {
+        case d.inbox <- dhtPacket { data: append([]byte(nil), data...), addr: addr }:
+        default:
+    }
+}
+
+//stops the workers
+func (d *dht) close() {
+    d.closeOnce.Do(func() {
+        close(d.done)
+    })
+}
+
+func (d *dht) start(p *peerRegistry) error {
+    if len(d.bootstrap) == 0 {
+        return fmt.Errorf("DHT discovery requires at least one bootstrap node")
+    }
+
+    go func() {
+        for _, addr := range d.bootstrap {
+            d.request(addr, dhtMessage { Type: "ping" })
+        }
+        d.lookup(d.self, false)
+
+        for !p.shouldStop() {
+            d.announce(p)
+            time.Sleep(d.interval)
+        }
+    }()
+    return nil
+}
+
+//the DHT is shared by every topic, so the host closes it instead
+func (d *dht) stop() {}
+
+func (d *dht) announce(p *peerRegistry) {
+    key := topicKey(p.topic)
+    self := p.self()
+
+    r := dhtRecord {
+        Topic:    p.topic,
+        Name:     self.Name,
+        IP:       self.IP.String(),
+        Port:     self.Port,
+        Expires:  time.Now().Add(dhtRecordTTL).UnixMilli(),
+        CheckKey: self.PublicKey,
+        Key:      d.key.Public().(ed25519.PublicKey),
+    }
+    if self.Mapped != nil {
+        r.Mapped = self.Mapped.String()
+    }
+    r.Sig = ed25519.Sign(d.key, r.signedData())
+    d.storeRecord(key, r)
+
+    closest, _ := d.lookup(key, false)
+    for _, c := range closest {
+        go d.request(c.addr(), dhtMessage {
+            Type:   "store",
+            Target: key[:],
+            Record: &r,
+        })
+    }
+
+    _, records := d.lookup(key, true)
+    p.updatePeers("dht", d.members(p.topic, append(records, d.localRecords(key, 0)...)))
+}
+
+//the peers records of topic announce. Each name is bound to the first check key found
+//for it until no record has carried that key for a whole record TTL, and names
+//announced with several keys before being bound are ignored, as there's no telling
+//which one is the peer's.
+func (d *dht) members(topic string, records []dhtRecord) []coord.Peer {
+    now := time.Now()
+    //latest record of each announcer, by name then check key
+    byName := make(map[string]map[string][]dhtRecord)
+    latest := make(map[string]dhtRecord)
+    for _, r := range records {
+        if r.Topic != topic || !r.valid(now) {
+            continue
+        }
+        if prev, ok := latest[r.storeKey()]; !ok || prev.Expires < r.Expires {
+            latest[r.storeKey()] = r
+        }
+    }
+    for _, r := range latest {
+        keys, ok := byName[r.Name]
+        if !ok {
+            keys = make(map[string][]dhtRecord)
+            byName[r.Name] = keys
+        }
+        keys[r.CheckKey] = append(keys[r.CheckKey], r)
+    }
+
+    d.mu.Lock()
+    defer d.mu.Unlock()
+
+    pins, ok := d.pins[topic]
+    if !ok {
+        pins = make(map[string]dhtPin)
+        d.pins[topic] = pins
+    }
+    for name, pin := range pins {
+        if _, found := byName[name][pin.checkKey]; !found && now.Sub(pin.seen) >= dhtRecordTTL {
+            delete(pins, name)
+        }
+    }
+
+    peers := []coord.Peer(nil)
+    for name, keys := range byName {
+        pin, pinned := pins[name]
+        if !pinned {
+            if len(keys) > 1 {
+                log.Printf("Ignoring %s of topic %s in the DHT: announced with %d keys", name, topic, len(keys))
+                continue
+            }
+            for k := range keys {
+                pin.checkKey = k
+            }
+        }
+        found, ok := keys[pin.checkKey]
+        if !ok {
+            continue
+        }
+        pin.seen = now
+        pins[name] = pin
+        for _, r := range found {
+            peers = append(peers, r.peer())
+        }
+    }
+    return peers
+}
+
+func (d *dht) storeRecord(key dhtID, r dhtRecord) bool {
+    now := time.Now()
+    if key != topicKey(r.Topic) || !r.valid(now) {
+        return false
+    }
+
+    d.mu.Lock()
+    defer d.mu.Unlock()
+
+    m, ok := d.records[key]
+    if !ok {
+        m = make(map[string]dhtRecord)
+        d.records[key] = m
+    }
+    for k, v := range m {
+        if time.UnixMilli(v.Expires).Before(now) {
+            delete(m, k)
+        }
+    }
+    prev, ok := m[r.storeKey()]
+    if ok && prev.Expires > r.Expires {
+        return false
+    }
+    if !ok && len(m) >= dhtMaxStored {
+        return false
+    }
+    m[r.storeKey()] = r
+    return true
+}
+
+//records stored under key from the offset-th on, in a stable order so responses can
+//be paged through
+func (d *dht) localRecords(key dhtID, offset int) []dhtRecord {
+    d.mu.Lock()
+    keys := make([]string, 0, len(d.records[key]))
+    for k := range d.records[key] {
+        keys = append(keys, k)
+    }
+    sort.Strings(keys)
+    res := []dhtRecord(nil)
+    for i := offset; i < len(keys); i++ {
+        res = append(res, d.records[key][keys[i]])
+    }
+    d.mu.Unlock()
+    return res
+}
+
+func (d *dht) seen(c dhtContact) {
+    id, ok := c.id()
+    if !ok || id == d.self {
+        return
+    }
+
+    d.mu.Lock()
+    defer d.mu.Unlock()
+
+    b := d.self.bucket(id)
+    bucket := d.buckets[b]
+    for i, e := range bucket {
+        if bytes.Equal(e.contact.ID, c.ID) {
+            bucket = append(bucket[:i], bucket[i + 1:]...)
+            break
+        }
+    }
+    if len(bucket) >= dhtK {
+        //least recently seen contacts go first, but only once they look dead
+        if time.Since(bucket[0].lastSeen) < 2 * d.interval {
+            d.buckets[b] = bucket
+            return
+        }
+        bucket = bucket[1:]
+    }
+    d.buckets[b] = append(bucket, dhtEntry {
+        contact:  c,
+        lastSeen: time.Now(),
+    })
+}
+
+func (d *dht) closest(target dhtID, n int) []dhtContact {
+    d.mu.Lock()
+    res := []dhtContact(nil)
+    for _, bucket := range d.buckets {
+        for _, e := range bucket {
+            res = append(res, e.contact)
+        }
+    }
+    d.mu.Unlock()
+
+    sortByDistance(res, target)
+    if len(res) > n {
+        res = res[:n]
+    }
+    return res
+}
+
+func sortByDistance(contacts []dhtContact, target dhtID) {
+    sort.Slice(contacts, func(i, j int) bool {
+        a, _ := contacts[i].id()
+        b, _ := contacts[j].id()
+        da := a.xor(target)
+        db := b.xor(target)
+        return bytes.Compare(da[:], db[:]) < 0
+    })
+}
+
+//iterative lookup of the nodes closest to target, also collecting records stored
+//under it when findValue is set
+func (d *dht) lookup(target dhtID, findValue bool) ([]dhtContact, []dhtRecord) {
+    typ := "find_node"
+    if findValue {
+        typ = "find_value"
+    }
+
+    shortlist := d.closest(target, dhtK)
+    queried := make(map[string]bool)
+    records := []dhtRecord(nil)
+
+    for {
+        batch := []dhtContact(nil)
+        for _, c := range shortlist {
+            if !queried[string(c.ID)] {
+                queried[string(c.ID)] = true
+                batch = append(batch, c)
+                if len(batch) == dhtAlpha {
+                    break
+                }
+            }
+        }
+        if len(batch) == 0 {
+            break
+        }
+
+        var mu sync.Mutex
+        var wg sync.WaitGroup
+        found := []dhtContact(nil)
+        for _, c := range batch {
+            wg.Add(1)
+            go func(c dhtContact) {
+                defer wg.Done()
+                res, ok := d.request(c.addr(), dhtMessage {
+                    Type:   typ,
+                    Target: target[:],
+                })
+                if !ok {
+                    return
+                }
+                more := d.morePages(c.addr(), target, res)
+                mu.Lock()
+                defer mu.Unlock()
+                found = append(found, res.Nodes...)
+                records = append(records, res.Records...)
+                records = append(records, more...)
+            }(c)
+        }
+        wg.Wait()
+
+        known := make(map[string]bool)
+        for _, c := range shortlist {
+            known[string(c.ID)] = true
+        }
+        for _, c := range found {
+            if id, ok := c.id(); !ok || id == d.self || known[string(c.ID)] {
+                continue
+            }
+            known[string(c.ID)] = true
+            shortlist = append(shortlist, c)
+        }
+        sortByDistance(shortlist, target)
+        if len(shortlist) > dhtK {
+            shortlist = shortlist[:dhtK]
+        }
+    }
+
+    return shortlist, records
+}
+
+//requests the records left out of a find_value response, a page at a time
+func (d *dht) morePages(addr *net.UDPAddr, target dhtID, res dhtMessage) []dhtRecord {
+    records := []dhtRecord(nil)
+    offset := len(res.Records)
+    for page := 1; res.More && len(res.Records) > 0 && page < dhtMaxPages; page++ {
+        var ok bool
+        res, ok = d.request(addr, dhtMessage {
+            Type:   "find_value",
+            Target: target[:],
+            Offset: offset,
+        })
+        if !ok {
+            break
+        }
+        records = append(records, res.Records...)
+        offset += len(res.Records)
+    }
+    return records
+}
+
+func (d *dht) request(addr *net.UDPAddr, msg dhtMessage) (dhtMessage, bool) {
+    var tx [8]byte
+    _, _ = rand.Read(tx[:])
+    msg.Tx = binary.BigEndian.Uint64(tx[:])
+    msg.From = d.self[:]
+
+    ch := make(chan dhtMessage, 1)
+    d.mu.Lock()
+    d.pending[msg.Tx] = ch
+    d.mu.Unlock()
+
+    defer func() {
+        d.mu.Lock()
+        delete(d.pending, msg.Tx)
+        d.mu.Unlock()
+    }()
+
+    d.send(addr, msg)
+
+    select {
+        case res := <-ch:
+            return res, true
+        case <-time.After(dhtTimeout):
+            return dhtMessage {}, false
+    }
+}
+
+func (d *dht) send(addr *net.UDPAddr, msg dhtMessage) {
+    data, err := json.Marshal(msg)
+    if err != nil {
+        log.Printf("Failed to encode DHT message: %v", err)
+        return
+    }
+    d.write(makeMessage(magicDHT, data), addr)
+}
+
+//handles a DHT packet received from addr
+func (d *dht) handle(data []byte, addr *net.UDPAddr) {
+    var msg dhtMessage
+    if err := json.Unmarshal(data, &msg); err != nil {
+        log.Printf("Malformed DHT message from %v: %v", addr, err)
+        return
+    }
+
+    d.seen(dhtContact {
+        ID:   msg.From,
+        IP:   addr.IP.String(),
+        Port: uint16(addr.Port),
+    })
+
+    if msg.Response {
+        d.mu.Lock()
+        ch, ok := d.pending[msg.Tx]
+        d.mu.Unlock()
+        if ok {
+            select {
+                case ch <- msg:
+                default:
+            }
+        }
+        return
+    }
+
+    res := dhtMessage {
+        Type:     msg.Type,
+        Tx:       msg.Tx,
+        Response: true,
+        From:     d.self[:],
+    }
+
+    var target dhtID
+    if msg.Type != "ping" {
+        if len(msg.Target) != len(target) {
+            return
+        }
+        copy(target[:], msg.Target)
+    }
+
+    switch msg.Type {
+        case "ping":
+        case "find_node":
+            fitMessage(&res, nil, d.closest(target, dhtK))
+        case "find_value":
+            if msg.Offset < 0 {
+                return
+            }
+            fitMessage(&res, d.localRecords(target, msg.Offset), d.closest(target, dhtK))
+        case "store":
+            if msg.Record == nil || !d.storeRecord(target, *msg.Record) {
+                return
+            }
+        default:
+            return
+    }
+    d.send(addr, res)
+}
+
+//adds as many records, then contacts, to msg as fit in dhtMaxPacket, flagging records
+//left out so they can be requested next
+func fitMessage(msg *dhtMessage, records []dhtRecord, nodes []dhtContact) {
+    more := msg.More
+    msg.More = true
+    base, _ := json.Marshal(msg)
+    msg.More = more
+    //what makeMessage puts before the message
+    left := dhtMaxPacket - 128 - len(base)
+
+    //each item also takes a comma, and the first the field name and brackets
+    left -= len(`,"records":[]`)
+    for i, r := range records {
+        data, _ := json.Marshal(r)
+        if left -= len(data) + 1; left < 0 {
+            msg.More = true
+            break
+        }
+        msg.Records = records[:i + 1]
+    }
+    left -= len(`,"nodes":[]`)
+    for i, c := range nodes {
+        data, _ := json.Marshal(c)
+        if left -= len(data) + 1; left < 0 {
+            break
+        }
+        msg.Nodes = nodes[:i + 1]
+    }
+}
@@ -0,0 +1,249 @@
+package client
+
+import (
+    "context"
+    "crypto/ed25519"
+    "fmt"
+    "net"
+    "sort"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/natanbc/ssc0904-nat-traversal/coord"
+    "github.com/natanbc/ssc0904-nat-traversal/netsim"
+)
+
+const testBootstrap = "198.51.100.4:6881"
+
+//runs a DHT node that only stores and answers, like a public bootstrap node
+func startBootstrapNode(t *testing.T, w *testWorld) {
+    t.Helper()
+    conn, err := w.serverHost(testBootstrap).ListenPacket("udp4", testBootstrap)
+    if err != nil {
+        t.Fatal(err)
+    }
+    d, err := newDHT(func(msg []byte, addr *net.UDPAddr) {
+        conn.WriteTo(msg, addr)
+    }, nil, 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() {
+        conn.Close()
+        d.close()
+    })
+    go func() {
+        buf := make([]byte, 65536)
+        for {
+            n, addr, err := conn.ReadFrom(buf)
+            if err != nil {
+                return
+            }
+            if data, typ, err := parseMessage(buf[:n]); err == nil && typ == magicDHT {
+                d.queue(data, addr.(*net.UDPAddr))
+            }
+        }
+    }()
+}
+
+func startDHTPeer(t *testing.T, stack netstack, name string) *host {
+    t.Helper()
+    config := testConfig(stack, "fixed")
+    config.discovery = "dht"
+    config.bootstrap = testBootstrap
+    config.dhtAnnounce = 200 * time.Millisecond
+    h, err := newHostWith(context.Background(), config, []string { testTopic }, name)
+    if err != nil {
+        t.Fatalf("Unable to start %s: %v", name, err)
+    }
+    t.Cleanup(func() {
+        h.close()
+    })
+    go h.run()
+    return h
+}
+
+//peers bootstrapped from the same node store their records on it, find each other's
+//and connect with checks signed with the keys in the records
+func TestDHTDiscovery(t *testing.T) {
+    w := newTestWorld(t, netsim.Config { Latency: 10 * time.Millisecond })
+    startBootstrapNode(t, w)
+    alice := startDHTPeer(t, w.peerHost(w.newNAT(&netsim.PortRestricted)), "alice")
+    bob := startDHTPeer(t, w.peerHost(w.newNAT(&netsim.PortRestricted)), "bob")
+
+    if !waitConnected(alice, bob, testConnectTimeout) {
+        t.Fatalf("Not connected within %v", testConnectTimeout)
+    }
+    if key, _ := alice.sessions[0].peers.keyOf("bob"); key != bob.publicKey {
+        t.Fatalf("Found the key '%s' for bob instead of '%s'", key, bob.publicKey)
+    }
+    if key, _ := bob.sessions[0].peers.keyOf("alice"); key != alice.publicKey {
+        t.Fatalf("Found the key '%s' for alice instead of '%s'", key, alice.publicKey)
+    }
+}
+
+//the check key is signed with the record, so nodes storing it can't swap it
+func TestDHTRecordSignsCheckKey(t *testing.T) {
+    pub, key, err := ed25519.GenerateKey(nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    r := dhtRecord {
+        Topic:    testTopic,
+        Name:     "alice",
+        IP:       "203.0.113.2",
+        Port:     1234,
+        Expires:  time.Now().Add(dhtRecordTTL).UnixMilli(),
+        CheckKey: "aa",
+        Key:      pub,
+    }
+    r.Sig = ed25519.Sign(key, r.signedData())
+    if !r.valid(time.Now()) {
+        t.Fatal("Signed record isn't valid")
+    }
+    r.CheckKey = "bb"
+    if r.valid(time.Now()) {
+        t.Fatal("Record with another check key is valid")
+    }
+}
+
+func signedRecord(t *testing.T, key ed25519.PrivateKey, name, checkKey string) dhtRecord {
+    t.Helper()
+    r := dhtRecord {
+        Topic:    testTopic,
+        Name:     name,
+        IP:       "203.0.113.2",
+        Port:     1234,
+        Expires:  time.Now().Add(dhtRecordTTL).UnixMilli(),
+        CheckKey: checkKey,
+        Key:      key.Public().(ed25519.PublicKey),
+    }
+    r.Sig = ed25519.Sign(key, r.signedData())
+    return r
+}
+
+func newTestKey(t *testing.T) ed25519.PrivateKey {
+    t.Helper()
+    _, key, err := ed25519.GenerateKey(nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return key
+}
+
+func memberKeys(peers []coord.Peer) string {
+    s := []string(nil)
+    for _, p := range peers {
+        s = append(s, p.Name + "=" + p.PublicKey)
+    }
+    sort.Strings(s)
+    return strings.Join(s, ",")
+}
+
+//storing a record first doesn't claim a name, readers stick to the first check key
+//they found for it and ignore names announced with several keys
+func TestDHTNameBinding(t *testing.T) {
+    d, err := newDHT(func([]byte, *net.UDPAddr) {}, nil, 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer d.close()
+
+    key := topicKey(testTopic)
+    owner, squatter := newTestKey(t), newTestKey(t)
+    alice := signedRecord(t, owner, "alice", "aa")
+    if !d.storeRecord(key, alice) {
+        t.Fatal("Refused alice's record")
+    }
+    if got := memberKeys(d.members(testTopic, d.localRecords(key, 0))); got != "alice=aa" {
+        t.Fatalf("Found '%s'", got)
+    }
+
+    //stored next to alice's, but alice stays bound to her key
+    fake := signedRecord(t, squatter, "alice", "ff")
+    if !d.storeRecord(key, fake) {
+        t.Fatal("Refused a second announcer of alice")
+    }
+    if got := memberKeys(d.members(testTopic, d.localRecords(key, 0))); got != "alice=aa" {
+        t.Fatalf("Found '%s' after the squatter announced alice", got)
+    }
+
+    //a squatter announcing a name first doesn't keep its owner out
+    if !d.storeRecord(key, signedRecord(t, squatter, "bob", "ff")) || !d.storeRecord(key, signedRecord(t, owner, "bob", "bb")) {
+        t.Fatal("Refused a record for bob")
+    }
+    if got := memberKeys(d.members(testTopic, d.localRecords(key, 0))); got != "alice=aa" {
+        t.Fatalf("Bound contested bob, found '%s'", got)
+    }
+
+    //a record can't be swapped for one with another check key by its storer
+    alice.CheckKey = "ff"
+    if d.storeRecord(key, alice) {
+        t.Fatal("Stored a record whose signature doesn't cover its check key")
+    }
+}
+
+//connects two DHT nodes by handing each one's packets to the other
+func linkedDHTs(t *testing.T) (*dht, *dht) {
+    t.Helper()
+    aAddr := &net.UDPAddr { IP: net.IPv4(192, 0, 2, 1), Port: 1 }
+    bAddr := &net.UDPAddr { IP: net.IPv4(192, 0, 2, 2), Port: 2 }
+    var a, b *dht
+    deliver := func(to **dht, from *net.UDPAddr) func([]byte, *net.UDPAddr) {
+        return func(msg []byte, _ *net.UDPAddr) {
+            if len(msg) > dhtMaxPacket {
+                t.Errorf("Sent a %d byte DHT packet", len(msg))
+            }
+            if data, typ, err := parseMessage(msg); err == nil && typ == magicDHT {
+                (*to).handle(data, from)
+            }
+        }
+    }
+    var err error
+    if a, err = newDHT(deliver(&b, aAddr), nil, 0); err != nil {
+        t.Fatal(err)
+    }
+    if b, err = newDHT(deliver(&a, bAddr), nil, 0); err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() {
+        a.close()
+        b.close()
+    })
+    if _, ok := a.request(bAddr, dhtMessage { Type: "ping" }); !ok {
+        t.Fatal("Linked nodes can't reach each other")
+    }
+    return a, b
+}
+
+//responses stay under the path MTU however many records a key has, and lookups page
+//through the rest
+func TestDHTResponsesFitPacket(t *testing.T) {
+    a, b := linkedDHTs(t)
+
+    key := topicKey(testTopic)
+    announcer := newTestKey(t)
+    const records = 20
+    for i := 0; i < records; i++ {
+        if !b.storeRecord(key, signedRecord(t, announcer, fmt.Sprintf("peer%02d", i), fmt.Sprintf("%064x", i))) {
+            t.Fatalf("Refused record %d", i)
+        }
+    }
+
+    res, ok := a.request(&net.UDPAddr { IP: net.IPv4(192, 0, 2, 2), Port: 2 }, dhtMessage {
+        Type:   "find_value",
+        Target: key[:],
+    })
+    if !ok {
+        t.Fatal("No answer to find_value")
+    }
+    if len(res.Records) == 0 || len(res.Records) == records || !res.More {
+        t.Fatalf("Got %d records in the first page, more: %v", len(res.Records), res.More)
+    }
+
+    _, found := a.lookup(key, true)
+    if got := len(a.members(testTopic, found)); got != records {
+        t.Fatalf("Lookup found %d of %d peers", got, records)
+    }
+}
@@ -0,0 +1,358 @@
+package client
+
+import (
+    "context"
+    "encoding/json"
+    "flag"
+    "fmt"
+    "io"
+    "log"
+    "net"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/peterbourgon/ff/v3/ffcli"
+)
+
+type stringList []string
+
+func (s *stringList) String() string {
+    return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(v string) error {
+    *s = append(*s, v)
+    return nil
+}
+
+var (
+    localForwards  stringList
+    remoteForwards stringList
+    forwardAllow   string
+    listenAllow    string
+)
+
+var forwardFs = (func() *flag.FlagSet {
+    fs := flag.NewFlagSet("forward", flag.ExitOnError)
+    addSessionFlags(fs)
+    fs.Var(&localForwards,       "L",            "localport:peer:remoteport, forwards a local port to a port on the peer (repeatable)")
+    fs.Var(&remoteForwards,      "R",            "remoteport:peer:localport, forwards a port on the peer to a local port (repeatable)")
+    fs.StringVar(&forwardAllow,  "allow",        "", "Comma separated ports or host:port targets peers may connect to through this client")
+    fs.StringVar(&listenAllow,   "allow-listen", "", "Comma separated ports peers may ask this client to listen on with -R")
+    return fs
+})()
+
+//forwardSpec is a parsed -L or -R argument
+type forwardSpec struct {
+    bindPort   int
+    peer       string
+    targetPort int
+}
+
+func parseForwardSpec(v string) (forwardSpec, error) {
+    parts := strings.Split(v, ":")
+    if len(parts) != 3 {
+        return forwardSpec {}, fmt.Errorf("Malformed forward '%s', expected port:peer:port", v)
+    }
+    bind, err := strconv.ParseUint(parts[0], 10, 16)
+    if err != nil || bind == 0 {
+        return forwardSpec {}, fmt.Errorf("Invalid port in forward '%s'", v)
+    }
+    target, err := strconv.ParseUint(parts[2], 10, 16)
+    if err != nil || target == 0 {
+        return forwardSpec {}, fmt.Errorf("Invalid port in forward '%s'", v)
+    }
+    return forwardSpec {
+        bindPort:   int(bind),
+        peer:       parts[1],
+        targetPort: int(target),
+    }, nil
+}
+
+//targets allowed in an allow list, bare ports refer to localhost
+func parseAllowList(list string) map[string]struct{} {
+    res := make(map[string]struct{})
+    for _, v := range strings.Split(list, ",") {
+        if v = strings.TrimSpace(v); v == "" {
+            continue
+        }
+        if !strings.Contains(v, ":") {
+            v = net.JoinHostPort("127.0.0.1", v)
+        }
+        res[v] = struct{}{}
+    }
+    return res
+}
+
+type forwardRequest struct {
+    Kind   string `json:"kind"`
+    Target string `json:"target,omitempty"`
+    Port   int    `json:"port,omitempty"`
+    ID     uint32 `json:"id,omitempty"`
+}
+
+func parseForwardRequest(raw []byte) (forwardRequest, error) {
+    var req forwardRequest
+    err := json.Unmarshal(raw, &req)
+    return req, err
+}
+
+//forwarder tunnels TCP connections through streams, in both directions
+type forwarder struct {
+    mux          *streamMux
+    allow        map[string]struct{}
+    allowListen  map[string]struct{}
+
+    mu           sync.Mutex
+    nextID       uint32
+    //local targets of -R forwards, by peer and id
+    reverse      map[string]map[uint32]string
+}
+
+func newForwarder(mux *streamMux, allow, allowListen string) *forwarder {
+    f := &forwarder {
+        mux:         mux,
+        allow:       parseAllowList(allow),
+        allowListen: parseAllowList(allowListen),
+        reverse:     make(map[string]map[uint32]string),
+    }
+    mux.listen("forward", f.onForward)
+    mux.listen("listen", f.onListen)
+    mux.listen("reverse", f.onReverse)
+    return f
+}
+
+//copies in both directions, half-closing each side when the other one finishes
+func splice(conn *net.TCPConn, st *stream) {
+    var wg sync.WaitGroup
+    wg.Add(2)
+    go func() {
+        defer wg.Done()
+        io.Copy(st, conn)
+        st.CloseWrite()
+    }()
+    go func() {
+        defer wg.Done()
+        if _, err := io.Copy(conn, st); err != nil {
+            log.Printf("Forwarded connection to %s failed: %v", st.peer, err)
+            conn.Close()
+        }
+        conn.CloseWrite()
+    }()
+    wg.Wait()
+    conn.Close()
+    st.Close()
+}
+
+func dialAndSplice(st *stream, target string) error {
+    conn, err := net.Dial("tcp", target)
+    if err != nil {
+        return err
+    }
+    go splice(conn.(*net.TCPConn), st)
+    return nil
+}
+
+//a peer wants to reach a target through us
+func (f *forwarder) onForward(st *stream, raw []byte) error {
+    req, err := parseForwardRequest(raw)
+    if err != nil {
+        return err
+    }
+    if _, ok := f.allow[req.Target]; !ok {
+        return fmt.Errorf("Forwarding to %s is not allowed", req.Target)
+    }
+    log.Printf("Forwarding connection from %s to %s", st.peer, req.Target)
+    return dialAndSplice(st, req.Target)
+}
+
+//a peer wants us to listen on a port and send connections back to it, for as long
+//as the stream stays open
+func (f *forwarder) onListen(st *stream, raw []byte) error {
+    req, err := parseForwardRequest(raw)
+    if err != nil {
+        return err
+    }
+    bind := net.JoinHostPort("127.0.0.1", strconv.Itoa(req.Port))
+    if _, ok := f.allowListen[bind]; !ok {
+        return fmt.Errorf("Listening on port %d is not allowed", req.Port)
+    }
+
+    l, err := net.Listen("tcp", bind)
+    if err != nil {
+        return err
+    }
+    log.Printf("Listening on %s for %s", bind, st.peer)
+
+    go func() {
+        //the peer closing the control stream ends the forward
+        io.Copy(io.Discard, st)
+        l.Close()
+        st.Close()
+    }()
+    go func() {
+        defer l.Close()
+        for {
+            conn, err := l.Accept()
+            if err != nil {
+                return
+            }
+            go func() {
+                back, err := f.mux.open(st.peer, forwardRequest {
+                    Kind: "reverse",
+                    ID:   req.ID,
+                })
+                if err != nil {
+                    log.Printf("Failed to forward connection back to %s: %v", st.peer, err)
+                    conn.Close()
+                    return
+                }
+                splice(conn.(*net.TCPConn), back)
+            }()
+        }
+    }()
+    return nil
+}
+
+//a connection accepted by a peer for one of our -R forwards
+func (f *forwarder) onReverse(st *stream, raw []byte) error {
+    req, err := parseForwardRequest(raw)
+    if err != nil {
+        return err
+    }
+
+    f.mu.Lock()
+    target, ok := f.reverse[st.peer][req.ID]
+    f.mu.Unlock()
+    if !ok {
+        return fmt.Errorf("Unknown reverse forward %d", req.ID)
+    }
+    return dialAndSplice(st, target)
+}
+
+func (f *forwarder) forwardLocal(spec forwardSpec) error {
+    l, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(spec.bindPort)))
+    if err != nil {
+        return fmt.Errorf("Unable to listen for forward: %w", err)
+    }
+    log.Printf("Forwarding %s to port %d of %s", l.Addr(), spec.targetPort, spec.peer)
+
+    go func() {
+        for {
+            conn, err := l.Accept()
+            if err != nil {
+                log.Printf("Stopped forwarding %s: %v", l.Addr(), err)
+                return
+            }
+            go func() {
+                st, err := f.mux.open(spec.peer, forwardRequest {
+                    Kind:   "forward",
+                    Target: net.JoinHostPort("127.0.0.1", strconv.Itoa(spec.targetPort)),
+                })
+                if err != nil {
+                    log.Printf("Failed to forward connection to %s: %v", spec.peer, err)
+                    conn.Close()
+                    return
+                }
+                splice(conn.(*net.TCPConn), st)
+            }()
+        }
+    }()
+    return nil
+}
+
+func (f *forwarder) forwardRemote(spec forwardSpec) error {
+    f.mu.Lock()
+    f.nextID++
+    id := f.nextID
+    if f.reverse[spec.peer] == nil {
+        f.reverse[spec.peer] = make(map[uint32]string)
+    }
+    f.reverse[spec.peer][id] = net.JoinHostPort("127.0.0.1", strconv.Itoa(spec.targetPort))
+    f.mu.Unlock()
+
+    st, err := f.mux.open(spec.peer, forwardRequest {
+        Kind: "listen",
+        Port: spec.bindPort,
+        ID:   id,
+    })
+    if err != nil {
+        return fmt.Errorf("Unable to start remote forward on %s: %w", spec.peer, err)
+    }
+    log.Printf("Forwarding port %d of %s to local port %d", spec.bindPort, spec.peer, spec.targetPort)
+
+    go func() {
+        io.Copy(io.Discard, st)
+        log.Printf("Remote forward of port %d on %s ended", spec.bindPort, spec.peer)
+        st.Close()
+    }()
+    return nil
+}
+
+var forwardCommand = &ffcli.Command {
+    Name:       "forward",
+    ShortUsage: "client forward [flags] <topic> <name>",
+    ShortHelp:  "Forwards TCP ports to and from peers over the punched paths",
+    LongHelp:   "Forwards TCP ports to and from peers over the punched paths. Peers only connect to targets " +
+                "listed in their -allow flag, and only listen on ports listed in their -allow-listen flag.",
+    FlagSet:    forwardFs,
+    Exec:       func(ctx context.Context, args []string) error {
+        if len(args) != 2 {
+            return flag.ErrHelp
+        }
+        topic := args[0]
+        name  := args[1]
+
+        local := []forwardSpec(nil)
+        for _, v := range localForwards {
+            spec, err := parseForwardSpec(v)
+            if err != nil {
+                return err
+            }
+            local = append(local, spec)
+        }
+        remote := []forwardSpec(nil)
+        for _, v := range remoteForwards {
+            spec, err := parseForwardSpec(v)
+            if err != nil {
+                return err
+            }
+            remote = append(remote, spec)
+        }
+
+        s, err := newSession(ctx, topic, name)
+        if err != nil {
+            return err
+        }
+        defer s.close()
+
+        f := newForwarder(newStreamMux(s), forwardAllow, listenAllow)
+        for _, spec := range local {
+            if err := f.forwardLocal(spec); err != nil {
+                return err
+            }
+        }
+
+        errs := make(chan error, 1)
+        go func() { errs <- s.run() }()
+
+        //remote forwards need the peer to be known and punched first
+        for _, spec := range remote {
+            spec := spec
+            go func() {
+                for s.peers.waitForPeer(ctx, spec.peer) {
+                    err := f.forwardRemote(spec)
+                    if err == nil {
+                        return
+                    }
+                    log.Printf("%v", err)
+                    time.Sleep(5 * time.Second)
+                }
+            }()
+        }
+
+        return <-errs
+    },
+}
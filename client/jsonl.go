@@ -0,0 +1,207 @@
+package client
+
+import (
+    "bufio"
+    "encoding/json"
+    "fmt"
+    "io"
+    "sync"
+    "time"
+)
+
+//jsonl drives the client with JSON objects, one per line: commands are read from
+//stdin and events are written to stdout, while logs keep going to stderr
+
+type jsonlCommand struct {
+    //copied to the events answering the command
+    ID      json.RawMessage `json:"id,omitempty"`
+    Command string          `json:"command"`
+    //the first topic joined if empty
+    Topic   string          `json:"topic,omitempty"`
+    To      []string        `json:"to,omitempty"`
+    Channel string          `json:"channel,omitempty"`
+    Data    []byte          `json:"data,omitempty"`
+}
+
+var peerEventNames = map[peerEventKind]string {
+    peerJoined:    "peer_joined",
+    peerLeft:      "peer_left",
+    peerConnected: "connected",
+}
+
+type jsonlPeerEvent struct {
+    Event string `json:"event"`
+    Topic string `json:"topic"`
+    Name  string `json:"name"`
+    Addr  string `json:"addr"`
+}
+
+type jsonlMessageEvent struct {
+    Event   string `json:"event"`
+    Topic   string `json:"topic"`
+    From    string `json:"from"`
+    Addr    string `json:"addr"`
+    Kind    string `json:"kind"`
+    Channel string `json:"channel,omitempty"`
+    Data    []byte `json:"data"`
+}
+
+type jsonlErrorEvent struct {
+    Event string          `json:"event"`
+    ID    json.RawMessage `json:"id,omitempty"`
+    Error string          `json:"error"`
+}
+
+type jsonlPeer struct {
+    Name   string  `json:"name"`
+    Addr   string  `json:"addr"`
+    State  string  `json:"state"`
+    //round trip time in milliseconds, 0 if not measured yet
+    RTT    float64 `json:"rtt_ms"`
+    //the address the peer sees us as, if it answers connectivity checks
+    SeenAs string  `json:"seen_as,omitempty"`
+}
+
+func jsonlPeers(p *peerRegistry) []jsonlPeer {
+    peers := []jsonlPeer {}
+    for _, info := range p.peerInfos() {
+        seenAs := ""
+        if info.seenAs != nil {
+            seenAs = info.seenAs.String()
+        }
+        peers = append(peers, jsonlPeer {
+            Name:   info.peer.Name,
+            Addr:   info.peer.IPPort().String(),
+            State:  info.state(),
+            RTT:    float64(info.rtt) / float64(time.Millisecond),
+            SeenAs: seenAs,
+        })
+    }
+    return peers
+}
+
+type jsonlPeersEvent struct {
+    Event string          `json:"event"`
+    ID    json.RawMessage `json:"id,omitempty"`
+    Topic string          `json:"topic"`
+    Peers []jsonlPeer     `json:"peers"`
+}
+
+type jsonlSentEvent struct {
+    Event string          `json:"event"`
+    ID    json.RawMessage `json:"id,omitempty"`
+}
+
+type jsonlFrontend struct {
+    topics topicList
+
+    mu     sync.Mutex
+    enc    *json.Encoder
+}
+
+func newJsonlFrontend(sessions []*session, out io.Writer) *jsonlFrontend {
+    f := &jsonlFrontend {
+        enc: json.NewEncoder(out),
+    }
+    for _, s := range sessions {
+        f.topics = append(f.topics, newMessenger(s, func(msg chatMessage) {
+            f.emit(newJsonlMessageEvent(msg))
+        }))
+        topic := s.topic
+        s.peers.subscribe(func(e peerEvent) {
+            f.emit(newJsonlPeerEvent(topic, e))
+        })
+    }
+    return f
+}
+
+func newJsonlMessageEvent(msg chatMessage) jsonlMessageEvent {
+    return jsonlMessageEvent {
+        Event:   "message",
+        Topic:   msg.topic,
+        From:    msg.from,
+        Addr:    msg.addr.String(),
+        Kind:    msg.kind.String(),
+        Channel: msg.channel,
+        Data:    msg.data,
+    }
+}
+
+func newJsonlPeerEvent(topic string, e peerEvent) jsonlPeerEvent {
+    return jsonlPeerEvent {
+        Event: peerEventNames[e.kind],
+        Topic: topic,
+        Name:  e.peer.Name,
+        Addr:  e.peer.IPPort().String(),
+    }
+}
+
+func (f *jsonlFrontend) emit(event interface{}) {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    f.enc.Encode(event)
+}
+
+func (f *jsonlFrontend) fail(id json.RawMessage, err error) {
+    f.emit(jsonlErrorEvent {
+        Event: "error",
+        ID:    id,
+        Error: err.Error(),
+    })
+}
+
+//reads commands until r is closed
+func (f *jsonlFrontend) run(r io.Reader) {
+    scanner := bufio.NewScanner(r)
+    //room for base64 encoded payloads of a full datagram
+    scanner.Buffer(make([]byte, 64 * 1024), 256 * 1024)
+    for scanner.Scan() {
+        line := scanner.Bytes()
+        if len(line) == 0 {
+            continue
+        }
+        var cmd jsonlCommand
+        if err := json.Unmarshal(line, &cmd); err != nil {
+            f.fail(nil, fmt.Errorf("Malformed command: %w", err))
+            continue
+        }
+        if err := f.handle(cmd); err != nil {
+            f.fail(cmd.ID, err)
+        }
+    }
+    if err := scanner.Err(); err != nil {
+        f.fail(nil, fmt.Errorf("Failed to read commands: %w", err))
+    }
+}
+
+func (f *jsonlFrontend) handle(cmd jsonlCommand) error {
+    m, err := f.topics.find(cmd.Topic)
+    if err != nil {
+        return err
+    }
+    switch cmd.Command {
+        case "send":
+            if err := m.broadcast(cmd.Channel, cmd.Data); err != nil {
+                return err
+            }
+        case "sendto":
+            if err := m.sendTo(cmd.To, cmd.Channel, cmd.Data); err != nil {
+                return err
+            }
+        case "list":
+            f.emit(jsonlPeersEvent {
+                Event: "peers",
+                ID:    cmd.ID,
+                Topic: m.s.topic,
+                Peers: jsonlPeers(m.s.peers),
+            })
+            return nil
+        default:
+            return fmt.Errorf("Unknown command '%s'", cmd.Command)
+    }
+    f.emit(jsonlSentEvent {
+        Event: "sent",
+        ID:    cmd.ID,
+    })
+    return nil
+}
@@ -0,0 +1,141 @@
+package client
+
+import (
+    "encoding/json"
+    "io"
+    "testing"
+    "time"
+
+    "github.com/natanbc/ssc0904-nat-traversal/netsim"
+)
+
+//the fields of every event the frontend writes
+type jsonlTestEvent struct {
+    Event   string          `json:"event"`
+    ID      json.RawMessage `json:"id"`
+    Topic   string          `json:"topic"`
+    Name    string          `json:"name"`
+    From    string          `json:"from"`
+    Kind    string          `json:"kind"`
+    Channel string          `json:"channel"`
+    Data    []byte          `json:"data"`
+    Error   string          `json:"error"`
+    Peers   []jsonlPeer     `json:"peers"`
+}
+
+//a frontend for the sessions of h, taking commands written to the returned writer and
+//sending the events it writes to the returned channel
+func startJsonl(t *testing.T, h *host) (io.Writer, chan jsonlTestEvent) {
+    t.Helper()
+    inR, inW := io.Pipe()
+    outR, outW := io.Pipe()
+    t.Cleanup(func() {
+        inW.Close()
+        outR.Close()
+    })
+
+    events := make(chan jsonlTestEvent, 64)
+    go func() {
+        dec := json.NewDecoder(outR)
+        for {
+            var e jsonlTestEvent
+            if err := dec.Decode(&e); err != nil {
+                return
+            }
+            events <- e
+        }
+    }()
+    go newJsonlFrontend(h.sessions, outW).run(inR)
+    return inW, events
+}
+
+//the next event named name, skipping the others
+func nextEvent(t *testing.T, events chan jsonlTestEvent, name string) jsonlTestEvent {
+    t.Helper()
+    timeout := time.After(time.Second)
+    for {
+        select {
+            case e := <-events:
+                if e.Event == name {
+                    return e
+                }
+            case <-timeout:
+                t.Fatalf("No %s event", name)
+        }
+    }
+}
+
+func TestJsonlFrontend(t *testing.T) {
+    w := newTestWorld(t, netsim.Config { Latency: time.Millisecond })
+    ha := startPeer(t, w.peerHost(nil), "fixed", "alice")
+    hb := startPeer(t, w.peerHost(nil), "fixed", "bob")
+    if !waitConnected(ha, hb, testConnectTimeout) {
+        t.Fatal("Peers didn't connect")
+    }
+    bob := startMessenger(hb)
+    in, events := startJsonl(t, ha)
+
+    //peers already known are replayed
+    if e := nextEvent(t, events, "connected"); e.Name != "bob" || e.Topic != testTopic {
+        t.Fatalf("Got %+v", e)
+    }
+
+    command := func(line string) {
+        t.Helper()
+        if _, err := io.WriteString(in, line + "\n"); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    //data is base64, as encoding/json does with byte slices
+    command(`{"id":1,"command":"send","data":"aGVsbG8="}`)
+    if e := nextEvent(t, events, "sent"); string(e.ID) != "1" {
+        t.Fatalf("Answered with id %s", e.ID)
+    }
+    if msg := nextMessage(bob.got, time.Second); msg.kind != messageBroadcast || string(msg.data) != "hello" {
+        t.Fatalf("Bob got %+v", msg)
+    }
+
+    command(`{"id":"x","command":"sendto","to":["bob"],"channel":"dev","data":"aGk="}`)
+    if e := nextEvent(t, events, "sent"); string(e.ID) != `"x"` {
+        t.Fatalf("Answered with id %s", e.ID)
+    }
+    if msg := nextMessage(bob.got, time.Second); msg.kind != messageDirect || msg.channel != "dev" || string(msg.data) != "hi" {
+        t.Fatalf("Bob got %+v", msg)
+    }
+
+    command(`{"id":2,"command":"list"}`)
+    e := nextEvent(t, events, "peers")
+    if string(e.ID) != "2" || e.Topic != testTopic || len(e.Peers) != 1 || e.Peers[0].Name != "bob" || e.Peers[0].State != "connected" {
+        t.Fatalf("Listed %+v", e)
+    }
+
+    //messages from peers come as events
+    if err := bob.sendTo([]string { "alice" }, defaultChannel, []byte("back")); err != nil {
+        t.Fatal(err)
+    }
+    if e := nextEvent(t, events, "message"); e.From != "bob" || e.Kind != "direct" || string(e.Data) != "back" {
+        t.Fatalf("Got %+v", e)
+    }
+
+    //errors answer the command that caused them, and don't stop the frontend
+    errors := []struct {
+        line string
+        id   string
+    } {
+        { `{"id":3,"command":"shout"}`, "3" },
+        { `{"id":4,"command":"send","topic":"nope"}`, "4" },
+        { `{"id":5,"command":"sendto","to":["dave"],"data":"eA=="}`, "5" },
+        { `not json`, "" },
+    }
+    for _, c := range errors {
+        command(c.line)
+        if e := nextEvent(t, events, "error"); string(e.ID) != c.id || e.Error == "" {
+            t.Fatalf("Answered '%s' with %+v", c.line, e)
+        }
+    }
+    command(`{"id":6,"command":"list"}`)
+    if e := nextEvent(t, events, "peers"); string(e.ID) != "6" {
+        t.Fatalf("Answered with id %s", e.ID)
+    }
+}
@@ -0,0 +1,233 @@
+package client
+
+import (
+    "encoding/json"
+    "fmt"
+    "log"
+    "net"
+    "sync"
+    "time"
+
+    "github.com/natanbc/ssc0904-nat-traversal/coord"
+)
+
+const lanSource = "lan"
+
+const lanAnnounceInterval = 5 * time.Second
+
+type lanAnnouncement struct {
+    Topic string `json:"topic"`
+    Name  string `json:"name"`
+    Port  uint16 `json:"port"`
+    //the key connectivity checks with the peer are signed with a key derived from
+    Key   string `json:"key"`
+}
+
+//lanDiscovery announces membership to a multicast group on the local link, so peers
+//on the same subnet find each other's host addresses without coord or the NAT
+type lanDiscovery struct {
+    group *net.UDPAddr
+    port  uint16
+
+    mu           sync.Mutex
+    seen         map[string]lanPeer
+    sender       *net.UDPConn
+    listener     *net.UDPConn
+    announcement []byte
+}
+
+type lanPeer struct {
+    peer     coord.Peer
+    lastSeen time.Time
+}
+
+func newLanDiscovery(group string, localPort int) (*lanDiscovery, error) {
+    addr, err := net.ResolveUDPAddr("udp4", group)
+    if err != nil {
+        return nil, fmt.Errorf("Unable to resolve LAN multicast group: %w", err)
+    }
+    if !addr.IP.IsMulticast() {
+        return nil, fmt.Errorf("LAN group %s is not a multicast address", group)
+    }
+    return &lanDiscovery {
+        group: addr,
+        port:  uint16(localPort),
+        seen:  make(map[string]lanPeer),
+    }, nil
+}
+
+func (l *lanDiscovery) start(p *peerRegistry) error {
+    listener, err := net.ListenMulticastUDP("udp4", nil, l.group)
+    if err != nil {
+        return fmt.Errorf("Unable to join LAN multicast group: %w", err)
+    }
+    sender, err := net.DialUDP("udp4", nil, l.group)
+    if err != nil {
+        listener.Close()
+        return fmt.Errorf("Unable to create LAN announcement socket: %w", err)
+    }
+
+    l.sender = sender
+    l.mu.Lock()
+    l.listener = listener
+    l.mu.Unlock()
+    if err := l.setName(p, p.self().Name); err != nil {
+        listener.Close()
+        sender.Close()
+        return err
+    }
+
+    go func() {
+        defer listener.Close()
+
+        buf := make([]byte, 2048)
+        for !p.shouldStop() {
+            listener.SetReadDeadline(time.Now().Add(lanAnnounceInterval))
+            n, src, err := listener.ReadFromUDP(buf)
+            if err != nil {
+                if ne, ok := err.(net.Error); ok && ne.Timeout() {
+                    l.expire(p)
+                    continue
+                }
+                if !p.shouldStop() {
+                    log.Printf("Failed to read LAN announcement: %v", err)
+                }
+                return
+            }
+
+            var a lanAnnouncement
+            if err := json.Unmarshal(buf[:n], &a); err != nil {
+                continue
+            }
+            if a.Topic != p.topic || a.Name == p.self().Name || a.Port == 0 {
+                continue
+            }
+            l.onAnnouncement(p, a, src.IP)
+        }
+    }()
+    go func() {
+        defer sender.Close()
+
+        t := time.NewTicker(lanAnnounceInterval)
+        defer t.Stop()
+
+        for !p.shouldStop() {
+            l.announce()
+            <-t.C
+        }
+    }()
+
+    return nil
+}
+
+//stops listening right away, the announcements stop on their next tick
+func (l *lanDiscovery) stop() {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    if l.listener != nil {
+        l.listener.Close()
+    }
+}
+
+func (l *lanDiscovery) setName(p *peerRegistry, name string) error {
+    a := lanAnnouncement {
+        Topic: p.topic,
+        Name:  name,
+        Port:  l.port,
+        Key:   p.self().PublicKey,
+    }
+    announcement, err := json.Marshal(a)
+    if err != nil {
+        return fmt.Errorf("Unable to encode LAN announcement: %w", err)
+    }
+    l.mu.Lock()
+    l.announcement = announcement
+    l.mu.Unlock()
+    return nil
+}
+
+//peers see the old name expire and the new one appear
+func (l *lanDiscovery) rename(p *peerRegistry, name string) error {
+    if err := l.setName(p, name); err != nil {
+        return err
+    }
+    l.announce()
+    return nil
+}
+
+func (l *lanDiscovery) announce() {
+    l.mu.Lock()
+    announcement := l.announcement
+    l.mu.Unlock()
+    if _, err := l.sender.Write(announcement); err != nil {
+        log.Printf("Failed to send LAN announcement: %v", err)
+    }
+}
+
+//announcements must carry the key another discovery source gave for the peer, if
+//any, so peers still find each other when coord is unreachable. Anyone on the link
+//can announce any name, so addresses are only used once a check signed with the key
+//of the pair verified the peer holds the key announced.
+func (l *lanDiscovery) onAnnouncement(p *peerRegistry, a lanAnnouncement, ip net.IP) {
+    if ip4 := ip.To4(); ip4 != nil {
+        ip = ip4
+    }
+    if a.Key == "" {
+        return
+    }
+    if key, ok := p.trustedKeyOf(a.Name); ok && key != a.Key {
+        return
+    }
+
+    l.mu.Lock()
+    prev, known := l.seen[a.Name]
+    l.seen[a.Name] = lanPeer {
+        peer:     coord.Peer {
+            Name:      a.Name,
+            IP:        ip,
+            Port:      a.Port,
+            LastSeen:  time.Now(),
+            PublicKey: a.Key,
+        },
+        lastSeen: time.Now(),
+    }
+    changed := !known || !prev.peer.IP.Equal(ip) || prev.peer.Port != a.Port || prev.peer.PublicKey != a.Key
+    l.mu.Unlock()
+
+    if changed {
+        l.report(p)
+    } else {
+        l.expire(p)
+    }
+    //lets newcomers find us without waiting for the next interval
+    if !known {
+        l.announce()
+    }
+}
+
+func (l *lanDiscovery) expire(p *peerRegistry) {
+    l.mu.Lock()
+    changed := false
+    for name, v := range l.seen {
+        if time.Since(v.lastSeen) > 3 * lanAnnounceInterval {
+            delete(l.seen, name)
+            changed = true
+        }
+    }
+    l.mu.Unlock()
+
+    if changed {
+        l.report(p)
+    }
+}
+
+func (l *lanDiscovery) report(p *peerRegistry) {
+    l.mu.Lock()
+    peers := []coord.Peer(nil)
+    for _, v := range l.seen {
+        peers = append(peers, v.peer)
+    }
+    l.mu.Unlock()
+
+    p.updatePeers(lanSource, peers)
+}
@@ -0,0 +1,108 @@
+package client
+
+import (
+    "context"
+    "net"
+    "testing"
+    "time"
+
+    "github.com/natanbc/ssc0904-nat-traversal/coord"
+    "github.com/natanbc/ssc0904-nat-traversal/netsim"
+)
+
+//nothing listens there, like a coordination server that is down
+const testDeadCoordServer = "198.51.100.9:6969"
+
+func startPeerWithoutCoord(t *testing.T, stack netstack, name string) *host {
+    t.Helper()
+    config := testConfig(stack, "fixed")
+    config.coordServer = "http://" + testDeadCoordServer
+    h, err := newHostWith(context.Background(), config, []string { testTopic }, name)
+    if err != nil {
+        t.Fatalf("Unable to start %s: %v", name, err)
+    }
+    t.Cleanup(func() {
+        h.close()
+    })
+    go h.run()
+    return h
+}
+
+//what from announces on the local link, as to receives it. The multicast group itself
+//isn't simulated, announcements sent back go to the discard port on loopback.
+func lanAnnounce(t *testing.T, to, from *host, ip net.IP, key string) *lanDiscovery {
+    t.Helper()
+    l, err := newLanDiscovery("239.255.42.99:6970", 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    l.sender, err = net.DialUDP("udp4", nil, &net.UDPAddr { IP: net.IPv4(127, 0, 0, 1), Port: 9 })
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() {
+        l.sender.Close()
+    })
+    l.onAnnouncement(to.sessions[0].peers, lanAnnouncement {
+        Topic: testTopic,
+        Name:  from.sessions[0].getName(),
+        Port:  uint16(from.socket.Conn.LocalAddr().(*net.UDPAddr).Port),
+        Key:   key,
+    }, ip)
+    return l
+}
+
+//peers behind the same NAT without hairpinning only reach each other through the
+//addresses they announce on the link, which works without the coordination server
+func TestLanWithoutCoord(t *testing.T) {
+    w := newTestWorld(t, netsim.Config { Latency: 10 * time.Millisecond })
+    nat := w.newNAT(&netsim.PortRestricted)
+    ha, hb := w.peerHost(nat), w.peerHost(nat)
+    alice := startPeerWithoutCoord(t, ha, "alice")
+    bob := startPeerWithoutCoord(t, hb, "bob")
+
+    lanAnnounce(t, alice, bob, hb.IP(), bob.publicKey)
+    lanAnnounce(t, bob, alice, ha.IP(), alice.publicKey)
+    if !waitConnected(alice, bob, testConnectTimeout) {
+        t.Fatalf("Not connected within %v", testConnectTimeout)
+    }
+}
+
+//announcements with another key than the one a trusted source gave are ignored
+func TestLanRejectsOtherKey(t *testing.T) {
+    w := newTestWorld(t, netsim.Config {})
+    ha, hb := w.peerHost(nil), w.peerHost(nil)
+    alice := startPeerWithoutCoord(t, ha, "alice")
+    bob := startPeerWithoutCoord(t, hb, "bob")
+
+    alice.sessions[0].peers.updatePeers("coord", []coord.Peer {{
+        Name:      "bob",
+        IP:        hb.IP(),
+        Port:      1234,
+        PublicKey: bob.publicKey,
+    }})
+    l := lanAnnounce(t, alice, bob, net.IPv4(192, 168, 1, 99), alice.publicKey)
+    if _, ok := l.seen["bob"]; ok {
+        t.Fatal("Announcement with another key accepted")
+    }
+    l = lanAnnounce(t, alice, bob, net.IPv4(192, 168, 1, 99), bob.publicKey)
+    if _, ok := l.seen["bob"]; !ok {
+        t.Fatal("Announcement with the key of bob ignored")
+    }
+}
+
+//peers started while the coordination server is down register once it comes up
+func TestCoordRetriedInBackground(t *testing.T) {
+    w := newTestWorld(t, netsim.Config { Latency: 10 * time.Millisecond })
+    alice := startPeerWithoutCoord(t, w.peerHost(nil), "alice")
+    bob := startPeerWithoutCoord(t, w.peerHost(nil), "bob")
+
+    l, err := w.serverHost(testDeadCoordServer).Listen("tcp4", testDeadCoordServer)
+    if err != nil {
+        t.Fatal(err)
+    }
+    go coord.Serve(l, 30 * time.Second, 10 * time.Second)
+    if !waitConnected(alice, bob, coordRetryMin + testConnectTimeout) {
+        t.Fatalf("Not connected within %v", coordRetryMin + testConnectTimeout)
+    }
+}
@@ -0,0 +1,243 @@
+package client
+
+import (
+    "fmt"
+    "log"
+    "net"
+    "sync"
+)
+
+//text messages between peers. Broadcasts to the whole topic are sent as plain
+//DATADATA packets, so older clients still see them, everything else is a MSGSMSGS
+//packet: a kind byte, the channel name prefixed by its length, then the text.
+
+type messageKind uint8
+
+const (
+    messageBroadcast messageKind = iota
+    messageDirect
+    messageMulticast
+)
+
+func (k messageKind) String() string {
+    switch k {
+        case messageBroadcast:
+            return "broadcast"
+        case messageDirect:
+            return "direct"
+        case messageMulticast:
+            return "multicast"
+        default:
+            return "unknown"
+    }
+}
+
+//the channel every peer is in, and the one plain broadcasts belong to
+const defaultChannel = ""
+
+type chatMessage struct {
+    topic   string
+    kind    messageKind
+    channel string
+    from    string
+    addr    *net.UDPAddr
+    data    []byte
+}
+
+func encodeChatMessage(kind messageKind, channel string, data []byte) []byte {
+    b := make([]byte, 0, 2 + len(channel) + len(data))
+    b = append(b, byte(kind), byte(len(channel)))
+    b = append(b, channel...)
+    return append(b, data...)
+}
+
+func decodeChatMessage(b []byte) (messageKind, string, []byte, error) {
+    if len(b) < 2 || len(b) < 2 + int(b[1]) {
+        return 0, "", nil, fmt.Errorf("Message too small")
+    }
+    kind := messageKind(b[0])
+    if kind > messageMulticast {
+        return 0, "", nil, fmt.Errorf("Unknown message kind %d", kind)
+    }
+    return kind, string(b[2:2 + b[1]]), b[2 + b[1]:], nil
+}
+
+//messenger sends and receives text messages, only delivering those of the channels
+//that were joined to onMessage. Subscribers get the messages of every channel.
+type messenger struct {
+    s           *session
+    onMessage   func(chatMessage)
+
+    mu          sync.Mutex
+    channels    map[string]struct{}
+    subscribers map[int]func(chatMessage)
+    nextSub     int
+}
+
+func newMessenger(s *session, onMessage func(chatMessage)) *messenger {
+    m := &messenger {
+        s:           s,
+        onMessage:   onMessage,
+        channels:    map[string]struct{} { defaultChannel: {} },
+        subscribers: make(map[int]func(chatMessage)),
+    }
+    s.handle(magicData, func(data []byte, sender *net.UDPAddr) {
+        m.deliver(messageBroadcast, defaultChannel, data, sender)
+    })
+    s.handle(magicMessage, func(data []byte, sender *net.UDPAddr) {
+        kind, channel, text, err := decodeChatMessage(data)
+        if err != nil {
+            log.Printf("[%s aka %s]: %v", sender.String(), s.peers.peerName(sender), err)
+            return
+        }
+        m.deliver(kind, channel, text, sender)
+    })
+    return m
+}
+
+//the messengers of the topics joined, the first one is used when no topic is given
+type topicList []*messenger
+
+func (t topicList) find(topic string) (*messenger, error) {
+    if topic == "" {
+        return t[0], nil
+    }
+    for _, m := range t {
+        if m.s.topic == topic {
+            return m, nil
+        }
+    }
+    return nil, fmt.Errorf("Not in topic '%s'", topic)
+}
+
+func validChannel(channel string) error {
+    if len(channel) > 255 {
+        return fmt.Errorf("Channel name too long")
+    }
+    return nil
+}
+
+func (m *messenger) join(channel string) error {
+    if err := validChannel(channel); err != nil {
+        return err
+    }
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    m.channels[channel] = struct{}{}
+    return nil
+}
+
+func (m *messenger) leave(channel string) {
+    if channel == defaultChannel {
+        return
+    }
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    delete(m.channels, channel)
+}
+
+func (m *messenger) joined(channel string) bool {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    _, ok := m.channels[channel]
+    return ok
+}
+
+//calls f with every message received, returning a function that stops it
+func (m *messenger) subscribe(f func(chatMessage)) func() {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    id := m.nextSub
+    m.nextSub++
+    m.subscribers[id] = f
+    return func() {
+        m.mu.Lock()
+        defer m.mu.Unlock()
+        delete(m.subscribers, id)
+    }
+}
+
+func (m *messenger) deliver(kind messageKind, channel string, data []byte, sender *net.UDPAddr) {
+    msg := chatMessage {
+        topic:   m.s.topic,
+        kind:    kind,
+        channel: channel,
+        from:    m.s.peers.peerName(sender),
+        addr:    sender,
+        //subscribers may queue it, and the packet's buffer is reused
+        data:    append([]byte(nil), data...),
+    }
+
+    m.mu.Lock()
+    subscribers := make([]func(chatMessage), 0, len(m.subscribers))
+    for _, f := range m.subscribers {
+        subscribers = append(subscribers, f)
+    }
+    m.mu.Unlock()
+    for _, f := range subscribers {
+        f(msg)
+    }
+
+    //direct messages reach us whatever channel they were sent on
+    if kind == messageBroadcast && !m.joined(channel) {
+        return
+    }
+    m.onMessage(msg)
+}
+
+//sends a message to every peer of the topic
+func (m *messenger) broadcast(channel string, data []byte) error {
+    if err := validChannel(channel); err != nil {
+        return err
+    }
+    magic, payload := magicData, data
+    if channel != defaultChannel {
+        magic, payload = magicMessage, encodeChatMessage(messageBroadcast, channel, data)
+    }
+
+    return m.s.sendAll(magic, payload, m.s.peers.peerAddrs())
+}
+
+//sends a message to the named peers only
+func (m *messenger) sendTo(names []string, channel string, data []byte) error {
+    if err := validChannel(channel); err != nil {
+        return err
+    }
+    if len(names) == 0 {
+        return fmt.Errorf("No recipients")
+    }
+
+    addrs := make([]*net.UDPAddr, 0, len(names))
+    for _, name := range names {
+        addr, ok := m.s.peers.peerAddr(name)
+        if !ok {
+            return fmt.Errorf("Unknown peer '%s'", name)
+        }
+        addrs = append(addrs, addr)
+    }
+
+    kind := messageDirect
+    if len(addrs) > 1 {
+        kind = messageMulticast
+    }
+    return m.s.sendAll(magicMessage, encodeChatMessage(kind, channel, data), addrs)
+}
+
+func formatChatMessage(msg chatMessage) string {
+    prefix := ""
+    if msg.channel != defaultChannel {
+        prefix = "#" + msg.channel + " "
+    }
+    switch msg.kind {
+        case messageDirect:
+            prefix += "(to you) "
+        case messageMulticast:
+            prefix += "(to you and others) "
+    }
+    return fmt.Sprintf("%s[%s aka %s]: %s", prefix, msg.addr.String(), msg.from, string(msg.data))
+}
+
+//splits a comma separated list of peer names
+func parseRecipients(list string) []string {
+    return splitList(list)
+}
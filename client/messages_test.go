@@ -0,0 +1,203 @@
+package client
+
+import (
+    "testing"
+    "time"
+
+    "github.com/natanbc/ssc0904-nat-traversal/netsim"
+)
+
+func TestChatMessageEncoding(t *testing.T) {
+    kind, channel, text, err := decodeChatMessage(encodeChatMessage(messageMulticast, "dev", []byte("hello")))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if kind != messageMulticast || channel != "dev" || string(text) != "hello" {
+        t.Fatalf("Decoded %v #%s '%s'", kind, channel, text)
+    }
+
+    for _, b := range [][]byte { nil, { 0 }, { 0, 4, 'd', 'e' }, { 9, 0 } } {
+        if _, _, _, err := decodeChatMessage(b); err == nil {
+            t.Errorf("Decoded %v", b)
+        }
+    }
+}
+
+//a messenger whose messages are sent to a channel
+type testMessenger struct {
+    *messenger
+    got chan chatMessage
+    //every message received, whatever the channel
+    all chan chatMessage
+}
+
+func startMessenger(h *host) testMessenger {
+    return sessionMessenger(h.sessions[0])
+}
+
+func sessionMessenger(s *session) testMessenger {
+    m := testMessenger {
+        got: make(chan chatMessage, 16),
+        all: make(chan chatMessage, 16),
+    }
+    m.messenger = newMessenger(s, func(msg chatMessage) {
+        m.got <- msg
+    })
+    m.subscribe(func(msg chatMessage) {
+        m.all <- msg
+    })
+    return m
+}
+
+//drops the messages received so far
+func (m testMessenger) clear() {
+    for _, ch := range []chan chatMessage { m.got, m.all } {
+        for len(ch) > 0 {
+            <-ch
+        }
+    }
+}
+
+//the next message from ch, or a zero message if none comes within timeout
+func nextMessage(ch chan chatMessage, timeout time.Duration) chatMessage {
+    select {
+        case msg := <-ch:
+            return msg
+        case <-time.After(timeout):
+            return chatMessage {}
+    }
+}
+
+//three peers on the internet connected to each other
+func peerTrio(t *testing.T) (*host, *host, *host) {
+    t.Helper()
+    w := newTestWorld(t, netsim.Config { Latency: time.Millisecond })
+    hosts := []*host(nil)
+    for _, name := range []string { "alice", "bob", "carol" } {
+        hosts = append(hosts, startPeer(t, w.peerHost(nil), "fixed", name))
+    }
+    for i, a := range hosts {
+        for _, b := range hosts[i + 1:] {
+            if !waitConnected(a, b, testConnectTimeout) {
+                t.Fatal("Peers didn't connect")
+            }
+        }
+    }
+    return hosts[0], hosts[1], hosts[2]
+}
+
+func TestMessageRouting(t *testing.T) {
+    ha, hb, hc := peerTrio(t)
+    alice, bob, carol := startMessenger(ha), startMessenger(hb), startMessenger(hc)
+
+    if err := alice.sendTo([]string { "bob" }, defaultChannel, []byte("direct")); err != nil {
+        t.Fatal(err)
+    }
+    if msg := nextMessage(bob.got, time.Second); msg.kind != messageDirect || msg.from != "alice" || string(msg.data) != "direct" {
+        t.Fatalf("Bob got %+v", msg)
+    }
+    if msg := nextMessage(carol.all, 100 * time.Millisecond); msg.data != nil {
+        t.Fatalf("Carol got the direct message to bob: %+v", msg)
+    }
+
+    if err := alice.sendTo([]string { "bob", "carol" }, defaultChannel, []byte("multicast")); err != nil {
+        t.Fatal(err)
+    }
+    for _, m := range []testMessenger { bob, carol } {
+        if msg := nextMessage(m.got, time.Second); msg.kind != messageMulticast || string(msg.data) != "multicast" {
+            t.Fatalf("Got %+v instead of the multicast", msg)
+        }
+    }
+
+    if err := alice.sendTo([]string { "bob", "dave" }, defaultChannel, []byte("x")); err == nil {
+        t.Fatal("Sent to an unknown peer")
+    }
+
+    //only peers in a channel see its broadcasts, subscribers see everything
+    bob.clear()
+    carol.clear()
+    if err := bob.join("dev"); err != nil {
+        t.Fatal(err)
+    }
+    if err := alice.broadcast("dev", []byte("channel")); err != nil {
+        t.Fatal(err)
+    }
+    if msg := nextMessage(bob.got, time.Second); msg.kind != messageBroadcast || msg.channel != "dev" || string(msg.data) != "channel" {
+        t.Fatalf("Bob got %+v instead of the channel message", msg)
+    }
+    if msg := nextMessage(carol.all, time.Second); string(msg.data) != "channel" {
+        t.Fatalf("Carol's subscriber got %+v instead of the channel message", msg)
+    }
+    if msg := nextMessage(carol.got, 100 * time.Millisecond); msg.data != nil {
+        t.Fatalf("Carol got a message of a channel she isn't in: %+v", msg)
+    }
+
+    //direct messages reach peers whatever channel they were sent on
+    if err := alice.sendTo([]string { "carol" }, "dev", []byte("aside")); err != nil {
+        t.Fatal(err)
+    }
+    if msg := nextMessage(carol.got, time.Second); msg.channel != "dev" || string(msg.data) != "aside" {
+        t.Fatalf("Carol got %+v instead of the direct message", msg)
+    }
+
+    //the default channel is plain DATADATA broadcasts
+    bob.leave("dev")
+    if err := alice.broadcast(defaultChannel, []byte("everyone")); err != nil {
+        t.Fatal(err)
+    }
+    for _, m := range []testMessenger { bob, carol } {
+        if msg := nextMessage(m.got, time.Second); msg.channel != defaultChannel || string(msg.data) != "everyone" {
+            t.Fatalf("Got %+v instead of the broadcast", msg)
+        }
+    }
+}
+
+//console lines are sent to the current channel, /msg to the listed peers only
+func TestConsoleMessages(t *testing.T) {
+    ha, hb, hc := peerTrio(t)
+    c := newConsole(ha.sessions)
+    bob, carol := startMessenger(hb), startMessenger(hc)
+
+    c.handleLine("/msg bob,carol hello there\n")
+    for _, m := range []testMessenger { bob, carol } {
+        if msg := nextMessage(m.got, time.Second); msg.kind != messageMulticast || string(msg.data) != "hello there" {
+            t.Fatalf("Got %+v instead of the /msg", msg)
+        }
+    }
+    bob.clear()
+    c.handleLine("/msg carol psst")
+    if msg := nextMessage(carol.got, time.Second); msg.kind != messageDirect || string(msg.data) != "psst" {
+        t.Fatalf("Carol got %+v instead of the /msg", msg)
+    }
+    if msg := nextMessage(bob.all, 100 * time.Millisecond); msg.data != nil {
+        t.Fatalf("Bob got %+v sent to carol", msg)
+    }
+
+    if err := c.dispatch("/msg bob"); err == nil {
+        t.Fatal("Sent /msg without text")
+    }
+
+    //a doubled slash sends a message starting with one
+    c.handleLine("//path")
+    for _, m := range []testMessenger { bob, carol } {
+        if msg := nextMessage(m.got, time.Second); msg.kind != messageBroadcast || string(msg.data) != "/path" {
+            t.Fatalf("Got %+v instead of the escaped message", msg)
+        }
+    }
+
+    c.handleLine("/join dev")
+    if err := carol.join("dev"); err != nil {
+        t.Fatal(err)
+    }
+    c.handleLine("in dev")
+    if msg := nextMessage(carol.got, time.Second); msg.channel != "dev" || string(msg.data) != "in dev" {
+        t.Fatalf("Carol got %+v instead of the channel message", msg)
+    }
+    if msg := nextMessage(bob.got, 100 * time.Millisecond); msg.data != nil {
+        t.Fatalf("Bob got %+v of a channel he isn't in", msg)
+    }
+    c.handleLine("/leave")
+    if ch := c.currentChannel(); ch != defaultChannel {
+        t.Fatalf("Still sending to #%s", ch)
+    }
+}
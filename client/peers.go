@@ -1,101 +1,328 @@
 package client
 
 import (
-    "encoding/json"
-    "fmt"
+    "context"
     "log"
     "net"
     "net/netip"
-    "net/url"
-    "path"
+    "sort"
     "sync"
     "time"
 
     "github.com/natanbc/ssc0904-nat-traversal/coord"
-
-    "github.com/gorilla/websocket"
 )
 
+//discovery finds the peers of a topic and reports them to the registry
+type discovery interface {
+    start(peers *peerRegistry) error
+    //releases what start acquired, called once the registry stops
+    stop()
+}
+
+//implemented by discovery sources that need to announce a new name, an error keeps
+//the old name
+type renamer interface {
+    rename(peers *peerRegistry, name string) error
+}
+
+//implemented by discovery sources that need to announce a new mapped address
+type updater interface {
+    update(peers *peerRegistry)
+}
+
+const unknownPeer = "<unknown peer>"
+
+//addresses peers checked connectivity to us from, when they differ from the ones
+//discovery reported
+const prflxSource = "prflx"
+
+//how long a peer-reflexive address is kept without checks coming from it
+const prflxTimeout = 15 * time.Second
+
+//ports the gateways of peers forward to them, as reported by other sources
+const mappedSource = "mapped"
+
+//sources whose addresses are only used once a check reached the peer through them, the
+//last one a peer was verified through is preferred
+var candidateSources = []string { mappedSource, lanSource }
+
+//interval between checks to a candidate address, until one is answered
+const candidateCheckInterval = time.Second
+
+//pings and checks received but not handled yet. More are dropped, peers send them again.
+const contactQueue = 64
+
+//a ping, or a check from the named peer, that reached us from addr
+type contact struct {
+    name string
+    addr *net.UDPAddr
+}
+
+func candidateSource(source string) bool {
+    for _, s := range candidateSources {
+        if s == source {
+            return true
+        }
+    }
+    return false
+}
+
+//whether source reports peers by the key they registered with, unlike the ones whose
+//peers are only known from the network or derived from other sources
+func trustedSource(source string) bool {
+    return source != lanSource && source != prflxSource && source != mappedSource
+}
+
 type peerRegistry struct {
-    mu          sync.Mutex
-    baseUrl     *url.URL
-    peers       map[netip.AddrPort]coord.Peer
-    holepunched map[netip.AddrPort]struct{}
-    selfPeer    coord.Peer
-    topic       string
-    doStop      bool
-    socket      *websocket.Conn
+    mu           sync.Mutex
+    //peers reported by each discovery source, merged into peers
+    sources      map[string]map[netip.AddrPort]coord.Peer
+    peers        map[netip.AddrPort]coord.Peer
+    //when each punched peer last pinged us
+    holepunched  map[netip.AddrPort]time.Time
+    rtt          map[netip.AddrPort]time.Duration
+    //the address each peer answering our checks saw us coming from
+    seenAs       map[netip.AddrPort]*net.UDPAddr
+    strategy     punchStrategy
+    //when the next packet is sent to each peer
+    schedule     map[netip.AddrPort]*punchSchedule
+    //when punching each peer by name started, until it answers
+    punchStart   map[string]punchAttempt
+    //time to connect by strategy
+    connectTimes map[string]connectStats
+    selfPeer     coord.Peer
+    topic        string
+    //the discovery sources that started
+    discovery    []discovery
+    doStop       bool
+    //closed by stop
+    done         chan struct{}
+    //pings and checks for the registry to handle, queued by the socket readers
+    contacts     chan contact
+    //serializes changes to the peer-reflexive addresses
+    prflxMu      sync.Mutex
+    //candidate addresses that a signed check reached, by the name of the peer. Others
+    //aren't used, as anyone on the link can announce any name, and forwarded ports
+    //may not be reachable.
+    verified     map[netip.AddrPort]string
+    //when the next check is sent to each candidate address
+    nextCheck    map[netip.AddrPort]time.Time
+
+    //taken with mu held before releasing it, so events are delivered in order
+    eventMu      sync.Mutex
+    listeners    map[int]func(peerEvent)
+    nextID       int
+}
+
+type peerEventKind int
+
+const (
+    peerJoined peerEventKind = iota
+    peerLeft
+    //the peer answered our pings or checks, packets can be exchanged with it
+    peerConnected
+)
+
+type peerEvent struct {
+    kind peerEventKind
+    peer coord.Peer
 }
 
-func newPeerRegistry(baseUrl, topic, name string, selfAddr *net.UDPAddr, ping func(*net.UDPAddr)) (*peerRegistry, error) {
-    base, err := url.Parse(baseUrl)
-    if err != nil {
-        return nil, fmt.Errorf("Unable to parse base url: %w", err)
+//how long a punched peer may stay silent before it's shown as stale, when pinged
+//every 250ms. Longer keepalives are given 3 chances.
+const peerStaleAfter = 5 * time.Second
+
+//where the hole punching of a peer address is at
+type punchSchedule struct {
+    attempt int
+    next    time.Time
+    punched bool
+}
+
+type punchAttempt struct {
+    start    time.Time
+    strategy string
+}
+
+//peerInfo is a snapshot of what is known about a peer
+type peerInfo struct {
+    peer       coord.Peer
+    punched    bool
+    lastPing   time.Time
+    rtt        time.Duration
+    //the address the peer saw our last check coming from, nil if it doesn't answer them
+    seenAs     *net.UDPAddr
+    //how long the peer may stay silent
+    staleAfter time.Duration
+}
+
+func (i peerInfo) state() string {
+    switch {
+        case !i.punched:
+            return "punching"
+        case time.Since(i.lastPing) > i.staleAfter:
+            return "stale"
+        default:
+            return "connected"
     }
+}
 
+//ping is called with every peer whenever strategy says so until they leave, self is
+//how we're announced to peers
+func newPeerRegistry(topic string, self coord.Peer, strategy punchStrategy, ping func(coord.Peer, punchStep), discovery ...discovery) (*peerRegistry, error) {
     p := &peerRegistry {
-        baseUrl:     base,
-        peers:       make(map[netip.AddrPort]coord.Peer),
-        holepunched: make(map[netip.AddrPort]struct{}),
-        selfPeer:    coord.Peer {
-            Name: name,
-            IP:   selfAddr.IP,
-            Port: uint16(selfAddr.Port),
-        },
-        topic:       topic,
+        sources:      make(map[string]map[netip.AddrPort]coord.Peer),
+        peers:        make(map[netip.AddrPort]coord.Peer),
+        holepunched:  make(map[netip.AddrPort]time.Time),
+        rtt:          make(map[netip.AddrPort]time.Duration),
+        seenAs:       make(map[netip.AddrPort]*net.UDPAddr),
+        strategy:     strategy,
+        schedule:     make(map[netip.AddrPort]*punchSchedule),
+        punchStart:   make(map[string]punchAttempt),
+        connectTimes: make(map[string]connectStats),
+        verified:     make(map[netip.AddrPort]string),
+        contacts:     make(chan contact, contactQueue),
+        done:         make(chan struct{}),
+        nextCheck:    make(map[netip.AddrPort]time.Time),
+        listeners:    make(map[int]func(peerEvent)),
+        selfPeer:     self,
+        topic:        topic,
     }
 
-    if err = p.connect(); err != nil {
-        return nil, err
+    //only fail if no discovery source could be started
+    var lastErr error
+    for _, d := range discovery {
+        if err := d.start(p); err != nil {
+            log.Printf("Failed to start peer discovery: %v", err)
+            lastErr = err
+            continue
+        }
+        p.discovery = append(p.discovery, d)
+    }
+    if len(p.discovery) == 0 && lastErr != nil {
+        p.stop()
+        return nil, lastErr
     }
 
     go func() {
-        t := time.NewTicker(5 * time.Second)
-        defer t.Stop()
-
-        for range t.C {
-            if p.shouldStop() {
-                break
-            }
-            if err := p.socket.WriteMessage(websocket.PingMessage, []byte{}); err != nil {
-                log.Printf("Failed to send ping message to server: %v", err)
-                p.stop()
-                break
-            }
+        for !p.shouldStop() {
+            p.expireReflexive()
+            time.Sleep(p.punch(ping))
         }
     }()
+    //listeners can take their time without holding up the socket
     go func() {
         for {
-            if p.shouldStop() {
-                break
-            }
-            mt, message, err := p.socket.ReadMessage()
-            if err != nil {
-                log.Printf("Failed to read message from server: %v", err)
-                p.stop()
-                break
-            }
-
-            if mt == websocket.TextMessage {
-                if err := p.handlePeerList(message); err != nil {
-                    log.Printf("Failed to update peer list: %v", err)
-                }
+            select {
+                case c := <-p.contacts:
+                    if c.name == "" {
+                        p.onPing(c.addr)
+                    } else {
+                        p.onChecked(c.name, c.addr)
+                    }
+                case <-p.done:
+                    return
             }
         }
     }()
-    go func() {
-        t := time.NewTicker(250 * time.Millisecond)
-        defer t.Stop()
 
-        for range t.C {
-            if p.shouldStop() {
-                break
+    return p, nil
+}
+
+//sends the packets due to every peer, returning how long until the next ones. Waits
+//are capped at 250ms so leaving peers and expired addresses are noticed.
+func (p *peerRegistry) punch(ping func(coord.Peer, punchStep)) time.Duration {
+    type due struct {
+        peer coord.Peer
+        step punchStep
+    }
+
+    p.mu.Lock()
+    now := time.Now()
+    wait := pingInterval
+    staleAfter := p.staleAfter()
+    me := p.selfPeer.IPPort()
+    pending := []due(nil)
+    for k, v := range p.peers {
+        if k == me || v.Name == p.selfPeer.Name {
+            continue
+        }
+        sched, ok := p.schedule[k]
+        if !ok {
+            sched = &punchSchedule { next: now }
+            p.schedule[k] = sched
+        }
+        //starts over when the peer answers or stops answering
+        lastPing, punched := p.holepunched[k]
+        punched = punched && now.Sub(lastPing) <= staleAfter
+        if punched != sched.punched {
+            sched.attempt, sched.punched = 0, punched
+        }
+        if !now.Before(sched.next) {
+            step := p.strategy.next(sched.attempt, punched)
+            sched.attempt++
+            sched.next = now.Add(step.wait)
+            pending = append(pending, due { peer: v, step: step })
+        }
+        if d := sched.next.Sub(now); d < wait {
+            wait = d
+        }
+    }
+    //candidate addresses are checked before being used
+    for _, source := range candidateSources {
+        for k, v := range p.sources[source] {
+            if p.verified[k] == v.Name || v.Name == p.selfPeer.Name {
+                continue
             }
-            p.forEachPeerAddress(ping)
+            key := p.keyLocked(v.Name)
+            if key == "" {
+                continue
+            }
+            if next, ok := p.nextCheck[k]; ok && now.Before(next) {
+                if d := next.Sub(now); d < wait {
+                    wait = d
+                }
+                continue
+            }
+            p.nextCheck[k] = now.Add(candidateCheckInterval)
+            v.PublicKey = key
+            pending = append(pending, due { peer: v })
         }
-    }()
+    }
+    p.mu.Unlock()
 
-    return p, nil
+    for _, d := range pending {
+        ping(d.peer, d.step)
+    }
+    return wait
+}
+
+//how long a peer may stay silent before it's stale, with the keepalive of our strategy
+//as peers of a deployment use the same one
+func (p *peerRegistry) staleAfter() time.Duration {
+    keepalive := p.strategy.keepaliveInterval()
+    if 3 * keepalive > peerStaleAfter {
+        return 3 * keepalive
+    }
+    return peerStaleAfter
+}
+
+//changes the interval peers that answer are pinged at
+func (p *peerRegistry) setKeepalive(d time.Duration) {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    p.strategy.setKeepalive(d)
+}
+
+//the time peers took to answer after being found, by strategy
+func (p *peerRegistry) connectStats() map[string]connectStats {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    res := make(map[string]connectStats, len(p.connectTimes))
+    for k, v := range p.connectTimes {
+        res[k] = v
+    }
+    return res
 }
 
 func (p *peerRegistry) shouldStop() bool {
@@ -106,51 +333,165 @@ func (p *peerRegistry) shouldStop() bool {
 
 func (p *peerRegistry) stop() {
     p.mu.Lock()
-    defer p.mu.Unlock()
+    if !p.doStop {
+        close(p.done)
+    }
     p.doStop = true
-    p.socket.Close()
+    discovery := p.discovery
+    p.mu.Unlock()
+
+    for _, d := range discovery {
+        d.stop()
+    }
 }
 
-func (p *peerRegistry) connect() error {
-    u := p.makeUrl("websocket", map[string]string {
-        "topic": p.topic,
-        "name":  p.selfPeer.Name,
-        "ip":    p.selfPeer.IP.String(),
-        "port":  fmt.Sprintf("%d", p.selfPeer.Port),
-    })
+//the public key checks with the named peer are signed with a key derived from
+func (p *peerRegistry) keyOf(name string) (string, bool) {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    key := p.keyLocked(name)
+    return key, key != ""
+}
 
-    c, _, err := websocket.DefaultDialer.Dial(u, nil)
-    if err != nil {
-        return fmt.Errorf("Unable to establish websocket connection: %w", err)
+//the public key the named peer gave a discovery source that can be trusted with it
+func (p *peerRegistry) trustedKeyOf(name string) (string, bool) {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    key := p.trustedKeyLocked(name)
+    return key, key != ""
+}
+
+//the trusted key of the peer, or the one it announced on the local link when no
+//trusted source knows it. Checks signed with a key announced on the link only prove
+//the peer holds it, not that the name is its own. mu must be held.
+func (p *peerRegistry) keyLocked(name string) string {
+    if key := p.trustedKeyLocked(name); key != "" {
+        return key
+    }
+    for _, v := range p.sources[lanSource] {
+        if v.Name == name {
+            return v.PublicKey
+        }
     }
+    return ""
+}
 
-    p.socket = c
-    return nil
+//mu must be held
+func (p *peerRegistry) trustedKeyLocked(name string) string {
+    for source, src := range p.sources {
+        if !trustedSource(source) {
+            continue
+        }
+        for _, v := range src {
+            if v.Name == name && v.PublicKey != "" {
+                return v.PublicKey
+            }
+        }
+    }
+    return ""
 }
 
-func (p *peerRegistry) handlePeerList(raw []byte) error {
-    var r coord.PeerList
+//replaces the peers reported by source
+func (p *peerRegistry) updatePeers(source string, peers []coord.Peer) {
+    p.mu.Lock()
 
-    if err := json.Unmarshal(raw, &r); err != nil {
-        return fmt.Errorf("Malformed response: %w", err)
+    list := make(map[netip.AddrPort]coord.Peer)
+    for _, v := range peers {
+        list[v.IPPort()] = v
     }
+    p.sources[source] = list
 
-    p.mu.Lock()
-    defer p.mu.Unlock()
+    p.unlockAndEmit(p.merge())
+}
 
+//merges the peers reported by every source, returning what changed. mu must be held.
+func (p *peerRegistry) merge() []peerEvent {
+    events := []peerEvent(nil)
     prev := p.peers
     discovered := make(map[netip.AddrPort]coord.Peer)
     next := make(map[netip.AddrPort]coord.Peer)
 
-    for _, v := range r.Peers {
-        k := v.IPPort()
-
-        if _, ok := p.peers[k]; !ok {
-            discovered[k] = v
+    //keys given by trusted sources replace those announced on the local link, and are
+    //given to the sources that don't know the key a peer gave coord
+    keys := make(map[string]string)
+    named := make(map[string]struct{})
+    mapped := make(map[netip.AddrPort]coord.Peer)
+    for source, src := range p.sources {
+        if !trustedSource(source) {
+            continue
+        }
+        for _, v := range src {
+            if v.PublicKey != "" {
+                keys[v.Name] = v.PublicKey
+            }
+            named[v.Name] = struct{}{}
+            if v.Mapped != nil {
+                m := v
+                m.IP, m.Port, m.Mapped = v.Mapped.IP, uint16(v.Mapped.Port), nil
+                if m.IPPort() != v.IPPort() {
+                    mapped[m.IPPort()] = m
+                }
+            }
+        }
+    }
+    p.sources[mappedSource] = mapped
+
+    //peers on the local link are reached directly instead of through their public
+    //address once a check reached them there, as are ports forwarded to peers, and
+    //peers that checked us from another address are reached through it
+    for k, name := range p.verified {
+        if v, ok := p.candidate(k); !ok || v.Name != name {
+            delete(p.verified, k)
         }
+    }
+    for k := range p.nextCheck {
+        if _, ok := p.candidate(k); !ok {
+            delete(p.nextCheck, k)
+        }
+    }
+    //peers only found on the local link are still there
+    for _, name := range p.verified {
+        named[name] = struct{}{}
+    }
+    preferred := make(map[string]string)
+    for k, v := range p.sources[prflxSource] {
+        //the peer left
+        if _, ok := named[v.Name]; !ok {
+            delete(p.sources[prflxSource], k)
+            continue
+        }
+        preferred[v.Name] = prflxSource
+    }
+    for _, source := range candidateSources {
+        for k, v := range p.sources[source] {
+            if p.verified[k] == v.Name {
+                preferred[v.Name] = source
+            }
+        }
+    }
 
-        delete(prev, k)
-        next[k] = v
+    for source, src := range p.sources {
+        for k, v := range src {
+            //the same peer may be reported by multiple sources
+            if _, ok := next[k]; ok {
+                continue
+            }
+            if candidateSource(source) && p.verified[k] != v.Name {
+                continue
+            }
+            if s, ok := preferred[v.Name]; ok && source != s {
+                continue
+            }
+            if key, ok := keys[v.Name]; ok {
+                v.PublicKey = key
+            }
+            if _, ok := p.peers[k]; !ok {
+                discovered[k] = v
+            }
+
+            delete(prev, k)
+            next[k] = v
+        }
     }
 
     p.peers = next
@@ -163,18 +504,123 @@ func (p *peerRegistry) handlePeerList(raw []byte) error {
         }
 
         delete(p.holepunched, k)
+        delete(p.rtt, k)
+        delete(p.seenAs, k)
+        delete(p.schedule, k)
 
         log.Printf("Peer %s (aka %s) disconnected", k.String(), v.Name)
+        events = append(events, peerEvent { kind: peerLeft, peer: v })
+    }
+    names := make(map[string]struct{}, len(next))
+    for _, v := range next {
+        names[v.Name] = struct{}{}
+    }
+    for name := range p.punchStart {
+        if _, ok := names[name]; !ok {
+            delete(p.punchStart, name)
+        }
     }
     for k, v := range discovered {
         if k == me {
             continue
         }
+        //new addresses of peers already punching, like peer-reflexive ones, don't
+        //restart the clock
+        if _, ok := p.punchStart[v.Name]; !ok && !p.punchedName(v.Name) {
+            p.punchStart[v.Name] = punchAttempt {
+                start:    time.Now(),
+                strategy: p.strategy.name(),
+            }
+        }
 
         log.Printf("New peer %s (aka %s)", k.String(), v.Name)
+        events = append(events, peerEvent { kind: peerJoined, peer: v })
     }
+    return events
+}
 
-    return nil
+//the peer a candidate source reported at k. mu must be held.
+func (p *peerRegistry) candidate(k netip.AddrPort) (coord.Peer, bool) {
+    for _, source := range candidateSources {
+        if v, ok := p.sources[source][k]; ok {
+            return v, true
+        }
+    }
+    return coord.Peer {}, false
+}
+
+//marks a candidate address as verified if it's one, returning whether it was. mu must
+//be held.
+func (p *peerRegistry) verifyCandidate(k netip.AddrPort, name string) bool {
+    v, ok := p.candidate(k)
+    if !ok || v.Name != name || p.verified[k] == name {
+        return false
+    }
+    p.verified[k] = name
+    if _, lan := p.sources[lanSource][k]; lan {
+        log.Printf("Peer %s answered checks on the local link at %s", name, k.String())
+    } else {
+        log.Printf("Peer %s answered checks on its forwarded port %s", name, k.String())
+    }
+    return true
+}
+
+//releases mu and delivers the events to the listeners
+func (p *peerRegistry) unlockAndEmit(events []peerEvent) {
+    if len(events) == 0 {
+        p.mu.Unlock()
+        return
+    }
+    p.eventMu.Lock()
+    p.mu.Unlock()
+    defer p.eventMu.Unlock()
+
+    for _, e := range events {
+        for _, f := range p.listeners {
+            f(e)
+        }
+    }
+}
+
+//calls f with every change to the peers, starting with the peers already known,
+//until the returned function is called. f must not call back into the registry.
+func (p *peerRegistry) subscribe(f func(peerEvent)) func() {
+    p.mu.Lock()
+    me := p.selfPeer.IPPort()
+    replay := []peerEvent(nil)
+    for k, v := range p.peers {
+        if k == me {
+            continue
+        }
+        replay = append(replay, peerEvent { kind: peerJoined, peer: v })
+        if _, ok := p.holepunched[k]; ok {
+            replay = append(replay, peerEvent { kind: peerConnected, peer: v })
+        }
+    }
+    p.eventMu.Lock()
+    p.mu.Unlock()
+    defer p.eventMu.Unlock()
+
+    id := p.nextID
+    p.nextID++
+    p.listeners[id] = f
+    for _, e := range replay {
+        f(e)
+    }
+    return func() {
+        p.eventMu.Lock()
+        defer p.eventMu.Unlock()
+        delete(p.listeners, id)
+    }
+}
+
+//queues a ping from addr or, if name isn't empty, a check from the named peer, to be
+//handled like onPing and onChecked do
+func (p *peerRegistry) queueContact(name string, addr *net.UDPAddr) {
+    select {
+        case p.contacts <- contact { name: name, addr: addr }:
+        default:
+    }
 }
 
 func (p *peerRegistry) onPing(addr *net.UDPAddr) {
@@ -184,18 +630,192 @@ func (p *peerRegistry) onPing(addr *net.UDPAddr) {
     }).IPPort()
 
     p.mu.Lock()
-    defer p.mu.Unlock()
+    events := []peerEvent(nil)
+    defer func() {
+        p.unlockAndEmit(events)
+    }()
 
     _, punched := p.holepunched[k]
-    p.holepunched[k] = struct{}{}
+    p.holepunched[k] = time.Now()
 
     if !punched {
-        p, ok := p.peers[k]
+        peer, ok := p.peers[k]
         if !ok {
             return
         }
-        log.Printf("Established connection to peer %s (aka %s)", k.String(), p.Name)
+        if attempt, ok := p.punchStart[peer.Name]; ok {
+            delete(p.punchStart, peer.Name)
+            took := time.Since(attempt.start)
+            stats := p.connectTimes[attempt.strategy]
+            stats.add(took)
+            p.connectTimes[attempt.strategy] = stats
+            log.Printf("Established connection to peer %s (aka %s) in %v", k.String(), peer.Name, took.Round(time.Millisecond))
+        } else {
+            log.Printf("Established connection to peer %s (aka %s)", k.String(), peer.Name)
+        }
+        events = append(events, peerEvent { kind: peerConnected, peer: peer })
+    }
+}
+
+//whether any address of the named peer answered, mu must be held
+func (p *peerRegistry) punchedName(name string) bool {
+    for k, v := range p.peers {
+        if _, ok := p.holepunched[k]; ok && v.Name == name {
+            return true
+        }
+    }
+    return false
+}
+
+//a peer answered our check: it can be reached, and saw us coming from mapped
+func (p *peerRegistry) onCheck(addr, mapped *net.UDPAddr, rtt time.Duration) {
+    k := (&coord.Peer {
+        IP:   addr.IP,
+        Port: uint16(addr.Port),
+    }).IPPort()
+
+    p.mu.Lock()
+    if v, ok := p.candidate(k); ok && p.verifyCandidate(k, v.Name) {
+        p.unlockAndEmit(p.merge())
+        p.mu.Lock()
+    }
+    peer, ok := p.peers[k]
+    prev := p.seenAs[k]
+    if ok {
+        p.seenAs[k] = mapped
+    }
+    self := p.selfPeer
+    p.mu.Unlock()
+
+    //the NAT mapped us differently for this peer, or the peer is on our network
+    changed := prev == nil || prev.String() != mapped.String()
+    if ok && changed && (!self.IP.Equal(mapped.IP) || int(self.Port) != mapped.Port) {
+        log.Printf("Peer %s (aka %s) sees us as %s", k.String(), peer.Name, mapped.String())
+    }
+    p.setRTT(addr, rtt)
+    p.onPing(addr)
+}
+
+//a peer checked connectivity to us from addr. When that isn't the address we know it
+//by, the NAT in front of it maps it differently for us: a peer-reflexive address,
+//which is used instead from now on.
+func (p *peerRegistry) onChecked(name string, addr *net.UDPAddr) {
+    k := (&coord.Peer {
+        IP:   addr.IP,
+        Port: uint16(addr.Port),
+    }).IPPort()
+
+    p.mu.Lock()
+    if p.verifyCandidate(k, name) {
+        p.unlockAndEmit(p.merge())
+        p.onPing(addr)
+        return
+    }
+    if peer, ok := p.peers[k]; ok && peer.Name == name {
+        if v, ok := p.sources[prflxSource][k]; ok {
+            v.LastSeen = time.Now()
+            p.sources[prflxSource][k] = v
+        }
+        p.mu.Unlock()
+        p.onPing(addr)
+        return
+    }
+    known := false
+    for _, v := range p.peers {
+        if v.Name == name {
+            known = true
+            break
+        }
+    }
+    self := p.selfPeer.Name
+    p.mu.Unlock()
+    if !known || name == self {
+        return
+    }
+
+    log.Printf("Peer %s checked us from %s, using it as its peer-reflexive address", name, addr.String())
+    ip := addr.IP
+    if ip4 := ip.To4(); ip4 != nil {
+        ip = ip4
+    }
+    p.learnReflexive(coord.Peer {
+        Name:     name,
+        IP:       ip,
+        Port:     uint16(addr.Port),
+        LastSeen: time.Now(),
+    })
+    p.onPing(addr)
+}
+
+//replaces the peer-reflexive address of a peer
+func (p *peerRegistry) learnReflexive(peer coord.Peer) {
+    p.prflxMu.Lock()
+    defer p.prflxMu.Unlock()
+
+    p.mu.Lock()
+    list := []coord.Peer { peer }
+    for _, v := range p.sources[prflxSource] {
+        if v.Name != peer.Name {
+            list = append(list, v)
+        }
+    }
+    p.mu.Unlock()
+    p.updatePeers(prflxSource, list)
+}
+
+//forgets the peer-reflexive addresses no checks came from lately, going back to the
+//address the peer advertised
+func (p *peerRegistry) expireReflexive() {
+    p.prflxMu.Lock()
+    defer p.prflxMu.Unlock()
+
+    p.mu.Lock()
+    list := []coord.Peer(nil)
+    expired := false
+    for _, v := range p.sources[prflxSource] {
+        if time.Since(v.LastSeen) > prflxTimeout {
+            log.Printf("Peer-reflexive address %s of peer %s expired", v.IPPort().String(), v.Name)
+            expired = true
+            continue
+        }
+        list = append(list, v)
+    }
+    p.mu.Unlock()
+    if expired {
+        p.updatePeers(prflxSource, list)
+    }
+}
+
+//blocks until the named peer answered our pings, returning false if ctx is done first
+func (p *peerRegistry) waitForPeer(ctx context.Context, name string) bool {
+    t := time.NewTicker(250 * time.Millisecond)
+    defer t.Stop()
+
+    for {
+        if p.isConnected(name) {
+            return true
+        }
+        select {
+            case <-ctx.Done():
+                return false
+            case <-t.C:
+        }
+    }
+}
+
+func (p *peerRegistry) isConnected(name string) bool {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+
+    for k, v := range p.peers {
+        if v.Name != name {
+            continue
+        }
+        if _, ok := p.holepunched[k]; ok {
+            return true
+        }
     }
+    return false
 }
 
 func (p *peerRegistry) peerName(addr *net.UDPAddr) string {
@@ -209,44 +829,176 @@ func (p *peerRegistry) peerName(addr *net.UDPAddr) string {
     if v, ok := p.peers[k]; ok {
         return v.Name
     }
-    return "<unknown peer>"
+    return unknownPeer
 }
 
-func (p *peerRegistry) forEachPeerAddress(f func(*net.UDPAddr)) {
-    me := p.selfPeer.IPPort()
+//whether addr is the address of a peer of the topic
+func (p *peerRegistry) knows(addr *net.UDPAddr) bool {
+    k := (&coord.Peer {
+        IP:   addr.IP,
+        Port: uint16(addr.Port),
+    }).IPPort()
 
     p.mu.Lock()
     defer p.mu.Unlock()
+    _, ok := p.peers[k]
+    return ok
+}
 
+func (p *peerRegistry) forEachPeer(f func(coord.Peer)) {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+
+    me := p.selfPeer.IPPort()
     for k, v := range p.peers {
         //ignore self
-        if k == me {
+        if k == me || v.Name == p.selfPeer.Name {
             continue
         }
 
+        f(v)
+    }
+}
+
+func (p *peerRegistry) forEachPeerAddress(f func(*net.UDPAddr)) {
+    p.forEachPeer(func(v coord.Peer) {
         f(&net.UDPAddr {
             IP:   v.IP,
             Port: int(v.Port),
         })
+    })
+}
+
+func (p *peerRegistry) peerAddrs() []*net.UDPAddr {
+    res := []*net.UDPAddr(nil)
+    p.forEachPeerAddress(func(addr *net.UDPAddr) {
+        res = append(res, addr)
+    })
+    return res
+}
+
+func (p *peerRegistry) peerAddr(name string) (*net.UDPAddr, bool) {
+    var addr *net.UDPAddr
+    p.forEachPeer(func(v coord.Peer) {
+        if v.Name == name {
+            addr = &net.UDPAddr {
+                IP:   v.IP,
+                Port: int(v.Port),
+            }
+        }
+    })
+    return addr, addr != nil
+}
+
+func (p *peerRegistry) self() coord.Peer {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    return p.selfPeer
+}
+
+//advertises the port forwarded to us besides our address, nil if none, registering
+//again where needed
+func (p *peerRegistry) setMapped(mapped *net.UDPAddr) {
+    p.setAddrs(nil, mapped)
+}
+
+//advertises our public address, kept if nil, and the port forwarded to us, registering
+//again where needed
+func (p *peerRegistry) setAddrs(public, mapped *net.UDPAddr) {
+    p.mu.Lock()
+    self := p.selfPeer
+    if public != nil {
+        self.IP, self.Port = public.IP, uint16(public.Port)
+    }
+    self.Mapped = mapped
+    old := p.selfPeer
+    if self.IP.Equal(old.IP) && self.Port == old.Port && self.Mapped.String() == old.Mapped.String() {
+        p.mu.Unlock()
+        return
+    }
+    p.selfPeer = self
+    p.mu.Unlock()
+    for _, d := range p.discovery {
+        if u, ok := d.(updater); ok {
+            u.update(p)
+        }
     }
 }
 
-func (p *peerRegistry) makeUrl(reqPath string, query map[string]string) string {
-    url := *p.baseUrl
-    if url.Scheme == "http" {
-        url.Scheme = "ws"
-    } else if url.Scheme == "https" {
-        url.Scheme = "wss"
+//changes the name we're known by, once every discovery source announced it
+func (p *peerRegistry) rename(name string) error {
+    for _, d := range p.discovery {
+        if r, ok := d.(renamer); ok {
+            if err := r.rename(p, name); err != nil {
+                return err
+            }
+        }
     }
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    p.selfPeer.Name = name
+    return nil
+}
 
-    url.Path = path.Join(url.Path, reqPath)
+func (p *peerRegistry) setRTT(addr *net.UDPAddr, rtt time.Duration) {
+    k := (&coord.Peer {
+        IP:   addr.IP,
+        Port: uint16(addr.Port),
+    }).IPPort()
 
-    q := url.Query()
-    for k, v := range query {
-        q.Set(k, v)
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    if _, ok := p.peers[k]; ok {
+        p.rtt[k] = rtt
     }
-    url.RawQuery = q.Encode()
+}
 
-    return url.String()
+//forgets that the named peer was punched, so the connection is established again
+//by the pings
+func (p *peerRegistry) resetPunch(name string) bool {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+
+    found := false
+    for k, v := range p.peers {
+        if v.Name == name {
+            delete(p.holepunched, k)
+            delete(p.schedule, k)
+            found = true
+        }
+    }
+    if found {
+        p.punchStart[name] = punchAttempt {
+            start:    time.Now(),
+            strategy: p.strategy.name(),
+        }
+    }
+    return found
 }
 
+func (p *peerRegistry) peerInfos() []peerInfo {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+
+    me := p.selfPeer.IPPort()
+    staleAfter := p.staleAfter()
+    res := []peerInfo(nil)
+    for k, v := range p.peers {
+        if k == me || v.Name == p.selfPeer.Name {
+            continue
+        }
+        lastPing, punched := p.holepunched[k]
+        res = append(res, peerInfo {
+            peer:       v,
+            punched:    punched,
+            lastPing:   lastPing,
+            rtt:        p.rtt[k],
+            seenAs:     p.seenAs[k],
+            staleAfter: staleAfter,
+        })
+    }
+    sort.Slice(res, func(i, j int) bool {
+        return res[i].peer.Name < res[j].peer.Name
+    })
+    return res
+}
@@ -0,0 +1,144 @@
+package client
+
+import (
+    "net"
+    "testing"
+    "time"
+
+    "github.com/natanbc/ssc0904-nat-traversal/netsim"
+)
+
+//the mapped address peer b has for the peer named name, once coord reported one
+func coordMapped(b *host, name string) *net.UDPAddr {
+    p := b.sessions[0].peers
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    for _, v := range p.sources["coord"] {
+        if v.Name == name {
+            return v.Mapped
+        }
+    }
+    return nil
+}
+
+//the address coord reported to peer b for the peer named name, empty if none
+func coordAddr(b *host, name string) string {
+    p := b.sessions[0].peers
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    for _, v := range p.sources["coord"] {
+        if v.Name == name {
+            return v.IPPort().String()
+        }
+    }
+    return ""
+}
+
+//a forwarded port is tried besides the address seen by STUN servers, and used once a
+//check reached the peer through it. Peers behind the same NAT without hairpinning only
+//reach each other that way, here through the private address standing in for one.
+func TestMappedCandidate(t *testing.T) {
+    w := newTestWorld(t, netsim.Config { Latency: 10 * time.Millisecond })
+    nat := w.newNAT(&netsim.PortRestricted)
+    ha, hb := w.peerHost(nat), w.peerHost(nat)
+    alice := startPeer(t, ha, "fixed", "alice")
+    bob := startPeer(t, hb, "fixed", "bob")
+
+    mapped := &net.UDPAddr {
+        IP:   hb.IP(),
+        Port: bob.socket.Conn.LocalAddr().(*net.UDPAddr).Port,
+    }
+    bob.sessions[0].peers.setMapped(mapped)
+    if !waitConnected(alice, bob, coordRetryMin + testConnectTimeout) {
+        t.Fatalf("Not connected within %v", coordRetryMin + testConnectTimeout)
+    }
+    if addr, ok := alice.sessions[0].peers.peerAddr("bob"); !ok || addr.String() != mapped.String() {
+        t.Fatalf("Bob reached at %v instead of %v", addr, mapped)
+    }
+}
+
+//a mapped address that doesn't reach the peer, like the external address of a gateway
+//behind carrier-grade NAT, doesn't keep peers from connecting through the one seen by
+//STUN servers. Changing it registers again.
+func TestMappedCandidateUnreachable(t *testing.T) {
+    w := newTestWorld(t, netsim.Config { Latency: 10 * time.Millisecond })
+    alice := startPeer(t, w.peerHost(w.newNAT(&netsim.PortRestricted)), "fixed", "alice")
+    bob := startPeer(t, w.peerHost(w.newNAT(&netsim.PortRestricted)), "fixed", "bob")
+    if !waitConnected(alice, bob, testConnectTimeout) {
+        t.Fatalf("Not connected within %v", testConnectTimeout)
+    }
+
+    mapped := &net.UDPAddr { IP: net.IPv4(100, 64, 0, 1), Port: 4321 }
+    alice.sessions[0].peers.setMapped(mapped)
+    deadline := time.Now().Add(coordRetryMin + testConnectTimeout)
+    for coordMapped(bob, "alice").String() != mapped.String() {
+        if time.Now().After(deadline) {
+            t.Fatal("Mapped address not registered again")
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+    if !waitConnected(alice, bob, testConnectTimeout) {
+        t.Fatalf("Not connected within %v", testConnectTimeout)
+    }
+    if addr, ok := bob.sessions[0].peers.peerAddr("alice"); !ok || addr.String() == mapped.String() {
+        t.Fatalf("Alice reached at %v", addr)
+    }
+}
+
+//the NAT dropping our mapping and making a new one for the next keepalive changes the
+//address we're registered with, and peers reach us there
+func TestPublicAddrChange(t *testing.T) {
+    //the mapping only expires when the clock moves, and without latency packets are
+    //delivered without it moving
+    clock := netsim.NewManualClock(time.Unix(0, 0))
+    w := newTestWorld(t, netsim.Config { Clock: clock })
+    config := netsim.PortRestricted
+    config.Timeout = 30 * time.Second
+    alice := startPeer(t, w.peerHost(w.newNAT(&config)), "fixed", "alice")
+    bob := startPeer(t, w.peerHost(nil), "fixed", "bob")
+    if !waitConnected(alice, bob, testConnectTimeout) {
+        t.Fatalf("Not connected within %v", testConnectTimeout)
+    }
+    before := alice.socket.PublicAddr().String()
+    if got := coordAddr(bob, "alice"); got != before {
+        t.Fatalf("Alice registered at %s instead of %s", got, before)
+    }
+
+    alice.socket.SetKeepAliveInterval(20 * time.Millisecond)
+    clock.Advance(time.Minute)
+    deadline := time.Now().Add(coordRetryMin + testConnectTimeout)
+    for {
+        after := alice.socket.PublicAddr().String()
+        self := alice.sessions[0].peers.self()
+        if after != before && self.IPPort().String() == after && coordAddr(bob, "alice") == after {
+            break
+        }
+        if time.Now().After(deadline) {
+            t.Fatalf("Public address %s, registered at %s", after, coordAddr(bob, "alice"))
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+    if !waitConnected(alice, bob, testConnectTimeout) {
+        t.Fatalf("Not connected again within %v", testConnectTimeout)
+    }
+}
+
+//closing a host closes its connection to coord, so the server drops it right away
+//instead of when it stops answering pings
+func TestClosedPeerUnlisted(t *testing.T) {
+    w := newTestWorld(t, netsim.Config { Latency: time.Millisecond })
+    alice := startPeer(t, w.peerHost(nil), "fixed", "alice")
+    bob := startPeer(t, w.peerHost(nil), "fixed", "bob")
+    if !waitConnected(alice, bob, testConnectTimeout) {
+        t.Fatalf("Not connected within %v", testConnectTimeout)
+    }
+
+    alice.close()
+    deadline := time.Now().Add(time.Second)
+    for coordAddr(bob, "alice") != "" {
+        if time.Now().After(deadline) {
+            t.Fatal("Coord still lists alice")
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+}
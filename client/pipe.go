@@ -0,0 +1,128 @@
+package client
+
+import (
+    "context"
+    "flag"
+    "fmt"
+    "io"
+    "log"
+    "os"
+    "time"
+
+    "github.com/peterbourgon/ff/v3/ffcli"
+)
+
+var pipeFs = (func() *flag.FlagSet {
+    fs := flag.NewFlagSet("pipe", flag.ExitOnError)
+    addSessionFlags(fs)
+    return fs
+})()
+
+const pipeRetryInterval = time.Second
+
+//connects a pipe stream with the peer. Both ends run pipe naming each other, the one
+//with the smaller name opens the stream and the other accepts it.
+func connectPipe(ctx context.Context, s *session, mux *streamMux, peer string) (*stream, error) {
+    accepted := make(chan *stream, 1)
+    mux.listen("pipe", func(st *stream, raw []byte) error {
+        if st.peer != peer {
+            return fmt.Errorf("Not expecting a pipe from %s", st.peer)
+        }
+        select {
+            case accepted <- st:
+                return nil
+            default:
+                return fmt.Errorf("Already piping to %s", peer)
+        }
+    })
+
+    if s.getName() > peer {
+        log.Printf("Waiting for %s to connect", peer)
+        select {
+            case st := <-accepted:
+                return st, nil
+            case <-ctx.Done():
+                return nil, ctx.Err()
+        }
+    }
+
+    for {
+        if !s.peers.waitForPeer(ctx, peer) {
+            return nil, ctx.Err()
+        }
+        //fails until the peer is running pipe too
+        st, err := mux.open(peer, streamRequest {
+            Kind: "pipe",
+        })
+        if err == nil {
+            return st, nil
+        }
+        log.Printf("Unable to connect to %s, retrying: %v", peer, err)
+        select {
+            case <-time.After(pipeRetryInterval):
+            case <-ctx.Done():
+                return nil, ctx.Err()
+        }
+    }
+}
+
+//copies stdin to the stream and the stream to stdout, until both ended
+func runPipe(st *stream, in io.Reader, out io.Writer) error {
+    sent := make(chan error, 1)
+    go func() {
+        _, err := io.Copy(st, in)
+        st.CloseWrite()
+        sent <- err
+    }()
+
+    if _, err := io.Copy(out, st); err != nil {
+        return err
+    }
+    if err := <-sent; err != nil {
+        return err
+    }
+    //everything was written, wait for the peer to acknowledge it before exiting
+    return st.flush()
+}
+
+var pipeCommand = &ffcli.Command {
+    Name:       "pipe",
+    ShortUsage: "client pipe [flags] <topic> <name> <peer>",
+    ShortHelp:  "Connects stdin and stdout to a peer running pipe, as a reliable byte stream",
+    LongHelp:   "Connects stdin and stdout to a peer running pipe, as a reliable byte stream. Exits once both " +
+                "sides closed their stdin and all data was delivered, so redirect it from /dev/null on the side " +
+                "that only receives.",
+    FlagSet:    pipeFs,
+    Exec:       func(ctx context.Context, args []string) error {
+        if len(args) != 3 {
+            return flag.ErrHelp
+        }
+        topic := args[0]
+        name  := args[1]
+        peer  := args[2]
+        if name == peer {
+            return fmt.Errorf("Can't pipe to ourselves")
+        }
+
+        s, err := newSession(ctx, topic, name)
+        if err != nil {
+            return err
+        }
+        defer s.close()
+
+        mux := newStreamMux(s)
+        errs := make(chan error, 2)
+        go func() { errs <- s.run() }()
+        go func() {
+            st, err := connectPipe(ctx, s, mux, peer)
+            if err != nil {
+                errs <- err
+                return
+            }
+            defer st.Close()
+            log.Printf("Connected to %s", peer)
+            errs <- runPipe(st, os.Stdin, os.Stdout)
+        }()
+        return <-errs
+    },
+}
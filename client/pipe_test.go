@@ -0,0 +1,73 @@
+package client
+
+import (
+    "bytes"
+    "context"
+    "math/rand"
+    "testing"
+    "time"
+)
+
+type pipeResult struct {
+    out []byte
+    err error
+}
+
+//connects a pipe of m to peer and runs it with in as stdin
+func startPipe(ctx context.Context, m *streamMux, peer string, in []byte) chan pipeResult {
+    res := make(chan pipeResult, 1)
+    go func() {
+        st, err := connectPipe(ctx, m.s, m, peer)
+        if err != nil {
+            res <- pipeResult { err: err }
+            return
+        }
+        defer st.Close()
+        var out bytes.Buffer
+        err = runPipe(st, bytes.NewReader(in), &out)
+        res <- pipeResult { out.Bytes(), err }
+    }()
+    return res
+}
+
+//arbitrary bytes go both ways, and alice keeps retrying until bob runs pipe too
+func TestPipe(t *testing.T) {
+    ma, mb, _ := streamPair(t)
+    ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Second)
+    defer cancel()
+
+    toBob := make([]byte, 3 * streamMSS + 17)
+    rand.New(rand.NewSource(1)).Read(toBob)
+    toAlice := []byte { 0, '\n', 0xFF, '\r', 0 }
+
+    alice := startPipe(ctx, ma, "bob", toBob)
+    time.Sleep(pipeRetryInterval / 2)
+    bob := startPipe(ctx, mb, "alice", toAlice)
+
+    for _, c := range []struct {
+        name string
+        res  chan pipeResult
+        want []byte
+    } {
+        { "alice", alice, toAlice },
+        { "bob", bob, toBob },
+    } {
+        r := <-c.res
+        if r.err != nil {
+            t.Fatalf("Pipe of %s failed: %v", c.name, r.err)
+        }
+        if !bytes.Equal(r.out, c.want) {
+            t.Fatalf("%s received %d bytes different from the %d sent", c.name, len(r.out), len(c.want))
+        }
+    }
+}
+
+//the side accepting the stream gives up with its context
+func TestPipeCancelled(t *testing.T) {
+    _, mb, _ := streamPair(t)
+    ctx, cancel := context.WithTimeout(context.Background(), 100 * time.Millisecond)
+    defer cancel()
+    if r := <-startPipe(ctx, mb, "alice", nil); r.err != context.DeadlineExceeded {
+        t.Fatalf("Pipe ended with %v", r.err)
+    }
+}
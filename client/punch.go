@@ -0,0 +1,226 @@
+package client
+
+import (
+    "fmt"
+    "math/rand"
+    "sort"
+    "strings"
+    "time"
+)
+
+const (
+    //how often peers are pinged by the fixed strategy, and kept alive without -nat-timeout
+    pingInterval    = 250 * time.Millisecond
+    //pings sent back to back by the burst strategy before backing off
+    burstPings      = 10
+    burstInterval   = 20 * time.Millisecond
+    maxBackoff      = 2 * time.Second
+    //pings with a limited TTL sent by the ttl strategy before the normal ones
+    ttlPings        = 3
+    ttlInterval     = 50 * time.Millisecond
+    defaultPunchTTL = 2
+    //keepalives are sent this much before the NAT would drop the mapping
+    keepaliveMargin = 5
+)
+
+var punchStrategies = []string { "fixed", "burst", "ttl", "jitter" }
+
+//how the next packet of the hole punching is sent to a peer
+type punchStep struct {
+    //until the packet after this one
+    wait   time.Duration
+    //how far the packet goes, 0 for the default. Packets dropped before reaching the
+    //peer's NAT open our mapping without the peer's NAT seeing unsolicited packets.
+    ttl    int
+    //sends a ping instead of a connectivity check, to open mappings faster than
+    //checks are retransmitted
+    primer bool
+}
+
+//punchStrategy decides when peers are pinged, as NATs differ in what opens a mapping
+//and how fast they drop it
+type punchStrategy interface {
+    name() string
+    //the packet to send to a peer, attempt counts the packets sent since punching it
+    //started, or since it answered or stopped answering
+    next(attempt int, punched bool) punchStep
+    //the longest wait between packets to a peer that answers
+    keepaliveInterval() time.Duration
+    //changes it, like once the NAT timeout is measured
+    setKeepalive(d time.Duration)
+}
+
+//punchConfig is shared by every strategy
+type punchConfig struct {
+    //interval between pings to peers that answer
+    keepalive time.Duration
+    //TTL of the first packets of the ttl strategy
+    ttl       int
+}
+
+func (c punchConfig) keepaliveInterval() time.Duration {
+    return c.keepalive
+}
+
+func (c *punchConfig) setKeepalive(d time.Duration) {
+    c.keepalive = d
+}
+
+//the keepalive interval for NATs dropping mappings after natTimeout, 0 if unknown
+func keepaliveFor(natTimeout time.Duration) time.Duration {
+    if natTimeout <= 0 {
+        return pingInterval
+    }
+    keepalive := natTimeout - natTimeout / keepaliveMargin
+    if keepalive < pingInterval {
+        keepalive = pingInterval
+    }
+    return keepalive
+}
+
+func newPunchStrategy(name string, config punchConfig) (punchStrategy, error) {
+    if config.keepalive <= 0 {
+        config.keepalive = pingInterval
+    }
+    if config.ttl <= 0 {
+        config.ttl = defaultPunchTTL
+    }
+    switch name {
+        case "fixed":
+            return &fixedStrategy { config }, nil
+        case "burst":
+            return &burstStrategy { config }, nil
+        case "ttl":
+            return &ttlStrategy { config }, nil
+        case "jitter":
+            return &jitterStrategy { config }, nil
+        default:
+            return nil, fmt.Errorf("Unknown punching strategy '%s', known ones are %s", name, strings.Join(punchStrategies, ", "))
+    }
+}
+
+//pings every 250ms until the peer answers, then keeps it alive
+type fixedStrategy struct {
+    punchConfig
+}
+
+func (s *fixedStrategy) name() string {
+    return "fixed"
+}
+
+func (s *fixedStrategy) next(attempt int, punched bool) punchStep {
+    if punched {
+        return punchStep { wait: s.keepalive }
+    }
+    return punchStep { wait: pingInterval }
+}
+
+//sends a burst of pings as soon as a peer is found, so both NATs open their mappings
+//at about the same time, then backs off up to 2s between checks
+type burstStrategy struct {
+    punchConfig
+}
+
+func (s *burstStrategy) name() string {
+    return "burst"
+}
+
+func (s *burstStrategy) next(attempt int, punched bool) punchStep {
+    switch {
+        case punched:
+            return punchStep { wait: s.keepalive }
+        //the first packet is a check, so it is already being retransmitted
+        case attempt == 0:
+            return punchStep { wait: burstInterval }
+        case attempt < burstPings:
+            return punchStep { wait: burstInterval, primer: true }
+    }
+    wait := pingInterval
+    for i := burstPings; i < attempt && wait < maxBackoff; i++ {
+        wait *= 2
+    }
+    if wait > maxBackoff {
+        wait = maxBackoff
+    }
+    return punchStep { wait: wait }
+}
+
+//opens our mapping with packets that die before the peer's NAT, which could otherwise
+//block the peer's mapping for us after seeing them, then pings like fixed
+type ttlStrategy struct {
+    punchConfig
+}
+
+func (s *ttlStrategy) name() string {
+    return "ttl"
+}
+
+func (s *ttlStrategy) next(attempt int, punched bool) punchStep {
+    switch {
+        case punched:
+            return punchStep { wait: s.keepalive }
+        case attempt < ttlPings:
+            return punchStep { wait: ttlInterval, ttl: s.ttl, primer: true }
+        default:
+            return punchStep { wait: pingInterval }
+    }
+}
+
+//pings at random intervals around the fixed ones, so peers started together don't
+//keep sending in lockstep, and NATs that rate limit mappings see them spread out
+type jitterStrategy struct {
+    punchConfig
+}
+
+func (s *jitterStrategy) name() string {
+    return "jitter"
+}
+
+//d plus or minus up to half of it
+func jitter(d time.Duration) time.Duration {
+    return d / 2 + time.Duration(rand.Int63n(int64(d)))
+}
+
+func (s *jitterStrategy) next(attempt int, punched bool) punchStep {
+    if punched {
+        //never later than the keepalive, which is already just under the NAT timeout
+        return punchStep { wait: s.keepalive - time.Duration(rand.Int63n(int64(s.keepalive / 4))) }
+    }
+    return punchStep { wait: jitter(pingInterval) }
+}
+
+//connectStats are the times peers took to answer after being found, with one strategy
+type connectStats struct {
+    peers int
+    total time.Duration
+    min   time.Duration
+    max   time.Duration
+}
+
+func (c *connectStats) add(d time.Duration) {
+    if c.peers == 0 || d < c.min {
+        c.min = d
+    }
+    if d > c.max {
+        c.max = d
+    }
+    c.peers++
+    c.total += d
+}
+
+func (c connectStats) mean() time.Duration {
+    if c.peers == 0 {
+        return 0
+    }
+    return c.total / time.Duration(c.peers)
+}
+
+//the strategies connect times were measured for, sorted
+func sortedStrategies(stats map[string]connectStats) []string {
+    res := make([]string, 0, len(stats))
+    for k := range stats {
+        res = append(res, k)
+    }
+    sort.Strings(res)
+    return res
+}
@@ -0,0 +1,117 @@
+package client
+
+import (
+    "testing"
+    "time"
+)
+
+func TestKeepaliveFor(t *testing.T) {
+    cases := []struct {
+        natTimeout time.Duration
+        keepalive  time.Duration
+    } {
+        { 0, pingInterval },
+        { -time.Second, pingInterval },
+        { 30 * time.Second, 24 * time.Second },
+        { time.Second, 800 * time.Millisecond },
+        //never more often than the pings punching peers
+        { 100 * time.Millisecond, pingInterval },
+    }
+    for _, c := range cases {
+        if got := keepaliveFor(c.natTimeout); got != c.keepalive {
+            t.Errorf("keepaliveFor(%v) = %v instead of %v", c.natTimeout, got, c.keepalive)
+        }
+    }
+}
+
+func newTestStrategy(t *testing.T, name string, config punchConfig) punchStrategy {
+    t.Helper()
+    s, err := newPunchStrategy(name, config)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if s.name() != name {
+        t.Fatalf("Asked for %s, got %s", name, s.name())
+    }
+    return s
+}
+
+func TestPunchStrategyDefaults(t *testing.T) {
+    if _, err := newPunchStrategy("shout", punchConfig {}); err == nil {
+        t.Fatal("Created an unknown strategy")
+    }
+    for _, name := range punchStrategies {
+        s := newTestStrategy(t, name, punchConfig {})
+        if s.keepaliveInterval() != pingInterval {
+            t.Errorf("%s keeps peers alive every %v by default", name, s.keepaliveInterval())
+        }
+        //peers that answer are only pinged to keep them alive, however long it's been
+        s.setKeepalive(20 * time.Second)
+        for _, attempt := range []int { 0, 1, 100 } {
+            step := s.next(attempt, true)
+            if step.wait > 20 * time.Second || step.wait < 15 * time.Second || step.ttl != 0 || step.primer {
+                t.Errorf("%s sends %+v to a punched peer", name, step)
+            }
+        }
+    }
+    if s := newTestStrategy(t, "ttl", punchConfig {}); s.next(0, false).ttl != defaultPunchTTL {
+        t.Errorf("ttl sends packets with TTL %d by default", s.next(0, false).ttl)
+    }
+}
+
+func TestPunchSchedules(t *testing.T) {
+    fixed := newTestStrategy(t, "fixed", punchConfig {})
+    for attempt := 0; attempt < 20; attempt++ {
+        if step := fixed.next(attempt, false); step != (punchStep { wait: pingInterval }) {
+            t.Fatalf("fixed sends %+v as packet %d", step, attempt)
+        }
+    }
+
+    //a check, the burst of primers, then checks backing off
+    burst := newTestStrategy(t, "burst", punchConfig {})
+    if step := burst.next(0, false); step != (punchStep { wait: burstInterval }) {
+        t.Fatalf("burst starts with %+v", step)
+    }
+    for attempt := 1; attempt < burstPings; attempt++ {
+        if step := burst.next(attempt, false); step != (punchStep { wait: burstInterval, primer: true }) {
+            t.Fatalf("burst sends %+v as packet %d", step, attempt)
+        }
+    }
+    last := time.Duration(0)
+    for attempt := burstPings; attempt < burstPings + 20; attempt++ {
+        step := burst.next(attempt, false)
+        if step.primer || step.ttl != 0 || step.wait < last || step.wait > maxBackoff {
+            t.Fatalf("burst sends %+v as packet %d, after waiting %v", step, attempt, last)
+        }
+        last = step.wait
+    }
+    if burst.next(burstPings, false).wait != pingInterval || last != maxBackoff {
+        t.Fatalf("burst backs off from %v to %v", burst.next(burstPings, false).wait, last)
+    }
+
+    ttl := newTestStrategy(t, "ttl", punchConfig { ttl: 3 })
+    for attempt := 0; attempt < ttlPings; attempt++ {
+        if step := ttl.next(attempt, false); step != (punchStep { wait: ttlInterval, ttl: 3, primer: true }) {
+            t.Fatalf("ttl sends %+v as packet %d", step, attempt)
+        }
+    }
+    if step := ttl.next(ttlPings, false); step != (punchStep { wait: pingInterval }) {
+        t.Fatalf("ttl sends %+v after the limited ones", step)
+    }
+
+    jitter := newTestStrategy(t, "jitter", punchConfig { keepalive: time.Second })
+    varied := false
+    for attempt := 0; attempt < 100; attempt++ {
+        step := jitter.next(attempt, false)
+        if step.wait < pingInterval / 2 || step.wait >= pingInterval * 3 / 2 || step.primer || step.ttl != 0 {
+            t.Fatalf("jitter sends %+v", step)
+        }
+        varied = varied || step.wait != jitter.next(attempt, false).wait
+        if w := jitter.next(attempt, true).wait; w > time.Second || w <= time.Second * 3 / 4 {
+            t.Fatalf("jitter keeps alive after %v", w)
+        }
+    }
+    if !varied {
+        t.Fatal("jitter always waits the same")
+    }
+}
@@ -0,0 +1,962 @@
+package client
+
+import (
+    "context"
+    "crypto/hmac"
+    crand "crypto/rand"
+    "crypto/sha256"
+    "encoding/binary"
+    "encoding/hex"
+    "flag"
+    "fmt"
+    "log"
+    "math/rand"
+    "net"
+    "net/netip"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/natanbc/ssc0904-nat-traversal/coord"
+    "github.com/natanbc/ssc0904-nat-traversal/portmap"
+    "github.com/natanbc/ssc0904-nat-traversal/stun"
+    "golang.org/x/crypto/curve25519"
+)
+
+var (
+    coordinationServer string
+    coordToken         string
+    stunServer         string
+    stunTimeout        time.Duration
+    discoveryMode      string
+    bootstrapNodes     string
+    lanEnabled         bool
+    lanGroup           string
+    portmapEnabled     bool
+    portmapGateway     string
+    punchMode          string
+    punchTTL           int
+    natTimeout         time.Duration
+    probeNat           bool
+)
+
+const defaultStunServers = "stun.l.google.com:19302,stun1.l.google.com:19302,stun2.l.google.com:19302"
+
+//registers the flags needed to join a topic, shared by every client subcommand
+func addSessionFlags(fs *flag.FlagSet) {
+    fs.StringVar(&coordinationServer, "coordination-server", "https://ssc0904-coord.natanbc.net", "Coordination server to use")
+    fs.StringVar(&coordToken,         "token",               "",                                  "Reserves our name on the coordination server, only this token can register it afterwards")
+    fs.StringVar(&stunServer,         "stun-server",         defaultStunServers,                  "Comma separated STUN servers to use, queried at once")
+    fs.DurationVar(&stunTimeout,      "stun-timeout",        stun.DefaultQueryTimeout,            "How long STUN servers have to answer")
+    fs.StringVar(&discoveryMode,      "discovery",           "coord",                             "Peer discovery backend (coord or dht)")
+    fs.StringVar(&bootstrapNodes,     "bootstrap",           "",                                  "Comma separated ip:port of known DHT nodes")
+    fs.BoolVar(&lanEnabled,           "lan",                 false,                               "Also discover peers on the local link via multicast")
+    fs.StringVar(&lanGroup,           "lan-group",           "239.255.42.99:6970",                "Multicast group used for LAN discovery")
+    fs.BoolVar(&portmapEnabled,       "portmap",             false,                               "Asks the gateway to forward our port with PCP, NAT-PMP or UPnP-IGD")
+    fs.StringVar(&portmapGateway,     "gateway",             "",                                  "Gateway asked for the port mapping, the default gateway if empty")
+    fs.StringVar(&punchMode,          "punch",               "fixed",                             "Hole punching strategy: " + strings.Join(punchStrategies, ", "))
+    fs.IntVar(&punchTTL,              "punch-ttl",           defaultPunchTTL,                     "TTL of the first packets of the ttl strategy, enough to leave our NAT but not reach the peer's")
+    fs.DurationVar(&natTimeout,       "nat-timeout",         0,                                   "How long the NAT keeps idle mappings, peers are kept alive just under it instead of every 250ms")
+    fs.BoolVar(&probeNat,             "probe-nat",           false,                               "Measures how long the NAT keeps idle mappings in the background, then acts like -nat-timeout")
+}
+
+//hostConfig is how a host reaches the network and its peers, taken from the session
+//flags by flagConfig
+type hostConfig struct {
+    stack       netstack
+    stunServers []string
+    stunTimeout time.Duration
+    coordServer string
+    //reserves our name on the coordination server, if set
+    coordToken  string
+    //"coord" or "dht"
+    discovery   string
+    bootstrap   string
+    //between DHT announcements, the default if 0
+    dhtAnnounce time.Duration
+    lan         bool
+    lanGroup    string
+    portmap     bool
+    gateway     string
+    punch       string
+    punchTTL    int
+    natTimeout  time.Duration
+    probeNAT    bool
+}
+
+//the config given by the session flags, on the system's network
+func flagConfig() hostConfig {
+    return hostConfig {
+        stack:       systemStack {},
+        stunServers: splitList(stunServer),
+        stunTimeout: stunTimeout,
+        coordServer: coordinationServer,
+        coordToken:  coordToken,
+        discovery:   discoveryMode,
+        bootstrap:   bootstrapNodes,
+        lan:         lanEnabled,
+        lanGroup:    lanGroup,
+        portmap:     portmapEnabled,
+        gateway:     portmapGateway,
+        punch:       punchMode,
+        punchTTL:    punchTTL,
+        natTimeout:  natTimeout,
+        probeNAT:    probeNat,
+    }
+}
+
+type packetHandler func(data []byte, from *net.UDPAddr)
+
+//netstack is where a host opens its socket and reaches the coordination server: the
+//system's network, or a simulated one like a netsim.Host
+type netstack interface {
+    ListenPacket(network, address string) (net.PacketConn, error)
+    DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+type systemStack struct {}
+
+func (systemStack) ListenPacket(network, address string) (net.PacketConn, error) {
+    return net.ListenPacket(network, address)
+}
+
+func (systemStack) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+    var d net.Dialer
+    return d.DialContext(ctx, network, address)
+}
+
+//host owns the punched socket, shared by the sessions of every topic joined. When
+//more than one topic is joined packets are tagged with the topic they belong to.
+type host struct {
+    config    hostConfig
+    socket    *stun.StunSocket
+    tagged    bool
+    //X25519 key pair, the public key is given to peers through discovery, and checks
+    //between two peers are signed with a key derived from both
+    key       []byte
+    publicKey string
+    //shared by every topic, as DHT records are keyed by topic already
+    dht       *dht
+    //forwards our port on the gateway, nil without -portmap or if no protocol worked
+    mapper    *portmap.PortMapper
+
+    mu        sync.Mutex
+    sessions  []*session
+    stats     sessionStats
+}
+
+//session is a client that joined a topic: the peers of the topic and the handlers
+//for each packet type received from them
+type session struct {
+    host     *host
+    peers    *peerRegistry
+    topic    string
+    //identifies the topic in tagged packets
+    tag      uint64
+
+    mu       sync.Mutex
+    name     string
+    handlers map[uint64]packetHandler
+    nextEcho uint64
+    echoes   map[uint64]chan time.Duration
+    //peer addresses with a connectivity check in flight
+    checking map[netip.AddrPort]struct{}
+}
+
+type sessionStats struct {
+    packetsSent     uint64
+    bytesSent       uint64
+    packetsReceived uint64
+    bytesReceived   uint64
+    //received packets by magic
+    received        map[uint64]uint64
+}
+
+func topicTag(topic string) uint64 {
+    key := topicKey(topic)
+    return binary.BigEndian.Uint64(key[:8])
+}
+
+//joins a single topic
+func newSession(ctx context.Context, topic, name string) (*session, error) {
+    h, err := newHost(ctx, []string { topic }, name)
+    if err != nil {
+        return nil, err
+    }
+    return h.sessions[0], nil
+}
+
+//joins every topic over the same socket, under the same name
+func newHost(ctx context.Context, topics []string, name string) (*host, error) {
+    return newHostWith(ctx, flagConfig(), topics, name)
+}
+
+//joins every topic as config says
+func newHostWith(ctx context.Context, config hostConfig, topics []string, name string) (*host, error) {
+    for _, topic := range topics {
+        if err := checkField("topic", topic); err != nil {
+            return nil, err
+        }
+    }
+    if err := checkField("name", name); err != nil {
+        return nil, err
+    }
+    conn, err := config.stack.ListenPacket("udp4", "0.0.0.0:0")
+    if err != nil {
+        return nil, fmt.Errorf("Unable to create UDP socket: %w", err)
+    }
+    stunConfig := stun.Config {
+        Servers:      config.stunServers,
+        QueryTimeout: config.stunTimeout,
+        Conn:         conn,
+    }
+    if config.natTimeout > 0 {
+        stunConfig.KeepAliveInterval = keepaliveFor(config.natTimeout)
+    }
+    s, err := stun.NewWithContext(ctx, stunConfig)
+    if err != nil {
+        conn.Close()
+        return nil, err
+    }
+    for _, r := range s.Results() {
+        if r.Err != nil {
+            log.Printf("STUN server %s failed: %v", r.Server, r.Err)
+        } else {
+            log.Printf("STUN server %s sees us as %s (%v)", r.Server, r.Mapped.String(), r.RTT.Round(10 * time.Microsecond))
+        }
+    }
+    log.Printf("Local address:  %s", s.Conn.LocalAddr().String())
+    log.Printf("Public address: %s", s.PublicAddr().String())
+    if s.SymmetricNAT() {
+        log.Printf("STUN servers disagree on the public address, the NAT is likely symmetric and peers may not reach us")
+    }
+
+    key := make([]byte, curve25519.ScalarSize)
+    if _, err := crand.Read(key); err != nil {
+        s.Close()
+        return nil, fmt.Errorf("Unable to generate key: %w", err)
+    }
+    publicKey, err := curve25519.X25519(key, curve25519.Basepoint)
+    if err != nil {
+        s.Close()
+        return nil, fmt.Errorf("Unable to generate key: %w", err)
+    }
+
+    h := &host {
+        config:    config,
+        socket:    s,
+        tagged:    len(topics) > 1,
+        key:       key,
+        publicKey: hex.EncodeToString(publicKey),
+        stats:     sessionStats {
+            received: make(map[uint64]uint64),
+        },
+    }
+    s.AnswerBindings(h.checkCredentials, h.onChecked)
+    go func() {
+        //the public address changing, once the NAT made a new mapping, is reported as an error
+        for err := range s.Errors() {
+            log.Printf("%v", err)
+            h.updateSelf()
+        }
+    }()
+
+    if config.portmap {
+        if err := h.mapPort(ctx); err != nil {
+            log.Printf("%v", err)
+        }
+    }
+    if config.probeNAT {
+        go h.probeNAT(ctx)
+    }
+
+    if config.discovery == "dht" {
+        bootstrap, err := parseAddrList(config.bootstrap)
+        if err != nil {
+            s.Close()
+            return nil, err
+        }
+        h.dht, err = newDHT(func(msg []byte, addr *net.UDPAddr) {
+            h.write(msg, addr)
+        }, bootstrap, config.dhtAnnounce)
+        if err != nil {
+            s.Close()
+            return nil, err
+        }
+    } else if config.discovery != "coord" {
+        s.Close()
+        return nil, fmt.Errorf("Unknown discovery backend '%s'", config.discovery)
+    }
+
+    for _, topic := range topics {
+        sess, err := h.join(topic, name)
+        if err != nil {
+            h.close()
+            return nil, fmt.Errorf("Unable to join topic '%s': %w", topic, err)
+        }
+        h.mu.Lock()
+        h.sessions = append(h.sessions, sess)
+        h.mu.Unlock()
+    }
+    return h, nil
+}
+
+func (h *host) join(topic, name string) (*session, error) {
+    sess := &session {
+        host:     h,
+        topic:    topic,
+        tag:      topicTag(topic),
+        name:     name,
+        handlers: make(map[uint64]packetHandler),
+        echoes:   make(map[uint64]chan time.Duration),
+        checking: make(map[netip.AddrPort]struct{}),
+    }
+
+    var disc discovery
+    if h.dht != nil {
+        disc = h.dht
+    } else {
+        c, err := newCoordDiscovery(h.config.coordServer, h.config.coordToken, h.config.stack.DialContext)
+        if err != nil {
+            return nil, err
+        }
+        disc = c
+    }
+
+    sources := []discovery { disc }
+    if h.config.lan {
+        lan, err := newLanDiscovery(h.config.lanGroup, h.socket.Conn.LocalAddr().(*net.UDPAddr).Port)
+        if err != nil {
+            return nil, err
+        }
+        sources = append(sources, lan)
+    }
+
+    strategy, err := newPunchStrategy(h.config.punch, punchConfig {
+        keepalive: keepaliveFor(h.config.natTimeout),
+        ttl:       h.config.punchTTL,
+    })
+    if err != nil {
+        return nil, err
+    }
+    ping := func(peer coord.Peer, step punchStep) {
+        addr := &net.UDPAddr {
+            IP:   peer.IP,
+            Port: int(peer.Port),
+        }
+        if step.ttl > 0 {
+            sess.host.writeTTL(makePingMessage(), addr, step.ttl)
+            return
+        }
+        //peers that didn't give us a key only understand pings
+        if peer.PublicKey == "" || step.primer {
+            sess.write(makePingMessage(), addr)
+            return
+        }
+        sess.check(peer, addr)
+    }
+
+    sess.handle(magicEcho, sess.onEcho)
+
+    public := h.socket.PublicAddr()
+    self := coord.Peer {
+        Name:      name,
+        IP:        public.IP,
+        Port:      uint16(public.Port),
+        PublicKey: h.publicKey,
+        Mapped:    h.mappedAddr(),
+    }
+    sess.peers, err = newPeerRegistry(topic, self, strategy, ping, sources...)
+    if err != nil {
+        return nil, err
+    }
+    return sess, nil
+}
+
+//the username of connectivity checks from one peer of a topic to another
+func checkUsername(topic, to, from string) string {
+    return topic + ":" + to + ":" + from
+}
+
+//topics and names are the fields of check usernames, which can't be split apart again
+//if they contain the separator
+func checkField(kind, value string) error {
+    if strings.Contains(value, ":") {
+        return fmt.Errorf("The %s '%s' can't contain ':'", kind, value)
+    }
+    return nil
+}
+
+//the session a connectivity check is for, and the name of the peer that sent it
+func (h *host) checkTarget(username string) (*session, string, bool) {
+    fields := strings.Split(username, ":")
+    if len(fields) != 3 {
+        return nil, "", false
+    }
+    for _, s := range h.getSessions() {
+        if fields[0] == s.topic && fields[1] == s.getName() {
+            return s, fields[2], true
+        }
+    }
+    return nil, "", false
+}
+
+//the password of the check with username between us and the peer whose public key is
+//peerKey. Both derive it from the X25519 secret only the two of them share, so other
+//members can't sign checks in the name of the peer.
+func (h *host) checkPassword(peerKey, username string) (string, bool) {
+    pub, err := hex.DecodeString(peerKey)
+    if err != nil || len(pub) != curve25519.PointSize {
+        return "", false
+    }
+    secret, err := curve25519.X25519(h.key, pub)
+    if err != nil {
+        return "", false
+    }
+    mac := hmac.New(sha256.New, secret)
+    mac.Write([]byte(username))
+    return hex.EncodeToString(mac.Sum(nil)), true
+}
+
+//checks are only answered if they come from a peer a trusted discovery source gave
+//us the key of, signed with the key of the pair
+func (h *host) checkCredentials(username string) (stun.Credentials, bool) {
+    s, from, ok := h.checkTarget(username)
+    if !ok {
+        return stun.Credentials {}, false
+    }
+    peerKey, ok := s.peers.keyOf(from)
+    if !ok {
+        return stun.Credentials {}, false
+    }
+    password, ok := h.checkPassword(peerKey, username)
+    if !ok {
+        return stun.Credentials {}, false
+    }
+    return stun.Credentials {
+        Username: username,
+        Password: password,
+    }, true
+}
+
+func (h *host) onChecked(username string, from *net.UDPAddr) {
+    if s, name, ok := h.checkTarget(username); ok {
+        s.peers.queueContact(name, from)
+    }
+}
+
+func (h *host) getSessions() []*session {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    return append([]*session(nil), h.sessions...)
+}
+
+//sends an already built packet, everything sent goes through here
+func (h *host) write(msg []byte, to *net.UDPAddr) error {
+    h.mu.Lock()
+    h.stats.packetsSent++
+    h.stats.bytesSent += uint64(len(msg))
+    h.mu.Unlock()
+
+    _, err := h.socket.WriteTo(msg, to)
+    return err
+}
+
+//sends a packet that only goes ttl hops, it can't be tagged as it isn't meant to arrive
+func (h *host) writeTTL(msg []byte, to *net.UDPAddr, ttl int) error {
+    h.mu.Lock()
+    h.stats.packetsSent++
+    h.stats.bytesSent += uint64(len(msg))
+    h.mu.Unlock()
+
+    _, err := h.socket.WriteToTTL(msg, to, ttl)
+    return err
+}
+
+func (h *host) writeBatch(packets []stun.Packet) error {
+    size := 0
+    for _, p := range packets {
+        for _, b := range p.Buffers {
+            size += len(b)
+        }
+    }
+    h.mu.Lock()
+    h.stats.packetsSent += uint64(len(packets))
+    h.stats.bytesSent += uint64(size)
+    h.mu.Unlock()
+
+    _, err := h.socket.WriteBatch(packets)
+    return err
+}
+
+//dispatches received packets to the sessions of their topic until the socket fails
+//handlers get packets in the buffer the socket reads them to, so whatever they keep
+//after returning must be copied
+func (h *host) run() error {
+    for {
+        msg, sender, err := h.socket.Read()
+        if err != nil {
+            return err
+        }
+        h.mu.Lock()
+        h.stats.packetsReceived++
+        h.stats.bytesReceived += uint64(len(msg))
+        h.mu.Unlock()
+
+        data, typ, err := parseMessage(msg)
+        if err != nil {
+            log.Printf("[%s]: %v", sender.String(), err)
+            continue
+        }
+
+        var targets []*session
+        switch {
+            case typ == magicTopic:
+                tag, inner, payload, err := parseTopicMessage(data)
+                if err != nil {
+                    log.Printf("[%s]: %v", sender.String(), err)
+                    continue
+                }
+                for _, s := range h.getSessions() {
+                    if s.tag == tag {
+                        targets = append(targets, s)
+                    }
+                }
+                if len(targets) == 0 {
+                    //a topic the peer shares with another process of ours, or one we left
+                    continue
+                }
+                typ, data = inner, payload
+            case typ == magicDHT && h.dht != nil:
+                h.countReceived(typ)
+                h.dht.queue(data, sender)
+                continue
+            default:
+                //untagged packets come from peers that joined a single topic, which
+                //only the sessions of that topic know
+                sessions := h.getSessions()
+                for _, s := range sessions {
+                    if s.peers.knows(sender) {
+                        targets = append(targets, s)
+                    }
+                }
+                if len(targets) == 0 {
+                    if h.tagged {
+                        //nothing tells which of our topics a stranger meant
+                        continue
+                    }
+                    targets = sessions
+                }
+        }
+
+        h.countReceived(typ)
+        for _, s := range targets {
+            s.dispatch(typ, data, sender)
+        }
+    }
+}
+
+func (h *host) countReceived(magic uint64) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    h.stats.received[magic]++
+}
+
+func (h *host) getStats() sessionStats {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+
+    res := h.stats
+    res.received = make(map[uint64]uint64, len(h.stats.received))
+    for k, v := range h.stats.received {
+        res.received[k] = v
+    }
+    return res
+}
+
+//asks the gateway to forward the port of the socket. Failing isn't fatal, peers can
+//still reach us by hole punching.
+func (h *host) mapPort(ctx context.Context) error {
+    config := portmap.Config {}
+    if h.config.gateway != "" {
+        config.Gateway = net.ParseIP(h.config.gateway).To4()
+        if config.Gateway == nil {
+            return fmt.Errorf("Invalid gateway address '%s'", h.config.gateway)
+        }
+    }
+    pm, err := portmap.New(ctx, h.socket.Conn.LocalAddr().(*net.UDPAddr).Port, config)
+    if err != nil {
+        return err
+    }
+    m := pm.Mapping()
+    log.Printf("Mapped address: %s (%s)", m.External.String(), m.Protocol)
+    h.mapper = pm
+    if h.mappedAddr() == nil {
+        log.Printf("STUN servers don't see us at %s, the gateway is behind another NAT and the mapped address isn't advertised", m.External.IP)
+    }
+    go func() {
+        //the gateway moving the mapping is reported as an error
+        for err := range pm.Errors() {
+            log.Printf("%v", err)
+            h.updateSelf()
+        }
+    }()
+    return nil
+}
+
+//measures how long the NAT keeps idle mappings with the STUN server receiving our
+//keepalives, then keeps the socket's mapping and peers alive just under that
+func (h *host) probeNAT(ctx context.Context) {
+    server := h.socket.KeepAliveServer()
+    for _, s := range h.config.stunServers {
+        //the name has no credentials, which the measurement needs too
+        if s == server || strings.HasSuffix(s, "@" + server) {
+            server = s
+            break
+        }
+    }
+    log.Printf("Measuring how long the NAT keeps idle mappings in the background")
+    res, err := stun.MeasureLifetime(ctx, stun.LifetimeConfig {
+        Server:       server,
+        QueryTimeout: h.config.stunTimeout,
+        Listen:       func() (net.PacketConn, error) {
+            return h.config.stack.ListenPacket("udp4", "0.0.0.0:0")
+        },
+    })
+    if err != nil {
+        if ctx.Err() == nil {
+            log.Printf("Unable to measure NAT mapping lifetime: %v", err)
+        }
+        return
+    }
+    //a mapping that never expired when asked again from its socket may have been
+    //replaced by one at the same port, which hides how long it lasts
+    if !res.Expired && res.Method != stun.LifetimeResponsePort {
+        log.Printf("NAT mapping lifetime unknown, mappings at the same port survived %v (measured with %s), keeping the default intervals", res.Lifetime, res.Method)
+        return
+    }
+    keepalive := keepaliveFor(res.Lifetime)
+    if res.Expired {
+        log.Printf("NAT keeps idle mappings %v (measured with %s), keeping them alive every %v", res.Lifetime, res.Method, keepalive)
+    } else {
+        log.Printf("NAT keeps idle mappings at least %v (measured with %s), keeping them alive every %v", res.Lifetime, res.Method, keepalive)
+    }
+    h.socket.SetKeepAliveInterval(keepalive)
+    for _, s := range h.getSessions() {
+        s.peers.setKeepalive(keepalive)
+    }
+}
+
+//the port forwarded by the gateway, given to peers besides the address seen by STUN
+//servers as it works without punching. nil without a mapping, or if STUN servers
+//didn't see us coming from the gateway's external address: the gateway is then behind
+//another NAT, like a carrier-grade one, and its external address is private.
+func (h *host) mappedAddr() *net.UDPAddr {
+    if h.mapper == nil {
+        return nil
+    }
+    external := h.mapper.Mapping().External
+    for _, r := range h.socket.Results() {
+        if r.Err == nil && r.Mapped.IP.Equal(external.IP) {
+            return external
+        }
+    }
+    if h.socket.PublicAddr().IP.Equal(external.IP) {
+        return external
+    }
+    return nil
+}
+
+//gives peers the address STUN servers see us at and the port the gateway forwards to
+//us now
+func (h *host) updateSelf() {
+    public, mapped := h.socket.PublicAddr(), h.mappedAddr()
+    for _, s := range h.getSessions() {
+        s.peers.setAddrs(public, mapped)
+    }
+}
+
+func (h *host) close() error {
+    for _, s := range h.getSessions() {
+        s.peers.stop()
+    }
+    if h.dht != nil {
+        h.dht.close()
+    }
+    //deleted while the socket is still bound, so the port isn't forwarded to nothing
+    if h.mapper != nil {
+        if err := h.mapper.Close(); err != nil {
+            log.Printf("Unable to delete port mapping: %v", err)
+        }
+    }
+    return h.socket.Close()
+}
+
+//registers the handler for packets with the given magic, must be called before run
+func (s *session) handle(magic uint64, h packetHandler) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.handlers[magic] = h
+}
+
+//headers of the packets being sent, the data is written after them without copying it
+var headerPool = sync.Pool {
+    New: func() interface{} {
+        b := make([]byte, 128 + 16)
+        return &b
+    },
+}
+
+//builds the header of packets of magic into b: the magic then random bytes, followed
+//by the topic tag and the magic again when tagging
+func (s *session) header(b []byte, magic uint64) []byte {
+    b = b[:128]
+    _, _ = rand.Read(b[8:])
+    if !s.host.tagged {
+        binary.BigEndian.PutUint64(b[:8], magic)
+        return b
+    }
+    binary.BigEndian.PutUint64(b[:8], magicTopic)
+    b = b[:144]
+    binary.BigEndian.PutUint64(b[128:136], s.tag)
+    binary.BigEndian.PutUint64(b[136:144], magic)
+    return b
+}
+
+func (s *session) send(magic uint64, data []byte, to *net.UDPAddr) error {
+    return s.sendAll(magic, data, []*net.UDPAddr { to })
+}
+
+//outPacket is a packet to send with sendPackets, whose payload is made of parts
+type outPacket struct {
+    parts [][]byte
+    to    *net.UDPAddr
+}
+
+//sends the same packet to every address, in as few system calls as possible
+func (s *session) sendAll(magic uint64, data []byte, to []*net.UDPAddr) error {
+    packets := make([]outPacket, len(to))
+    for i, addr := range to {
+        packets[i] = outPacket {
+            parts: [][]byte { data },
+            to:    addr,
+        }
+    }
+    return s.sendPackets(magic, packets)
+}
+
+//sends packets of magic in as few system calls as possible, without copying them
+func (s *session) sendPackets(magic uint64, packets []outPacket) error {
+    if len(packets) == 0 {
+        return nil
+    }
+    hp := headerPool.Get().(*[]byte)
+    defer headerPool.Put(hp)
+    header := s.header(*hp, magic)
+
+    batch := make([]stun.Packet, len(packets))
+    for i, p := range packets {
+        batch[i] = stun.Packet {
+            Buffers: append([][]byte { header }, p.parts...),
+            Addr:    p.to,
+        }
+    }
+    return s.host.writeBatch(batch)
+}
+
+//checks connectivity to a peer with a STUN binding request signed with the key of the
+//pair, unless a check to it is still in flight. Checks that fail are retried on the
+//next ping, peers whose key can't be used are sent pings instead.
+func (s *session) check(peer coord.Peer, addr *net.UDPAddr) {
+    k := peer.IPPort()
+    s.mu.Lock()
+    if _, ok := s.checking[k]; ok {
+        s.mu.Unlock()
+        return
+    }
+    name := s.name
+    username := checkUsername(s.topic, peer.Name, name)
+    password, ok := s.host.checkPassword(peer.PublicKey, username)
+    if !ok {
+        s.mu.Unlock()
+        s.write(makePingMessage(), addr)
+        return
+    }
+    s.checking[k] = struct{}{}
+    s.mu.Unlock()
+
+    go func() {
+        defer func() {
+            s.mu.Lock()
+            delete(s.checking, k)
+            s.mu.Unlock()
+        }()
+        mapped, rtt, err := s.host.socket.Check(context.Background(), addr, stun.Credentials {
+            Username: username,
+            Password: password,
+            SHA256:   true,
+        })
+        if err != nil {
+            return
+        }
+        s.peers.onCheck(addr, mapped, rtt)
+    }()
+}
+
+//sends an already built packet, tagging it with the topic if needed
+func (s *session) write(msg []byte, to *net.UDPAddr) error {
+    if s.host.tagged {
+        msg = makeTopicMessage(s.tag, msg)
+    }
+    return s.host.write(msg, to)
+}
+
+func (s *session) dispatch(typ uint64, data []byte, sender *net.UDPAddr) {
+    if typ == magicPing {
+        s.peers.queueContact("", sender)
+        return
+    }
+
+    s.mu.Lock()
+    h, ok := s.handlers[typ]
+    s.mu.Unlock()
+    if !ok {
+        log.Printf("[%s aka %s]: Unknown magic %X", sender.String(), s.peers.peerName(sender), typ)
+        return
+    }
+    h(data, sender)
+}
+
+//dispatches received packets to their handlers until the socket fails
+func (s *session) run() error {
+    return s.host.run()
+}
+
+func (s *session) getName() string {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.name
+}
+
+func (s *session) rename(name string) error {
+    if err := checkField("name", name); err != nil {
+        return err
+    }
+    if err := s.peers.rename(name); err != nil {
+        return err
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.name = name
+    return nil
+}
+
+//the counters of the socket, shared by every topic
+func (s *session) getStats() sessionStats {
+    return s.host.getStats()
+}
+
+//echo packets measure the round trip time to peers: a kind byte (request or reply),
+//an id and the time the request was sent, which replies copy
+const (
+    echoRequest byte = 0
+    echoReply   byte = 1
+)
+
+func (s *session) onEcho(data []byte, sender *net.UDPAddr) {
+    if len(data) < 17 {
+        return
+    }
+    switch data[0] {
+        case echoRequest:
+            reply := make([]byte, 17)
+            copy(reply, data)
+            reply[0] = echoReply
+            s.send(magicEcho, reply, sender)
+        case echoReply:
+            sent := time.Unix(0, int64(binary.BigEndian.Uint64(data[9:17])))
+            rtt := time.Since(sent)
+            if rtt < 0 {
+                return
+            }
+            s.peers.setRTT(sender, rtt)
+
+            s.mu.Lock()
+            ch, ok := s.echoes[binary.BigEndian.Uint64(data[1:9])]
+            s.mu.Unlock()
+            if ok {
+                select {
+                    case ch <- rtt:
+                    default:
+                }
+            }
+    }
+}
+
+func makeEchoRequest(id uint64) []byte {
+    req := make([]byte, 17)
+    req[0] = echoRequest
+    binary.BigEndian.PutUint64(req[1:9], id)
+    binary.BigEndian.PutUint64(req[9:17], uint64(time.Now().UnixNano()))
+    return req
+}
+
+//sends an echo request without waiting for the reply, which updates the peer's RTT
+func (s *session) sendEcho(to *net.UDPAddr) error {
+    s.mu.Lock()
+    s.nextEcho++
+    id := s.nextEcho
+    s.mu.Unlock()
+    return s.send(magicEcho, makeEchoRequest(id), to)
+}
+
+//how often measureRTT sends echo requests
+const echoInterval = 5 * time.Second
+
+//sends echo requests to every peer until stop is closed, keeping their RTTs up to date
+func (s *session) measureRTT(stop <-chan struct{}) {
+    t := time.NewTicker(echoInterval)
+    defer t.Stop()
+
+    for {
+        s.peers.forEachPeerAddress(func(addr *net.UDPAddr) {
+            s.sendEcho(addr)
+        })
+        select {
+            case <-t.C:
+            case <-stop:
+                return
+        }
+    }
+}
+
+//measures the round trip time to a peer
+func (s *session) echo(ctx context.Context, to *net.UDPAddr) (time.Duration, error) {
+    ch := make(chan time.Duration, 1)
+    s.mu.Lock()
+    s.nextEcho++
+    id := s.nextEcho
+    s.echoes[id] = ch
+    s.mu.Unlock()
+
+    defer func() {
+        s.mu.Lock()
+        delete(s.echoes, id)
+        s.mu.Unlock()
+    }()
+
+    if err := s.send(magicEcho, makeEchoRequest(id), to); err != nil {
+        return 0, err
+    }
+
+    select {
+        case rtt := <-ch:
+            return rtt, nil
+        case <-ctx.Done():
+            return 0, ctx.Err()
+    }
+}
+
+func (s *session) close() error {
+    return s.host.close()
+}
@@ -0,0 +1,443 @@
+package client
+
+import (
+    "context"
+    "flag"
+    "fmt"
+    "io"
+    "log"
+    "net"
+    "os"
+    "sync"
+    "testing"
+    "time"
+
+    "github.com/natanbc/ssc0904-nat-traversal/coord"
+    "github.com/natanbc/ssc0904-nat-traversal/netsim"
+    "github.com/natanbc/ssc0904-nat-traversal/stun"
+)
+
+//addresses of the servers every test network has, on the internet
+var testStunServers = []string { "198.51.100.1:3478", "198.51.100.2:3478" }
+
+const (
+    testCoordServer    = "198.51.100.3:6969"
+    testTopic          = "test"
+    testConnectTimeout = 5 * time.Second
+    //peers that shouldn't connect are given less time, punching that works does so
+    //within the first rounds
+    testRefuseTimeout  = 2 * time.Second
+)
+
+//the clients log a lot, only shown with -v
+func TestMain(m *testing.M) {
+    flag.Parse()
+    if !testing.Verbose() {
+        log.SetOutput(io.Discard)
+    }
+    os.Exit(m.Run())
+}
+
+//testNAT is what a test peer is behind, nothing when config is nil
+type testNAT struct {
+    name   string
+    config *netsim.NATConfig
+}
+
+var testNATs = []testNAT {
+    { name: "public" },
+    { name: "full-cone",       config: &netsim.FullCone },
+    { name: "restricted",      config: &netsim.Restricted },
+    { name: "port-restricted", config: &netsim.PortRestricted },
+    { name: "symmetric",       config: &netsim.Symmetric },
+}
+
+//whether hole punching works between peers behind a and b. It only fails when one
+//NAT maps each destination to a new port, as the other NAT then only lets packets
+//through if it filters by address alone.
+func expectConnect(a, b testNAT) bool {
+    symmetric := func(n testNAT) bool {
+        return n.config != nil && n.config.Mapping != netsim.EndpointIndependent
+    }
+    portFiltered := func(n testNAT) bool {
+        return n.config != nil && n.config.Filtering == netsim.AddressPortDependent
+    }
+    return !(symmetric(a) && portFiltered(b)) && !(symmetric(b) && portFiltered(a))
+}
+
+//testWorld is a simulated network with the STUN and coordination servers peers use
+type testWorld struct {
+    t       *testing.T
+    network *netsim.Network
+
+    mu      sync.Mutex
+    //for peers given a NAT or public address of their own
+    nextIP  int
+    hosts   int
+}
+
+func newTestWorld(t *testing.T, config netsim.Config) *testWorld {
+    t.Helper()
+    w := &testWorld {
+        t:       t,
+        network: netsim.New(config),
+        nextIP:  1,
+    }
+    for _, addr := range testStunServers {
+        conn, err := w.serverHost(addr).ListenPacket("udp4", addr)
+        if err != nil {
+            t.Fatal(err)
+        }
+        go stun.Serve(conn)
+    }
+    l, err := w.serverHost(testCoordServer).Listen("tcp4", testCoordServer)
+    if err != nil {
+        t.Fatal(err)
+    }
+    go coord.Serve(l, 30 * time.Second, 10 * time.Second)
+    return w
+}
+
+func (w *testWorld) addHost(h *netsim.Host, err error) *netsim.Host {
+    w.t.Helper()
+    if err != nil {
+        w.t.Fatal(err)
+    }
+    w.t.Cleanup(func() {
+        h.Close()
+    })
+    return h
+}
+
+//a host on the internet at the IP of addr
+func (w *testWorld) serverHost(addr string) *netsim.Host {
+    w.t.Helper()
+    ip, _, err := net.SplitHostPort(addr)
+    if err != nil {
+        w.t.Fatal(err)
+    }
+    return w.addHost(w.network.NewHost(ip))
+}
+
+func (w *testWorld) publicIP() string {
+    w.mu.Lock()
+    defer w.mu.Unlock()
+    w.nextIP++
+    return fmt.Sprintf("203.0.113.%d", w.nextIP)
+}
+
+//a NAT of its own, or nil for peers on the internet
+func (w *testWorld) newNAT(config *netsim.NATConfig) *netsim.NAT {
+    w.t.Helper()
+    if config == nil {
+        return nil
+    }
+    nat, err := w.network.NewNAT(w.publicIP(), *config)
+    if err != nil {
+        w.t.Fatal(err)
+    }
+    return nat
+}
+
+//a host behind nat, or on the internet if nil
+func (w *testWorld) peerHost(nat *netsim.NAT) *netsim.Host {
+    w.t.Helper()
+    if nat == nil {
+        return w.addHost(w.network.NewHost(w.publicIP()))
+    }
+    w.mu.Lock()
+    w.hosts++
+    //hosts behind different NATs share private addresses, like home networks do
+    ip := fmt.Sprintf("192.168.1.%d", w.hosts + 1)
+    w.mu.Unlock()
+    return w.addHost(nat.NewHost(ip))
+}
+
+//the config of a peer on stack, using the servers of the test network
+func testConfig(stack netstack, punch string) hostConfig {
+    return hostConfig {
+        stack:       stack,
+        stunServers: testStunServers,
+        stunTimeout: stun.DefaultQueryTimeout,
+        coordServer: "http://" + testCoordServer,
+        discovery:   "coord",
+        punch:       punch,
+        punchTTL:    defaultPunchTTL,
+    }
+}
+
+//runs a peer named name on stack, closed when the test ends
+func startPeer(t *testing.T, stack netstack, punch, name string) *host {
+    t.Helper()
+    return startPeerTopics(t, stack, punch, name, testTopic)
+}
+
+//runs a peer named name on stack that joined topics
+func startPeerTopics(t *testing.T, stack netstack, punch, name string, topics ...string) *host {
+    t.Helper()
+    h, err := newHostWith(context.Background(), testConfig(stack, punch), topics, name)
+    if err != nil {
+        t.Fatalf("Unable to start %s: %v", name, err)
+    }
+    t.Cleanup(func() {
+        h.close()
+    })
+    go h.run()
+    return h
+}
+
+//whether the single sessions of a and b connect to each other within timeout
+func waitConnected(a, b *host, timeout time.Duration) bool {
+    ctx, cancel := context.WithTimeout(context.Background(), timeout)
+    defer cancel()
+    return a.sessions[0].peers.waitForPeer(ctx, b.sessions[0].getName()) && b.sessions[0].peers.waitForPeer(ctx, a.sessions[0].getName())
+}
+
+//runs alice and bob on a and b, failing unless they connect to each other exactly
+//when expected
+func expectConnected(t *testing.T, a, b *netsim.Host, punch string, expected bool) {
+    t.Helper()
+    alice := startPeer(t, a, punch, "alice")
+    bob := startPeer(t, b, punch, "bob")
+
+    timeout := testConnectTimeout
+    if !expected {
+        timeout = testRefuseTimeout
+    }
+    connected := waitConnected(alice, bob, timeout)
+    if connected && !expected {
+        t.Fatal("Connected, which shouldn't be possible")
+    }
+    if !connected && expected {
+        t.Fatalf("Not connected within %v", timeout)
+    }
+}
+
+//peers behind their own NATs of every pair of types connect exactly when hole
+//punching can work
+func testPairs(t *testing.T, punch string) {
+    for i, a := range testNATs {
+        for _, b := range testNATs[i:] {
+            a, b := a, b
+            t.Run(a.name + "/" + b.name, func(t *testing.T) {
+                t.Parallel()
+                w := newTestWorld(t, netsim.Config { Latency: 10 * time.Millisecond })
+                ha := w.peerHost(w.newNAT(a.config))
+                hb := w.peerHost(w.newNAT(b.config))
+                expectConnected(t, ha, hb, punch, expectConnect(a, b))
+            })
+        }
+    }
+}
+
+func TestTraversal(t *testing.T) {
+    for _, punch := range punchStrategies {
+        punch := punch
+        t.Run(punch, func(t *testing.T) {
+            if testing.Short() && punch != "fixed" {
+                t.Skip("Only the fixed strategy runs in short mode")
+            }
+            testPairs(t, punch)
+        })
+    }
+}
+
+//peers behind the same NAT only reach each other's public address through it with
+//hairpinning
+func TestSameNAT(t *testing.T) {
+    for _, hairpinning := range []bool { false, true } {
+        hairpinning := hairpinning
+        t.Run(fmt.Sprintf("hairpinning=%v", hairpinning), func(t *testing.T) {
+            t.Parallel()
+            w := newTestWorld(t, netsim.Config { Latency: 10 * time.Millisecond })
+            config := netsim.PortRestricted
+            config.Hairpinning = hairpinning
+            nat := w.newNAT(&config)
+            expectConnected(t, w.peerHost(nat), w.peerHost(nat), "fixed", hairpinning)
+        })
+    }
+}
+
+//peers behind port-restricted NATs connect over a link losing a fifth of the packets
+func TestLossyLink(t *testing.T) {
+    for _, seed := range []int64 { 1, 2, 3 } {
+        seed := seed
+        t.Run(fmt.Sprintf("seed=%d", seed), func(t *testing.T) {
+            t.Parallel()
+            w := newTestWorld(t, netsim.Config {
+                Latency: 60 * time.Millisecond,
+                Jitter:  20 * time.Millisecond,
+                Loss:    0.2,
+                Seed:    seed,
+            })
+            a := w.peerHost(w.newNAT(&netsim.PortRestricted))
+            b := w.peerHost(w.newNAT(&netsim.PortRestricted))
+            expectConnected(t, a, b, "fixed", true)
+        })
+    }
+}
+
+//checks claiming to come from another peer are refused, as only that peer shares the
+//key of the pair with the one checked
+func TestCheckSenderCannotBeForged(t *testing.T) {
+    w := newTestWorld(t, netsim.Config { Latency: 10 * time.Millisecond })
+    alice := startPeer(t, w.peerHost(nil), "fixed", "alice")
+    bob := startPeer(t, w.peerHost(nil), "fixed", "bob")
+    mallory := startPeer(t, w.peerHost(nil), "fixed", "mallory")
+    if !waitConnected(alice, bob, testConnectTimeout) || !waitConnected(alice, mallory, testConnectTimeout) {
+        t.Fatalf("Not connected within %v", testConnectTimeout)
+    }
+
+    username := checkUsername(testTopic, "alice", "bob")
+    creds, ok := alice.checkCredentials(username)
+    if !ok {
+        t.Fatal("Checks from bob aren't answered")
+    }
+    if password, _ := bob.checkPassword(alice.publicKey, username); password != creds.Password {
+        t.Fatal("Bob and alice derive different keys")
+    }
+    forged, ok := mallory.checkPassword(alice.publicKey, username)
+    if !ok || forged == creds.Password {
+        t.Fatal("Mallory derives the key of bob and alice")
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), testRefuseTimeout)
+    defer cancel()
+    _, _, err := mallory.socket.Check(ctx, alice.socket.PublicAddr(), stun.Credentials {
+        Username: username,
+        Password: forged,
+        SHA256:   true,
+    })
+    if err == nil {
+        t.Fatal("Check in the name of bob answered")
+    }
+}
+
+//topics and names can't contain the separator of check usernames, so a check can't be
+//credited to another session of the host
+func TestCheckUsernameFields(t *testing.T) {
+    config := testConfig(nil, "fixed")
+    if _, err := newHostWith(context.Background(), config, []string { testTopic }, "alice:bob"); err == nil {
+        t.Fatal("Joined under a name containing ':'")
+    }
+    if _, err := newHostWith(context.Background(), config, []string { "test:alice" }, "bob"); err == nil {
+        t.Fatal("Joined a topic containing ':'")
+    }
+
+    w := newTestWorld(t, netsim.Config {})
+    h := startPeer(t, w.peerHost(nil), "fixed", "alice")
+    if _, from, ok := h.checkTarget(checkUsername(testTopic, "alice", "bob")); !ok || from != "bob" {
+        t.Fatal("Check from bob not credited to it")
+    }
+    for _, username := range []string { checkUsername(testTopic, "alice", "bob:x"), checkUsername(testTopic + ":alice", "alice", "bob"), "test:alice" } {
+        if _, _, ok := h.checkTarget(username); ok {
+            t.Fatalf("Check with username '%s' accepted", username)
+        }
+    }
+}
+
+//whether sessions a and b of the same topic connect to each other within timeout
+func waitSessionsConnected(a, b *session, timeout time.Duration) bool {
+    ctx, cancel := context.WithTimeout(context.Background(), timeout)
+    defer cancel()
+    return a.peers.waitForPeer(ctx, b.getName()) && b.peers.waitForPeer(ctx, a.getName())
+}
+
+//packets only reach the sessions of the topic they were sent on, tagged or not
+func TestTopicDemux(t *testing.T) {
+    const other = "other"
+    w := newTestWorld(t, netsim.Config { Latency: time.Millisecond })
+    alice := startPeerTopics(t, w.peerHost(nil), "fixed", "alice", testTopic, other)
+    carol := startPeerTopics(t, w.peerHost(nil), "fixed", "carol", testTopic, other)
+    //joined a single topic, so doesn't tag its packets
+    bob := startPeer(t, w.peerHost(nil), "fixed", "bob")
+    if !alice.tagged || bob.tagged {
+        t.Fatal("Hosts tag packets with a single topic, or not with several")
+    }
+    for _, pair := range [][2]*session {
+        { alice.sessions[0], carol.sessions[0] },
+        { alice.sessions[1], carol.sessions[1] },
+        { alice.sessions[0], bob.sessions[0] },
+        { carol.sessions[0], bob.sessions[0] },
+    } {
+        if !waitSessionsConnected(pair[0], pair[1], testConnectTimeout) {
+            t.Fatalf("%s didn't connect to %s in %s", pair[0].getName(), pair[1].getName(), pair[0].topic)
+        }
+    }
+    if _, ok := bob.sessions[0].peers.peerAddr("alice"); !ok {
+        t.Fatal("Bob doesn't know alice")
+    }
+
+    aliceMain, aliceOther := sessionMessenger(alice.sessions[0]), sessionMessenger(alice.sessions[1])
+    carolMain, carolOther := sessionMessenger(carol.sessions[0]), sessionMessenger(carol.sessions[1])
+    bobMain := startMessenger(bob)
+    quiet := func(ms ...testMessenger) {
+        t.Helper()
+        for _, m := range ms {
+            if msg := nextMessage(m.all, 100 * time.Millisecond); msg.data != nil {
+                t.Fatalf("%s of %s got %+v", m.s.getName(), m.s.topic, msg)
+            }
+        }
+    }
+
+    if err := aliceOther.broadcast(defaultChannel, []byte("other")); err != nil {
+        t.Fatal(err)
+    }
+    if msg := nextMessage(carolOther.got, time.Second); msg.topic != other || msg.from != "alice" || string(msg.data) != "other" {
+        t.Fatalf("Carol got %+v", msg)
+    }
+    quiet(carolMain, bobMain)
+
+    //tagged packets to a host that isn't tagging
+    carolOther.clear()
+    if err := aliceMain.broadcast(defaultChannel, []byte("main")); err != nil {
+        t.Fatal(err)
+    }
+    for _, m := range []testMessenger { carolMain, bobMain } {
+        if msg := nextMessage(m.got, time.Second); msg.topic != testTopic || string(msg.data) != "main" {
+            t.Fatalf("%s got %+v", m.s.getName(), msg)
+        }
+    }
+    quiet(carolOther)
+
+    //untagged packets go to the sessions knowing their sender
+    carolMain.clear()
+    if err := bobMain.sendTo([]string { "alice" }, defaultChannel, []byte("untagged")); err != nil {
+        t.Fatal(err)
+    }
+    if msg := nextMessage(aliceMain.got, time.Second); msg.from != "bob" || string(msg.data) != "untagged" {
+        t.Fatalf("Alice got %+v", msg)
+    }
+    quiet(aliceOther, carolMain)
+}
+
+//untagged packets from a sender no session knows can't be told apart by topic, so a
+//host in several topics drops them instead of letting them into every topic
+func TestTopicDemuxUnknownSender(t *testing.T) {
+    const other = "other"
+    w := newTestWorld(t, netsim.Config { Latency: time.Millisecond })
+    stack := w.peerHost(nil)
+    alice := startPeerTopics(t, stack, "fixed", "alice", testTopic, other)
+    aliceMain, aliceOther := sessionMessenger(alice.sessions[0]), sessionMessenger(alice.sessions[1])
+
+    conn, err := w.peerHost(nil).ListenPacket("udp4", ":0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+    //how a peer that joined a single topic sends a message
+    untagged := &session { host: &host {} }
+    msg := append(untagged.header(make([]byte, 128), magicMessage), encodeChatMessage(messageBroadcast, defaultChannel, []byte("stranger"))...)
+    to := &net.UDPAddr {
+        IP:   stack.IP(),
+        Port: alice.socket.Conn.LocalAddr().(*net.UDPAddr).Port,
+    }
+    if _, err := conn.WriteTo(msg, to); err != nil {
+        t.Fatal(err)
+    }
+    for _, m := range []testMessenger { aliceMain, aliceOther } {
+        if msg := nextMessage(m.all, 200 * time.Millisecond); msg.data != nil {
+            t.Fatalf("%s got %+v", m.s.topic, msg)
+        }
+    }
+}
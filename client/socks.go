@@ -0,0 +1,743 @@
+package client
+
+import (
+    "bufio"
+    "context"
+    "encoding/binary"
+    "errors"
+    "flag"
+    "fmt"
+    "io"
+    "log"
+    "net"
+    "net/netip"
+    "strconv"
+    "strings"
+    "sync"
+    "syscall"
+    "time"
+
+    "github.com/peterbourgon/ff/v3/ffcli"
+)
+
+var (
+    socksListen   string
+    socksExitPeer string
+    exitAllow     string
+)
+
+var socksFs = (func() *flag.FlagSet {
+    fs := flag.NewFlagSet("socks", flag.ExitOnError)
+    addSessionFlags(fs)
+    fs.StringVar(&socksListen,   "listen",     "127.0.0.1:1080", "Address the local SOCKS5 proxy listens on")
+    fs.StringVar(&socksExitPeer, "exit",       "",               "Peer traffic of the local SOCKS5 proxy exits through, the proxy is disabled if empty")
+    fs.StringVar(&exitAllow,     "exit-allow", "",               "Comma separated destinations peers may reach when exiting through this client " +
+                                                                 "(ip, cidr, host, *.domain or *, each optionally followed by :port)")
+    return fs
+})()
+
+const socksVersion = 5
+
+const (
+    socksCmdConnect      = 1
+    socksCmdUDPAssociate = 3
+)
+
+const (
+    socksAtypIPv4   = 1
+    socksAtypDomain = 3
+    socksAtypIPv6   = 4
+)
+
+const (
+    socksSucceeded           byte = 0
+    socksGeneralFailure      byte = 1
+    socksNotAllowed          byte = 2
+    socksNetworkUnreachable  byte = 3
+    socksHostUnreachable     byte = 4
+    socksConnectionRefused   byte = 5
+    socksCommandNotSupported byte = 7
+    socksAddressNotSupported byte = 8
+)
+
+const socksHandshakeTimeout = 30 * time.Second
+
+const (
+    //how long a UDP association reuses the result of resolving a destination
+    socksResolveTTL = time.Minute
+    //destinations remembered by each UDP association
+    socksUDPTargets = 256
+    //datagrams held for a destination while it's being resolved
+    socksUDPQueue   = 8
+)
+
+var errSocksAddressType = errors.New("Unsupported address type")
+
+//parses an address in SOCKS format (type, address, port), returning it as host:port
+//and the bytes following it
+func parseSocksAddr(b []byte) (string, []byte, error) {
+    if len(b) < 1 {
+        return "", nil, fmt.Errorf("Address too small")
+    }
+    var host string
+    switch b[0] {
+        case socksAtypIPv4:
+            if len(b) < 1 + 4 + 2 {
+                return "", nil, fmt.Errorf("Address too small")
+            }
+            host = ipv4Addr(b[1:5]).String()
+            b = b[5:]
+        case socksAtypIPv6:
+            if len(b) < 1 + 16 + 2 {
+                return "", nil, fmt.Errorf("Address too small")
+            }
+            var a [16]byte
+            copy(a[:], b[1:17])
+            host = netip.AddrFrom16(a).String()
+            b = b[17:]
+        case socksAtypDomain:
+            if len(b) < 2 || len(b) < 2 + int(b[1]) + 2 {
+                return "", nil, fmt.Errorf("Address too small")
+            }
+            host = string(b[2:2 + b[1]])
+            b = b[2 + b[1]:]
+        default:
+            return "", nil, errSocksAddressType
+    }
+    port := binary.BigEndian.Uint16(b[:2])
+    return net.JoinHostPort(host, strconv.Itoa(int(port))), b[2:], nil
+}
+
+func readSocksAddr(r io.Reader) (string, error) {
+    head := make([]byte, 2)
+    if _, err := io.ReadFull(r, head); err != nil {
+        return "", err
+    }
+    var size int
+    switch head[0] {
+        case socksAtypIPv4:
+            size = 4 + 2
+        case socksAtypIPv6:
+            size = 16 + 2
+        case socksAtypDomain:
+            size = int(head[1]) + 2
+        default:
+            return "", errSocksAddressType
+    }
+    //the first byte of the address was already read along with the type
+    if head[0] != socksAtypDomain {
+        size--
+    }
+    rest := make([]byte, size)
+    if _, err := io.ReadFull(r, rest); err != nil {
+        return "", err
+    }
+    addr, _, err := parseSocksAddr(append(head, rest...))
+    return addr, err
+}
+
+func appendSocksAddr(b []byte, addr netip.AddrPort) []byte {
+    ip := addr.Addr().Unmap()
+    if ip.Is4() {
+        a := ip.As4()
+        b = append(b, socksAtypIPv4)
+        b = append(b, a[:]...)
+    } else {
+        a := ip.As16()
+        b = append(b, socksAtypIPv6)
+        b = append(b, a[:]...)
+    }
+    return append(b, byte(addr.Port() >> 8), byte(addr.Port()))
+}
+
+func socksReply(w io.Writer, code byte, bind netip.AddrPort) error {
+    if !bind.IsValid() {
+        bind = netip.AddrPortFrom(netip.IPv4Unspecified(), 0)
+    }
+    _, err := w.Write(appendSocksAddr([]byte { socksVersion, code, 0 }, bind))
+    return err
+}
+
+//UDP datagrams are sent over streams prefixed by their length
+func writeFrame(w io.Writer, frame []byte) error {
+    b := make([]byte, 2 + len(frame))
+    binary.BigEndian.PutUint16(b, uint16(len(frame)))
+    copy(b[2:], frame)
+    _, err := w.Write(b)
+    return err
+}
+
+func readFrame(r io.Reader) ([]byte, error) {
+    var size [2]byte
+    if _, err := io.ReadFull(r, size[:]); err != nil {
+        return nil, err
+    }
+    frame := make([]byte, binary.BigEndian.Uint16(size[:]))
+    if _, err := io.ReadFull(r, frame); err != nil {
+        return nil, err
+    }
+    return frame, nil
+}
+
+type exitRule struct {
+    any    bool
+    prefix netip.Prefix
+    //exact host name, or a suffix starting with a dot for *.domain rules
+    domain string
+    //0 allows any port
+    port   uint16
+}
+
+//exitPolicy is the allow-list of destinations peers may reach through an exit
+type exitPolicy struct {
+    rules []exitRule
+}
+
+func parseExitPolicy(list string) (*exitPolicy, error) {
+    p := &exitPolicy {}
+    for _, v := range strings.Split(list, ",") {
+        if v = strings.TrimSpace(v); v == "" {
+            continue
+        }
+        rule := exitRule {}
+        host := v
+        if h, port, err := net.SplitHostPort(v); err == nil {
+            n, err := strconv.ParseUint(port, 10, 16)
+            if err != nil || n == 0 {
+                return nil, fmt.Errorf("Invalid port in exit rule '%s'", v)
+            }
+            host = h
+            rule.port = uint16(n)
+        }
+
+        if host == "*" {
+            rule.any = true
+        } else if prefix, err := netip.ParsePrefix(host); err == nil {
+            rule.prefix = prefix.Masked()
+        } else if addr, err := netip.ParseAddr(host); err == nil {
+            rule.prefix = netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen())
+        } else if strings.HasPrefix(host, "*.") {
+            rule.domain = strings.ToLower(host[1:])
+        } else if host != "" {
+            rule.domain = strings.ToLower(host)
+        } else {
+            return nil, fmt.Errorf("Invalid exit rule '%s'", v)
+        }
+        p.rules = append(p.rules, rule)
+    }
+    return p, nil
+}
+
+func (p *exitPolicy) allowName(name string, port uint16) bool {
+    name = strings.ToLower(strings.TrimSuffix(name, "."))
+    for _, r := range p.rules {
+        if r.port != 0 && r.port != port {
+            continue
+        }
+        if r.any {
+            return true
+        }
+        if r.domain == "" {
+            continue
+        }
+        if name == r.domain || (strings.HasPrefix(r.domain, ".") && strings.HasSuffix(name, r.domain)) {
+            return true
+        }
+    }
+    return false
+}
+
+func (p *exitPolicy) allowAddr(addr netip.Addr, port uint16) bool {
+    addr = addr.Unmap()
+    for _, r := range p.rules {
+        if r.port != 0 && r.port != port {
+            continue
+        }
+        if r.any || (r.prefix.IsValid() && r.prefix.Contains(addr)) {
+            return true
+        }
+    }
+    return false
+}
+
+//resolves a destination requested by a peer, checking it against the policy. Names
+//are resolved here so the address that gets dialed is the one that was checked.
+func (p *exitPolicy) resolve(target string) (netip.AddrPort, byte) {
+    host, portStr, err := net.SplitHostPort(target)
+    if err != nil {
+        return netip.AddrPort {}, socksAddressNotSupported
+    }
+    n, err := strconv.ParseUint(portStr, 10, 16)
+    if err != nil {
+        return netip.AddrPort {}, socksAddressNotSupported
+    }
+    port := uint16(n)
+
+    if addr, err := netip.ParseAddr(host); err == nil {
+        if !p.allowAddr(addr, port) {
+            return netip.AddrPort {}, socksNotAllowed
+        }
+        return netip.AddrPortFrom(addr.Unmap(), port), socksSucceeded
+    }
+
+    byName := p.allowName(host, port)
+    ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Second)
+    defer cancel()
+    addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+    if err != nil || len(addrs) == 0 {
+        return netip.AddrPort {}, socksHostUnreachable
+    }
+    for _, addr := range addrs {
+        if byName || p.allowAddr(addr, port) {
+            return netip.AddrPortFrom(addr.Unmap(), port), socksSucceeded
+        }
+    }
+    return netip.AddrPort {}, socksNotAllowed
+}
+
+func dialErrorCode(err error) byte {
+    switch {
+        case errors.Is(err, syscall.ECONNREFUSED):
+            return socksConnectionRefused
+        case errors.Is(err, syscall.ENETUNREACH):
+            return socksNetworkUnreachable
+        default:
+            return socksHostUnreachable
+    }
+}
+
+//socksExit carries the traffic of peers using this client as their exit. Streams
+//start with a single byte holding the SOCKS reply code for the request.
+type socksExit struct {
+    policy *exitPolicy
+}
+
+func newSocksExit(mux *streamMux, allow string) (*socksExit, error) {
+    policy, err := parseExitPolicy(allow)
+    if err != nil {
+        return nil, err
+    }
+    x := &socksExit {
+        policy: policy,
+    }
+    mux.listen("socks-connect", x.onConnect)
+    mux.listen("socks-udp", x.onAssociate)
+    return x, nil
+}
+
+func (x *socksExit) onConnect(st *stream, raw []byte) error {
+    req, err := parseForwardRequest(raw)
+    if err != nil {
+        return err
+    }
+
+    addr, code := x.policy.resolve(req.Target)
+    if code != socksSucceeded {
+        log.Printf("Refused SOCKS connection from %s to %s (code %d)", st.peer, req.Target, code)
+        st.Write([]byte { code })
+        st.Close()
+        return nil
+    }
+
+    conn, err := net.DialTimeout("tcp", addr.String(), 10 * time.Second)
+    if err != nil {
+        log.Printf("SOCKS connection from %s to %s failed: %v", st.peer, req.Target, err)
+        st.Write([]byte { dialErrorCode(err) })
+        st.Close()
+        return nil
+    }
+    log.Printf("Exiting connection from %s to %s", st.peer, req.Target)
+    if _, err := st.Write([]byte { socksSucceeded }); err != nil {
+        conn.Close()
+        return err
+    }
+    go splice(conn.(*net.TCPConn), st)
+    return nil
+}
+
+func (x *socksExit) onAssociate(st *stream, raw []byte) error {
+    conn, err := net.ListenUDP("udp", nil)
+    if err != nil {
+        st.Write([]byte { socksGeneralFailure })
+        st.Close()
+        return nil
+    }
+    if _, err := st.Write([]byte { socksSucceeded }); err != nil {
+        conn.Close()
+        return err
+    }
+    log.Printf("Exiting UDP association from %s through %s", st.peer, conn.LocalAddr())
+
+    var mu sync.Mutex
+    //only destinations the peer sent to may answer
+    contacted := make(map[netip.AddrPort]struct{})
+    targets := newUDPTargets(x.policy.resolve, func(data []byte, addr netip.AddrPort) {
+        mu.Lock()
+        contacted[addr] = struct{}{}
+        mu.Unlock()
+        conn.WriteToUDPAddrPort(data, addr)
+    })
+
+    go func() {
+        defer conn.Close()
+        defer st.Close()
+
+        r := bufio.NewReader(st)
+        for {
+            frame, err := readFrame(r)
+            if err != nil {
+                return
+            }
+            target, data, err := parseSocksAddr(frame)
+            if err != nil {
+                continue
+            }
+            targets.send(target, data)
+        }
+    }()
+    go func() {
+        buf := make([]byte, 65535)
+        for {
+            n, from, err := conn.ReadFromUDPAddrPort(buf)
+            if err != nil {
+                return
+            }
+            from = netip.AddrPortFrom(from.Addr().Unmap(), from.Port())
+            mu.Lock()
+            _, ok := contacted[from]
+            mu.Unlock()
+            if !ok {
+                continue
+            }
+            if err := writeFrame(st, append(appendSocksAddr(nil, from), buf[:n]...)); err != nil {
+                return
+            }
+        }
+    }()
+    return nil
+}
+
+//udpTargets resolves the destinations of a UDP association off its read loop, so a
+//slow lookup doesn't hold up datagrams to other destinations, and remembers the
+//results so datagrams to a name don't each wait for one
+type udpTargets struct {
+    resolve func(target string) (netip.AddrPort, byte)
+    deliver func(data []byte, addr netip.AddrPort)
+
+    mu      sync.Mutex
+    targets map[string]*udpTarget
+}
+
+type udpTarget struct {
+    addr     netip.AddrPort
+    code     byte
+    expires  time.Time
+    //set while the target is being resolved, with the datagrams waiting for it
+    waiting  [][]byte
+    pending  bool
+}
+
+func newUDPTargets(resolve func(string) (netip.AddrPort, byte), deliver func([]byte, netip.AddrPort)) *udpTargets {
+    return &udpTargets {
+        resolve: resolve,
+        deliver: deliver,
+        targets: make(map[string]*udpTarget),
+    }
+}
+
+//delivers data to target once it's resolved, dropping it if the policy refuses the
+//target or too many datagrams are waiting for it
+func (u *udpTargets) send(target string, data []byte) {
+    now := time.Now()
+    u.mu.Lock()
+    t, ok := u.targets[target]
+    if ok && t.pending {
+        if len(t.waiting) < socksUDPQueue {
+            t.waiting = append(t.waiting, data)
+        }
+        u.mu.Unlock()
+        return
+    }
+    if ok && now.Before(t.expires) {
+        u.mu.Unlock()
+        if t.code == socksSucceeded {
+            u.deliver(data, t.addr)
+        }
+        return
+    }
+    if !ok && len(u.targets) >= socksUDPTargets {
+        for k, v := range u.targets {
+            if !v.pending && !now.Before(v.expires) {
+                delete(u.targets, k)
+            }
+        }
+        if len(u.targets) >= socksUDPTargets {
+            u.mu.Unlock()
+            return
+        }
+    }
+    t = &udpTarget {
+        waiting: [][]byte { data },
+        pending: true,
+    }
+    u.targets[target] = t
+    u.mu.Unlock()
+
+    go func() {
+        addr, code := u.resolve(target)
+        u.mu.Lock()
+        waiting := t.waiting
+        t.addr, t.code, t.expires = addr, code, time.Now().Add(socksResolveTTL)
+        t.waiting, t.pending = nil, false
+        u.mu.Unlock()
+        if code != socksSucceeded {
+            return
+        }
+        for _, data := range waiting {
+            u.deliver(data, addr)
+        }
+    }()
+}
+
+//socksProxy is the local SOCKS5 server, sending every request to the exit peer
+type socksProxy struct {
+    mux  *streamMux
+    exit string
+}
+
+func (p *socksProxy) serve(l net.Listener) {
+    for {
+        conn, err := l.Accept()
+        if err != nil {
+            log.Printf("Stopped SOCKS5 proxy on %s: %v", l.Addr(), err)
+            return
+        }
+        go func() {
+            if err := p.handle(conn.(*net.TCPConn)); err != nil {
+                log.Printf("SOCKS5 request from %s failed: %v", conn.RemoteAddr(), err)
+            }
+        }()
+    }
+}
+
+func (p *socksProxy) handle(conn *net.TCPConn) error {
+    conn.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+
+    head := make([]byte, 2)
+    if _, err := io.ReadFull(conn, head); err != nil {
+        conn.Close()
+        return err
+    }
+    if head[0] != socksVersion {
+        conn.Close()
+        return fmt.Errorf("Unsupported SOCKS version %d", head[0])
+    }
+    methods := make([]byte, head[1])
+    if _, err := io.ReadFull(conn, methods); err != nil {
+        conn.Close()
+        return err
+    }
+    noAuth := false
+    for _, m := range methods {
+        noAuth = noAuth || m == 0
+    }
+    if !noAuth {
+        conn.Write([]byte { socksVersion, 0xFF })
+        conn.Close()
+        return fmt.Errorf("No supported authentication method")
+    }
+    if _, err := conn.Write([]byte { socksVersion, 0 }); err != nil {
+        conn.Close()
+        return err
+    }
+
+    req := make([]byte, 3)
+    if _, err := io.ReadFull(conn, req); err != nil {
+        conn.Close()
+        return err
+    }
+    target, err := readSocksAddr(conn)
+    if err == errSocksAddressType {
+        socksReply(conn, socksAddressNotSupported, netip.AddrPort {})
+        conn.Close()
+        return err
+    }
+    if err != nil {
+        conn.Close()
+        return err
+    }
+
+    switch req[1] {
+        case socksCmdConnect:
+            return p.connect(conn, target)
+        case socksCmdUDPAssociate:
+            return p.associate(conn, target)
+        default:
+            socksReply(conn, socksCommandNotSupported, netip.AddrPort {})
+            conn.Close()
+            return fmt.Errorf("Unsupported SOCKS command %d", req[1])
+    }
+}
+
+//opens a stream to the exit and waits for its reply code
+func (p *socksProxy) open(kind, target string) (*stream, byte, error) {
+    st, err := p.mux.open(p.exit, forwardRequest {
+        Kind:   kind,
+        Target: target,
+    })
+    if err != nil {
+        return nil, socksGeneralFailure, err
+    }
+    code := make([]byte, 1)
+    if _, err := io.ReadFull(st, code); err != nil {
+        st.Close()
+        return nil, socksGeneralFailure, err
+    }
+    if code[0] != socksSucceeded {
+        st.Close()
+        return nil, code[0], fmt.Errorf("Exit %s refused %s (code %d)", p.exit, target, code[0])
+    }
+    return st, socksSucceeded, nil
+}
+
+func (p *socksProxy) connect(conn *net.TCPConn, target string) error {
+    st, code, err := p.open("socks-connect", target)
+    if err != nil {
+        socksReply(conn, code, netip.AddrPort {})
+        conn.Close()
+        return err
+    }
+    if err := socksReply(conn, socksSucceeded, netip.AddrPort {}); err != nil {
+        conn.Close()
+        st.Close()
+        return err
+    }
+    conn.SetDeadline(time.Time {})
+    splice(conn, st)
+    return nil
+}
+
+func (p *socksProxy) associate(conn *net.TCPConn, expected string) error {
+    local := conn.LocalAddr().(*net.TCPAddr)
+    relay, err := net.ListenUDP("udp", &net.UDPAddr { IP: local.IP })
+    if err != nil {
+        socksReply(conn, socksGeneralFailure, netip.AddrPort {})
+        conn.Close()
+        return err
+    }
+    st, code, err := p.open("socks-udp", "")
+    if err != nil {
+        socksReply(conn, code, netip.AddrPort {})
+        relay.Close()
+        conn.Close()
+        return err
+    }
+    if err := socksReply(conn, socksSucceeded, relay.LocalAddr().(*net.UDPAddr).AddrPort()); err != nil {
+        relay.Close()
+        conn.Close()
+        st.Close()
+        return err
+    }
+    conn.SetDeadline(time.Time {})
+
+    //datagrams are only accepted from the host that made the request, and from the
+    //port it announced if it did
+    clientIP := conn.RemoteAddr().(*net.TCPAddr).AddrPort().Addr().Unmap()
+    clientPort := uint16(0)
+    if _, port, err := net.SplitHostPort(expected); err == nil {
+        n, _ := strconv.ParseUint(port, 10, 16)
+        clientPort = uint16(n)
+    }
+
+    var mu sync.Mutex
+    var client netip.AddrPort
+
+    go func() {
+        buf := make([]byte, 65535)
+        for {
+            n, from, err := relay.ReadFromUDPAddrPort(buf)
+            if err != nil {
+                return
+            }
+            from = netip.AddrPortFrom(from.Addr().Unmap(), from.Port())
+            if from.Addr() != clientIP || (clientPort != 0 && from.Port() != clientPort) {
+                continue
+            }
+            //RSV and FRAG, fragmented datagrams aren't supported
+            if n < 4 || buf[2] != 0 {
+                continue
+            }
+            mu.Lock()
+            client = from
+            mu.Unlock()
+            if err := writeFrame(st, buf[3:n]); err != nil {
+                return
+            }
+        }
+    }()
+    go func() {
+        r := bufio.NewReader(st)
+        for {
+            frame, err := readFrame(r)
+            if err != nil {
+                return
+            }
+            mu.Lock()
+            to := client
+            mu.Unlock()
+            if to.IsValid() {
+                relay.WriteToUDPAddrPort(append([]byte { 0, 0, 0 }, frame...), to)
+            }
+        }
+    }()
+
+    //the association lasts as long as the TCP connection
+    io.Copy(io.Discard, conn)
+    conn.Close()
+    relay.Close()
+    st.Close()
+    return nil
+}
+
+var socksCommand = &ffcli.Command {
+    Name:       "socks",
+    ShortUsage: "client socks [flags] <topic> <name>",
+    ShortHelp:  "Runs a SOCKS5 proxy whose traffic exits through a peer, or acts as the exit for other peers",
+    LongHelp:   "Runs a SOCKS5 proxy on -listen whose CONNECT and UDP ASSOCIATE requests exit through the peer " +
+                "named by -exit. Peers exiting through this client may only reach the destinations listed in " +
+                "-exit-allow, which defaults to nothing.",
+    FlagSet:    socksFs,
+    Exec:       func(ctx context.Context, args []string) error {
+        if len(args) != 2 {
+            return flag.ErrHelp
+        }
+        topic := args[0]
+        name  := args[1]
+
+        s, err := newSession(ctx, topic, name)
+        if err != nil {
+            return err
+        }
+        defer s.close()
+
+        mux := newStreamMux(s)
+        if _, err := newSocksExit(mux, exitAllow); err != nil {
+            return err
+        }
+
+        if socksExitPeer != "" {
+            l, err := net.Listen("tcp", socksListen)
+            if err != nil {
+                return fmt.Errorf("Unable to listen for SOCKS5 proxy: %w", err)
+            }
+            defer l.Close()
+            log.Printf("SOCKS5 proxy listening on %s, exiting through %s", l.Addr(), socksExitPeer)
+            go (&socksProxy {
+                mux:  mux,
+                exit: socksExitPeer,
+            }).serve(l)
+        }
+
+        return s.run()
+    },
+}
@@ -0,0 +1,168 @@
+package client
+
+import (
+    "net/netip"
+    "sync"
+    "testing"
+    "time"
+)
+
+func TestExitPolicyAllow(t *testing.T) {
+    p, err := parseExitPolicy("example.com:443, *.internal, 10.0.0.0/8, 192.0.2.7:53, 2001:db8::/32")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    names := []struct {
+        name  string
+        port  uint16
+        allow bool
+    } {
+        { "example.com", 443, true },
+        { "EXAMPLE.com.", 443, true },
+        { "example.com", 80, false },
+        { "www.example.com", 443, false },
+        { "db.internal", 5432, true },
+        { "a.b.internal", 1, true },
+        //the suffix rule doesn't cover the domain itself
+        { "internal", 80, false },
+        { "notinternal", 80, false },
+        { "example.org", 443, false },
+    }
+    for _, c := range names {
+        if got := p.allowName(c.name, c.port); got != c.allow {
+            t.Errorf("allowName(%s, %d) = %v", c.name, c.port, got)
+        }
+    }
+
+    addrs := []struct {
+        addr  string
+        port  uint16
+        allow bool
+    } {
+        { "10.1.2.3", 22, true },
+        { "::ffff:10.1.2.3", 22, true },
+        { "11.0.0.1", 22, false },
+        { "192.0.2.7", 53, true },
+        { "192.0.2.7", 54, false },
+        { "192.0.2.8", 53, false },
+        { "2001:db8::1", 80, true },
+        { "2001:db9::1", 80, false },
+    }
+    for _, c := range addrs {
+        if got := p.allowAddr(netip.MustParseAddr(c.addr), c.port); got != c.allow {
+            t.Errorf("allowAddr(%s, %d) = %v", c.addr, c.port, got)
+        }
+    }
+}
+
+func TestExitPolicyRejectsBadRules(t *testing.T) {
+    for _, list := range []string { "example.com:0", "example.com:http", "10.0.0.1:99999" } {
+        if _, err := parseExitPolicy(list); err == nil {
+            t.Errorf("Accepted '%s'", list)
+        }
+    }
+}
+
+func TestExitPolicyResolve(t *testing.T) {
+    cases := []struct {
+        policy string
+        target string
+        code   byte
+        addr   string
+    } {
+        { "10.0.0.0/8", "10.0.0.1:80", socksSucceeded, "10.0.0.1:80" },
+        { "10.0.0.0/8", "[::ffff:10.0.0.1]:80", socksSucceeded, "10.0.0.1:80" },
+        { "10.0.0.0/8", "11.0.0.1:80", socksNotAllowed, "" },
+        { "10.0.0.0/8:443", "10.0.0.1:80", socksNotAllowed, "" },
+        { "10.0.0.0/8", "10.0.0.1", socksAddressNotSupported, "" },
+        { "10.0.0.0/8", "10.0.0.1:port", socksAddressNotSupported, "" },
+        //names are checked against the addresses they resolve to
+        { "127.0.0.0/8,::1", "localhost:80", socksSucceeded, "" },
+        { "10.0.0.0/8", "localhost:80", socksNotAllowed, "" },
+        //and allowed by name whatever they resolve to
+        { "localhost:80", "localhost:80", socksSucceeded, "" },
+        { "localhost:80", "localhost:81", socksNotAllowed, "" },
+    }
+    for _, c := range cases {
+        p, err := parseExitPolicy(c.policy)
+        if err != nil {
+            t.Fatal(err)
+        }
+        addr, code := p.resolve(c.target)
+        if code != c.code {
+            t.Errorf("Resolving %s with '%s' gave code %d instead of %d", c.target, c.policy, code, c.code)
+            continue
+        }
+        if c.addr != "" && addr.String() != c.addr {
+            t.Errorf("Resolved %s to %v instead of %s", c.target, addr, c.addr)
+        }
+        if code == socksSucceeded && !addr.Addr().IsLoopback() && c.addr == "" {
+            t.Errorf("Resolved %s to %v", c.target, addr)
+        }
+    }
+}
+
+//a slow lookup doesn't hold up datagrams to other destinations, and each name is
+//only resolved once
+func TestUDPTargetsResolveOnce(t *testing.T) {
+    slow := make(chan struct{})
+    var mu sync.Mutex
+    lookups := make(map[string]int)
+    delivered := make(chan string, 16)
+
+    u := newUDPTargets(func(target string) (netip.AddrPort, byte) {
+        mu.Lock()
+        lookups[target]++
+        mu.Unlock()
+        switch target {
+            case "slow.example:53":
+                <-slow
+                return netip.MustParseAddrPort("192.0.2.1:53"), socksSucceeded
+            case "denied.example:53":
+                return netip.AddrPort {}, socksNotAllowed
+        }
+        return netip.MustParseAddrPort("192.0.2.2:53"), socksSucceeded
+    }, func(data []byte, addr netip.AddrPort) {
+        delivered <- addr.String() + " " + string(data)
+    })
+
+    u.send("slow.example:53", []byte("1"))
+    u.send("slow.example:53", []byte("2"))
+    u.send("fast.example:53", []byte("3"))
+    select {
+        case got := <-delivered:
+            if got != "192.0.2.2:53 3" {
+                t.Fatalf("Delivered '%s' first", got)
+            }
+        case <-time.After(time.Second):
+            t.Fatal("Datagram waited for another destination's lookup")
+    }
+
+    close(slow)
+    for _, want := range []string { "192.0.2.1:53 1", "192.0.2.1:53 2" } {
+        if got := <-delivered; got != want {
+            t.Fatalf("Delivered '%s' instead of '%s'", got, want)
+        }
+    }
+
+    u.send("slow.example:53", []byte("4"))
+    u.send("denied.example:53", []byte("5"))
+    u.send("denied.example:53", []byte("6"))
+    if got := <-delivered; got != "192.0.2.1:53 4" {
+        t.Fatalf("Delivered '%s'", got)
+    }
+    select {
+        case got := <-delivered:
+            t.Fatalf("Delivered '%s' to a refused destination", got)
+        case <-time.After(50 * time.Millisecond):
+    }
+
+    mu.Lock()
+    defer mu.Unlock()
+    for target, n := range lookups {
+        if n != 1 {
+            t.Errorf("Resolved %s %d times", target, n)
+        }
+    }
+}
@@ -0,0 +1,803 @@
+package client
+
+import (
+    "bytes"
+    "encoding/binary"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "math"
+    "math/rand"
+    "net"
+    "net/netip"
+    "sync"
+    "time"
+)
+
+//reliable, ordered byte streams multiplexed over the punched socket, used by
+//everything that can't live with lost or reordered datagrams
+
+const (
+    segSyn uint8 = 1 << iota
+    segAck
+    segFin
+    segRst
+    //asks the peer for an ack, to tell whether an idle stream is still alive
+    segProbe
+)
+
+const (
+    segHeaderSize     = 15
+    //keeps segments within a 1500 byte MTU after the 128 byte message header
+    streamMSS         = 1200
+    //most segments accepted ahead of the next expected one, fewer are advertised as
+    //the read buffer fills up
+    streamRecvWindow  = 512
+    //segments queued by Write before it blocks
+    streamSendBuffer  = 256
+    //bytes buffered for Read, the window advertised to the peer shrinks as it fills
+    streamReadBuffer  = 4 << 20
+    streamMaxRetries  = 12
+    streamMinRTO      = 200 * time.Millisecond
+    streamMaxRTO      = 10 * time.Second
+    streamOpenTimeout = 15 * time.Second
+    //how long finished streams linger to acknowledge retransmissions
+    streamLinger      = 5 * time.Second
+    //idle streams are probed this often, and fail if the peer stays silent for streamIdleTimeout
+    streamKeepAlive   = 5 * time.Second
+    streamIdleTimeout = 30 * time.Second
+)
+
+var errStreamClosed = errors.New("Stream closed")
+
+type segment struct {
+    id    uint32
+    flags uint8
+    seq   uint32
+    ack   uint32
+    //segments after ack the sender of this one has room for
+    wnd   uint16
+    data  []byte
+}
+
+//the header of the segment, sent followed by its data
+func (s *segment) header() []byte {
+    b := make([]byte, segHeaderSize)
+    binary.BigEndian.PutUint32(b[0:4], s.id)
+    b[4] = s.flags
+    binary.BigEndian.PutUint32(b[5:9], s.seq)
+    binary.BigEndian.PutUint32(b[9:13], s.ack)
+    binary.BigEndian.PutUint16(b[13:15], s.wnd)
+    return b
+}
+
+func decodeSegment(b []byte) (segment, error) {
+    if len(b) < segHeaderSize {
+        return segment {}, fmt.Errorf("Segment too small")
+    }
+    return segment {
+        id:    binary.BigEndian.Uint32(b[0:4]),
+        flags: b[4],
+        seq:   binary.BigEndian.Uint32(b[5:9]),
+        ack:   binary.BigEndian.Uint32(b[9:13]),
+        wnd:   binary.BigEndian.Uint16(b[13:15]),
+        data:  b[segHeaderSize:],
+    }, nil
+}
+
+//whether the segment takes up a sequence number and must be acknowledged
+func (s *segment) occupiesSeq() bool {
+    return s.flags & (segSyn | segFin) != 0 || len(s.data) > 0
+}
+
+//streamRequest is the payload of SYN segments, telling the accepting peer which
+//service the stream is meant for
+type streamRequest struct {
+    Kind string `json:"kind"`
+}
+
+type streamService func(st *stream, req []byte) error
+
+type streamKey struct {
+    addr netip.AddrPort
+    id   uint32
+}
+
+type streamMux struct {
+    s        *session
+    mu       sync.Mutex
+    streams  map[streamKey]*stream
+    services map[string]streamService
+}
+
+func newStreamMux(s *session) *streamMux {
+    m := &streamMux {
+        s:        s,
+        streams:  make(map[streamKey]*stream),
+        services: make(map[string]streamService),
+    }
+    s.handle(magicStream, m.onSegment)
+    return m
+}
+
+//registers the service accepting streams of the given kind. If it returns an
+//error the stream is reset.
+func (m *streamMux) listen(kind string, service streamService) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    m.services[kind] = service
+}
+
+func addrKey(addr *net.UDPAddr) netip.AddrPort {
+    a := addr.AddrPort()
+    return netip.AddrPortFrom(a.Addr().Unmap(), a.Port())
+}
+
+//opens a stream to the named peer, req must be a JSON object with a kind field
+func (m *streamMux) open(peer string, req interface{}) (*stream, error) {
+    addr, ok := m.s.peers.peerAddr(peer)
+    if !ok {
+        return nil, fmt.Errorf("Unknown peer '%s'", peer)
+    }
+    hello, err := json.Marshal(req)
+    if err != nil {
+        return nil, err
+    }
+
+    m.mu.Lock()
+    var st *stream
+    for st == nil {
+        key := streamKey {
+            addr: addrKey(addr),
+            id:   rand.Uint32(),
+        }
+        if _, ok := m.streams[key]; !ok {
+            st = newStream(m, key, addr, peer)
+            m.streams[key] = st
+        }
+    }
+    m.mu.Unlock()
+
+    st.mu.Lock()
+    st.queue(segSyn, hello)
+    deadline := time.Now().Add(streamOpenTimeout)
+    for !st.established && st.err == nil && time.Now().Before(deadline) {
+        st.waitTimeout(time.Until(deadline))
+    }
+    err = st.err
+    if err == nil && !st.established {
+        err = fmt.Errorf("Timed out opening stream to %s", peer)
+    }
+    st.mu.Unlock()
+
+    if err != nil {
+        st.reset(err)
+        return nil, err
+    }
+    return st, nil
+}
+
+func (m *streamMux) remove(st *stream) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    if m.streams[st.key] == st {
+        delete(m.streams, st.key)
+    }
+}
+
+func (m *streamMux) onSegment(data []byte, sender *net.UDPAddr) {
+    seg, err := decodeSegment(data)
+    if err != nil {
+        return
+    }
+    key := streamKey {
+        addr: addrKey(sender),
+        id:   seg.id,
+    }
+
+    m.mu.Lock()
+    st, ok := m.streams[key]
+    if !ok {
+        //streams are only accepted from peers of the topic
+        name := m.s.peers.peerName(sender)
+        if seg.flags & segRst != 0 || name == unknownPeer {
+            m.mu.Unlock()
+            return
+        }
+        if seg.flags & segSyn == 0 || seg.flags & segAck != 0 {
+            m.mu.Unlock()
+            m.sendRaw(sender, segment { id: seg.id, flags: segRst })
+            return
+        }
+        //refused before the SYN is acknowledged, so open fails instead of handing
+        //out a stream that gets reset right away
+        kind, service, err := m.findService(seg.data)
+        if err != nil {
+            m.mu.Unlock()
+            m.sendRaw(sender, segment { id: seg.id, flags: segRst, data: []byte(err.Error()) })
+            return
+        }
+        st = newStream(m, key, sender, name)
+        m.streams[key] = st
+        m.mu.Unlock()
+
+        st.mu.Lock()
+        st.queue(segSyn, nil)
+        st.mu.Unlock()
+        st.onSegment(seg)
+
+        go m.accept(st, kind, service, append([]byte(nil), seg.data...))
+        return
+    }
+    m.mu.Unlock()
+
+    st.onSegment(seg)
+}
+
+//the service for the stream request hello, called with the lock held
+func (m *streamMux) findService(hello []byte) (string, streamService, error) {
+    var req streamRequest
+    if err := json.Unmarshal(hello, &req); err != nil {
+        return "", nil, fmt.Errorf("Malformed stream request: %w", err)
+    }
+    service, ok := m.services[req.Kind]
+    if !ok {
+        return "", nil, fmt.Errorf("No service for streams of kind '%s'", req.Kind)
+    }
+    return req.Kind, service, nil
+}
+
+func (m *streamMux) accept(st *stream, kind string, service streamService, hello []byte) {
+    if err := service(st, hello); err != nil {
+        log.Printf("Rejected %s stream from %s: %v", kind, st.peer, err)
+        st.reset(err)
+    }
+}
+
+func (m *streamMux) sendRaw(addr *net.UDPAddr, seg segment) {
+    m.sendSegments(addr, []segment { seg })
+}
+
+//sends segments at once, which the kernel may split itself if they're of the same size
+func (m *streamMux) sendSegments(addr *net.UDPAddr, segs []segment) {
+    packets := make([]outPacket, len(segs))
+    for i := range segs {
+        packets[i] = outPacket {
+            parts: [][]byte { segs[i].header(), segs[i].data },
+            to:    addr,
+        }
+    }
+    m.s.sendPackets(magicStream, packets)
+}
+
+type outSegment struct {
+    seq     uint32
+    flags   uint8
+    data    []byte
+    sentAt  time.Time
+    retries int
+}
+
+//stream is one side of a reliable connection. Sequence numbers count segments:
+//the SYN takes 0, data segments follow and the FIN takes the last one.
+type stream struct {
+    mux  *streamMux
+    key  streamKey
+    addr *net.UDPAddr
+    peer string
+
+    mu          sync.Mutex
+    cond        *sync.Cond
+
+    nextSeq     uint32
+    unsent      []*outSegment
+    inflight    map[uint32]*outSegment
+    sndUna      uint32
+    //the first sequence number past the window the peer advertised
+    sndEdge     uint32
+    cwnd        float64
+    ssthresh    float64
+    srtt        time.Duration
+    rttvar      time.Duration
+    rto         time.Duration
+    dupAcks     int
+    //segments sent before the last loss, acks below it are partial acks
+    recover     uint32
+    finQueued   bool
+    finAcked    bool
+
+    rcvNext     uint32
+    ooo         map[uint32]segment
+    readBuf     bytes.Buffer
+    //the window last advertised to the peer
+    rcvWnd      uint32
+    established bool
+    peerFin     bool
+    closed      bool
+
+    lastRecv    time.Time
+    lastProbe   time.Time
+
+    err         error
+    done        bool
+
+    stats       streamStats
+}
+
+type streamStats struct {
+    bytesSent     uint64
+    bytesReceived uint64
+    retransmits   uint64
+}
+
+func newStream(m *streamMux, key streamKey, addr *net.UDPAddr, peer string) *stream {
+    st := &stream {
+        mux:      m,
+        key:      key,
+        addr:     addr,
+        peer:     peer,
+        inflight: make(map[uint32]*outSegment),
+        //until the peer advertises its window, it's assumed to have an empty buffer
+        sndEdge:  streamRecvWindow,
+        rcvWnd:   streamRecvWindow,
+        cwnd:     4,
+        ssthresh: streamRecvWindow,
+        rto:      time.Second,
+        ooo:      make(map[uint32]segment),
+        lastRecv: time.Now(),
+    }
+    st.cond = sync.NewCond(&st.mu)
+    go st.timer()
+    return st
+}
+
+//waits on the condition variable, waking up after at most d
+func (st *stream) waitTimeout(d time.Duration) {
+    t := time.AfterFunc(d, func() {
+        st.mu.Lock()
+        st.cond.Broadcast()
+        st.mu.Unlock()
+    })
+    st.cond.Wait()
+    t.Stop()
+}
+
+//queues a segment taking up a sequence number, called with the lock held
+func (st *stream) queue(flags uint8, data []byte) {
+    st.unsent = append(st.unsent, &outSegment {
+        seq:   st.nextSeq,
+        flags: flags,
+        data:  data,
+    })
+    st.nextSeq++
+    st.pump()
+}
+
+//sends queued segments while the congestion window and the peer's receive window
+//allow, called with the lock held
+func (st *stream) pump() {
+    segs := []segment(nil)
+    for len(st.unsent) > 0 && float64(len(st.inflight)) < st.cwnd && st.unsent[0].seq < st.sndEdge {
+        seg := st.unsent[0]
+        st.unsent = st.unsent[1:]
+        st.inflight[seg.seq] = seg
+        segs = append(segs, st.prepare(seg))
+    }
+    if len(segs) > 0 {
+        st.mux.sendSegments(st.addr, segs)
+    }
+    st.cond.Broadcast()
+}
+
+//builds the segment to send for seg, called with the lock held
+func (st *stream) prepare(seg *outSegment) segment {
+    seg.sentAt = time.Now()
+    flags := seg.flags
+    if st.established {
+        flags |= segAck
+    }
+    st.stats.bytesSent += uint64(len(seg.data))
+    return segment {
+        id:    st.key.id,
+        flags: flags,
+        seq:   seg.seq,
+        ack:   st.rcvNext,
+        wnd:   st.advertise(),
+        data:  seg.data,
+    }
+}
+
+//how many segments after rcvNext the read buffer has room for, called with the lock held
+func (st *stream) window() uint32 {
+    free := streamReadBuffer - st.readBuf.Len()
+    if free < 0 {
+        free = 0
+    }
+    w := uint32(free / streamMSS)
+    if w > streamRecvWindow {
+        w = streamRecvWindow
+    }
+    return w
+}
+
+//the window to put in a segment, remembered to tell when it grew enough to be worth
+//an update. Called with the lock held.
+func (st *stream) advertise() uint16 {
+    st.rcvWnd = st.window()
+    return uint16(st.rcvWnd)
+}
+
+func (st *stream) transmit(seg *outSegment) {
+    st.mux.sendRaw(st.addr, st.prepare(seg))
+}
+
+func (st *stream) retransmit(seg *outSegment) {
+    seg.retries++
+    st.stats.retransmits++
+    st.transmit(seg)
+}
+
+func (st *stream) sendAck() {
+    st.mux.sendRaw(st.addr, segment {
+        id:    st.key.id,
+        flags: segAck,
+        seq:   st.nextSeq,
+        ack:   st.rcvNext,
+        wnd:   st.advertise(),
+    })
+}
+
+//asks the peer for an ack, which tells whether the stream is alive and the window it
+//has, called with the lock held
+func (st *stream) sendProbe(now time.Time) {
+    st.lastProbe = now
+    st.mux.sendRaw(st.addr, segment {
+        id:    st.key.id,
+        flags: segAck | segProbe,
+        seq:   st.nextSeq,
+        ack:   st.rcvNext,
+        wnd:   st.advertise(),
+    })
+}
+
+func (st *stream) onSegment(seg segment) {
+    st.mu.Lock()
+    defer st.mu.Unlock()
+
+    if st.done {
+        //the peer missed our last ack
+        if seg.occupiesSeq() {
+            st.sendAck()
+        }
+        return
+    }
+    st.lastRecv = time.Now()
+
+    if seg.flags & segRst != 0 {
+        msg := "Stream reset by peer"
+        if len(seg.data) > 0 {
+            msg = fmt.Sprintf("Stream reset by peer: %s", string(seg.data))
+        }
+        st.fail(errors.New(msg))
+        return
+    }
+
+    if seg.flags & segAck != 0 {
+        st.onAck(seg.ack, uint32(seg.wnd), seg.occupiesSeq())
+    }
+
+    if seg.occupiesSeq() {
+        if seg.seq == st.rcvNext {
+            if !st.deliver(seg) {
+                //out of buffer space, the peer will retransmit later
+                return
+            }
+            for {
+                next, ok := st.ooo[st.rcvNext]
+                if !ok {
+                    break
+                }
+                delete(st.ooo, st.rcvNext)
+                if !st.deliver(next) {
+                    st.ooo[next.seq] = next
+                    break
+                }
+            }
+        } else if seg.seq > st.rcvNext && seg.seq - st.rcvNext < st.window() {
+            data := make([]byte, len(seg.data))
+            copy(data, seg.data)
+            seg.data = data
+            st.ooo[seg.seq] = seg
+        }
+        st.sendAck()
+    } else if seg.flags & segProbe != 0 {
+        st.sendAck()
+    }
+
+    st.checkDone()
+}
+
+//hands an in-order segment to the reader, called with the lock held
+func (st *stream) deliver(seg segment) bool {
+    if st.readBuf.Len() + len(seg.data) > streamReadBuffer {
+        return false
+    }
+    if seg.flags & segSyn != 0 {
+        //the SYN carries the stream request, not stream data
+        st.established = true
+    } else if !st.closed {
+        st.readBuf.Write(seg.data)
+        st.stats.bytesReceived += uint64(len(seg.data))
+    }
+    if seg.flags & segFin != 0 {
+        st.peerFin = true
+    }
+    st.rcvNext++
+    st.cond.Broadcast()
+    return true
+}
+
+func (st *stream) onAck(ack, wnd uint32, carriesData bool) {
+    if ack > st.nextSeq || ack < st.sndUna {
+        return
+    }
+    //the window shrinks as the peer's read buffer fills, and grows as it's read
+    edge := ack + wnd
+    opened := edge > st.sndEdge
+    st.sndEdge = edge
+
+    if ack > st.sndUna {
+        now := time.Now()
+        for seq := st.sndUna; seq < ack; seq++ {
+            seg, ok := st.inflight[seq]
+            if !ok {
+                continue
+            }
+            //Karn's algorithm, retransmitted segments give ambiguous samples
+            if seg.retries == 0 {
+                st.updateRTT(now.Sub(seg.sentAt))
+            }
+            if seg.flags & segFin != 0 {
+                st.finAcked = true
+            }
+            delete(st.inflight, seq)
+
+            if st.cwnd < st.ssthresh {
+                st.cwnd++
+            } else {
+                st.cwnd += 1 / st.cwnd
+            }
+        }
+        //the receiver drops anything beyond its window
+        st.cwnd = math.Min(st.cwnd, streamRecvWindow)
+        st.sndUna = ack
+        st.dupAcks = 0
+        //partial ack while recovering, the next hole was lost too (NewReno)
+        if ack < st.recover {
+            if seg, ok := st.inflight[ack]; ok {
+                st.retransmit(seg)
+            }
+        }
+        st.pump()
+        return
+    }
+
+    if opened {
+        //a window update rather than a duplicate ack
+        st.pump()
+        return
+    }
+    if carriesData || len(st.inflight) == 0 {
+        return
+    }
+    st.dupAcks++
+    if st.dupAcks == 3 {
+        //fast retransmit
+        if seg, ok := st.inflight[st.sndUna]; ok && st.sndUna >= st.recover {
+            st.ssthresh = math.Max(st.cwnd / 2, 2)
+            st.cwnd = st.ssthresh
+            st.recover = st.nextSeq
+            st.retransmit(seg)
+        }
+    }
+}
+
+func (st *stream) updateRTT(sample time.Duration) {
+    if st.srtt == 0 {
+        st.srtt = sample
+        st.rttvar = sample / 2
+    } else {
+        diff := st.srtt - sample
+        if diff < 0 {
+            diff = -diff
+        }
+        st.rttvar = (3 * st.rttvar + diff) / 4
+        st.srtt = (7 * st.srtt + sample) / 8
+    }
+    st.rto = st.srtt + 4 * st.rttvar
+    if st.rto < streamMinRTO {
+        st.rto = streamMinRTO
+    }
+    if st.rto > streamMaxRTO {
+        st.rto = streamMaxRTO
+    }
+}
+
+func (st *stream) timer() {
+    t := time.NewTicker(streamMinRTO / 4)
+    defer t.Stop()
+
+    for range t.C {
+        st.mu.Lock()
+        if st.done {
+            st.mu.Unlock()
+            return
+        }
+
+        now := time.Now()
+        if seg, ok := st.inflight[st.sndUna]; ok && now.Sub(seg.sentAt) > st.rto {
+            if seg.retries >= streamMaxRetries {
+                st.fail(fmt.Errorf("Stream to %s timed out", st.peer))
+                st.mu.Unlock()
+                return
+            }
+            st.ssthresh = math.Max(st.cwnd / 2, 2)
+            st.cwnd = 1
+            st.recover = st.nextSeq
+            st.rto *= 2
+            if st.rto > streamMaxRTO {
+                st.rto = streamMaxRTO
+            }
+            st.retransmit(seg)
+        } else if st.established {
+            idle := now.Sub(st.lastRecv)
+            if idle > streamIdleTimeout {
+                st.fail(fmt.Errorf("Stream to %s timed out", st.peer))
+                st.mu.Unlock()
+                return
+            }
+            //the peer's window closed with data waiting, its update may have been lost
+            stalled := len(st.inflight) == 0 && len(st.unsent) > 0
+            if stalled && now.Sub(st.lastProbe) > st.rto {
+                st.sendProbe(now)
+            } else if idle > streamKeepAlive && now.Sub(st.lastProbe) > streamKeepAlive {
+                st.sendProbe(now)
+            }
+        }
+        st.mu.Unlock()
+    }
+}
+
+//fails the stream locally, called with the lock held
+func (st *stream) fail(err error) {
+    if st.err == nil {
+        st.err = err
+    }
+    st.finish()
+}
+
+//marks the stream as finished, lingering for a while to ack retransmissions
+func (st *stream) finish() {
+    if st.done {
+        return
+    }
+    st.done = true
+    st.cond.Broadcast()
+    time.AfterFunc(streamLinger, func() {
+        st.mux.remove(st)
+    })
+}
+
+func (st *stream) checkDone() {
+    if st.finAcked && st.peerFin {
+        st.finish()
+    }
+}
+
+func (st *stream) Read(b []byte) (int, error) {
+    st.mu.Lock()
+    defer st.mu.Unlock()
+
+    for st.readBuf.Len() == 0 && !st.peerFin && st.err == nil && !st.closed {
+        st.cond.Wait()
+    }
+    if st.readBuf.Len() > 0 {
+        n, err := st.readBuf.Read(b)
+        //tells a peer waiting on a small window that there's room again
+        if w := st.window(); st.rcvWnd < streamRecvWindow / 4 && w >= st.rcvWnd + streamRecvWindow / 4 && !st.done {
+            st.sendAck()
+        }
+        return n, err
+    }
+    if st.err != nil {
+        return 0, st.err
+    }
+    return 0, io.EOF
+}
+
+func (st *stream) Write(b []byte) (int, error) {
+    st.mu.Lock()
+    defer st.mu.Unlock()
+
+    written := 0
+    for len(b) > 0 {
+        for len(st.unsent) >= streamSendBuffer && st.err == nil && !st.finQueued {
+            st.cond.Wait()
+        }
+        if st.err != nil {
+            return written, st.err
+        }
+        if st.finQueued {
+            return written, errStreamClosed
+        }
+
+        n := len(b)
+        if n > streamMSS {
+            n = streamMSS
+        }
+        data := make([]byte, n)
+        copy(data, b[:n])
+        st.queue(0, data)
+        b = b[n:]
+        written += n
+    }
+    return written, nil
+}
+
+//sends a FIN once all written data is delivered, the peer reads EOF after it
+func (st *stream) CloseWrite() error {
+    st.mu.Lock()
+    defer st.mu.Unlock()
+
+    if st.finQueued || st.err != nil {
+        return nil
+    }
+    st.finQueued = true
+    st.queue(segFin, nil)
+    return nil
+}
+
+//closes both directions, discarding any data received afterwards
+func (st *stream) Close() error {
+    st.CloseWrite()
+
+    st.mu.Lock()
+    defer st.mu.Unlock()
+    st.closed = true
+    st.readBuf.Reset()
+    st.cond.Broadcast()
+    return nil
+}
+
+//aborts the stream, telling the peer why
+func (st *stream) reset(reason error) {
+    st.mu.Lock()
+    defer st.mu.Unlock()
+
+    if st.done {
+        return
+    }
+    msg := []byte(nil)
+    if reason != nil {
+        msg = []byte(reason.Error())
+    }
+    st.mux.sendRaw(st.addr, segment {
+        id:    st.key.id,
+        flags: segRst,
+        data:  msg,
+    })
+    st.fail(errStreamClosed)
+}
+
+//waits until everything written was acknowledged, or the stream failed
+func (st *stream) flush() error {
+    st.mu.Lock()
+    defer st.mu.Unlock()
+
+    for (len(st.unsent) > 0 || len(st.inflight) > 0) && st.err == nil {
+        st.cond.Wait()
+    }
+    return st.err
+}
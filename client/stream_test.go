@@ -0,0 +1,91 @@
+package client
+
+import (
+    "bytes"
+    "io"
+    "math/rand"
+    "net"
+    "testing"
+    "time"
+
+    "github.com/natanbc/ssc0904-nat-traversal/netsim"
+)
+
+//stream muxes of two connected peers on the internet, the second accepting streams
+//of kind "test" into the returned channel
+func streamPair(t *testing.T) (*streamMux, *streamMux, chan *stream) {
+    t.Helper()
+    w := newTestWorld(t, netsim.Config { Latency: time.Millisecond })
+    alice := startPeer(t, w.peerHost(nil), "fixed", "alice")
+    bob := startPeer(t, w.peerHost(nil), "fixed", "bob")
+    if !waitConnected(alice, bob, testConnectTimeout) {
+        t.Fatal("Peers didn't connect")
+    }
+    ma, mb := newStreamMux(alice.sessions[0]), newStreamMux(bob.sessions[0])
+    accepted := make(chan *stream, 1)
+    mb.listen("test", func(st *stream, req []byte) error {
+        accepted <- st
+        return nil
+    })
+    return ma, mb, accepted
+}
+
+func TestStreamRespectsReceiveWindow(t *testing.T) {
+    ma, _, accepted := streamPair(t)
+    st, err := ma.open("bob", streamRequest { Kind: "test" })
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer st.Close()
+    peer := <-accepted
+
+    //twice what the receiver buffers, which it doesn't read until it's all sent
+    data := make([]byte, 2 * streamReadBuffer)
+    rand.New(rand.NewSource(1)).Read(data)
+    written := make(chan error, 1)
+    go func() {
+        _, err := st.Write(data)
+        if err == nil {
+            err = st.CloseWrite()
+        }
+        written <- err
+    }()
+
+    //nothing in flight with data waiting: only a closed window holds the sender back
+    deadline := time.Now().Add(5 * time.Second)
+    for {
+        st.mu.Lock()
+        stalled := len(st.inflight) == 0 && len(st.unsent) > 0
+        st.mu.Unlock()
+        if stalled {
+            break
+        }
+        if time.Now().After(deadline) {
+            t.Fatal("Sender never waited for the receiver's window")
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+
+    got, err := io.ReadAll(peer)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := <-written; err != nil {
+        t.Fatal(err)
+    }
+    if !bytes.Equal(got, data) {
+        t.Fatalf("Received %d bytes different from the %d sent", len(got), len(data))
+    }
+}
+
+func TestStreamIgnoresUnknownSender(t *testing.T) {
+    _, mb, _ := streamPair(t)
+    syn := segment { id: 1, flags: segSyn, data: []byte(`{"kind":"test"}`) }
+    mb.onSegment(append(syn.header(), syn.data...), &net.UDPAddr { IP: net.IPv4(203, 0, 113, 99), Port: 1234 })
+
+    mb.mu.Lock()
+    defer mb.mu.Unlock()
+    if len(mb.streams) != 0 {
+        t.Fatal("Accepted a stream from a sender that isn't a peer")
+    }
+}
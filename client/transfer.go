@@ -0,0 +1,483 @@
+package client
+
+import (
+    "bufio"
+    "context"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "flag"
+    "fmt"
+    "io"
+    "log"
+    "os"
+    "path/filepath"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "github.com/peterbourgon/ff/v3/ffcli"
+)
+
+//files are sent over streams, which take care of reliability and congestion control.
+//The receiver keeps partially received files so an interrupted transfer can resume
+//from where it stopped.
+
+var (
+    senderName     string
+    receiveDir     string
+    acceptAllFiles bool
+)
+
+var sendFileFs = (func() *flag.FlagSet {
+    fs := flag.NewFlagSet("send-file", flag.ExitOnError)
+    addSessionFlags(fs)
+    fs.StringVar(&senderName, "name", defaultSenderName(), "Name to join the topic with")
+    return fs
+})()
+
+var receiveFilesFs = (func() *flag.FlagSet {
+    fs := flag.NewFlagSet("receive-files", flag.ExitOnError)
+    addSessionFlags(fs)
+    fs.StringVar(&receiveDir,   "dir", ".",   "Directory received files are saved to")
+    fs.BoolVar(&acceptAllFiles, "yes", false, "Accept every offer without asking")
+    return fs
+})()
+
+func defaultSenderName() string {
+    host, err := os.Hostname()
+    if err != nil {
+        return "sender"
+    }
+    return host
+}
+
+const (
+    fileChunkSize        = 64 * 1024
+    fileProgressInterval = time.Second
+)
+
+type fileOffer struct {
+    Kind   string `json:"kind"`
+    Name   string `json:"name"`
+    Size   int64  `json:"size"`
+    SHA256 string `json:"sha256"`
+}
+
+//fileAnswer is sent by the receiver when it decides on an offer, then again with
+//Done set once the whole file was received and checked
+type fileAnswer struct {
+    Accept bool   `json:"accept"`
+    Offset int64  `json:"offset,omitempty"`
+    Done   bool   `json:"done,omitempty"`
+    Error  string `json:"error,omitempty"`
+}
+
+//progress periodically logs how far a transfer got
+type progress struct {
+    label string
+    total int64
+    done  int64
+    start time.Time
+    stop  chan struct{}
+}
+
+func newProgress(label string, total, done int64) *progress {
+    p := &progress {
+        label: label,
+        total: total,
+        done:  done,
+        start: time.Now(),
+        stop:  make(chan struct{}),
+    }
+    go func() {
+        t := time.NewTicker(fileProgressInterval)
+        defer t.Stop()
+        for {
+            select {
+                case <-t.C:
+                    p.report()
+                case <-p.stop:
+                    return
+            }
+        }
+    }()
+    return p
+}
+
+func (p *progress) Write(b []byte) (int, error) {
+    atomic.AddInt64(&p.done, int64(len(b)))
+    return len(b), nil
+}
+
+func (p *progress) report() {
+    done := atomic.LoadInt64(&p.done)
+    percent := 100.0
+    if p.total > 0 {
+        percent = float64(done) * 100 / float64(p.total)
+    }
+    rate := float64(done) / time.Since(p.start).Seconds()
+    log.Printf("%s: %d/%d bytes (%.1f%%, %.1f KiB/s)", p.label, done, p.total, percent, rate / 1024)
+}
+
+func (p *progress) finish() {
+    close(p.stop)
+    p.report()
+}
+
+func hashFile(path string) (string, int64, error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return "", 0, err
+    }
+    defer f.Close()
+
+    h := sha256.New()
+    n, err := io.Copy(h, f)
+    if err != nil {
+        return "", 0, err
+    }
+    return hex.EncodeToString(h.Sum(nil)), n, nil
+}
+
+func sendFile(mux *streamMux, peer, path string) error {
+    hash, size, err := hashFile(path)
+    if err != nil {
+        return err
+    }
+    f, err := os.Open(path)
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+
+    offer := fileOffer {
+        Kind:   "file",
+        Name:   filepath.Base(path),
+        Size:   size,
+        SHA256: hash,
+    }
+    log.Printf("Offering %s (%d bytes, sha256 %s) to %s", offer.Name, size, hash, peer)
+    st, err := mux.open(peer, offer)
+    if err != nil {
+        return err
+    }
+    defer st.Close()
+
+    dec := json.NewDecoder(st)
+    var answer fileAnswer
+    if err := dec.Decode(&answer); err != nil {
+        return fmt.Errorf("No answer from %s: %w", peer, err)
+    }
+    if !answer.Accept {
+        return fmt.Errorf("%s rejected the file: %s", peer, answer.Error)
+    }
+    if answer.Offset < 0 || answer.Offset > size {
+        return fmt.Errorf("%s asked to resume from invalid offset %d", peer, answer.Offset)
+    }
+    if answer.Offset > 0 {
+        log.Printf("Resuming from byte %d", answer.Offset)
+    }
+    if _, err := f.Seek(answer.Offset, io.SeekStart); err != nil {
+        return err
+    }
+
+    p := newProgress("Sent " + offer.Name, size, answer.Offset)
+    _, err = io.CopyBuffer(io.MultiWriter(st, p), f, make([]byte, fileChunkSize))
+    p.finish()
+    if err != nil {
+        return err
+    }
+    st.CloseWrite()
+
+    if err := dec.Decode(&answer); err != nil {
+        return fmt.Errorf("No confirmation from %s: %w", peer, err)
+    }
+    if !answer.Done {
+        return fmt.Errorf("%s failed to receive the file: %s", peer, answer.Error)
+    }
+    log.Printf("%s received %s", peer, offer.Name)
+    return st.flush()
+}
+
+//fileReceiver saves the files offered by peers
+type fileReceiver struct {
+    dir    string
+    all    bool
+
+    //offers are asked about one at a time
+    mu     sync.Mutex
+    input  *bufio.Reader
+
+    activeMu sync.Mutex
+    //transfers in progress by partial file, closed once they stop using it
+    active   map[string]*activeTransfer
+}
+
+type activeTransfer struct {
+    st   *stream
+    done chan struct{}
+}
+
+func newFileReceiver(mux *streamMux, dir string, all bool) *fileReceiver {
+    r := &fileReceiver {
+        dir:    dir,
+        all:    all,
+        input:  bufio.NewReader(os.Stdin),
+        active: make(map[string]*activeTransfer),
+    }
+    mux.listen("file", r.onOffer)
+    return r
+}
+
+func (r *fileReceiver) ask(peer string, offer fileOffer) bool {
+    if r.all {
+        return true
+    }
+    r.mu.Lock()
+    defer r.mu.Unlock()
+
+    fmt.Fprintf(os.Stderr, "Accept %s (%d bytes) from %s? [y/N] ", offer.Name, offer.Size, peer)
+    line, err := r.input.ReadString('\n')
+    if err != nil {
+        return false
+    }
+    line = strings.ToLower(strings.TrimSpace(line))
+    return line == "y" || line == "yes"
+}
+
+//partial files are named after their hash, so resuming never mixes different contents
+func (r *fileReceiver) partPath(offer fileOffer) string {
+    return filepath.Join(r.dir, "." + offer.Name + "." + offer.SHA256[:16] + ".part")
+}
+
+//finds a name that doesn't overwrite an existing file
+func (r *fileReceiver) finalPath(name string) string {
+    path := filepath.Join(r.dir, name)
+    ext := filepath.Ext(name)
+    for i := 1; ; i++ {
+        if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+            return path
+        }
+        path = filepath.Join(r.dir, fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(name, ext), i, ext))
+    }
+}
+
+//takes over a partial file, a new offer for a file still being received means the
+//sender restarted, so the old transfer is aborted
+func (r *fileReceiver) claim(part string, st *stream) *activeTransfer {
+    t := &activeTransfer {
+        st:   st,
+        done: make(chan struct{}),
+    }
+    for {
+        r.activeMu.Lock()
+        old, ok := r.active[part]
+        if !ok {
+            r.active[part] = t
+            r.activeMu.Unlock()
+            return t
+        }
+        r.activeMu.Unlock()
+
+        old.st.reset(fmt.Errorf("Superseded by a new offer"))
+        <-old.done
+    }
+}
+
+func (r *fileReceiver) release(part string, t *activeTransfer) {
+    r.activeMu.Lock()
+    if r.active[part] == t {
+        delete(r.active, part)
+    }
+    r.activeMu.Unlock()
+    close(t.done)
+}
+
+func answer(st *stream, a fileAnswer) error {
+    b, err := json.Marshal(a)
+    if err != nil {
+        return err
+    }
+    _, err = st.Write(append(b, '\n'))
+    return err
+}
+
+func (r *fileReceiver) onOffer(st *stream, raw []byte) error {
+    var offer fileOffer
+    if err := json.Unmarshal(raw, &offer); err != nil {
+        return err
+    }
+    if _, err := hex.DecodeString(offer.SHA256); err != nil || len(offer.SHA256) != 64 {
+        return fmt.Errorf("Invalid hash in offer")
+    }
+    if offer.Size < 0 {
+        return fmt.Errorf("Invalid size in offer")
+    }
+    if offer.Name != filepath.Base(offer.Name) || offer.Name == "." || offer.Name == ".." || offer.Name == string(filepath.Separator) {
+        return fmt.Errorf("Invalid file name '%s'", offer.Name)
+    }
+
+    if !r.ask(st.peer, offer) {
+        log.Printf("Rejected %s from %s", offer.Name, st.peer)
+        answer(st, fileAnswer { Error: "Rejected by the receiver" })
+        st.Close()
+        return nil
+    }
+
+    part := r.partPath(offer)
+    transfer := r.claim(part, st)
+    //the receiving goroutine releases the part once started, until then every error
+    //must, or the next offer for it waits forever
+    var f *os.File
+    started := false
+    defer func() {
+        if started {
+            return
+        }
+        if f != nil {
+            f.Close()
+        }
+        r.release(part, transfer)
+    }()
+
+    f, err := os.OpenFile(part, os.O_RDWR | os.O_CREATE, 0644)
+    if err != nil {
+        return err
+    }
+    offset, err := f.Seek(0, io.SeekEnd)
+    if err != nil {
+        return err
+    }
+    if offset > offer.Size {
+        offset = 0
+        if err := f.Truncate(0); err != nil {
+            return err
+        }
+        if _, err := f.Seek(0, io.SeekStart); err != nil {
+            return err
+        }
+    }
+    if offset > 0 {
+        log.Printf("Resuming %s from %s at byte %d", offer.Name, st.peer, offset)
+    } else {
+        log.Printf("Receiving %s (%d bytes) from %s", offer.Name, offer.Size, st.peer)
+    }
+    if err := answer(st, fileAnswer { Accept: true, Offset: offset }); err != nil {
+        return err
+    }
+
+    started = true
+    go func() {
+        defer st.Close()
+        defer r.release(part, transfer)
+        err := r.receive(st, f, offer, offset)
+        f.Close()
+        if err != nil {
+            log.Printf("Failed to receive %s from %s: %v", offer.Name, st.peer, err)
+            answer(st, fileAnswer { Accept: true, Error: err.Error() })
+            return
+        }
+
+        path := r.finalPath(offer.Name)
+        if err := os.Rename(part, path); err != nil {
+            answer(st, fileAnswer { Accept: true, Error: err.Error() })
+            return
+        }
+        log.Printf("Saved %s from %s to %s", offer.Name, st.peer, path)
+        answer(st, fileAnswer { Accept: true, Done: true })
+        st.flush()
+    }()
+    return nil
+}
+
+func (r *fileReceiver) receive(st *stream, f *os.File, offer fileOffer, offset int64) error {
+    p := newProgress("Received " + offer.Name, offer.Size, offset)
+    //the partial file is kept if the stream fails, so the sender can resume it
+    _, err := io.CopyBuffer(io.MultiWriter(f, p), io.LimitReader(st, offer.Size - offset), make([]byte, fileChunkSize))
+    p.finish()
+    if err != nil {
+        return err
+    }
+    if err := f.Sync(); err != nil {
+        return err
+    }
+
+    if _, err := f.Seek(0, io.SeekStart); err != nil {
+        return err
+    }
+    h := sha256.New()
+    n, err := io.Copy(h, f)
+    if err != nil {
+        return err
+    }
+    if n != offer.Size || hex.EncodeToString(h.Sum(nil)) != offer.SHA256 {
+        //corrupted, start over next time
+        f.Truncate(0)
+        return fmt.Errorf("Hash mismatch, got %d bytes", n)
+    }
+    return nil
+}
+
+var sendFileCommand = &ffcli.Command {
+    Name:       "send-file",
+    ShortUsage: "client send-file [flags] <topic> <peer> <path>",
+    ShortHelp:  "Sends a file to a peer running receive-files, resuming interrupted transfers",
+    FlagSet:    sendFileFs,
+    Exec:       func(ctx context.Context, args []string) error {
+        if len(args) != 3 {
+            return flag.ErrHelp
+        }
+        topic := args[0]
+        peer  := args[1]
+        path  := args[2]
+
+        s, err := newSession(ctx, topic, senderName)
+        if err != nil {
+            return err
+        }
+        defer s.close()
+
+        mux := newStreamMux(s)
+        errs := make(chan error, 2)
+        go func() { errs <- s.run() }()
+        go func() {
+            log.Printf("Waiting for %s", peer)
+            if !s.peers.waitForPeer(ctx, peer) {
+                errs <- ctx.Err()
+                return
+            }
+            errs <- sendFile(mux, peer, path)
+        }()
+        return <-errs
+    },
+}
+
+var receiveFilesCommand = &ffcli.Command {
+    Name:       "receive-files",
+    ShortUsage: "client receive-files [flags] <topic> <name>",
+    ShortHelp:  "Receives files sent by peers with send-file",
+    FlagSet:    receiveFilesFs,
+    Exec:       func(ctx context.Context, args []string) error {
+        if len(args) != 2 {
+            return flag.ErrHelp
+        }
+        topic := args[0]
+        name  := args[1]
+
+        if err := os.MkdirAll(receiveDir, 0755); err != nil {
+            return err
+        }
+
+        s, err := newSession(ctx, topic, name)
+        if err != nil {
+            return err
+        }
+        defer s.close()
+
+        newFileReceiver(newStreamMux(s), receiveDir, acceptAllFiles)
+        return s.run()
+    },
+}
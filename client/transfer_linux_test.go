@@ -0,0 +1,39 @@
+package client
+
+import (
+    "encoding/json"
+    "strings"
+    "syscall"
+    "testing"
+)
+
+func TestOfferReleasesPartOnError(t *testing.T) {
+    r := &fileReceiver {
+        dir:    t.TempDir(),
+        all:    true,
+        active: make(map[string]*activeTransfer),
+    }
+    offer := fileOffer {
+        Kind:   "file",
+        Name:   "data.bin",
+        Size:   10,
+        SHA256: strings.Repeat("ab", 32),
+    }
+    //opens fine but can't seek, failing after the part is claimed
+    if err := syscall.Mkfifo(r.partPath(offer), 0644); err != nil {
+        t.Fatal(err)
+    }
+    raw, err := json.Marshal(offer)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if err := r.onOffer(&stream { peer: "bob" }, raw); err == nil {
+        t.Fatal("Accepted an offer for a part that can't be seeked")
+    }
+    r.activeMu.Lock()
+    defer r.activeMu.Unlock()
+    if len(r.active) != 0 {
+        t.Fatal("Part still claimed after the offer failed")
+    }
+}
@@ -0,0 +1,157 @@
+package client
+
+import (
+    "bytes"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "math/rand"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+//a stream mux of alice connected to bob, and the receiver of bob saving every file
+//offered into its directory
+func transferPair(t *testing.T) (*streamMux, *fileReceiver) {
+    t.Helper()
+    ma, mb, _ := streamPair(t)
+    return ma, newFileReceiver(mb, t.TempDir(), true)
+}
+
+func testFile(t *testing.T, size int) (string, []byte) {
+    t.Helper()
+    data := make([]byte, size)
+    rand.New(rand.NewSource(int64(size))).Read(data)
+    path := filepath.Join(t.TempDir(), "data.bin")
+    if err := os.WriteFile(path, data, 0644); err != nil {
+        t.Fatal(err)
+    }
+    return path, data
+}
+
+func offerFor(data []byte) fileOffer {
+    h := sha256.Sum256(data)
+    return fileOffer {
+        Kind:   "file",
+        Name:   "data.bin",
+        Size:   int64(len(data)),
+        SHA256: hex.EncodeToString(h[:]),
+    }
+}
+
+func checkReceived(t *testing.T, r *fileReceiver, data []byte) {
+    t.Helper()
+    got, err := os.ReadFile(filepath.Join(r.dir, "data.bin"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !bytes.Equal(got, data) {
+        t.Fatalf("Received %d bytes different from the %d sent", len(got), len(data))
+    }
+    if _, err := os.Stat(r.partPath(offerFor(data))); !os.IsNotExist(err) {
+        t.Fatalf("Partial file left behind: %v", err)
+    }
+}
+
+func TestTransferRoundTrip(t *testing.T) {
+    ma, r := transferPair(t)
+    path, data := testFile(t, 3 * fileChunkSize + 123)
+
+    if err := sendFile(ma, "bob", path); err != nil {
+        t.Fatal(err)
+    }
+    checkReceived(t, r, data)
+}
+
+//offers data to bob by hand, sending what bob asks for from the offset it answers,
+//returning that offset and bob's final answer
+func offerRaw(t *testing.T, ma *streamMux, offer fileOffer, data []byte) (int64, fileAnswer) {
+    t.Helper()
+    st, err := ma.open("bob", offer)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer st.Close()
+    dec := json.NewDecoder(st)
+
+    var a fileAnswer
+    if err := dec.Decode(&a); err != nil {
+        t.Fatal(err)
+    }
+    if !a.Accept {
+        t.Fatalf("Offer rejected: %s", a.Error)
+    }
+    offset := a.Offset
+    if _, err := st.Write(data[offset:]); err != nil {
+        t.Fatal(err)
+    }
+    st.CloseWrite()
+    if err := dec.Decode(&a); err != nil {
+        t.Fatal(err)
+    }
+    return offset, a
+}
+
+//a partial file left by an interrupted transfer is resumed from where it stopped
+func TestTransferResumesPartialFile(t *testing.T) {
+    ma, r := transferPair(t)
+    _, data := testFile(t, 2 * fileChunkSize)
+    offer := offerFor(data)
+
+    half := len(data) / 2
+    if err := os.WriteFile(r.partPath(offer), data[:half], 0644); err != nil {
+        t.Fatal(err)
+    }
+    offset, a := offerRaw(t, ma, offer, data)
+    if offset != int64(half) {
+        t.Fatalf("Resumed from byte %d instead of %d", offset, half)
+    }
+    if !a.Done {
+        t.Fatalf("Transfer failed: %s", a.Error)
+    }
+    checkReceived(t, r, data)
+}
+
+//a partial file that doesn't match the offer is thrown away instead of being saved
+func TestTransferRejectsCorruptPartialFile(t *testing.T) {
+    ma, r := transferPair(t)
+    _, data := testFile(t, 2 * fileChunkSize)
+    offer := offerFor(data)
+    part := r.partPath(offer)
+
+    //the right size for the offset, wrong contents
+    corrupt := append([]byte(nil), data[:fileChunkSize]...)
+    corrupt[0] ^= 0xFF
+    if err := os.WriteFile(part, corrupt, 0644); err != nil {
+        t.Fatal(err)
+    }
+    _, a := offerRaw(t, ma, offer, data)
+    if a.Done || !strings.Contains(a.Error, "Hash mismatch") {
+        t.Fatalf("Saved a file built on a corrupt part, answer %+v", a)
+    }
+    if _, err := os.Stat(filepath.Join(r.dir, "data.bin")); !os.IsNotExist(err) {
+        t.Fatal("Corrupt file saved")
+    }
+
+    //the sender retrying starts over
+    offset, a := offerRaw(t, ma, offer, data)
+    if offset != 0 || !a.Done {
+        t.Fatalf("Retry resumed from byte %d, answer %+v", offset, a)
+    }
+    checkReceived(t, r, data)
+
+    //and a part larger than the file can't be resumed either
+    if err := os.WriteFile(part, append(data, 0), 0644); err != nil {
+        t.Fatal(err)
+    }
+    if err := os.Remove(filepath.Join(r.dir, "data.bin")); err != nil {
+        t.Fatal(err)
+    }
+    offset, a = offerRaw(t, ma, offer, data)
+    if offset != 0 || !a.Done {
+        t.Fatalf("Oversized part resumed from byte %d, answer %+v", offset, a)
+    }
+    checkReceived(t, r, data)
+}
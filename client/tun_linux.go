@@ -0,0 +1,64 @@
+//go:build linux
+
+package client
+
+import (
+    "fmt"
+    "net/netip"
+    "os"
+    "os/exec"
+    "strings"
+    "syscall"
+    "unsafe"
+)
+
+const (
+    tunSetIff = 0x400454ca
+    iffTun    = 0x0001
+    iffNoPi   = 0x1000
+)
+
+type linuxTun struct {
+    *os.File
+    name string
+}
+
+func (t *linuxTun) Name() string {
+    return t.name
+}
+
+//creates a TUN interface, name may contain %d to let the kernel pick a number
+func openTun(name string) (tunDevice, error) {
+    f, err := os.OpenFile("/dev/net/tun", os.O_RDWR, 0)
+    if err != nil {
+        return nil, fmt.Errorf("Unable to open /dev/net/tun: %w", err)
+    }
+
+    //struct ifreq: 16 byte name followed by the flags
+    var req [40]byte
+    copy(req[:15], name)
+    *(*uint16)(unsafe.Pointer(&req[16])) = iffTun | iffNoPi
+
+    if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), tunSetIff, uintptr(unsafe.Pointer(&req[0]))); errno != 0 {
+        f.Close()
+        return nil, fmt.Errorf("Unable to create TUN interface: %w", errno)
+    }
+
+    return &linuxTun {
+        File: f,
+        name: strings.TrimRight(string(req[:16]), "\x00"),
+    }, nil
+}
+
+func configureTun(dev tunDevice, addr netip.Prefix, mtu int) error {
+    cmds := [][]string {
+        { "ip", "addr", "add", addr.String(), "dev", dev.Name() },
+        { "ip", "link", "set", "dev", dev.Name(), "mtu", fmt.Sprintf("%d", mtu), "up" },
+    }
+    for _, c := range cmds {
+        if out, err := exec.Command(c[0], c[1:]...).CombinedOutput(); err != nil {
+            return fmt.Errorf("'%s' failed: %w: %s", strings.Join(c, " "), err, strings.TrimSpace(string(out)))
+        }
+    }
+    return nil
+}
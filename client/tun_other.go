@@ -0,0 +1,16 @@
+//go:build !linux
+
+package client
+
+import (
+    "fmt"
+    "net/netip"
+)
+
+func openTun(name string) (tunDevice, error) {
+    return nil, fmt.Errorf("TUN devices are only supported on linux")
+}
+
+func configureTun(dev tunDevice, addr netip.Prefix, mtu int) error {
+    return fmt.Errorf("TUN devices are only supported on linux")
+}
@@ -0,0 +1,312 @@
+package client
+
+import (
+    "context"
+    "crypto/sha256"
+    "encoding/binary"
+    "flag"
+    "fmt"
+    "io"
+    "log"
+    "net"
+    "net/netip"
+    "sync"
+
+    "github.com/natanbc/ssc0904-nat-traversal/coord"
+
+    "github.com/peterbourgon/ff/v3/ffcli"
+)
+
+//room for the 128 byte header within a 1500 byte ethernet MTU, rounded down to
+//the minimum IPv6 MTU so the interface stays usable if IPv6 is added later
+const vpnMTU = 1280
+
+type tunDevice interface {
+    io.ReadWriteCloser
+    Name() string
+}
+
+var (
+    vpnNetwork string
+    tunName    string
+)
+
+var vpnFs = (func() *flag.FlagSet {
+    fs := flag.NewFlagSet("vpn", flag.ExitOnError)
+    addSessionFlags(fs)
+    fs.StringVar(&vpnNetwork, "vpn-net", "10.77.0.0/16", "Overlay network peer addresses are allocated from")
+    fs.StringVar(&tunName,    "tun",     "natvpn%d",     "Name of the TUN interface to create")
+    return fs
+})()
+
+//derives the overlay address of a peer from the public key its checks are signed
+//with, so a name can't be registered to take over the address of another peer
+func overlayAddr(prefix netip.Prefix, topic, key string) netip.Addr {
+    h := sha256.Sum256([]byte(topic + "/" + key))
+
+    base := prefix.Masked().Addr().As4()
+    hostMask := uint32(1) << (32 - prefix.Bits()) - 1
+    host := binary.BigEndian.Uint32(h[:4]) & hostMask
+    //skip the network and broadcast addresses
+    if host == 0 || host == hostMask {
+        host ^= 1
+    }
+
+    var res [4]byte
+    binary.BigEndian.PutUint32(res[:], binary.BigEndian.Uint32(base[:]) | host)
+    return netip.AddrFrom4(res)
+}
+
+func ipv4Addr(b []byte) netip.Addr {
+    var a [4]byte
+    copy(a[:], b)
+    return netip.AddrFrom4(a)
+}
+
+//vpn routes IPv4 packets between a TUN device and the peers of a topic. Keys can
+//hash to the same overlay address, and since one can be generated to collide with
+//any address nobody owns an address derived from several keys: it's neither routed
+//to nor accepted packets from.
+type vpn struct {
+    s        *session
+    dev      tunDevice
+    prefix   netip.Prefix
+    self     netip.Addr
+    //receives an error once a peer takes our address
+    conflict chan error
+
+    mu       sync.Mutex
+    //peers known to the registry, kept up to date from its events
+    members  map[netip.AddrPort]coord.Peer
+    //overlay address of each peer by name
+    addrs    map[string]netip.Addr
+    //name owning each overlay address, empty if it's contested
+    owners   map[netip.Addr]string
+    //where packets to each owned address are sent
+    routes   map[netip.Addr][]*net.UDPAddr
+    //contested addresses, already logged
+    shadowed map[netip.Addr]struct{}
+}
+
+func newVPN(s *session, dev tunDevice, prefix netip.Prefix) *vpn {
+    v := &vpn {
+        s:        s,
+        dev:      dev,
+        prefix:   prefix,
+        self:     overlayAddr(prefix, s.topic, s.host.publicKey),
+        conflict: make(chan error, 1),
+        members:  make(map[netip.AddrPort]coord.Peer),
+        addrs:    make(map[string]netip.Addr),
+        owners:   make(map[netip.Addr]string),
+        routes:   make(map[netip.Addr][]*net.UDPAddr),
+        shadowed: make(map[netip.Addr]struct{}),
+    }
+    s.handle(magicIPv4, v.onPacket)
+    s.peers.subscribe(func(e peerEvent) {
+        switch e.kind {
+            case peerJoined:
+                v.mu.Lock()
+                v.members[e.peer.IPPort()] = e.peer
+                v.mu.Unlock()
+            case peerLeft:
+                v.mu.Lock()
+                delete(v.members, e.peer.IPPort())
+                v.mu.Unlock()
+            default:
+                return
+        }
+        v.rebuild()
+    })
+    return v
+}
+
+//recomputes who owns each overlay address after the peers changed
+func (v *vpn) rebuild() {
+    v.mu.Lock()
+    defer v.mu.Unlock()
+
+    self := v.s.getName()
+    //keys by overlay address, ours included
+    keys := map[netip.Addr]map[string]struct{} {
+        v.self: { v.s.host.publicKey: {} },
+    }
+    addrs := make(map[string]netip.Addr)
+    for _, peer := range v.members {
+        if peer.PublicKey == "" || peer.Name == self {
+            continue
+        }
+        a := overlayAddr(v.prefix, v.s.topic, peer.PublicKey)
+        addrs[peer.Name] = a
+        if keys[a] == nil {
+            keys[a] = make(map[string]struct{})
+        }
+        keys[a][peer.PublicKey] = struct{}{}
+    }
+
+    owners := make(map[netip.Addr]string)
+    routes := make(map[netip.Addr][]*net.UDPAddr)
+    for name, a := range addrs {
+        if len(keys[a]) > 1 {
+            owners[a] = ""
+            continue
+        }
+        owners[a] = name
+    }
+    for _, peer := range v.members {
+        a, ok := addrs[peer.Name]
+        if !ok || owners[a] != peer.Name {
+            continue
+        }
+        routes[a] = append(routes[a], &net.UDPAddr {
+            IP:   peer.IP,
+            Port: int(peer.Port),
+        })
+    }
+    v.addrs, v.owners, v.routes = addrs, owners, routes
+
+    for a, k := range keys {
+        if len(k) < 2 {
+            delete(v.shadowed, a)
+            continue
+        }
+        if a == v.self {
+            select {
+                case v.conflict <- fmt.Errorf("Another peer has our overlay address %v, rejoin to get a new key", a):
+                default:
+            }
+        }
+        if _, logged := v.shadowed[a]; !logged {
+            v.shadowed[a] = struct{}{}
+            log.Printf("Overlay address %v is derived from %d keys, ignoring it", a, len(k))
+        }
+    }
+}
+
+//the name owning addr, empty if nobody or several peers do
+func (v *vpn) owner(addr netip.Addr) string {
+    v.mu.Lock()
+    defer v.mu.Unlock()
+    return v.owners[addr]
+}
+
+func (v *vpn) route(dst netip.Addr) []*net.UDPAddr {
+    v.mu.Lock()
+    defer v.mu.Unlock()
+
+    if dst != v.broadcastAddr() {
+        return v.routes[dst]
+    }
+    res := []*net.UDPAddr(nil)
+    for _, r := range v.routes {
+        res = append(res, r...)
+    }
+    return res
+}
+
+func (v *vpn) broadcastAddr() netip.Addr {
+    base := v.prefix.Masked().Addr().As4()
+    hostMask := uint32(1) << (32 - v.prefix.Bits()) - 1
+
+    var res [4]byte
+    binary.BigEndian.PutUint32(res[:], binary.BigEndian.Uint32(base[:]) | hostMask)
+    return netip.AddrFrom4(res)
+}
+
+//reads packets from the TUN device and sends them to the peers owning their destination
+func (v *vpn) run() error {
+    buf := make([]byte, 65536)
+    for {
+        n, err := v.dev.Read(buf)
+        if err != nil {
+            return fmt.Errorf("Failed to read from TUN device: %w", err)
+        }
+        packet := buf[:n]
+
+        if len(packet) < 20 || packet[0] >> 4 != 4 {
+            continue
+        }
+        dst := ipv4Addr(packet[16:20])
+        if dst == v.self || !v.prefix.Contains(dst) {
+            continue
+        }
+
+        if err := v.s.sendAll(magicIPv4, packet, v.route(dst)); err != nil {
+            log.Printf("Failed to send packet to %v: %v", dst, err)
+        }
+    }
+}
+
+func (v *vpn) onPacket(packet []byte, sender *net.UDPAddr) {
+    if len(packet) < 20 || packet[0] >> 4 != 4 {
+        return
+    }
+
+    name := v.s.peers.peerName(sender)
+    if name == unknownPeer {
+        return
+    }
+    //peers may only send packets from their own overlay address
+    src := ipv4Addr(packet[12:16])
+    v.mu.Lock()
+    addr, known := v.addrs[name]
+    owner := v.owners[src]
+    v.mu.Unlock()
+    if !known || src != addr {
+        log.Printf("Dropping packet from %s (aka %s) with spoofed source %v", sender.String(), name, src)
+        return
+    }
+    if owner != name {
+        return
+    }
+
+    if _, err := v.dev.Write(packet); err != nil {
+        log.Printf("Failed to write to TUN device: %v", err)
+    }
+}
+
+var vpnCommand = &ffcli.Command {
+    Name:       "vpn",
+    ShortUsage: "client vpn [flags] <topic> <name>",
+    ShortHelp:  "Joins a topic as a layer 3 VPN, routing IP packets to peers through a TUN interface",
+    FlagSet:    vpnFs,
+    Exec:       func(ctx context.Context, args []string) error {
+        if len(args) != 2 {
+            return flag.ErrHelp
+        }
+        topic := args[0]
+        name  := args[1]
+
+        prefix, err := netip.ParsePrefix(vpnNetwork)
+        if err != nil || !prefix.Addr().Is4() || prefix.Bits() > 30 {
+            return fmt.Errorf("Invalid overlay network '%s'", vpnNetwork)
+        }
+
+        dev, err := openTun(tunName)
+        if err != nil {
+            return err
+        }
+        defer dev.Close()
+
+        s, err := newSession(ctx, topic, name)
+        if err != nil {
+            return err
+        }
+        defer s.close()
+
+        v := newVPN(s, dev, prefix)
+        if err := configureTun(dev, netip.PrefixFrom(v.self, prefix.Bits()), vpnMTU); err != nil {
+            return err
+        }
+        log.Printf("Interface %s has overlay address %v", dev.Name(), v.self)
+
+        errs := make(chan error, 2)
+        go func() { errs <- v.run() }()
+        go func() { errs <- s.run() }()
+        select {
+            case err := <-errs:
+                return err
+            case err := <-v.conflict:
+                return err
+        }
+    },
+}
@@ -0,0 +1,203 @@
+package client
+
+import (
+    "encoding/binary"
+    "encoding/hex"
+    "io"
+    "net"
+    "net/netip"
+    "sync"
+    "testing"
+    "time"
+
+    "github.com/natanbc/ssc0904-nat-traversal/coord"
+    "github.com/natanbc/ssc0904-nat-traversal/netsim"
+)
+
+//fakeTun hands the packets written to in to the VPN, and the ones the VPN writes to out
+type fakeTun struct {
+    in     chan []byte
+    out    chan []byte
+    closed chan struct{}
+    once   sync.Once
+}
+
+func newFakeTun() *fakeTun {
+    return &fakeTun {
+        in:     make(chan []byte),
+        out:    make(chan []byte, 16),
+        closed: make(chan struct{}),
+    }
+}
+
+func (t *fakeTun) Read(b []byte) (int, error) {
+    select {
+        case p := <-t.in:
+            return copy(b, p), nil
+        case <-t.closed:
+            return 0, io.EOF
+    }
+}
+
+func (t *fakeTun) Write(b []byte) (int, error) {
+    select {
+        case t.out <- append([]byte(nil), b...):
+            return len(b), nil
+        case <-t.closed:
+            return 0, io.ErrClosedPipe
+    }
+}
+
+func (t *fakeTun) Close() error {
+    t.once.Do(func() {
+        close(t.closed)
+    })
+    return nil
+}
+
+func (t *fakeTun) Name() string {
+    return "fake0"
+}
+
+//a minimal IPv4 header from src to dst followed by payload
+func ipv4Packet(src, dst netip.Addr, payload string) []byte {
+    p := make([]byte, 20 + len(payload))
+    p[0] = 0x45
+    p[8] = 64
+    p[9] = 17
+    s, d := src.As4(), dst.As4()
+    copy(p[12:16], s[:])
+    copy(p[16:20], d[:])
+    copy(p[20:], payload)
+    return p
+}
+
+type testVPN struct {
+    *vpn
+    tun *fakeTun
+}
+
+//runs a VPN on a fake TUN device for h, stopped when the test ends
+func startVPN(t *testing.T, h *host, prefix netip.Prefix) testVPN {
+    t.Helper()
+    tun := newFakeTun()
+    v := newVPN(h.sessions[0], tun, prefix)
+    t.Cleanup(func() {
+        tun.Close()
+    })
+    go v.run()
+    return testVPN { vpn: v, tun: tun }
+}
+
+//the payload of the next packet v writes to its device, empty if none is within timeout
+func (v testVPN) received(timeout time.Duration) string {
+    select {
+        case p := <-v.tun.out:
+            return string(p[20:])
+        case <-time.After(timeout):
+            return ""
+    }
+}
+
+//two peers on the internet running VPNs on prefix, connected to each other
+func vpnPair(t *testing.T, prefix netip.Prefix, a, b string) (testVPN, testVPN) {
+    t.Helper()
+    w := newTestWorld(t, netsim.Config { Latency: time.Millisecond })
+    ha := startPeer(t, w.peerHost(nil), "fixed", a)
+    hb := startPeer(t, w.peerHost(nil), "fixed", b)
+    va, vb := startVPN(t, ha, prefix), startVPN(t, hb, prefix)
+    if !waitConnected(ha, hb, testConnectTimeout) {
+        t.Fatalf("%s and %s didn't connect", a, b)
+    }
+    return va, vb
+}
+
+var testPrefix = netip.MustParsePrefix("10.77.0.0/16")
+
+func TestVPNRoutes(t *testing.T) {
+    alice, bob := vpnPair(t, testPrefix, "alice", "bob")
+
+    alice.tun.in <- ipv4Packet(alice.self, bob.self, "unicast")
+    if p := bob.received(time.Second); p != "unicast" {
+        t.Fatalf("Bob received %q instead of the packet to bob", p)
+    }
+    bob.tun.in <- ipv4Packet(bob.self, netip.MustParseAddr("10.77.255.255"), "broadcast")
+    if p := alice.received(time.Second); p != "broadcast" {
+        t.Fatalf("Alice received %q instead of the broadcast", p)
+    }
+    //addresses of nobody and outside the overlay aren't sent anywhere
+    alice.tun.in <- ipv4Packet(alice.self, netip.MustParseAddr("10.78.0.1"), "outside")
+    if p := bob.received(100 * time.Millisecond); p != "" {
+        t.Fatalf("Bob received %q sent outside the overlay", p)
+    }
+}
+
+func TestVPNDropsSpoofedSource(t *testing.T) {
+    alice, bob := vpnPair(t, testPrefix, "alice", "bob")
+
+    spoofed := netip.MustParseAddr("10.77.1.1")
+    if spoofed == bob.self {
+        spoofed = netip.MustParseAddr("10.77.1.2")
+    }
+    bob.tun.in <- ipv4Packet(spoofed, alice.self, "spoofed")
+    bob.tun.in <- ipv4Packet(bob.self, alice.self, "genuine")
+    if p := alice.received(time.Second); p != "genuine" {
+        t.Fatalf("Alice received %q instead of the packet from bob's address", p)
+    }
+}
+
+//a public key deriving the overlay address addr in the network
+func collidingKey(t *testing.T, network netip.Prefix, addr netip.Addr) string {
+    t.Helper()
+    key := make([]byte, 32)
+    for i := 0; i < 1 << 24; i++ {
+        binary.BigEndian.PutUint32(key, uint32(i))
+        if k := hex.EncodeToString(key); overlayAddr(network, testTopic, k) == addr {
+            return k
+        }
+    }
+    t.Fatalf("No key derives %v", addr)
+    return ""
+}
+
+//makes v's registry list a peer named name with key
+func injectPeer(v testVPN, name, key string) {
+    v.s.peers.updatePeers("test", []coord.Peer { {
+        Name:      name,
+        IP:        net.IPv4(203, 0, 113, 99).To4(),
+        Port:      9999,
+        PublicKey: key,
+    } })
+}
+
+//addresses come from keys, so names don't matter, and an address derived from another
+//key too belongs to nobody instead of whoever generated the colliding key
+func TestVPNAddressCollision(t *testing.T) {
+    alice, bob := vpnPair(t, testPrefix, "alice", "bob")
+    if alice.self == bob.self {
+        t.Skip("The keys of alice and bob collide")
+    }
+    if owner := bob.owner(alice.self); owner != "alice" {
+        t.Fatalf("Bob has alice's address owned by '%s'", owner)
+    }
+
+    injectPeer(bob, "mallory", collidingKey(t, testPrefix, alice.self))
+    if owner := bob.owner(alice.self); owner != "" {
+        t.Fatalf("Contested address is owned by '%s'", owner)
+    }
+    bob.tun.in <- ipv4Packet(bob.self, alice.self, "contested")
+    if p := alice.received(100 * time.Millisecond); p != "" {
+        t.Fatalf("Alice received %q sent to a contested address", p)
+    }
+    if len(bob.route(alice.self)) != 0 {
+        t.Fatal("Bob routes a contested address")
+    }
+
+    //a peer learning its own address is contested asks to rejoin with a new key
+    injectPeer(alice, "mallory", collidingKey(t, testPrefix, alice.self))
+    select {
+        case <-alice.conflict:
+        case <-time.After(time.Second):
+            t.Fatal("Alice kept a contested address")
+    }
+}
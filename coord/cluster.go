@@ -0,0 +1,475 @@
+package coord
+
+import (
+    "crypto/subtle"
+    "errors"
+    "fmt"
+    "log"
+    "net/http"
+    "sync"
+    "time"
+
+    "github.com/gorilla/websocket"
+)
+
+//ClusterUpdate is a snapshot of the peers of a topic connected to a single node.
+//Updates are idempotent, so receivers only need to keep the one with the highest
+//sequence number for each (node, topic) pair.
+type ClusterUpdate struct {
+    //federation partner the members are connected to, empty for our own nodes
+    Server string `json:"server,omitempty"`
+    Node   string `json:"node"`
+    Seq    uint64 `json:"seq"`
+    Topic  string `json:"topic"`
+    Peers  []Peer `json:"peers"`
+}
+
+//the node that sent the update, qualified by its server for federated members since
+//node IDs are only unique within a server
+func (u ClusterUpdate) origin() string {
+    if u.Server == "" {
+        return u.Node
+    }
+    return u.Server + "/" + u.Node
+}
+
+//Broker distributes membership updates between coordination nodes
+type Broker interface {
+    //must not block, updates may be dropped since nodes periodically resend everything
+    Publish(update ClusterUpdate)
+    //brokers have a single subscriber, the node's cluster
+    Subscribe(handler func(ClusterUpdate)) error
+    //closed once the broker is closed
+    Done() <-chan struct{}
+    Close() error
+}
+
+var (
+    errBrokerSubscribed = errors.New("Broker already has a subscriber")
+    errBrokerClosed     = errors.New("Broker is closed")
+)
+
+//MemoryHub connects brokers living in the same process, standing in for a real
+//network between nodes
+type MemoryHub struct {
+    mu      sync.Mutex
+    brokers []*memoryBroker
+}
+
+func NewMemoryHub() *MemoryHub {
+    return &MemoryHub {}
+}
+
+func (h *MemoryHub) Broker() Broker {
+    b := &memoryBroker {
+        hub:     h,
+        updates: make(chan ClusterUpdate, 256),
+        done:    make(chan struct{}),
+    }
+
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    h.brokers = append(h.brokers, b)
+    return b
+}
+
+type memoryBroker struct {
+    hub     *MemoryHub
+    mu      sync.Mutex
+    handler func(ClusterUpdate)
+    updates chan ClusterUpdate
+    done    chan struct{}
+    closed  bool
+}
+
+func (b *memoryBroker) Publish(update ClusterUpdate) {
+    b.mu.Lock()
+    closed := b.closed
+    b.mu.Unlock()
+    if closed {
+        return
+    }
+
+    b.hub.mu.Lock()
+    defer b.hub.mu.Unlock()
+
+    for _, other := range b.hub.brokers {
+        if other == b {
+            continue
+        }
+        other.deliver(update)
+    }
+}
+
+func (b *memoryBroker) deliver(update ClusterUpdate) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    if b.closed {
+        return
+    }
+    select {
+        case b.updates <- update:
+        default:
+    }
+}
+
+func (b *memoryBroker) Subscribe(handler func(ClusterUpdate)) error {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    if b.closed {
+        return errBrokerClosed
+    }
+    if b.handler != nil {
+        return errBrokerSubscribed
+    }
+    b.handler = handler
+
+    go func() {
+        for u := range b.updates {
+            handler(u)
+        }
+    }()
+    return nil
+}
+
+func (b *memoryBroker) Done() <-chan struct{} {
+    return b.done
+}
+
+func (b *memoryBroker) Close() error {
+    b.hub.mu.Lock()
+    for i, other := range b.hub.brokers {
+        if other == b {
+            b.hub.brokers = append(b.hub.brokers[:i], b.hub.brokers[i + 1:]...)
+            break
+        }
+    }
+    b.hub.mu.Unlock()
+
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    if !b.closed {
+        b.closed = true
+        close(b.updates)
+        close(b.done)
+    }
+    return nil
+}
+
+//WebsocketBroker keeps a websocket link to every configured node, authenticated
+//with a shared secret. Links are bidirectional, so it's enough for one side of each
+//pair of nodes to list the other. Updates are relayed to the other links the first
+//time they're seen, so nodes only need to be connected through each other instead of
+//all being linked together.
+type WebsocketBroker struct {
+    secret  string
+    mu      sync.Mutex
+    handler func(ClusterUpdate)
+    links   map[*clusterLink]struct{}
+    //highest sequence number seen from each node for each topic, so every update is
+    //relayed once and copies coming back through other links are dropped
+    seen    map[string]map[string]uint64
+    done    chan struct{}
+    closed  bool
+}
+
+type clusterLink struct {
+    ws   *websocket.Conn
+    send chan ClusterUpdate
+}
+
+func NewWebsocketBroker(secret string, peers []string) *WebsocketBroker {
+    b := &WebsocketBroker {
+        secret: secret,
+        links:  make(map[*clusterLink]struct{}),
+        seen:   make(map[string]map[string]uint64),
+        done:   make(chan struct{}),
+    }
+    for _, peer := range peers {
+        go b.dialLoop(peer)
+    }
+    return b
+}
+
+func (b *WebsocketBroker) Publish(update ClusterUpdate) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    b.markSeen(update)
+    b.sendExcept(nil, update)
+}
+
+//whether the update wasn't seen before, remembering it. mu must be held.
+func (b *WebsocketBroker) markSeen(u ClusterUpdate) bool {
+    topics, ok := b.seen[u.origin()]
+    if !ok {
+        topics = make(map[string]uint64)
+        b.seen[u.origin()] = topics
+    }
+    if u.Seq <= topics[u.Topic] {
+        return false
+    }
+    topics[u.Topic] = u.Seq
+    return true
+}
+
+//queues the update on every link but from, mu must be held
+func (b *WebsocketBroker) sendExcept(from *clusterLink, u ClusterUpdate) {
+    for l := range b.links {
+        if l == from {
+            continue
+        }
+        select {
+            case l.send <- u:
+            default:
+        }
+    }
+}
+
+func (b *WebsocketBroker) Subscribe(handler func(ClusterUpdate)) error {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    if b.closed {
+        return errBrokerClosed
+    }
+    if b.handler != nil {
+        return errBrokerSubscribed
+    }
+    b.handler = handler
+    return nil
+}
+
+func (b *WebsocketBroker) Done() <-chan struct{} {
+    return b.done
+}
+
+func (b *WebsocketBroker) Close() error {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    if b.closed {
+        return nil
+    }
+    b.closed = true
+    close(b.done)
+    for l := range b.links {
+        l.ws.Close()
+    }
+    return nil
+}
+
+func (b *WebsocketBroker) isClosed() bool {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    return b.closed
+}
+
+//ServeHTTP accepts links from other nodes
+func (b *WebsocketBroker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer " + b.secret)) != 1 {
+        http.Error(w, "Invalid cluster secret", 401)
+        return
+    }
+
+    upgrader := websocket.Upgrader{}
+    ws, err := upgrader.Upgrade(w, r, nil)
+    if err != nil {
+        return
+    }
+    b.runLink(ws)
+}
+
+func (b *WebsocketBroker) dialLoop(url string) {
+    header := http.Header {}
+    header.Set("Authorization", "Bearer " + b.secret)
+
+    for !b.isClosed() {
+        ws, _, err := websocket.DefaultDialer.Dial(url, header)
+        if err != nil {
+            log.Printf("Unable to connect to cluster node %s: %v", url, err)
+        } else {
+            log.Printf("Connected to cluster node %s", url)
+            b.runLink(ws)
+            log.Printf("Lost connection to cluster node %s", url)
+        }
+        select {
+            case <-time.After(5 * time.Second):
+            case <-b.done:
+                return
+        }
+    }
+}
+
+func (b *WebsocketBroker) runLink(ws *websocket.Conn) {
+    l := &clusterLink {
+        ws:   ws,
+        send: make(chan ClusterUpdate, 256),
+    }
+
+    b.mu.Lock()
+    if b.closed {
+        b.mu.Unlock()
+        ws.Close()
+        return
+    }
+    b.links[l] = struct{}{}
+    b.mu.Unlock()
+
+    defer func() {
+        b.mu.Lock()
+        delete(b.links, l)
+        b.mu.Unlock()
+        ws.Close()
+    }()
+
+    done := make(chan struct{})
+    defer close(done)
+    go func() {
+        for {
+            select {
+                case <-done:
+                    return
+                case u := <-l.send:
+                    if err := ws.WriteJSON(u); err != nil {
+                        ws.Close()
+                        return
+                    }
+            }
+        }
+    }()
+
+    for {
+        var u ClusterUpdate
+        if err := ws.ReadJSON(&u); err != nil {
+            return
+        }
+
+        b.mu.Lock()
+        fresh := b.markSeen(u)
+        if fresh {
+            b.sendExcept(l, u)
+        }
+        handler := b.handler
+        b.mu.Unlock()
+        if fresh && handler != nil {
+            handler(u)
+        }
+    }
+}
+
+//cluster glues a broker to the local state, publishing local membership and
+//applying membership from other nodes
+type cluster struct {
+    node     string
+    broker   Broker
+    interval time.Duration
+    mu       sync.Mutex
+    seq      uint64
+    //last sequence number applied for each node and topic
+    applied  map[string]map[string]uint64
+}
+
+func newCluster(node string, broker Broker, interval time.Duration) (*cluster, error) {
+    if node == "" {
+        return nil, fmt.Errorf("Cluster node ID must not be empty")
+    }
+    if interval <= 0 {
+        return nil, fmt.Errorf("Cluster sync interval must be positive")
+    }
+    return &cluster {
+        node:     node,
+        broker:   broker,
+        interval: interval,
+        //start from the clock so a restarted node isn't ignored by the others
+        seq:      uint64(time.Now().UnixNano()),
+        applied:  make(map[string]map[string]uint64),
+    }, nil
+}
+
+//called with the topic lock held, so sequence numbers follow the order of changes.
+//Returns the update sent, which federation reuses so partners see one sequence per node.
+func (c *cluster) publish(topic string, peers []Peer) ClusterUpdate {
+    c.mu.Lock()
+    c.seq++
+    u := ClusterUpdate {
+        Node:  c.node,
+        Seq:   c.seq,
+        Topic: topic,
+        Peers: peers,
+    }
+    c.mu.Unlock()
+
+    c.broker.Publish(u)
+    return u
+}
+
+//passes members received from a federation partner on to the other nodes, which may
+//not be linked to that partner
+func (c *cluster) relay(u ClusterUpdate) {
+    c.broker.Publish(u)
+}
+
+func (c *cluster) shouldApply(u ClusterUpdate) bool {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    if u.Server == "" && u.Node == c.node {
+        return false
+    }
+    topics, ok := c.applied[u.origin()]
+    if !ok {
+        topics = make(map[string]uint64)
+        c.applied[u.origin()] = topics
+    }
+    if u.Seq <= topics[u.Topic] {
+        return false
+    }
+    topics[u.Topic] = u.Seq
+    return true
+}
+
+//subscribes to the broker and resends local membership every interval until the
+//broker is closed
+func (c *cluster) start(s *state) error {
+    err := c.broker.Subscribe(func(u ClusterUpdate) {
+        if u.Server != "" {
+            //federated members, which the federation keeps track of
+            if s.federation != nil {
+                s.federation.fromCluster(u)
+            }
+            return
+        }
+        if !c.shouldApply(u) {
+            return
+        }
+        //remote entries expire if the node stops resending them
+        s.topic(u.Topic).setRemote(u.Node, u.Peers, time.Now().Add(3 * c.interval))
+        if s.federation != nil {
+            s.federation.fromCluster(u)
+        }
+    })
+    if err != nil {
+        return fmt.Errorf("Unable to subscribe to cluster updates: %w", err)
+    }
+    go c.sync(s)
+    return nil
+}
+
+func (c *cluster) sync(s *state) {
+    t := time.NewTicker(c.interval)
+    defer t.Stop()
+
+    for {
+        select {
+            case <-t.C:
+            case <-c.broker.Done():
+                return
+        }
+        for _, topic := range s.topicList() {
+            topic.publishLocal()
+        }
+    }
+}
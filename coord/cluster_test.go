@@ -0,0 +1,285 @@
+package coord
+
+import (
+    "net"
+    "net/http/httptest"
+    "sort"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+)
+
+const testSync = 20 * time.Millisecond
+
+func newTestNode(t *testing.T, hub *MemoryHub, id string) (*state, Broker) {
+    t.Helper()
+    broker := hub.Broker()
+    c, err := newCluster(id, broker, testSync)
+    if err != nil {
+        t.Fatal(err)
+    }
+    s := &state {
+        cluster: c,
+    }
+    if err := c.start(s); err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() {
+        broker.Close()
+    })
+    return s, broker
+}
+
+//polls cond until it holds, failing the test after a few seconds
+func eventually(t *testing.T, what string, cond func() bool) {
+    t.Helper()
+    deadline := time.Now().Add(5 * time.Second)
+    for !cond() {
+        if time.Now().After(deadline) {
+            t.Fatalf("Timed out waiting for %s", what)
+        }
+        time.Sleep(5 * time.Millisecond)
+    }
+}
+
+func peerNames(s *state, topic string) string {
+    names := []string(nil)
+    for _, p := range s.topic(topic).getPeerList() {
+        names = append(names, p.Name)
+    }
+    sort.Strings(names)
+    return strings.Join(names, ",")
+}
+
+func register(t *testing.T, s *state, topic, name string) chan struct{} {
+    t.Helper()
+    ch, err := s.topic(topic).tryRegister(name, net.IPv4(192, 0, 2, 1).To4(), 1234, "", nil, "")
+    if err != nil {
+        t.Fatalf("Unable to register %s: %v", name, err)
+    }
+    return ch
+}
+
+func TestClusterSharesMembership(t *testing.T) {
+    hub := NewMemoryHub()
+    a, _ := newTestNode(t, hub, "a")
+    b, _ := newTestNode(t, hub, "b")
+    c, _ := newTestNode(t, hub, "c")
+
+    alice := register(t, a, "t1", "alice")
+    register(t, b, "t1", "bob")
+
+    for _, s := range []*state { a, b, c } {
+        eventually(t, "every node to list both peers", func() bool {
+            return peerNames(s, "t1") == "alice,bob"
+        })
+    }
+
+    a.topic("t1").unregister("alice", alice)
+    for _, s := range []*state { a, b, c } {
+        eventually(t, "every node to drop alice", func() bool {
+            return peerNames(s, "t1") == "bob"
+        })
+    }
+}
+
+func TestClusterRejectsNameTakenOnOtherNode(t *testing.T) {
+    hub := NewMemoryHub()
+    a, _ := newTestNode(t, hub, "a")
+    b, _ := newTestNode(t, hub, "b")
+
+    register(t, a, "t1", "alice")
+    eventually(t, "b to list alice", func() bool {
+        return peerNames(b, "t1") == "alice"
+    })
+    if _, err := b.topic("t1").tryRegister("alice", net.IPv4(192, 0, 2, 2).To4(), 1234, "", nil, ""); err == nil {
+        t.Fatal("Registered a name connected to another node")
+    }
+}
+
+func TestClusterDropsSilentNode(t *testing.T) {
+    hub := NewMemoryHub()
+    a, broker := newTestNode(t, hub, "a")
+    b, _ := newTestNode(t, hub, "b")
+
+    register(t, a, "t1", "alice")
+    eventually(t, "b to list alice", func() bool {
+        return peerNames(b, "t1") == "alice"
+    })
+
+    broker.Close()
+    eventually(t, "b to drop the peers of a", func() bool {
+        b.evictStale(time.Minute)
+        return peerNames(b, "t1") == ""
+    })
+}
+
+func TestClusterIgnoresOldUpdates(t *testing.T) {
+    c, err := newCluster("a", NewMemoryHub().Broker(), testSync)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if !c.shouldApply(ClusterUpdate { Node: "b", Seq: 10, Topic: "t1" }) {
+        t.Fatal("First update was ignored")
+    }
+    if c.shouldApply(ClusterUpdate { Node: "b", Seq: 9, Topic: "t1" }) {
+        t.Fatal("Applied an update older than the last one")
+    }
+    if !c.shouldApply(ClusterUpdate { Node: "b", Seq: 9, Topic: "t2" }) {
+        t.Fatal("Sequence numbers leaked between topics")
+    }
+    if c.shouldApply(ClusterUpdate { Node: "a", Seq: 100, Topic: "t1" }) {
+        t.Fatal("Applied our own update")
+    }
+}
+
+//counts the updates a broker hands to its subscriber
+type updateCounter struct {
+    mu     sync.Mutex
+    counts map[uint64]int
+}
+
+func subscribeCounter(t *testing.T, b Broker) *updateCounter {
+    t.Helper()
+    c := &updateCounter { counts: make(map[uint64]int) }
+    if err := b.Subscribe(func(u ClusterUpdate) {
+        c.mu.Lock()
+        defer c.mu.Unlock()
+        c.counts[u.Seq]++
+    }); err != nil {
+        t.Fatal(err)
+    }
+    return c
+}
+
+func (c *updateCounter) count(seq uint64) int {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return c.counts[seq]
+}
+
+func (b *WebsocketBroker) linkCount() int {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    return len(b.links)
+}
+
+func serveBroker(t *testing.T, b *WebsocketBroker) string {
+    t.Helper()
+    srv := httptest.NewServer(b)
+    t.Cleanup(srv.Close)
+    t.Cleanup(func() {
+        b.Close()
+    })
+    return "ws" + strings.TrimPrefix(srv.URL, "http") + "/cluster"
+}
+
+func TestWebsocketBrokerRelays(t *testing.T) {
+    //a - b - c, a and c only reach each other through b
+    c := NewWebsocketBroker("secret", nil)
+    cURL := serveBroker(t, c)
+    b := NewWebsocketBroker("secret", []string { cURL })
+    bURL := serveBroker(t, b)
+    a := NewWebsocketBroker("secret", []string { bURL })
+    t.Cleanup(func() {
+        a.Close()
+    })
+
+    aCount, cCount := subscribeCounter(t, a), subscribeCounter(t, c)
+    eventually(t, "the links to come up", func() bool {
+        return a.linkCount() == 1 && b.linkCount() == 2 && c.linkCount() == 1
+    })
+
+    a.Publish(ClusterUpdate { Node: "a", Seq: 1, Topic: "t1" })
+    eventually(t, "c to receive the update of a", func() bool {
+        return cCount.count(1) == 1
+    })
+    c.Publish(ClusterUpdate { Node: "c", Seq: 2, Topic: "t1" })
+    eventually(t, "a to receive the update of c", func() bool {
+        return aCount.count(2) == 1
+    })
+    if n := aCount.count(1); n != 0 {
+        t.Fatalf("a received its own update %d times", n)
+    }
+}
+
+func TestWebsocketBrokerDropsDuplicates(t *testing.T) {
+    //every node linked to every other, so each update arrives through two links
+    c := NewWebsocketBroker("secret", nil)
+    cURL := serveBroker(t, c)
+    b := NewWebsocketBroker("secret", []string { cURL })
+    bURL := serveBroker(t, b)
+    a := NewWebsocketBroker("secret", []string { bURL, cURL })
+    t.Cleanup(func() {
+        a.Close()
+    })
+
+    bCount, cCount := subscribeCounter(t, b), subscribeCounter(t, c)
+    eventually(t, "the links to come up", func() bool {
+        return a.linkCount() == 2 && b.linkCount() == 2 && c.linkCount() == 2
+    })
+
+    a.Publish(ClusterUpdate { Node: "a", Seq: 1, Topic: "t1" })
+    eventually(t, "b and c to receive the update", func() bool {
+        return bCount.count(1) > 0 && cCount.count(1) > 0
+    })
+    //gives the relayed copies time to arrive
+    time.Sleep(100 * time.Millisecond)
+    if bCount.count(1) != 1 || cCount.count(1) != 1 {
+        t.Fatalf("Update delivered %d times to b and %d times to c", bCount.count(1), cCount.count(1))
+    }
+}
+
+func TestWebsocketBrokerRejectsWrongSecret(t *testing.T) {
+    b := NewWebsocketBroker("secret", nil)
+    bURL := serveBroker(t, b)
+    a := NewWebsocketBroker("wrong", []string { bURL })
+    t.Cleanup(func() {
+        a.Close()
+    })
+
+    time.Sleep(100 * time.Millisecond)
+    if n := b.linkCount(); n != 0 {
+        t.Fatalf("Accepted %d links with the wrong secret", n)
+    }
+}
+
+func TestBrokerSingleSubscriber(t *testing.T) {
+    brokers := []Broker { NewMemoryHub().Broker(), NewWebsocketBroker("secret", nil) }
+    for _, b := range brokers {
+        if err := b.Subscribe(func(ClusterUpdate) {}); err != nil {
+            t.Fatal(err)
+        }
+        if err := b.Subscribe(func(ClusterUpdate) {}); err != errBrokerSubscribed {
+            t.Fatalf("Second subscriber got %v", err)
+        }
+        b.Close()
+    }
+}
+
+//the periodic resend stops once the broker is closed
+func TestClusterStopsWithBroker(t *testing.T) {
+    broker := NewMemoryHub().Broker()
+    c, err := newCluster("a", broker, testSync)
+    if err != nil {
+        t.Fatal(err)
+    }
+    s := &state { cluster: c }
+    register(t, s, "t1", "alice")
+
+    stopped := make(chan struct{})
+    go func() {
+        defer close(stopped)
+        c.sync(s)
+    }()
+
+    time.Sleep(2 * testSync)
+    broker.Close()
+    select {
+        case <-stopped:
+        case <-time.After(5 * time.Second):
+            t.Fatal("Cluster kept running after its broker closed")
+    }
+}
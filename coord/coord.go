@@ -2,14 +2,20 @@ package coord
 
 import (
     "context"
+    "crypto/sha256"
+    "crypto/subtle"
+    "encoding/hex"
     "encoding/json"
+    "errors"
     "flag"
     "fmt"
     "log"
     "net"
     "net/http"
     "net/netip"
+    "os"
     "strconv"
+    "strings"
     "sync"
     "time"
 
@@ -22,10 +28,15 @@ type PeerList struct {
 }
 
 type Peer struct {
-    Name     string
-    IP       net.IP    `json:"ip"`
-    Port     uint16    `json:"port"`
-    LastSeen time.Time `json:"last_seen"`
+    Name      string
+    IP        net.IP       `json:"ip"`
+    Port      uint16       `json:"port"`
+    LastSeen  time.Time    `json:"last_seen"`
+    //hex X25519 public key the STUN connectivity checks other peers send to this one
+    //are signed with a key derived from, empty for clients that only understand pings
+    PublicKey string       `json:"key"`
+    //port forwarded to the peer by its gateway, tried besides the address, nil if none
+    Mapped    *net.UDPAddr `json:"mapped"`
 }
 
 func (p *Peer) IPPort() netip.AddrPort {
@@ -34,19 +45,26 @@ func (p *Peer) IPPort() netip.AddrPort {
 }
 
 type jsonPeer struct {
-    Name     string `json:"name"`
-    IP       string `json:"ip"`
-    Port     uint16 `json:"port"`
-    LastSeen int64  `json:"last_seen"`
+    Name      string `json:"name"`
+    IP        string `json:"ip"`
+    Port      uint16 `json:"port"`
+    LastSeen  int64  `json:"last_seen"`
+    PublicKey string `json:"key,omitempty"`
+    Mapped    string `json:"mapped,omitempty"`
 }
 
 func (p Peer) MarshalJSON() ([]byte, error) {
-    return json.Marshal(jsonPeer {
-        Name:     p.Name,
-        IP:       p.IP.String(),
-        Port:     p.Port,
-        LastSeen: p.LastSeen.UnixMilli(),
-    })
+    j := jsonPeer {
+        Name:      p.Name,
+        IP:        p.IP.String(),
+        Port:      p.Port,
+        LastSeen:  p.LastSeen.UnixMilli(),
+        PublicKey: p.PublicKey,
+    }
+    if p.Mapped != nil {
+        j.Mapped = p.Mapped.String()
+    }
+    return json.Marshal(j)
 }
 
 func (p *Peer) UnmarshalJSON(data []byte) error {
@@ -67,15 +85,60 @@ func (p *Peer) UnmarshalJSON(data []byte) error {
     p.IP = ip
     p.Port = j.Port
     p.LastSeen = time.UnixMilli(j.LastSeen)
+    p.PublicKey = j.PublicKey
+    p.Mapped = nil
+    if j.Mapped != "" {
+        mapped, err := ParseMapped(j.Mapped)
+        if err != nil {
+            return err
+        }
+        p.Mapped = mapped
+    }
 
     return nil
 }
 
+//parses the ip:port of a forwarded port
+func ParseMapped(s string) (*net.UDPAddr, error) {
+    addr, err := netip.ParseAddrPort(s)
+    if err != nil || !addr.Addr().Is4() || addr.Port() == 0 {
+        return nil, fmt.Errorf("Malformed mapped address '%s'", s)
+    }
+    return net.UDPAddrFromAddrPort(addr), nil
+}
+
 type topic struct {
     mu            sync.Mutex
+    name          string
+    store         Store
     peers         map[string]*Peer
     notifications map[string]chan struct{}
+    //peers loaded from the store on startup that haven't reconnected yet,
+    //mapped to when they should be dropped
+    restored      map[string]time.Time
+    //names registered with a token, only kept by the node the name registered with
+    reservations  map[string]*Reservation
+    cluster       *cluster
+    federation    *federation
+    //peers connected to other cluster nodes or federated servers, keyed by node
+    remote        map[string]remoteMembers
     peerList      []Peer
+    //membership changes waiting to be written to the store
+    pending       []storeOp
+    //held while writing to the store, so changes are written in order without
+    //holding mu through slow writes
+    storeMu       sync.Mutex
+}
+
+//a change to write to the store, what describes it in errors
+type storeOp struct {
+    what  string
+    apply func(Store) error
+}
+
+type remoteMembers struct {
+    peers   []Peer
+    expires time.Time
 }
 
 func (t *topic) peerMap() map[string]*Peer {
@@ -92,28 +155,187 @@ func (t *topic) notificationMap() map[string]chan struct{} {
     return t.notifications
 }
 
-func (t *topic) tryRegister(name string, ip net.IP, port uint16) (bool, chan struct{}) {
+func (t *topic) restoredMap() map[string]time.Time {
+    if t.restored == nil {
+        t.restored = make(map[string]time.Time)
+    }
+    return t.restored
+}
+
+func (t *topic) reservationMap() map[string]*Reservation {
+    if t.reservations == nil {
+        t.reservations = make(map[string]*Reservation)
+    }
+    return t.reservations
+}
+
+var (
+    errNameTaken    = errors.New("Client with that name already exists")
+    errNameReserved = errors.New("Name is reserved by another token")
+)
+
+func hashToken(token string) string {
+    h := sha256.Sum256([]byte(token))
+    return hex.EncodeToString(h[:])
+}
+
+//registers a peer, reserving its name to token if given and not reserved yet
+func (t *topic) tryRegister(name string, ip net.IP, port uint16, key string, mapped *net.UDPAddr, token string) (chan struct{}, error) {
+    defer t.persist()
     t.mu.Lock()
     defer t.mu.Unlock()
 
+    for _, m := range t.remote {
+        for _, peer := range m.peers {
+            if peer.Name == name {
+                return nil, errNameTaken
+            }
+        }
+    }
+
+    hash := ""
+    if token != "" {
+        hash = hashToken(token)
+    }
+    r, reserved := t.reservationMap()[name]
+    if reserved && subtle.ConstantTimeCompare([]byte(r.Token), []byte(hash)) != 1 {
+        return nil, errNameReserved
+    }
+
     peers := t.peerMap()
     if _, ok := peers[name]; ok {
-        return false, nil
+        //a restored peer reconnecting takes its old place back
+        if _, restored := t.restoredMap()[name]; !restored {
+            return nil, errNameTaken
+        }
+        delete(t.restoredMap(), name)
     }
 
-    peers[name] = &Peer {
-        Name:     name,
-        IP:       ip,
-        Port:     port,
-        LastSeen: time.Now(),
+    if token != "" {
+        if !reserved {
+            r = &Reservation {
+                Name:  name,
+                Token: hash,
+            }
+            t.reservationMap()[name] = r
+        }
+        t.touchReservation(name)
+    }
+
+    peer := &Peer {
+        Name:      name,
+        IP:        ip,
+        Port:      port,
+        LastSeen:  time.Now(),
+        PublicKey: key,
+        Mapped:    mapped,
     }
+    peers[name] = peer
+    t.savePeer(peer)
 
     ch := make(chan struct{}, 1)
     t.notificationMap()[name] = ch
 
     t.peersChanged()
 
-    return true, ch
+    return ch, nil
+}
+
+//lists a peer loaded from the store until it reconnects or the deadline passes
+func (t *topic) restore(peer Peer, deadline time.Time) {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+
+    if _, ok := t.peerMap()[peer.Name]; ok {
+        return
+    }
+    t.peerMap()[peer.Name] = &peer
+    t.restoredMap()[peer.Name] = deadline
+    t.peersChanged()
+}
+
+//lists a reservation loaded from the store
+func (t *topic) restoreReservation(r Reservation) {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    t.reservationMap()[r.Name] = &r
+}
+
+//marks a reserved name as used now and queues saving it, mu must be held
+func (t *topic) touchReservation(name string) {
+    r, ok := t.reservationMap()[name]
+    if !ok {
+        return
+    }
+    r.LastUsed = time.Now()
+    saved := *r
+    t.queue("reservation of " + name, func(s Store) error {
+        return s.SaveReservation(t.name, saved)
+    })
+}
+
+//drops reservations of names nobody registered since cutoff
+func (t *topic) expireReservations(cutoff time.Time) []string {
+    defer t.persist()
+    t.mu.Lock()
+    defer t.mu.Unlock()
+
+    expired := []string(nil)
+    for name, r := range t.reservationMap() {
+        if _, connected := t.notificationMap()[name]; connected || !r.LastUsed.Before(cutoff) {
+            continue
+        }
+        name := name
+        delete(t.reservationMap(), name)
+        t.queue("reservation of " + name, func(s Store) error {
+            return s.DeleteReservation(t.name, name)
+        })
+        expired = append(expired, name)
+    }
+    return expired
+}
+
+//queues a change to be written by persist, mu must be held
+func (t *topic) queue(what string, apply func(Store) error) {
+    if t.store == nil {
+        return
+    }
+    t.pending = append(t.pending, storeOp { what: what, apply: apply })
+}
+
+//queues a peer to be saved by persist, mu must be held
+func (t *topic) savePeer(peer *Peer) {
+    saved := *peer
+    t.queue("peer " + peer.Name, func(s Store) error {
+        return s.SavePeer(t.name, saved)
+    })
+}
+
+//queues a peer to be deleted by persist, mu must be held
+func (t *topic) deletePeer(name string) {
+    t.queue("peer " + name, func(s Store) error {
+        return s.DeletePeer(t.name, name)
+    })
+}
+
+//writes the queued changes to the store, called after releasing mu
+func (t *topic) persist() {
+    if t.store == nil {
+        return
+    }
+    t.storeMu.Lock()
+    defer t.storeMu.Unlock()
+
+    t.mu.Lock()
+    ops := t.pending
+    t.pending = nil
+    t.mu.Unlock()
+
+    for _, op := range ops {
+        if err := op.apply(t.store); err != nil {
+            log.Printf("Failed to persist %s of topic %s: %v", op.what, t.name, err)
+        }
+    }
 }
 
 func (t *topic) updateLastSeen(name string) {
@@ -125,17 +347,93 @@ func (t *topic) updateLastSeen(name string) {
     }
 }
 
-func (t *topic) unregister(name string) {
+//ch must be the channel returned by tryRegister, so a connection that was already
+//evicted doesn't remove a newer registration using the same name
+func (t *topic) unregister(name string, ch chan struct{}) {
+    defer t.persist()
     t.mu.Lock()
     defer t.mu.Unlock()
 
-    close(t.notificationMap()[name])
+    if cur, ok := t.notificationMap()[name]; !ok || cur != ch {
+        return
+    }
+
+    close(ch)
     delete(t.notificationMap(), name)
     delete(t.peerMap(), name)
+    t.deletePeer(name)
+    t.touchReservation(name)
     t.peersChanged()
 }
 
+//removes every peer not seen since cutoff, closing their notification channels
+//so their connections get torn down
+func (t *topic) evictStale(cutoff time.Time) []string {
+    defer t.persist()
+    t.mu.Lock()
+    defer t.mu.Unlock()
+
+    now := time.Now()
+    evicted := []string(nil)
+    for name, peer := range t.peerMap() {
+        if deadline, ok := t.restoredMap()[name]; ok {
+            if now.Before(deadline) {
+                continue
+            }
+            delete(t.restoredMap(), name)
+        } else if !peer.LastSeen.Before(cutoff) {
+            continue
+        }
+        if ch, ok := t.notificationMap()[name]; ok {
+            close(ch)
+            delete(t.notificationMap(), name)
+            t.touchReservation(name)
+        }
+        delete(t.peerMap(), name)
+        t.deletePeer(name)
+        evicted = append(evicted, name)
+    }
+
+    remoteChanged := false
+    for node, m := range t.remote {
+        if now.After(m.expires) {
+            log.Printf("Cluster node %s stopped sending topic %s", node, t.name)
+            delete(t.remote, node)
+            remoteChanged = true
+        }
+    }
+
+    if len(evicted) > 0 {
+        t.peersChanged()
+    } else if remoteChanged {
+        t.notify()
+    }
+    return evicted
+}
+
+//called whenever local membership changes
 func (t *topic) peersChanged() {
+    t.notify()
+    t.publish()
+}
+
+func (t *topic) publish() {
+    if t.cluster == nil && t.federation == nil {
+        return
+    }
+    u := ClusterUpdate {
+        Topic: t.name,
+        Peers: t.localPeers(),
+    }
+    if t.cluster != nil {
+        u = t.cluster.publish(u.Topic, u.Peers)
+    }
+    if t.federation != nil && t.federation.handles(t.name) {
+        t.federation.publish(u)
+    }
+}
+
+func (t *topic) notify() {
     t.peerList = nil
 
     for _, ch := range t.notificationMap() {
@@ -146,6 +444,63 @@ func (t *topic) peersChanged() {
     }
 }
 
+func (t *topic) localPeers() []Peer {
+    s := []Peer(nil)
+    for _, peer := range t.peerMap() {
+        s = append(s, *peer)
+    }
+    return s
+}
+
+func (t *topic) publishLocal() {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    t.publish()
+}
+
+func (t *topic) setRemote(node string, peers []Peer, expires time.Time) {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+
+    if t.remote == nil {
+        t.remote = make(map[string]remoteMembers)
+    }
+
+    if _, ok := t.remote[node]; !ok && len(peers) == 0 {
+        //periodic resend of an empty topic, nothing changed
+        return
+    }
+    prev, existed := t.remote[node]
+    if len(peers) == 0 {
+        delete(t.remote, node)
+    } else {
+        t.remote[node] = remoteMembers {
+            peers:   peers,
+            expires: expires,
+        }
+    }
+    if !existed || !samePeers(prev.peers, peers) {
+        t.notify()
+    }
+}
+
+func samePeers(a, b []Peer) bool {
+    if len(a) != len(b) {
+        return false
+    }
+    byName := make(map[string]Peer, len(a))
+    for _, p := range a {
+        byName[p.Name] = p
+    }
+    for _, p := range b {
+        o, ok := byName[p.Name]
+        if !ok || !o.IP.Equal(p.IP) || o.Port != p.Port || !o.LastSeen.Equal(p.LastSeen) || o.PublicKey != p.PublicKey || o.Mapped.String() != p.Mapped.String() {
+            return false
+        }
+    }
+    return true
+}
+
 func (t *topic) getPeerList() []Peer {
     t.mu.Lock()
     defer t.mu.Unlock()
@@ -154,17 +509,27 @@ func (t *topic) getPeerList() []Peer {
         return t.peerList
     }
 
-    s := []Peer(nil)
-    for _, peer := range t.peerMap() {
-        s = append(s, *peer)
+    s := t.localPeers()
+    for _, m := range t.remote {
+        for _, peer := range m.peers {
+            //local peers win on the rare chance two nodes accepted the same name
+            if _, ok := t.peerMap()[peer.Name]; !ok {
+                s = append(s, peer)
+            }
+        }
     }
     t.peerList = s
     return t.peerList
 }
 
 type state struct {
-    mu     sync.Mutex
-    topics map[string]*topic
+    mu             sync.Mutex
+    store          Store
+    //how long reserved names are kept unused, forever if 0
+    reservationTTL time.Duration
+    cluster        *cluster
+    federation     *federation
+    topics         map[string]*topic
 }
 
 func (s *state) topic(name string) *topic {
@@ -179,98 +544,342 @@ func (s *state) topic(name string) *topic {
         return t
     }
 
-    t := &topic {}
+    t := &topic {
+        name:       name,
+        store:      s.store,
+        cluster:    s.cluster,
+        federation: s.federation,
+    }
     s.topics[name] = t
     return t
 }
 
-var port int
+func (s *state) topicList() []*topic {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    topics := make([]*topic, 0, len(s.topics))
+    for _, t := range s.topics {
+        topics = append(topics, t)
+    }
+    return topics
+}
+
+//loads peers persisted by a previous run, keeping them listed for the grace period
+func (s *state) restore(grace time.Duration) error {
+    if s.store == nil {
+        return nil
+    }
+
+    topics, err := s.store.LoadPeers()
+    if err != nil {
+        return fmt.Errorf("Unable to load stored peers: %w", err)
+    }
+
+    deadline := time.Now().Add(grace)
+    for name, peers := range topics {
+        t := s.topic(name)
+        for _, peer := range peers {
+            t.restore(peer, deadline)
+        }
+        log.Printf("Restored %d peers of topic %s", len(peers), name)
+    }
+
+    reservations, err := s.store.LoadReservations()
+    if err != nil {
+        return fmt.Errorf("Unable to load stored reservations: %w", err)
+    }
+    for name, rs := range reservations {
+        t := s.topic(name)
+        for _, r := range rs {
+            t.restoreReservation(r)
+        }
+        log.Printf("Restored %d reserved names of topic %s", len(rs), name)
+    }
+    return nil
+}
+
+func (s *state) evictStale(timeout time.Duration) {
+    cutoff := time.Now().Add(-timeout)
+    for _, t := range s.topicList() {
+        for _, peer := range t.evictStale(cutoff) {
+            log.Printf("Evicted peer %s from topic %s: not seen for over %v", peer, t.name, timeout)
+        }
+        if s.reservationTTL > 0 {
+            for _, name := range t.expireReservations(time.Now().Add(-s.reservationTTL)) {
+                log.Printf("Released name %s of topic %s: unused for over %v", name, t.name, s.reservationTTL)
+            }
+        }
+    }
+}
+
+//evicts stale peers until done is closed, forever if nil
+func (s *state) reapStale(timeout time.Duration, done <-chan struct{}) {
+    t := time.NewTicker(timeout / 2)
+    defer t.Stop()
+
+    for {
+        select {
+            case <-t.C:
+                s.evictStale(timeout)
+            case <-done:
+                return
+        }
+    }
+}
+
+//serves the websocket peers register with and get the peer list from
+func (s *state) websocketHandler(pingInterval time.Duration) http.HandlerFunc {
+    upgrader := websocket.Upgrader{}
+    return func(w http.ResponseWriter, r *http.Request) {
+        q := r.URL.Query()
+
+        topic := q.Get("topic")
+        if topic == "" {
+            http.Error(w, "Missing topic", 400)
+            return
+        }
+
+        name := q.Get("name")
+        if name == "" {
+            http.Error(w, "Missing name", 400)
+            return
+        }
+
+        ipRaw := q.Get("ip")
+        ip, err := netip.ParseAddr(ipRaw)
+        if err != nil {
+            http.Error(w, "Missing or invalid ip", 400)
+            return
+        }
+
+        portRaw := q.Get("port")
+        port, err := strconv.ParseUint(portRaw, 10, 16)
+        if err != nil || port == 0 {
+            http.Error(w, "Missing or invalid port", 400)
+            return
+        }
+
+        //optional, older clients only ping
+        key := q.Get("key")
+
+        //optional, reserves the name to whoever knows it
+        token := q.Get("token")
+
+        //optional, only given by clients their gateway forwards a port to
+        var mapped *net.UDPAddr
+        if raw := q.Get("mapped"); raw != "" {
+            mapped, err = ParseMapped(raw)
+            if err != nil {
+                http.Error(w, "Invalid mapped", 400)
+                return
+            }
+        }
+
+        t := s.topic(topic)
+        ch, err := t.tryRegister(name, net.IP(ip.AsSlice()), uint16(port), key, mapped, token)
+        if err != nil {
+            http.Error(w, err.Error(), 401)
+            return
+        }
+        defer t.unregister(name, ch)
+
+        ws, err := upgrader.Upgrade(w, r, nil)
+        if err != nil {
+            return
+        }
+        defer ws.Close()
+
+        done := make(chan struct{})
+        defer close(done)
+
+        ws.SetPingHandler(func (data string) error {
+            t.updateLastSeen(name)
+            err := ws.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(pingInterval))
+            if err == websocket.ErrCloseSent {
+                return nil
+            }
+            return err
+        })
+        ws.SetPongHandler(func (_ string) error {
+            t.updateLastSeen(name)
+            return nil
+        })
+
+        go func() {
+            tick := time.NewTicker(pingInterval)
+            defer tick.Stop()
+
+            for {
+                select {
+                    case <-done:
+                        return
+                    case <-tick.C:
+                }
+                if err := ws.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(pingInterval)); err != nil {
+                    ws.Close()
+                    return
+                }
+            }
+        }()
+
+        go func() {
+            for {
+                _, more := <-ch
+                if !more {
+                    //either evicted or already disconnected, closing twice is harmless
+                    ws.WriteControl(
+                        websocket.CloseMessage,
+                        websocket.FormatCloseMessage(websocket.CloseGoingAway, "peer timed out"),
+                        time.Now().Add(time.Second),
+                    )
+                    ws.Close()
+                    break
+                }
+                peers := t.getPeerList()
+                if err := ws.WriteJSON(PeerList {
+                    Peers: peers,
+                }); err != nil {
+                    ws.Close()
+                    break
+                }
+            }
+        }()
+        for {
+            if _, _, err := ws.NextReader(); err != nil {
+                break
+            }
+        }
+    }
+}
+
+//Serve runs a coordination server on l until it's closed, without clustering,
+//federation or persistence, like on a simulated network
+func Serve(l net.Listener, peerTimeout, pingInterval time.Duration) error {
+    s := &state {
+        store: &memoryStore {},
+    }
+    done := make(chan struct{})
+    defer close(done)
+    go s.reapStale(peerTimeout, done)
+
+    mux := http.NewServeMux()
+    mux.HandleFunc("/websocket", s.websocketHandler(pingInterval))
+    return http.Serve(l, mux)
+}
+
+var (
+    port           int
+    peerTimeout    time.Duration
+    pingInterval   time.Duration
+    storeType      string
+    storePath      string
+    restartGrace   time.Duration
+    reservationTTL time.Duration
+    nodeID         string
+    clusterPeers   string
+    clusterKey     string
+    clusterSync    time.Duration
+    serverName     string
+    fedConfig      string
+)
 
 var fs = (func() *flag.FlagSet {
     fs := flag.NewFlagSet("coord", flag.ExitOnError)
-    fs.IntVar(&port, "port", 6969, "Port to listen on")
+    fs.IntVar(&port,              "port",          6969,             "Port to listen on")
+    fs.DurationVar(&peerTimeout,  "peer-timeout",  30 * time.Second, "Evict peers not seen for this long")
+    fs.DurationVar(&pingInterval, "ping-interval", 10 * time.Second, "Interval between server-initiated websocket pings")
+    fs.StringVar(&storeType,      "store",         "memory",         "Storage backend for topic membership (memory or bolt)")
+    fs.StringVar(&storePath,      "store-path",    "coord.db",       "Database file used by the bolt store")
+    fs.DurationVar(&restartGrace, "restart-grace", 60 * time.Second, "How long peers restored from the store stay listed while they reconnect")
+    fs.DurationVar(&reservationTTL, "reservation-ttl", 30 * 24 * time.Hour, "How long a name registered with a token stays reserved while unused, 0 keeps it forever")
+    fs.StringVar(&nodeID,         "node-id",       "",               "Unique ID of this node in a cluster (defaults to hostname:port)")
+    fs.StringVar(&clusterPeers,   "cluster-peers", "",               "Comma separated websocket URLs of other cluster nodes' /cluster endpoint")
+    fs.StringVar(&clusterKey,     "cluster-secret", "",              "Shared secret cluster nodes authenticate with, enables clustering")
+    fs.DurationVar(&clusterSync,  "cluster-sync",  5 * time.Second,  "Interval between full membership resends to other cluster nodes and federation partners")
+    fs.StringVar(&serverName,     "server-name",   "",               "Name of this server in federated topic@server topics")
+    fs.StringVar(&fedConfig,      "federation-config", "",           "JSON file listing federation partners, enables federation")
     return fs
 })()
 
 
-
 var Command = &ffcli.Command {
     Name:       "coord",
     ShortUsage: "coord [flags]",
     ShortHelp:  "Coordination server for peer discovery",
     FlagSet:    fs,
     Exec:       func(ctx context.Context, args []string) error {
-        var s state
-        upgrader := websocket.Upgrader{}
+        if peerTimeout <= 0 || pingInterval <= 0 {
+            return fmt.Errorf("peer-timeout and ping-interval must be positive")
+        }
 
-        http.HandleFunc("/websocket", func(w http.ResponseWriter, r *http.Request) { 
-            q := r.URL.Query()
+        store, err := OpenStore(storeType, storePath)
+        if err != nil {
+            return err
+        }
+        defer store.Close()
 
-            topic := q.Get("topic")
-            if topic == "" {
-                http.Error(w, "Missing topic", 400)
-                return
-            }
+        s := state {
+            store:          store,
+            reservationTTL: reservationTTL,
+        }
 
-            name := q.Get("name")
-            if name == "" {
-                http.Error(w, "Missing name", 400)
+        if clusterKey != "" {
+            if nodeID == "" {
+                host, _ := os.Hostname()
+                nodeID = fmt.Sprintf("%s:%d", host, port)
             }
-
-            ipRaw := q.Get("ip")
-            ip, err := netip.ParseAddr(ipRaw)
-            if err != nil {
-                http.Error(w, "Missing or invalid ip", 400)
-                return
+            peers := []string(nil)
+            for _, p := range strings.Split(clusterPeers, ",") {
+                if p = strings.TrimSpace(p); p != "" {
+                    peers = append(peers, p)
+                }
             }
 
-            portRaw := q.Get("port")
-            port, err := strconv.ParseUint(portRaw, 10, 16)
-            if err != nil || port == 0 {
-                http.Error(w, "Missing or invalid port", 400)
-                return
-            }
+            broker := NewWebsocketBroker(clusterKey, peers)
+            defer broker.Close()
+            http.Handle("/cluster", broker)
 
-            t := s.topic(topic)
-            ok, ch := t.tryRegister(name, net.IP(ip.AsSlice()), uint16(port))
-            if !ok {
-                http.Error(w, "Client with that name already exists", 401)
-                return
+            c, err := newCluster(nodeID, broker, clusterSync)
+            if err != nil {
+                return err
             }
-            defer t.unregister(name)
+            s.cluster = c
+            log.Printf("Cluster node %s, linking to %d nodes", nodeID, len(peers))
+        } else if clusterPeers != "" {
+            return fmt.Errorf("cluster-peers requires cluster-secret")
+        }
 
-            ws, err := upgrader.Upgrade(w, r, nil)
+        if fedConfig != "" {
+            config, err := LoadFederationConfig(fedConfig)
             if err != nil {
-                return
+                return err
+            }
+            f, err := newFederation(&s, serverName, config, clusterSync)
+            if err != nil {
+                return err
             }
-            defer ws.Close()
+            s.federation = f
+            defer f.Close()
+            http.Handle("/federation", f)
+            go f.run()
+            log.Printf("Federating as %s with %d partners", serverName, len(config.Partners))
+        }
 
-            ws.SetPingHandler(func (_ string) error {
-                t.updateLastSeen(name)
-                return nil
-            })
-
-            go func() {
-                for {
-                    _, more := <-ch
-                    if !more {
-                        break
-                    }
-                    peers := t.getPeerList()
-                    if err := ws.WriteJSON(PeerList {
-                        Peers: peers,
-                    }); err != nil {
-                        ws.Close()
-                        break
-                    }
-                }
-            }()
-            for {
-                if _, _, err := ws.NextReader(); err != nil {
-                    break
-                }
+        //started once federation is set up, since cluster nodes relay federated members
+        if s.cluster != nil {
+            if err := s.cluster.start(&s); err != nil {
+                return err
             }
-        })
+        }
+
+        if err := s.restore(restartGrace); err != nil {
+            return err
+        }
+
+        go s.reapStale(peerTimeout, nil)
+
+        http.HandleFunc("/websocket", s.websocketHandler(pingInterval))
 
         log.Printf("Listening on :%d", port)
         return http.ListenAndServe(fmt.Sprintf(":%d", port), nil)
@@ -0,0 +1,130 @@
+package coord
+
+import (
+    "io"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "sort"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/gorilla/websocket"
+)
+
+//registering without a name is refused before the peer is added
+func TestWebsocketRequiresName(t *testing.T) {
+    s := &state {
+        store: &memoryStore {},
+    }
+    srv := httptest.NewServer(s.websocketHandler(time.Second))
+    defer srv.Close()
+
+    resp, err := http.Get(srv.URL + "?topic=t1&ip=192.0.2.1&port=1234")
+    if err != nil {
+        t.Fatal(err)
+    }
+    body, err := io.ReadAll(resp.Body)
+    resp.Body.Close()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if resp.StatusCode != 400 || string(body) != "Missing name\n" {
+        t.Fatalf("Got status %d and '%s'", resp.StatusCode, body)
+    }
+    if names := peerNames(s, "t1"); names != "" {
+        t.Fatalf("Registered '%s'", names)
+    }
+}
+
+//connects name to topic t1 on srv
+func dialPeer(t *testing.T, srv *httptest.Server, name string) *websocket.Conn {
+    t.Helper()
+    url := "ws" + strings.TrimPrefix(srv.URL, "http") + "?topic=t1&ip=192.0.2.1&port=1234&name=" + name
+    ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() {
+        ws.Close()
+    })
+    return ws
+}
+
+//a peer that stops answering pings is evicted and the others are told
+func TestEvictsSilentPeer(t *testing.T) {
+    const timeout = 300 * time.Millisecond
+
+    s := &state {
+        store: &memoryStore {},
+    }
+    done := make(chan struct{})
+    defer close(done)
+    go s.reapStale(timeout, done)
+
+    srv := httptest.NewServer(s.websocketHandler(timeout / 6))
+    defer srv.Close()
+
+    alice := dialPeer(t, srv, "alice")
+    //bob never reads, so the server pings are never answered
+    bob := dialPeer(t, srv, "bob")
+
+    lists := make(chan string, 16)
+    go func() {
+        defer close(lists)
+        for {
+            var list PeerList
+            if err := alice.ReadJSON(&list); err != nil {
+                return
+            }
+            names := []string(nil)
+            for _, p := range list.Peers {
+                names = append(names, p.Name)
+            }
+            lists <- strings.Join(sortedCopy(names), ",")
+        }
+    }()
+
+    start := time.Now()
+    sawBob := false
+    for names := range lists {
+        switch names {
+            case "alice,bob":
+                sawBob = true
+            case "alice":
+                if !sawBob {
+                    continue
+                }
+                if since := time.Since(start); since < timeout {
+                    t.Fatalf("Evicted bob after %v, before the %v timeout", since, timeout)
+                }
+                if names := peerNames(s, "t1"); names != "alice" {
+                    t.Fatalf("Server lists '%s'", names)
+                }
+                //the server closes the evicted connection after the lists bob never read
+                bob.SetReadDeadline(time.Now().Add(5 * time.Second))
+                for {
+                    _, _, err := bob.ReadMessage()
+                    if err == nil {
+                        continue
+                    }
+                    //answering a queued ping can race the close and fail the write instead
+                    if ne, ok := err.(net.Error); ok && ne.Timeout() {
+                        t.Fatal("bob was never disconnected")
+                    }
+                    return
+                }
+        }
+        if time.Since(start) > 5 * time.Second {
+            break
+        }
+    }
+    t.Fatal("alice never saw bob evicted")
+}
+
+func sortedCopy(s []string) []string {
+    s = append([]string(nil), s...)
+    sort.Strings(s)
+    return s
+}
@@ -0,0 +1,407 @@
+package coord
+
+import (
+    "crypto/subtle"
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+    "os"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/gorilla/websocket"
+)
+
+//FederationPartner is another organization's coordination server that shares
+//topics with this one. Both sides must be configured with the same secret.
+type FederationPartner struct {
+    //name clients use in topic@server
+    Name   string `json:"name"`
+    //websocket URL of the partner's /federation endpoint, optional if the partner dials us
+    URL    string `json:"url"`
+    Secret string `json:"secret"`
+}
+
+type FederationConfig struct {
+    Partners []FederationPartner `json:"partners"`
+}
+
+func LoadFederationConfig(path string) (*FederationConfig, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, fmt.Errorf("Unable to read federation config: %w", err)
+    }
+    var c FederationConfig
+    if err := json.Unmarshal(data, &c); err != nil {
+        return nil, fmt.Errorf("Malformed federation config: %w", err)
+    }
+    for _, p := range c.Partners {
+        if p.Name == "" || p.Secret == "" {
+            return nil, fmt.Errorf("Federation partners need a name and a secret")
+        }
+    }
+    return &c, nil
+}
+
+//splits topic@server, returning an empty server for local topics
+func topicOwner(topic string) string {
+    i := strings.LastIndexByte(topic, '@')
+    if i < 0 {
+        return ""
+    }
+    return topic[i + 1:]
+}
+
+//federation shares membership of topic@server topics with partner servers. The
+//server named in the topic owns it: other servers send their local members to the
+//owner, and the owner relays everyone's members to every server using the topic.
+//In a cluster every node sends the members connected to it under its own node ID,
+//and federated members go through the cluster broker, so it's enough for one node
+//of each server to be linked to a partner.
+type federation struct {
+    self     string
+    interval time.Duration
+    partners map[string]FederationPartner
+    state    *state
+
+    mu          sync.Mutex
+    links       map[string]map[*federationLink]struct{}
+    //partners that sent members of each topic we own, until they stop resending
+    subscribers map[string]map[string]time.Time
+    seq         uint64
+    //last sequence number applied for each server/node and topic
+    applied     map[string]map[string]uint64
+    done        chan struct{}
+    closed      bool
+}
+
+type federationLink struct {
+    ws   *websocket.Conn
+    send chan ClusterUpdate
+}
+
+func newFederation(s *state, self string, config *FederationConfig, interval time.Duration) (*federation, error) {
+    if self == "" {
+        return nil, fmt.Errorf("Federation requires a server name")
+    }
+    if interval <= 0 {
+        return nil, fmt.Errorf("Federation sync interval must be positive")
+    }
+
+    partners := make(map[string]FederationPartner)
+    for _, p := range config.Partners {
+        if p.Name == self {
+            return nil, fmt.Errorf("Federation partner uses this server's name '%s'", self)
+        }
+        partners[p.Name] = p
+    }
+
+    return &federation {
+        self:        self,
+        interval:    interval,
+        partners:    partners,
+        state:       s,
+        links:       make(map[string]map[*federationLink]struct{}),
+        subscribers: make(map[string]map[string]time.Time),
+        seq:         uint64(time.Now().UnixNano()),
+        applied:     make(map[string]map[string]uint64),
+        done:        make(chan struct{}),
+    }, nil
+}
+
+//drops every partner link and stops run and the loops dialing partners
+func (f *federation) Close() error {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+
+    if f.closed {
+        return nil
+    }
+    f.closed = true
+    close(f.done)
+    for _, links := range f.links {
+        for l := range links {
+            l.ws.Close()
+        }
+    }
+    return nil
+}
+
+func (f *federation) isClosed() bool {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    return f.closed
+}
+
+//whether a topic should be shared, either because we own it or a partner does
+func (f *federation) handles(topic string) bool {
+    owner := topicOwner(topic)
+    if owner == f.self {
+        return true
+    }
+    _, ok := f.partners[owner]
+    return ok
+}
+
+//remote membership from federation is kept apart from cluster nodes
+func federationKey(u ClusterUpdate) string {
+    return "federation:" + u.origin()
+}
+
+//called with the topic lock held. In a cluster u was already published to the other
+//nodes and keeps its node and sequence number, otherwise the server is its only node.
+func (f *federation) publish(u ClusterUpdate) {
+    if u.Node == "" {
+        f.mu.Lock()
+        f.seq++
+        u.Node = f.self
+        u.Seq = f.seq
+        f.mu.Unlock()
+    }
+    u.Server = f.self
+    f.share(u)
+}
+
+//sends members connected to this server to the owner of the topic, or to the
+//partners using it if we're the owner
+func (f *federation) share(u ClusterUpdate) {
+    owner := topicOwner(u.Topic)
+    if owner == f.self {
+        f.sendSubscribers(u, "")
+    } else {
+        f.sendTo(owner, u)
+    }
+}
+
+func (f *federation) sendTo(partner string, u ClusterUpdate) {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+
+    for l := range f.links[partner] {
+        select {
+            case l.send <- u:
+            default:
+        }
+    }
+}
+
+func (f *federation) sendSubscribers(u ClusterUpdate, except string) {
+    now := time.Now()
+    f.mu.Lock()
+    subs := []string(nil)
+    for p, expires := range f.subscribers[u.Topic] {
+        if now.After(expires) {
+            delete(f.subscribers[u.Topic], p)
+            continue
+        }
+        if p != except {
+            subs = append(subs, p)
+        }
+    }
+    if len(f.subscribers[u.Topic]) == 0 {
+        delete(f.subscribers, u.Topic)
+    }
+    f.mu.Unlock()
+
+    for _, p := range subs {
+        f.sendTo(p, u)
+    }
+}
+
+func (f *federation) shouldApply(u ClusterUpdate) bool {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+
+    topics, ok := f.applied[u.origin()]
+    if !ok {
+        topics = make(map[string]uint64)
+        f.applied[u.origin()] = topics
+    }
+    if u.Seq <= topics[u.Topic] {
+        return false
+    }
+    topics[u.Topic] = u.Seq
+    return true
+}
+
+func (f *federation) receive(from string, u ClusterUpdate) {
+    owner := topicOwner(u.Topic)
+    switch {
+        case owner == f.self:
+            //partners may only speak for themselves about our topics
+            if u.Server != from {
+                return
+            }
+            f.mu.Lock()
+            subs, ok := f.subscribers[u.Topic]
+            if !ok {
+                subs = make(map[string]time.Time)
+                f.subscribers[u.Topic] = subs
+            }
+            //partners resend every interval, like cluster nodes
+            subs[from] = time.Now().Add(3 * f.interval)
+            f.mu.Unlock()
+        case owner == from:
+            //the owner is authoritative for its topics, including relayed members
+            if u.Server == f.self {
+                return
+            }
+        default:
+            return
+    }
+
+    if !f.apply(u) {
+        return
+    }
+    if f.state.cluster != nil {
+        f.state.cluster.relay(u)
+    }
+}
+
+//applies federated members and relays them to the partners using our topics,
+//returning false if the update was already seen
+func (f *federation) apply(u ClusterUpdate) bool {
+    if u.Server == "" || u.Server == f.self || !f.shouldApply(u) {
+        return false
+    }
+    f.state.topic(u.Topic).setRemote(federationKey(u), u.Peers, time.Now().Add(3 * f.interval))
+
+    if topicOwner(u.Topic) == f.self {
+        f.sendSubscribers(u, u.Server)
+    }
+    return true
+}
+
+//handles updates from other nodes of our cluster: their own members are shared
+//with partners for them, and federated members they received are applied
+func (f *federation) fromCluster(u ClusterUpdate) {
+    if !f.handles(u.Topic) {
+        return
+    }
+    if u.Server == "" {
+        u.Server = f.self
+        f.share(u)
+        return
+    }
+    f.apply(u)
+}
+
+//dials partners and resends our members every interval until closed
+func (f *federation) run() {
+    for _, p := range f.partners {
+        if p.URL != "" {
+            go f.dialLoop(p)
+        }
+    }
+
+    t := time.NewTicker(f.interval)
+    defer t.Stop()
+
+    for {
+        select {
+            case <-t.C:
+            case <-f.done:
+                return
+        }
+        for _, topic := range f.state.topicList() {
+            if f.handles(topic.name) {
+                topic.publishLocal()
+            }
+        }
+    }
+}
+
+//ServeHTTP accepts links from partner servers
+func (f *federation) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    name := r.Header.Get("X-Federation-Server")
+    p, ok := f.partners[name]
+    if !ok || subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer " + p.Secret)) != 1 {
+        http.Error(w, "Unknown federation partner or invalid secret", 401)
+        return
+    }
+
+    upgrader := websocket.Upgrader{}
+    ws, err := upgrader.Upgrade(w, r, nil)
+    if err != nil {
+        return
+    }
+    log.Printf("Federation partner %s connected", name)
+    f.runLink(name, ws)
+    log.Printf("Federation partner %s disconnected", name)
+}
+
+func (f *federation) dialLoop(p FederationPartner) {
+    header := http.Header {}
+    header.Set("X-Federation-Server", f.self)
+    header.Set("Authorization", "Bearer " + p.Secret)
+
+    for !f.isClosed() {
+        ws, _, err := websocket.DefaultDialer.Dial(p.URL, header)
+        if err != nil {
+            log.Printf("Unable to connect to federation partner %s: %v", p.Name, err)
+        } else {
+            log.Printf("Connected to federation partner %s", p.Name)
+            f.runLink(p.Name, ws)
+            log.Printf("Lost connection to federation partner %s", p.Name)
+        }
+        select {
+            case <-time.After(5 * time.Second):
+            case <-f.done:
+                return
+        }
+    }
+}
+
+func (f *federation) runLink(partner string, ws *websocket.Conn) {
+    l := &federationLink {
+        ws:   ws,
+        send: make(chan ClusterUpdate, 256),
+    }
+
+    f.mu.Lock()
+    if f.closed {
+        f.mu.Unlock()
+        ws.Close()
+        return
+    }
+    links, ok := f.links[partner]
+    if !ok {
+        links = make(map[*federationLink]struct{})
+        f.links[partner] = links
+    }
+    links[l] = struct{}{}
+    f.mu.Unlock()
+
+    defer func() {
+        f.mu.Lock()
+        delete(f.links[partner], l)
+        f.mu.Unlock()
+        ws.Close()
+    }()
+
+    done := make(chan struct{})
+    defer close(done)
+    go func() {
+        for {
+            select {
+                case <-done:
+                    return
+                case u := <-l.send:
+                    if err := ws.WriteJSON(u); err != nil {
+                        ws.Close()
+                        return
+                    }
+            }
+        }
+    }()
+
+    for {
+        var u ClusterUpdate
+        if err := ws.ReadJSON(&u); err != nil {
+            return
+        }
+        f.receive(partner, u)
+    }
+}
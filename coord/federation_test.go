@@ -0,0 +1,172 @@
+package coord
+
+import (
+    "net/http/httptest"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+)
+
+const testFederationSecret = "secret"
+
+//starts a node of a federated server, in a cluster when hub isn't nil, returning the
+//URL of its /federation endpoint
+func newFederatedNode(t *testing.T, hub *MemoryHub, server, node string, partners ...FederationPartner) (*state, string) {
+    t.Helper()
+    s := &state {}
+    if hub != nil {
+        broker := hub.Broker()
+        t.Cleanup(func() {
+            broker.Close()
+        })
+        c, err := newCluster(node, broker, testSync)
+        if err != nil {
+            t.Fatal(err)
+        }
+        s.cluster = c
+    }
+
+    f, err := newFederation(s, server, &FederationConfig { Partners: partners }, testSync)
+    if err != nil {
+        t.Fatal(err)
+    }
+    s.federation = f
+    srv := httptest.NewServer(f)
+    t.Cleanup(srv.Close)
+    t.Cleanup(func() {
+        f.Close()
+    })
+
+    if s.cluster != nil {
+        if err := s.cluster.start(s); err != nil {
+            t.Fatal(err)
+        }
+    }
+    go f.run()
+    return s, "ws" + strings.TrimPrefix(srv.URL, "http") + "/federation"
+}
+
+//server a has two clustered nodes and only a1 is linked to server b, so members
+//connected to a2 only reach b, and b's members only reach a2, through the cluster
+func TestFederationWithCluster(t *testing.T) {
+    hub := NewMemoryHub()
+    a1, a1URL := newFederatedNode(t, hub, "a", "n1", FederationPartner { Name: "b", Secret: testFederationSecret })
+    a2, _ := newFederatedNode(t, hub, "a", "n2", FederationPartner { Name: "b", Secret: testFederationSecret })
+    b, _ := newFederatedNode(t, nil, "b", "", FederationPartner { Name: "a", URL: a1URL, Secret: testFederationSecret })
+    servers := []*state { a1, a2, b }
+
+    //owned by the clustered server, whose nodes both have members
+    alice := register(t, a1, "t@a", "alice")
+    register(t, a2, "t@a", "erin")
+    register(t, b, "t@a", "bob")
+    for _, s := range servers {
+        eventually(t, "every node to list the members of t@a", func() bool {
+            return peerNames(s, "t@a") == "alice,bob,erin"
+        })
+    }
+
+    //owned by the other server
+    register(t, a2, "u@b", "carol")
+    register(t, b, "u@b", "dave")
+    for _, s := range servers {
+        eventually(t, "every node to list the members of u@b", func() bool {
+            return peerNames(s, "u@b") == "carol,dave"
+        })
+    }
+
+    a1.topic("t@a").unregister("alice", alice)
+    for _, s := range servers {
+        eventually(t, "every node to drop alice", func() bool {
+            return peerNames(s, "t@a") == "bob,erin"
+        })
+    }
+}
+
+func TestFederationExpiresSubscribers(t *testing.T) {
+    s := &state {}
+    f, err := newFederation(s, "a", &FederationConfig { Partners: []FederationPartner {
+        { Name: "b", Secret: testFederationSecret },
+    } }, testSync)
+    if err != nil {
+        t.Fatal(err)
+    }
+    s.federation = f
+
+    f.receive("b", ClusterUpdate { Server: "b", Node: "n1", Seq: 1, Topic: "t@a" })
+    if peerNames(s, "t@a") != "" || len(f.subscribers["t@a"]) != 1 {
+        t.Fatal("Partner wasn't subscribed to the topic")
+    }
+
+    time.Sleep(4 * testSync)
+    f.sendSubscribers(ClusterUpdate { Server: "a", Node: "a", Seq: 2, Topic: "t@a" }, "")
+    if n := len(f.subscribers["t@a"]); n != 0 {
+        t.Fatalf("%d partners still subscribed after they stopped sending", n)
+    }
+}
+
+//partners may only send their own members of our topics, under their own name
+func TestFederationRejectsOtherServer(t *testing.T) {
+    s := &state {}
+    f, err := newFederation(s, "a", &FederationConfig { Partners: []FederationPartner {
+        { Name: "b", Secret: testFederationSecret },
+        { Name: "c", Secret: testFederationSecret },
+    } }, testSync)
+    if err != nil {
+        t.Fatal(err)
+    }
+    s.federation = f
+
+    f.receive("b", ClusterUpdate { Server: "c", Node: "n1", Seq: 1, Topic: "t@a", Peers: []Peer { { Name: "mallory" } } })
+    if names := peerNames(s, "t@a"); names != "" {
+        t.Fatalf("Applied members sent on behalf of another server: %s", names)
+    }
+}
+
+//closing the federation stops the resend loop and the partner dial loops
+func TestFederationClose(t *testing.T) {
+    a, aURL := newFederatedNode(t, nil, "a", "", FederationPartner { Name: "b", Secret: testFederationSecret })
+    s := &state {}
+    partner := FederationPartner { Name: "a", Secret: testFederationSecret }
+    b, err := newFederation(s, "b", &FederationConfig { Partners: []FederationPartner { partner } }, testSync)
+    if err != nil {
+        t.Fatal(err)
+    }
+    s.federation = b
+
+    running := sync.WaitGroup {}
+    running.Add(2)
+    go func() {
+        defer running.Done()
+        b.run()
+    }()
+    go func() {
+        defer running.Done()
+        partner.URL = aURL
+        b.dialLoop(partner)
+    }()
+    eventually(t, "b to link to a", func() bool {
+        return a.federation.linkCount("b") == 1
+    })
+
+    b.Close()
+    stopped := make(chan struct{})
+    go func() {
+        running.Wait()
+        close(stopped)
+    }()
+    select {
+        case <-stopped:
+        case <-time.After(5 * time.Second):
+            t.Fatal("Federation loops kept going after Close")
+    }
+    eventually(t, "a to lose its link to b", func() bool {
+        return a.federation.linkCount("b") == 0
+    })
+}
+
+func (f *federation) linkCount(partner string) int {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    return len(f.links[partner])
+}
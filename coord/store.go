@@ -0,0 +1,271 @@
+package coord
+
+import (
+    "encoding/json"
+    "fmt"
+    "sync"
+    "time"
+
+    bolt "go.etcd.io/bbolt"
+)
+
+//Store persists topic membership and name reservations, so a restarted server can
+//keep listing peers while they reconnect and names stay with their owners
+type Store interface {
+    SavePeer(topic string, peer Peer) error
+    DeletePeer(topic, name string) error
+    //returns every stored peer, keyed by topic
+    LoadPeers() (map[string][]Peer, error)
+    SaveReservation(topic string, r Reservation) error
+    DeleteReservation(topic, name string) error
+    //returns every stored reservation, keyed by topic
+    LoadReservations() (map[string][]Reservation, error)
+    Close() error
+}
+
+//Reservation ties a name in a topic to the token of the client that first registered
+//it, so nobody else can take the name while that client is away
+type Reservation struct {
+    Name     string    `json:"name"`
+    //hex SHA-256 of the token, the token itself is never stored
+    Token    string    `json:"token"`
+    //when the name was last registered or released
+    LastUsed time.Time `json:"last_used"`
+}
+
+func OpenStore(kind, path string) (Store, error) {
+    switch kind {
+        case "memory":
+            return &memoryStore {}, nil
+        case "bolt":
+            return openBoltStore(path)
+        default:
+            return nil, fmt.Errorf("Unknown store type '%s'", kind)
+    }
+}
+
+type memoryStore struct {
+    mu           sync.Mutex
+    topics       map[string]map[string]Peer
+    reservations map[string]map[string]Reservation
+}
+
+func (m *memoryStore) SavePeer(topic string, peer Peer) error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    if m.topics == nil {
+        m.topics = make(map[string]map[string]Peer)
+    }
+    peers, ok := m.topics[topic]
+    if !ok {
+        peers = make(map[string]Peer)
+        m.topics[topic] = peers
+    }
+    peers[peer.Name] = peer
+    return nil
+}
+
+func (m *memoryStore) DeletePeer(topic, name string) error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    if peers, ok := m.topics[topic]; ok {
+        delete(peers, name)
+        if len(peers) == 0 {
+            delete(m.topics, topic)
+        }
+    }
+    return nil
+}
+
+func (m *memoryStore) LoadPeers() (map[string][]Peer, error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    res := make(map[string][]Peer)
+    for topic, peers := range m.topics {
+        for _, peer := range peers {
+            res[topic] = append(res[topic], peer)
+        }
+    }
+    return res, nil
+}
+
+func (m *memoryStore) SaveReservation(topic string, r Reservation) error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    if m.reservations == nil {
+        m.reservations = make(map[string]map[string]Reservation)
+    }
+    names, ok := m.reservations[topic]
+    if !ok {
+        names = make(map[string]Reservation)
+        m.reservations[topic] = names
+    }
+    names[r.Name] = r
+    return nil
+}
+
+func (m *memoryStore) DeleteReservation(topic, name string) error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    if names, ok := m.reservations[topic]; ok {
+        delete(names, name)
+        if len(names) == 0 {
+            delete(m.reservations, topic)
+        }
+    }
+    return nil
+}
+
+func (m *memoryStore) LoadReservations() (map[string][]Reservation, error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    res := make(map[string][]Reservation)
+    for topic, names := range m.reservations {
+        for _, r := range names {
+            res[topic] = append(res[topic], r)
+        }
+    }
+    return res, nil
+}
+
+func (m *memoryStore) Close() error {
+    return nil
+}
+
+var (
+    topicsBucket       = []byte("topics")
+    reservationsBucket = []byte("reservations")
+)
+
+//stores one nested bucket per topic in topicsBucket, mapping peer names to their JSON
+//representation, and likewise for reservations in reservationsBucket
+type boltStore struct {
+    db *bolt.DB
+}
+
+func openBoltStore(path string) (*boltStore, error) {
+    db, err := bolt.Open(path, 0600, nil)
+    if err != nil {
+        return nil, fmt.Errorf("Unable to open store '%s': %w", path, err)
+    }
+
+    if err := db.Update(func(tx *bolt.Tx) error {
+        if _, err := tx.CreateBucketIfNotExists(topicsBucket); err != nil {
+            return err
+        }
+        _, err := tx.CreateBucketIfNotExists(reservationsBucket)
+        return err
+    }); err != nil {
+        db.Close()
+        return nil, fmt.Errorf("Unable to initialize store: %w", err)
+    }
+
+    return &boltStore { db: db }, nil
+}
+
+func (b *boltStore) SavePeer(topic string, peer Peer) error {
+    return b.put(topicsBucket, topic, peer.Name, peer)
+}
+
+func (b *boltStore) DeletePeer(topic, name string) error {
+    return b.delete(topicsBucket, topic, name)
+}
+
+func (b *boltStore) LoadPeers() (map[string][]Peer, error) {
+    res := make(map[string][]Peer)
+    err := b.load(topicsBucket, func(topic string, data []byte) error {
+        var peer Peer
+        if err := json.Unmarshal(data, &peer); err != nil {
+            return fmt.Errorf("Malformed peer in topic '%s': %w", topic, err)
+        }
+        res[topic] = append(res[topic], peer)
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
+    return res, nil
+}
+
+func (b *boltStore) SaveReservation(topic string, r Reservation) error {
+    return b.put(reservationsBucket, topic, r.Name, r)
+}
+
+func (b *boltStore) DeleteReservation(topic, name string) error {
+    return b.delete(reservationsBucket, topic, name)
+}
+
+func (b *boltStore) LoadReservations() (map[string][]Reservation, error) {
+    res := make(map[string][]Reservation)
+    err := b.load(reservationsBucket, func(topic string, data []byte) error {
+        var r Reservation
+        if err := json.Unmarshal(data, &r); err != nil {
+            return fmt.Errorf("Malformed reservation in topic '%s': %w", topic, err)
+        }
+        res[topic] = append(res[topic], r)
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
+    return res, nil
+}
+
+//stores the JSON of v under name in the bucket of topic inside root
+func (b *boltStore) put(root []byte, topic, name string, v interface{}) error {
+    data, err := json.Marshal(v)
+    if err != nil {
+        return err
+    }
+
+    return b.db.Update(func(tx *bolt.Tx) error {
+        t, err := tx.Bucket(root).CreateBucketIfNotExists([]byte(topic))
+        if err != nil {
+            return err
+        }
+        return t.Put([]byte(name), data)
+    })
+}
+
+//deletes name from the bucket of topic inside root, and the bucket once it's empty
+func (b *boltStore) delete(root []byte, topic, name string) error {
+    return b.db.Update(func(tx *bolt.Tx) error {
+        topics := tx.Bucket(root)
+        t := topics.Bucket([]byte(topic))
+        if t == nil {
+            return nil
+        }
+        if err := t.Delete([]byte(name)); err != nil {
+            return err
+        }
+        if k, _ := t.Cursor().First(); k == nil {
+            return topics.DeleteBucket([]byte(topic))
+        }
+        return nil
+    })
+}
+
+//calls fn with every value stored inside root and the topic it belongs to
+func (b *boltStore) load(root []byte, fn func(topic string, data []byte) error) error {
+    return b.db.View(func(tx *bolt.Tx) error {
+        return tx.Bucket(root).ForEach(func(topic, _ []byte) error {
+            t := tx.Bucket(root).Bucket(topic)
+            if t == nil {
+                return nil
+            }
+            return t.ForEach(func(_, data []byte) error {
+                return fn(string(topic), data)
+            })
+        })
+    })
+}
+
+func (b *boltStore) Close() error {
+    return b.db.Close()
+}
@@ -0,0 +1,158 @@
+package coord
+
+import (
+    "net"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+func openTestStore(t *testing.T, path string) Store {
+    t.Helper()
+    store, err := OpenStore("bolt", path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return store
+}
+
+func TestBoltStoreRoundTrip(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "coord.db")
+    store := openTestStore(t, path)
+
+    mapped := &net.UDPAddr { IP: net.IPv4(198, 51, 100, 7).To4(), Port: 4000 }
+    peers := []Peer {
+        { Name: "alice", IP: net.IPv4(192, 0, 2, 1).To4(), Port: 1234, PublicKey: "ak", Mapped: mapped },
+        { Name: "bob", IP: net.IPv4(192, 0, 2, 2).To4(), Port: 1235 },
+    }
+    for _, p := range peers {
+        if err := store.SavePeer("t1", p); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if err := store.SavePeer("t2", peers[1]); err != nil {
+        t.Fatal(err)
+    }
+    if err := store.DeletePeer("t2", "bob"); err != nil {
+        t.Fatal(err)
+    }
+    r := Reservation { Name: "alice", Token: hashToken("secret"), LastUsed: time.Unix(1700000000, 0) }
+    if err := store.SaveReservation("t1", r); err != nil {
+        t.Fatal(err)
+    }
+    if err := store.Close(); err != nil {
+        t.Fatal(err)
+    }
+
+    store = openTestStore(t, path)
+    defer store.Close()
+
+    loaded, err := store.LoadPeers()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(loaded) != 1 || len(loaded["t1"]) != 2 {
+        t.Fatalf("Loaded %v", loaded)
+    }
+    for _, p := range loaded["t1"] {
+        if p.Name == "alice" && (p.PublicKey != "ak" || p.Mapped == nil || p.Mapped.String() != mapped.String()) {
+            t.Fatalf("Loaded alice as %+v", p)
+        }
+    }
+
+    reservations, err := store.LoadReservations()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if got := reservations["t1"]; len(got) != 1 || got[0].Token != r.Token || !got[0].LastUsed.Equal(r.LastUsed) {
+        t.Fatalf("Loaded reservations %v", reservations)
+    }
+}
+
+//restored peers stay listed for the grace window, unless they reconnect
+func TestRestartGrace(t *testing.T) {
+    const grace = 200 * time.Millisecond
+
+    path := filepath.Join(t.TempDir(), "coord.db")
+    store := openTestStore(t, path)
+    s := &state { store: store }
+    register(t, s, "t1", "alice")
+    register(t, s, "t1", "bob")
+    if err := store.Close(); err != nil {
+        t.Fatal(err)
+    }
+
+    store = openTestStore(t, path)
+    defer store.Close()
+    s = &state { store: store }
+    if err := s.restore(grace); err != nil {
+        t.Fatal(err)
+    }
+    if names := peerNames(s, "t1"); names != "alice,bob" {
+        t.Fatalf("Restored '%s'", names)
+    }
+
+    register(t, s, "t1", "alice")
+    s.evictStale(time.Minute)
+    if names := peerNames(s, "t1"); names != "alice,bob" {
+        t.Fatalf("Dropped restored peers early, listing '%s'", names)
+    }
+
+    time.Sleep(grace)
+    s.evictStale(time.Minute)
+    if names := peerNames(s, "t1"); names != "alice" {
+        t.Fatalf("Expected bob to drop out, listing '%s'", names)
+    }
+}
+
+//a name registered with a token can only be taken back with it, even after a restart
+func TestReservedNames(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "coord.db")
+    store := openTestStore(t, path)
+    s := &state { store: store }
+
+    ip := net.IPv4(192, 0, 2, 1).To4()
+    ch, err := s.topic("t1").tryRegister("alice", ip, 1234, "", nil, "secret")
+    if err != nil {
+        t.Fatal(err)
+    }
+    s.topic("t1").unregister("alice", ch)
+    if _, err := s.topic("t1").tryRegister("alice", ip, 1234, "", nil, ""); err != errNameReserved {
+        t.Fatalf("Registered a reserved name without its token: %v", err)
+    }
+    if err := store.Close(); err != nil {
+        t.Fatal(err)
+    }
+
+    store = openTestStore(t, path)
+    defer store.Close()
+    s = &state {
+        store:          store,
+        reservationTTL: time.Hour,
+    }
+    if err := s.restore(time.Minute); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := s.topic("t1").tryRegister("alice", ip, 1234, "", nil, "wrong"); err != errNameReserved {
+        t.Fatalf("Registered a reserved name with the wrong token: %v", err)
+    }
+    ch, err = s.topic("t1").tryRegister("alice", ip, 1234, "", nil, "secret")
+    if err != nil {
+        t.Fatalf("Refused the owner of a reserved name: %v", err)
+    }
+    s.topic("t1").unregister("alice", ch)
+
+    //released once unused for longer than the TTL
+    s.reservationTTL = time.Nanosecond
+    s.evictStale(time.Minute)
+    if _, err := s.topic("t1").tryRegister("alice", ip, 1234, "", nil, ""); err != nil {
+        t.Fatalf("Name stayed reserved after the TTL: %v", err)
+    }
+    reservations, err := store.LoadReservations()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(reservations) != 0 {
+        t.Fatalf("Reservations left in the store: %v", reservations)
+    }
+}
@@ -7,4 +7,12 @@ require (
 	github.com/pion/stun v0.3.5
 )
 
-require github.com/gorilla/websocket v1.5.0
+require (
+	github.com/gorilla/websocket v1.5.0
+	go.etcd.io/bbolt v1.3.6
+	golang.org/x/crypto v0.14.0
+	golang.org/x/net v0.17.0
+	golang.org/x/term v0.13.0
+)
+
+require golang.org/x/sys v0.13.0 // indirect
@@ -9,6 +9,8 @@ import (
 
     "github.com/natanbc/ssc0904-nat-traversal/client"
     "github.com/natanbc/ssc0904-nat-traversal/coord"
+    "github.com/natanbc/ssc0904-nat-traversal/portmap"
+    "github.com/natanbc/ssc0904-nat-traversal/stun"
 
     "github.com/peterbourgon/ff/v3/ffcli"
 )
@@ -24,6 +26,8 @@ func main() {
         Subcommands: []*ffcli.Command {
             client.Command,
             coord.Command,
+            stun.LifetimeCommand,
+            portmap.Command,
         },
         Exec:        func(context.Context, []string) error { return flag.ErrHelp },
     }
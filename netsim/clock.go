@@ -0,0 +1,99 @@
+package netsim
+
+import (
+    "sync"
+    "time"
+)
+
+//Clock is what a Network tells time with: when NAT mappings expire and when delayed
+//packets arrive. Read deadlines of sockets are absolute times given by the caller, so
+//they always follow the system clock.
+type Clock interface {
+    Now() time.Time
+    //calls f in its own goroutine once d passed
+    AfterFunc(d time.Duration, f func())
+}
+
+//the system clock, used when Config has none
+type realClock struct {}
+
+func (realClock) Now() time.Time {
+    return time.Now()
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) {
+    time.AfterFunc(d, f)
+}
+
+//ManualClock only moves when told to, so packets are delivered and mappings expire at
+//exactly the same points of every run
+type ManualClock struct {
+    mu     sync.Mutex
+    now    time.Time
+    timers []manualTimer
+    //orders timers due at the same time by when they were scheduled
+    seq    uint64
+}
+
+type manualTimer struct {
+    when time.Time
+    seq  uint64
+    f    func()
+}
+
+func NewManualClock(start time.Time) *ManualClock {
+    return &ManualClock {
+        now: start,
+    }
+}
+
+func (c *ManualClock) Now() time.Time {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return c.now
+}
+
+//schedules f to run once Advance moves the clock d past now. Unlike the system clock f
+//runs in the goroutine calling Advance, so it's done when Advance returns.
+func (c *ManualClock) AfterFunc(d time.Duration, f func()) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.timers = append(c.timers, manualTimer {
+        when: c.now.Add(d),
+        seq:  c.seq,
+        f:    f,
+    })
+    c.seq++
+}
+
+//moves the clock forward by d, running the functions that become due in the order
+//they're due, and the ones due together in the order they were scheduled. Functions
+//scheduled while advancing run too if they're due before the new time.
+func (c *ManualClock) Advance(d time.Duration) {
+    c.mu.Lock()
+    target := c.now.Add(d)
+    for {
+        next := -1
+        for i, t := range c.timers {
+            if t.when.After(target) {
+                continue
+            }
+            if next < 0 || t.when.Before(c.timers[next].when) || (t.when.Equal(c.timers[next].when) && t.seq < c.timers[next].seq) {
+                next = i
+            }
+        }
+        if next < 0 {
+            break
+        }
+        t := c.timers[next]
+        c.timers = append(c.timers[:next], c.timers[next + 1:]...)
+        if t.when.After(c.now) {
+            c.now = t.when
+        }
+        c.mu.Unlock()
+        t.f()
+        c.mu.Lock()
+    }
+    c.now = target
+    c.mu.Unlock()
+}
@@ -0,0 +1,500 @@
+package netsim
+
+import (
+    "context"
+    "fmt"
+    "net"
+    "net/netip"
+    "os"
+    "strconv"
+    "sync"
+    "syscall"
+    "time"
+)
+
+//Host is a simulated machine with a single address, public or behind a NAT. Its
+//methods mirror the net package's, so code given them runs on the simulated network.
+type Host struct {
+    network  *Network
+    //nil for hosts on the internet
+    nat      *NAT
+    ip       netip.Addr
+
+    mu        sync.Mutex
+    conns     map[uint16]*Conn
+    listeners map[uint16]*listener
+    streams   map[*streamConn]struct{}
+    nextPort  uint16
+    closed    bool
+}
+
+func newHost(n *Network, nat *NAT, ip netip.Addr) *Host {
+    return &Host {
+        network:   n,
+        nat:       nat,
+        ip:        ip,
+        conns:     make(map[uint16]*Conn),
+        listeners: make(map[uint16]*listener),
+        streams:   make(map[*streamConn]struct{}),
+        nextPort:  firstEphemeral,
+    }
+}
+
+//the address of the host, private for hosts behind a NAT
+func (h *Host) IP() net.IP {
+    return h.ip.AsSlice()
+}
+
+//the port asked for, or the next free one if 0, which must not be in use by taken
+func (h *Host) allocPort(port uint16, taken func(uint16) bool) (uint16, error) {
+    if h.closed {
+        return 0, net.ErrClosed
+    }
+    if port != 0 {
+        if taken(port) {
+            return 0, syscall.EADDRINUSE
+        }
+        return port, nil
+    }
+    for i := 0; i < 65536 - firstEphemeral; i++ {
+        port := h.nextPort
+        h.nextPort++
+        if h.nextPort == 0 {
+            h.nextPort = firstEphemeral
+        }
+        if !taken(port) {
+            return port, nil
+        }
+    }
+    return 0, syscall.EADDRINUSE
+}
+
+//the port to bind from an address like the ones given to net.ListenPacket
+func (h *Host) bindPort(network, address string, networks ...string) (uint16, error) {
+    known := false
+    for _, n := range networks {
+        known = known || n == network
+    }
+    if !known {
+        return 0, net.UnknownNetworkError(network)
+    }
+    host, portRaw, err := net.SplitHostPort(address)
+    if err != nil {
+        return 0, err
+    }
+    if host != "" {
+        ip, err := netip.ParseAddr(host)
+        if err != nil || (!ip.IsUnspecified() && ip != h.ip) {
+            return 0, fmt.Errorf("Unable to bind %s: %w", address, syscall.EADDRNOTAVAIL)
+        }
+    }
+    port, err := strconv.ParseUint(portRaw, 10, 16)
+    if err != nil {
+        return 0, fmt.Errorf("Invalid port '%s'", portRaw)
+    }
+    return uint16(port), nil
+}
+
+//opens a UDP socket, like net.ListenPacket, on "udp" or "udp4"
+func (h *Host) ListenPacket(network, address string) (net.PacketConn, error) {
+    port, err := h.bindPort(network, address, "udp", "udp4")
+    if err != nil {
+        return nil, err
+    }
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    port, err = h.allocPort(port, func(p uint16) bool {
+        return h.conns[p] != nil
+    })
+    if err != nil {
+        return nil, &net.OpError { Op: "listen", Net: network, Err: err }
+    }
+    c := &Conn {
+        host:     h,
+        local:    netip.AddrPortFrom(h.ip, port),
+        queue:    make(chan packet, socketQueue),
+        done:     make(chan struct{}),
+        deadline: makeDeadline(),
+    }
+    h.conns[port] = c
+    return c, nil
+}
+
+//sends a datagram from one of the host's sockets, hosts behind a NAT reach the others
+//behind it directly
+func (h *Host) send(p packet) {
+    if p.dst.Addr() == h.ip {
+        h.receive(p)
+        return
+    }
+    if h.nat == nil {
+        h.network.route(p)
+        return
+    }
+    if target := h.nat.host(p.dst.Addr()); target != nil {
+        target.receive(p)
+        return
+    }
+    h.nat.outbound(p)
+}
+
+func (h *Host) receive(p packet) {
+    h.mu.Lock()
+    c := h.conns[p.dst.Port()]
+    h.mu.Unlock()
+    if c == nil {
+        return
+    }
+    //a full socket buffer drops the datagram, like the kernel does
+    select {
+        case c.queue <- p:
+        default:
+    }
+}
+
+//closes every socket, listener and stream of the host and takes it off the network
+func (h *Host) Close() error {
+    h.mu.Lock()
+    if h.closed {
+        h.mu.Unlock()
+        return net.ErrClosed
+    }
+    h.closed = true
+    conns := make([]*Conn, 0, len(h.conns))
+    for _, c := range h.conns {
+        conns = append(conns, c)
+    }
+    listeners := make([]*listener, 0, len(h.listeners))
+    for _, l := range h.listeners {
+        listeners = append(listeners, l)
+    }
+    streams := make([]*streamConn, 0, len(h.streams))
+    for c := range h.streams {
+        streams = append(streams, c)
+    }
+    h.mu.Unlock()
+
+    for _, c := range conns {
+        c.Close()
+    }
+    for _, l := range listeners {
+        l.Close()
+    }
+    for _, c := range streams {
+        c.Close()
+    }
+    if h.nat != nil {
+        h.nat.detach(h.ip)
+    } else {
+        h.network.detach(h.ip)
+    }
+    return nil
+}
+
+//Conn is a simulated UDP socket
+type Conn struct {
+    host      *Host
+    local     netip.AddrPort
+    queue     chan packet
+    done      chan struct{}
+    closeOnce sync.Once
+    deadline  deadline
+}
+
+func (c *Conn) opError(op string, addr net.Addr, err error) error {
+    return &net.OpError { Op: op, Net: "udp", Source: c.LocalAddr(), Addr: addr, Err: err }
+}
+
+func (c *Conn) ReadFrom(b []byte) (int, net.Addr, error) {
+    select {
+        case <-c.done:
+            return 0, nil, c.opError("read", nil, net.ErrClosed)
+        case <-c.deadline.wait():
+            return 0, nil, c.opError("read", nil, os.ErrDeadlineExceeded)
+        default:
+    }
+    select {
+        case p := <-c.queue:
+            return copy(b, p.data), udpAddr(p.src), nil
+        case <-c.done:
+            return 0, nil, c.opError("read", nil, net.ErrClosed)
+        case <-c.deadline.wait():
+            return 0, nil, c.opError("read", nil, os.ErrDeadlineExceeded)
+    }
+}
+
+func (c *Conn) WriteTo(b []byte, addr net.Addr) (int, error) {
+    return c.writeTo(b, addr, defaultTTL)
+}
+
+//sends a datagram dropped after ttl hops: the first one is the NAT in front of the host,
+//then a few routers across the internet, then the NAT in front of the destination
+func (c *Conn) WriteToTTL(b []byte, addr *net.UDPAddr, ttl int) (int, error) {
+    return c.writeTo(b, addr, ttl)
+}
+
+func (c *Conn) writeTo(b []byte, addr net.Addr, ttl int) (int, error) {
+    select {
+        case <-c.done:
+            return 0, c.opError("write", addr, net.ErrClosed)
+        default:
+    }
+    to, ok := addr.(*net.UDPAddr)
+    if !ok {
+        return 0, c.opError("write", addr, syscall.EINVAL)
+    }
+    dst := to.AddrPort()
+    dst = netip.AddrPortFrom(dst.Addr().Unmap(), dst.Port())
+    if !dst.Addr().Is4() {
+        return 0, c.opError("write", addr, syscall.EAFNOSUPPORT)
+    }
+    c.host.send(packet {
+        src:  c.local,
+        dst:  dst,
+        data: append([]byte(nil), b...),
+        ttl:  ttl,
+    })
+    return len(b), nil
+}
+
+func (c *Conn) Close() error {
+    err := net.ErrClosed
+    c.closeOnce.Do(func() {
+        close(c.done)
+        c.host.mu.Lock()
+        delete(c.host.conns, c.local.Port())
+        c.host.mu.Unlock()
+        err = nil
+    })
+    return err
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+    return udpAddr(c.local)
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+    return c.SetReadDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+    c.deadline.set(t)
+    return nil
+}
+
+//writes never block, so they need no deadline
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+    return nil
+}
+
+//deadline is closed once a read deadline passes, like the one of net.Pipe
+type deadline struct {
+    mu     sync.Mutex
+    timer  *time.Timer
+    cancel chan struct{}
+}
+
+func makeDeadline() deadline {
+    return deadline {
+        cancel: make(chan struct{}),
+    }
+}
+
+func (d *deadline) set(t time.Time) {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+
+    //the timer already fired, wait for it to close the channel
+    if d.timer != nil && !d.timer.Stop() {
+        <-d.cancel
+    }
+    d.timer = nil
+
+    closed := false
+    select {
+        case <-d.cancel:
+            closed = true
+        default:
+    }
+    if t.IsZero() {
+        if closed {
+            d.cancel = make(chan struct{})
+        }
+        return
+    }
+    if dur := time.Until(t); dur > 0 {
+        if closed {
+            d.cancel = make(chan struct{})
+        }
+        cancel := d.cancel
+        d.timer = time.AfterFunc(dur, func() {
+            close(cancel)
+        })
+        return
+    }
+    if !closed {
+        close(d.cancel)
+    }
+}
+
+func (d *deadline) wait() chan struct{} {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    return d.cancel
+}
+
+//listener accepts streams, which are in memory pipes: reliable and immediate, as the
+//TCP they stand for retransmits and orders data anyway
+type listener struct {
+    host      *Host
+    addr      netip.AddrPort
+    conns     chan net.Conn
+    done      chan struct{}
+    closeOnce sync.Once
+}
+
+//listens for streams, like net.Listen, on "tcp" or "tcp4"
+func (h *Host) Listen(network, address string) (net.Listener, error) {
+    port, err := h.bindPort(network, address, "tcp", "tcp4")
+    if err != nil {
+        return nil, err
+    }
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    port, err = h.allocPort(port, func(p uint16) bool {
+        return h.listeners[p] != nil
+    })
+    if err != nil {
+        return nil, &net.OpError { Op: "listen", Net: network, Err: err }
+    }
+    l := &listener {
+        host:  h,
+        addr:  netip.AddrPortFrom(h.ip, port),
+        conns: make(chan net.Conn),
+        done:  make(chan struct{}),
+    }
+    h.listeners[port] = l
+    return l, nil
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+    select {
+        case c := <-l.conns:
+            return c, nil
+        case <-l.done:
+            return nil, &net.OpError { Op: "accept", Net: "tcp", Addr: l.Addr(), Err: net.ErrClosed }
+    }
+}
+
+func (l *listener) Close() error {
+    err := net.ErrClosed
+    l.closeOnce.Do(func() {
+        close(l.done)
+        l.host.mu.Lock()
+        delete(l.host.listeners, l.addr.Port())
+        l.host.mu.Unlock()
+        err = nil
+    })
+    return err
+}
+
+func (l *listener) Addr() net.Addr {
+    return tcpAddr(l.addr)
+}
+
+//a side of a stream, reporting the addresses of its ends
+type streamConn struct {
+    net.Conn
+    host   *Host
+    local  net.Addr
+    remote net.Addr
+}
+
+func newStreamConn(h *Host, conn net.Conn, local, remote net.Addr) (*streamConn, error) {
+    c := &streamConn {
+        Conn:   conn,
+        host:   h,
+        local:  local,
+        remote: remote,
+    }
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    if h.closed {
+        return nil, net.ErrClosed
+    }
+    h.streams[c] = struct{}{}
+    return c, nil
+}
+
+func (c *streamConn) Close() error {
+    c.host.mu.Lock()
+    delete(c.host.streams, c)
+    c.host.mu.Unlock()
+    return c.Conn.Close()
+}
+
+func (c *streamConn) LocalAddr() net.Addr {
+    return c.local
+}
+
+func (c *streamConn) RemoteAddr() net.Addr {
+    return c.remote
+}
+
+//opens a stream to a host listening on address, like net.Dialer.DialContext, on "tcp"
+//or "tcp4". Only hosts on the internet or behind the same NAT can be reached.
+func (h *Host) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+    if network != "tcp" && network != "tcp4" {
+        return nil, net.UnknownNetworkError(network)
+    }
+    dst, err := netip.ParseAddrPort(address)
+    if err != nil {
+        return nil, &net.OpError { Op: "dial", Net: network, Err: err }
+    }
+    fail := func(err error) (net.Conn, error) {
+        return nil, &net.OpError { Op: "dial", Net: network, Addr: tcpAddr(dst), Err: err }
+    }
+
+    target := h.network.streamTarget(h, dst.Addr())
+    if target == nil {
+        return fail(syscall.EHOSTUNREACH)
+    }
+    target.mu.Lock()
+    l := target.listeners[dst.Port()]
+    target.mu.Unlock()
+    if l == nil {
+        return fail(syscall.ECONNREFUSED)
+    }
+
+    h.mu.Lock()
+    port, err := h.allocPort(0, func(p uint16) bool {
+        return h.listeners[p] != nil
+    })
+    h.mu.Unlock()
+    if err != nil {
+        return fail(err)
+    }
+    local := tcpAddr(netip.AddrPortFrom(h.ip, port))
+    client, server := net.Pipe()
+    accepted, err := newStreamConn(target, server, l.Addr(), local)
+    if err != nil {
+        client.Close()
+        return fail(syscall.ECONNREFUSED)
+    }
+    dialed, err := newStreamConn(h, client, local, l.Addr())
+    if err != nil {
+        accepted.Close()
+        return fail(err)
+    }
+    select {
+        case l.conns <- accepted:
+            return dialed, nil
+        case <-l.done:
+            err = syscall.ECONNREFUSED
+        case <-ctx.Done():
+            err = ctx.Err()
+    }
+    dialed.Close()
+    accepted.Close()
+    return fail(err)
+}
@@ -0,0 +1,292 @@
+package netsim
+
+import (
+    "fmt"
+    "net"
+    "net/netip"
+    "sync"
+    "time"
+)
+
+//Behavior is what NAT mappings and filters depend on, as classified by RFC 4787
+type Behavior int
+
+const (
+    //only on the internal address
+    EndpointIndependent Behavior = iota
+    //also on the IP of the remote host
+    AddressDependent
+    //also on the IP and port of the remote host
+    AddressPortDependent
+)
+
+func (b Behavior) String() string {
+    switch b {
+        case EndpointIndependent:
+            return "endpoint independent"
+        case AddressDependent:
+            return "address dependent"
+        case AddressPortDependent:
+            return "address and port dependent"
+        default:
+            return fmt.Sprintf("Behavior(%d)", int(b))
+    }
+}
+
+//NATConfig configures how a NAT maps and filters packets
+type NATConfig struct {
+    //whether the same internal address is given the same external port for every
+    //remote host (endpoint independent) or a new one for each
+    Mapping     Behavior
+    //which remote hosts may send packets through a mapping: anyone (endpoint
+    //independent), or only those the mapping already sent packets to
+    Filtering   Behavior
+    //idle time after which a mapping is dropped, only packets sent by the host behind
+    //the NAT keep it alive. Mappings never expire if 0.
+    Timeout     time.Duration
+    //whether packets from hosts behind the NAT to its public address go through the
+    //mapping they're sent to, instead of being dropped
+    Hairpinning bool
+    //whether mappings get the port of the internal address when it's free, so a
+    //mapping that expired comes back at the same port, like many NATs do
+    PreservePorts bool
+}
+
+//the classic NAT types, copied and changed for other behaviors or timeouts
+var (
+    //anyone can reach a mapping once it exists
+    FullCone       = NATConfig { Mapping: EndpointIndependent, Filtering: EndpointIndependent }
+    //only hosts a mapping sent packets to can reach it, from any port
+    Restricted     = NATConfig { Mapping: EndpointIndependent, Filtering: AddressDependent }
+    //only the addresses a mapping sent packets to can reach it
+    PortRestricted = NATConfig { Mapping: EndpointIndependent, Filtering: AddressPortDependent }
+    //a new mapping for every remote address, which only it can reach
+    Symmetric      = NATConfig { Mapping: AddressPortDependent, Filtering: AddressPortDependent }
+)
+
+//NAT is a router with a public address, translating the addresses of the hosts behind it
+type NAT struct {
+    network  *Network
+    ip       netip.Addr
+    config   NATConfig
+
+    mu       sync.Mutex
+    hosts    map[netip.Addr]*Host
+    mappings map[mappingKey]*mapping
+    //mappings by external port
+    ports    map[uint16]*mapping
+    nextPort uint16
+}
+
+//what a mapping is looked up by: the internal address, and the parts of the remote one
+//the mapping behavior depends on
+type mappingKey struct {
+    internal netip.AddrPort
+    remote   netip.AddrPort
+}
+
+type mapping struct {
+    key      mappingKey
+    external uint16
+    //remote addresses packets were sent to, which filtering lets reach the mapping
+    remotes  map[netip.AddrPort]struct{}
+    lastSent time.Time
+}
+
+func newNAT(n *Network, ip netip.Addr, config NATConfig) *NAT {
+    return &NAT {
+        network:  n,
+        ip:       ip,
+        config:   config,
+        hosts:    make(map[netip.Addr]*Host),
+        mappings: make(map[mappingKey]*mapping),
+        ports:    make(map[uint16]*mapping),
+        nextPort: firstMapped,
+    }
+}
+
+//the public address of the NAT
+func (nat *NAT) IP() net.IP {
+    return nat.ip.AsSlice()
+}
+
+//creates a host behind the NAT with a private address
+func (nat *NAT) NewHost(ip string) (*Host, error) {
+    addr, err := parseIPv4(ip)
+    if err != nil {
+        return nil, err
+    }
+    if addr == nat.ip {
+        return nil, fmt.Errorf("Address %s is the NAT's", addr)
+    }
+    nat.mu.Lock()
+    defer nat.mu.Unlock()
+    if _, ok := nat.hosts[addr]; ok {
+        return nil, fmt.Errorf("Address %s is already in use", addr)
+    }
+    h := newHost(nat.network, nat, addr)
+    nat.hosts[addr] = h
+    return h, nil
+}
+
+func (nat *NAT) host(addr netip.Addr) *Host {
+    nat.mu.Lock()
+    defer nat.mu.Unlock()
+    return nat.hosts[addr]
+}
+
+func (nat *NAT) detach(addr netip.Addr) {
+    nat.mu.Lock()
+    defer nat.mu.Unlock()
+    delete(nat.hosts, addr)
+}
+
+//the number of mappings that didn't expire
+func (nat *NAT) Mappings() int {
+    nat.mu.Lock()
+    defer nat.mu.Unlock()
+    now := nat.network.clock.Now()
+    n := 0
+    for _, m := range nat.mappings {
+        if !nat.expired(m, now) {
+            n++
+        }
+    }
+    return n
+}
+
+func (nat *NAT) expired(m *mapping, now time.Time) bool {
+    return nat.config.Timeout > 0 && now.Sub(m.lastSent) > nat.config.Timeout
+}
+
+func (nat *NAT) key(internal, remote netip.AddrPort) mappingKey {
+    switch nat.config.Mapping {
+        case AddressDependent:
+            remote = netip.AddrPortFrom(remote.Addr(), 0)
+        case AddressPortDependent:
+            //the whole remote address
+        default:
+            remote = netip.AddrPort {}
+    }
+    return mappingKey {
+        internal: internal,
+        remote:   remote,
+    }
+}
+
+//the mapping packets from internal to remote go through, created if needed
+func (nat *NAT) mappingFor(internal, remote netip.AddrPort, now time.Time) (*mapping, bool) {
+    key := nat.key(internal, remote)
+    if m, ok := nat.mappings[key]; ok {
+        if !nat.expired(m, now) {
+            return m, true
+        }
+        nat.remove(m)
+    }
+    if nat.config.PreservePorts {
+        if m, ok := nat.newMapping(key, internal.Port(), now); ok {
+            return m, true
+        }
+    }
+    for i := 0; i < 65536 - firstMapped; i++ {
+        port := nat.nextPort
+        nat.nextPort++
+        if nat.nextPort == 0 {
+            nat.nextPort = firstMapped
+        }
+        if m, ok := nat.newMapping(key, port, now); ok {
+            return m, true
+        }
+    }
+    return nil, false
+}
+
+//a mapping at the external port, unless one that didn't expire has it
+func (nat *NAT) newMapping(key mappingKey, port uint16, now time.Time) (*mapping, bool) {
+    if old, ok := nat.ports[port]; ok {
+        if !nat.expired(old, now) {
+            return nil, false
+        }
+        nat.remove(old)
+    }
+    m := &mapping {
+        key:      key,
+        external: port,
+        remotes:  make(map[netip.AddrPort]struct{}),
+    }
+    nat.mappings[key] = m
+    nat.ports[port] = m
+    return m, true
+}
+
+func (nat *NAT) remove(m *mapping) {
+    delete(nat.mappings, m.key)
+    delete(nat.ports, m.external)
+}
+
+//whether filtering lets packets from remote reach the mapping
+func (nat *NAT) allowed(m *mapping, remote netip.AddrPort) bool {
+    switch nat.config.Filtering {
+        case AddressDependent:
+            for r := range m.remotes {
+                if r.Addr() == remote.Addr() {
+                    return true
+                }
+            }
+            return false
+        case AddressPortDependent:
+            _, ok := m.remotes[remote]
+            return ok
+        default:
+            return true
+    }
+}
+
+//translates a packet from a host behind the NAT, sending it to the internet
+func (nat *NAT) outbound(p packet) {
+    if !p.forward() {
+        return
+    }
+    now := nat.network.clock.Now()
+    nat.mu.Lock()
+    m, ok := nat.mappingFor(p.src, p.dst, now)
+    if ok {
+        m.lastSent = now
+        m.remotes[p.dst] = struct{}{}
+        p.src = netip.AddrPortFrom(nat.ip, m.external)
+    }
+    nat.mu.Unlock()
+    if !ok {
+        return
+    }
+
+    if p.dst.Addr() == nat.ip {
+        if nat.config.Hairpinning {
+            nat.receive(p)
+        }
+        return
+    }
+    nat.network.route(p)
+}
+
+//translates a packet from the internet, delivering it to the host behind the NAT if
+//a mapping exists and lets it through
+func (nat *NAT) receive(p packet) {
+    if !p.forward() {
+        return
+    }
+    nat.mu.Lock()
+    m, ok := nat.ports[p.dst.Port()]
+    if ok && (nat.expired(m, nat.network.clock.Now()) || !nat.allowed(m, p.src)) {
+        ok = false
+    }
+    var h *Host
+    if ok {
+        p.dst = m.key.internal
+        h = nat.hosts[p.dst.Addr()]
+    }
+    nat.mu.Unlock()
+    if h != nil {
+        h.receive(p)
+    }
+}
@@ -0,0 +1,245 @@
+package netsim
+
+import (
+    "encoding/binary"
+    "fmt"
+    "hash/fnv"
+    "net"
+    "net/netip"
+    "sync"
+    "time"
+)
+
+const (
+    //TTL of packets sent without one, like most systems do
+    defaultTTL     = 64
+    //routers between any two addresses on the internet, each one decrementing the TTL
+    internetHops   = 4
+    //datagrams waiting to be read before a socket drops new ones
+    socketQueue    = 1024
+    //first port given to sockets bound to port 0, and to mappings of NATs
+    firstEphemeral = 40000
+    firstMapped    = 20000
+)
+
+//Config configures the links of a Network
+type Config struct {
+    //one way delay of packets crossing the internet
+    Latency time.Duration
+    //packets are delayed up to this much more, so they may arrive out of order
+    Jitter  time.Duration
+    //probability of a packet crossing the internet being dropped, from 0 to 1
+    Loss    float64
+    //decides which packets are lost and how much they're delayed, together with their
+    //addresses and how many packets went between them before. Runs with the same seed
+    //lose and delay the same packets, whichever order goroutines send them in.
+    Seed    int64
+    //tells when mappings expire and delayed packets arrive, the system clock if nil
+    Clock   Clock
+}
+
+//Network is a simulated IPv4 internet. Hosts are either on it with a public address,
+//or behind a NAT with a private one, and everything is in memory, so the hosts of
+//a network only see each other's packets. Links behind a NAT are perfect, latency,
+//jitter and loss only apply to the internet.
+type Network struct {
+    config Config
+    clock  Clock
+
+    mu     sync.Mutex
+    //hosts and NATs by their public address
+    nodes  map[netip.Addr]node
+    //packets that crossed the internet between each pair of addresses
+    flows  map[flow]uint64
+}
+
+type flow struct {
+    src netip.AddrPort
+    dst netip.AddrPort
+}
+
+//node is what packets crossing the internet are delivered to
+type node interface {
+    receive(p packet)
+}
+
+type packet struct {
+    src  netip.AddrPort
+    dst  netip.AddrPort
+    data []byte
+    ttl  int
+}
+
+//forwards a packet through a router, false if its TTL ran out
+func (p *packet) forward() bool {
+    if p.ttl <= 1 {
+        return false
+    }
+    p.ttl--
+    return true
+}
+
+func New(config Config) *Network {
+    clock := config.Clock
+    if clock == nil {
+        clock = realClock {}
+    }
+    return &Network {
+        config: config,
+        clock:  clock,
+        nodes:  make(map[netip.Addr]node),
+        flows:  make(map[flow]uint64),
+    }
+}
+
+func parseIPv4(ip string) (netip.Addr, error) {
+    addr, err := netip.ParseAddr(ip)
+    if err != nil || !addr.Is4() {
+        return netip.Addr {}, fmt.Errorf("Invalid IPv4 address '%s'", ip)
+    }
+    return addr, nil
+}
+
+//claims a public address for a host or NAT
+func (n *Network) attach(ip string, nd func(netip.Addr) node) (node, error) {
+    addr, err := parseIPv4(ip)
+    if err != nil {
+        return nil, err
+    }
+    n.mu.Lock()
+    defer n.mu.Unlock()
+    if _, ok := n.nodes[addr]; ok {
+        return nil, fmt.Errorf("Address %s is already in use", addr)
+    }
+    v := nd(addr)
+    n.nodes[addr] = v
+    return v, nil
+}
+
+func (n *Network) detach(addr netip.Addr) {
+    n.mu.Lock()
+    defer n.mu.Unlock()
+    delete(n.nodes, addr)
+}
+
+//creates a host on the internet with a public address
+func (n *Network) NewHost(ip string) (*Host, error) {
+    v, err := n.attach(ip, func(addr netip.Addr) node {
+        return newHost(n, nil, addr)
+    })
+    if err != nil {
+        return nil, err
+    }
+    return v.(*Host), nil
+}
+
+//creates a NAT with a public address, hosts behind it are created with NAT.NewHost
+func (n *Network) NewNAT(ip string, config NATConfig) (*NAT, error) {
+    v, err := n.attach(ip, func(addr netip.Addr) node {
+        return newNAT(n, addr, config)
+    })
+    if err != nil {
+        return nil, err
+    }
+    return v.(*NAT), nil
+}
+
+//sends a packet across the internet, where it may be lost or delayed
+func (n *Network) route(p packet) {
+    for i := 0; i < internetHops; i++ {
+        if !p.forward() {
+            return
+        }
+    }
+
+    lost, delay := n.fate(p)
+    if lost {
+        return
+    }
+    //delivered right away without latency, keeping the order packets were sent in
+    if delay <= 0 {
+        n.deliver(p)
+        return
+    }
+    n.clock.AfterFunc(delay, func() {
+        n.deliver(p)
+    })
+}
+
+//whether a packet crossing the internet is lost, and how long it takes otherwise. Both
+//are drawn from a hash of the seed, the addresses of the packet and how many packets
+//went between them before, so they don't depend on the order packets of different
+//flows are sent in.
+func (n *Network) fate(p packet) (bool, time.Duration) {
+    if n.config.Loss <= 0 && n.config.Jitter <= 0 {
+        return false, n.config.Latency
+    }
+    n.mu.Lock()
+    f := flow { src: p.src, dst: p.dst }
+    seq := n.flows[f]
+    n.flows[f]++
+    n.mu.Unlock()
+
+    var b [28]byte
+    binary.BigEndian.PutUint64(b[0:8], uint64(n.config.Seed))
+    src, dst := p.src.Addr().As4(), p.dst.Addr().As4()
+    copy(b[8:12], src[:])
+    binary.BigEndian.PutUint16(b[12:14], p.src.Port())
+    copy(b[14:18], dst[:])
+    binary.BigEndian.PutUint16(b[18:20], p.dst.Port())
+    binary.BigEndian.PutUint64(b[20:28], seq)
+    h := fnv.New64a()
+    h.Write(b[:])
+    x := h.Sum64()
+
+    lost := n.config.Loss > 0 && float64(mix(x) >> 11) / (1 << 53) < n.config.Loss
+    delay := n.config.Latency
+    if n.config.Jitter > 0 {
+        delay += time.Duration(mix(x + 1) % uint64(n.config.Jitter))
+    }
+    return lost, delay
+}
+
+//the finalizer of splitmix64, spreading the bits of a hash evenly
+func mix(x uint64) uint64 {
+    x ^= x >> 30
+    x *= 0xbf58476d1ce4e5b9
+    x ^= x >> 27
+    x *= 0x94d049bb133111eb
+    x ^= x >> 31
+    return x
+}
+
+func (n *Network) deliver(p packet) {
+    n.mu.Lock()
+    nd := n.nodes[p.dst.Addr()]
+    n.mu.Unlock()
+    if nd != nil {
+        nd.receive(p)
+    }
+}
+
+//the host a stream to addr reaches from h, nil if it can't be reached. Hosts behind a
+//NAT only accept streams from the same network, as nothing forwards them.
+func (n *Network) streamTarget(h *Host, addr netip.Addr) *Host {
+    if addr == h.ip {
+        return h
+    }
+    if h.nat != nil {
+        if target := h.nat.host(addr); target != nil {
+            return target
+        }
+    }
+    n.mu.Lock()
+    defer n.mu.Unlock()
+    target, _ := n.nodes[addr].(*Host)
+    return target
+}
+
+func udpAddr(addr netip.AddrPort) *net.UDPAddr {
+    return net.UDPAddrFromAddrPort(addr)
+}
+
+func tcpAddr(addr netip.AddrPort) *net.TCPAddr {
+    return net.TCPAddrFromAddrPort(addr)
+}
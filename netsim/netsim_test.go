@@ -0,0 +1,376 @@
+package netsim
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "syscall"
+    "testing"
+    "time"
+)
+
+//a network whose clock only moves when the test says so
+func newTestNetwork(t *testing.T, config Config) (*Network, *ManualClock) {
+    t.Helper()
+    clock := NewManualClock(time.Unix(0, 0))
+    config.Clock = clock
+    return New(config), clock
+}
+
+//creates a host with newHost, closing it when the test ends
+func addHost(t *testing.T, newHost func(string) (*Host, error), ip string) *Host {
+    t.Helper()
+    h, err := newHost(ip)
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() {
+        h.Close()
+    })
+    return h
+}
+
+func mustNAT(t *testing.T, n *Network, ip string, config NATConfig) *NAT {
+    t.Helper()
+    nat, err := n.NewNAT(ip, config)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return nat
+}
+
+func listen(t *testing.T, h *Host, addr string) net.PacketConn {
+    t.Helper()
+    c, err := h.ListenPacket("udp4", addr)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return c
+}
+
+func send(t *testing.T, c net.PacketConn, msg, to string) {
+    t.Helper()
+    addr, err := net.ResolveUDPAddr("udp4", to)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, err := c.WriteTo([]byte(msg), addr); err != nil {
+        t.Fatal(err)
+    }
+}
+
+//reads what was already delivered to c, packets without latency arrive as they're sent
+func recv(c net.PacketConn) (string, net.Addr, bool) {
+    c.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+    buf := make([]byte, 1500)
+    n, addr, err := c.ReadFrom(buf)
+    if err != nil {
+        return "", nil, false
+    }
+    return string(buf[:n]), addr, true
+}
+
+func mustRecv(t *testing.T, c net.PacketConn, msg string) net.Addr {
+    t.Helper()
+    got, addr, ok := recv(c)
+    if !ok {
+        t.Fatalf("'%s' wasn't received", msg)
+    }
+    if got != msg {
+        t.Fatalf("Received '%s' instead of '%s'", got, msg)
+    }
+    return addr
+}
+
+func mustNotRecv(t *testing.T, c net.PacketConn, what string) {
+    t.Helper()
+    if got, addr, ok := recv(c); ok {
+        t.Fatalf("%s, but '%s' was received from %v", what, got, addr)
+    }
+}
+
+var natTypes = []struct {
+    name   string
+    config NATConfig
+}{
+    { "full cone",       FullCone },
+    { "restricted",      Restricted },
+    { "port restricted", PortRestricted },
+    { "symmetric",       Symmetric },
+}
+
+func TestMapping(t *testing.T) {
+    for _, tt := range natTypes {
+        t.Run(tt.name, func(t *testing.T) {
+            n, _ := newTestNetwork(t, Config {})
+            nat := mustNAT(t, n, "203.0.113.1", tt.config)
+            h := addHost(t, nat.NewHost, "192.168.1.2")
+            s1 := addHost(t, n.NewHost, "198.51.100.1")
+            s2 := addHost(t, n.NewHost, "198.51.100.2")
+
+            c := listen(t, h, "0.0.0.0:0")
+            s1a, s1b, s2a := listen(t, s1, ":1000"), listen(t, s1, ":1001"), listen(t, s2, ":1000")
+            send(t, c, "a", "198.51.100.1:1000")
+            send(t, c, "b", "198.51.100.1:1001")
+            send(t, c, "c", "198.51.100.2:1000")
+            seenA, seenB, seenC := mustRecv(t, s1a, "a").String(), mustRecv(t, s1b, "b").String(), mustRecv(t, s2a, "c").String()
+
+            independent := tt.config.Mapping == EndpointIndependent
+            if (seenA == seenB) != independent || (seenA == seenC) != independent {
+                t.Fatalf("Mapped as %s, %s and %s with %s mapping", seenA, seenB, seenC, tt.config.Mapping)
+            }
+            if nat.Mappings() != map[bool]int { true: 1, false: 3 }[independent] {
+                t.Fatalf("NAT has %d mappings", nat.Mappings())
+            }
+        })
+    }
+}
+
+func TestFiltering(t *testing.T) {
+    for _, tt := range natTypes {
+        t.Run(tt.name, func(t *testing.T) {
+            n, _ := newTestNetwork(t, Config {})
+            nat := mustNAT(t, n, "203.0.113.1", tt.config)
+            h := addHost(t, nat.NewHost, "192.168.1.2")
+            s1 := addHost(t, n.NewHost, "198.51.100.1")
+            s2 := addHost(t, n.NewHost, "198.51.100.2")
+
+            c := listen(t, h, "0.0.0.0:0")
+            s1a, s1b, s2a := listen(t, s1, ":1000"), listen(t, s1, ":1001"), listen(t, s2, ":1000")
+            send(t, c, "out", "198.51.100.1:1000")
+            mapped := mustRecv(t, s1a, "out").String()
+
+            send(t, s1a, "same", mapped)
+            mustRecv(t, c, "same")
+
+            send(t, s1b, "other port", mapped)
+            if tt.config.Filtering == AddressPortDependent {
+                mustNotRecv(t, c, "Filtering by port")
+            } else {
+                mustRecv(t, c, "other port")
+            }
+
+            send(t, s2a, "other host", mapped)
+            if tt.config.Filtering == EndpointIndependent {
+                mustRecv(t, c, "other host")
+            } else {
+                mustNotRecv(t, c, "Filtering by address")
+            }
+        })
+    }
+}
+
+func TestTimeout(t *testing.T) {
+    n, clock := newTestNetwork(t, Config {})
+    config := PortRestricted
+    config.Timeout = 30 * time.Second
+    nat := mustNAT(t, n, "203.0.113.1", config)
+    h := addHost(t, nat.NewHost, "192.168.1.2")
+    s := addHost(t, n.NewHost, "198.51.100.1")
+    c, sc := listen(t, h, "0.0.0.0:0"), listen(t, s, ":1000")
+
+    send(t, c, "out", "198.51.100.1:1000")
+    mapped := mustRecv(t, sc, "out").String()
+
+    clock.Advance(29 * time.Second)
+    send(t, sc, "in time", mapped)
+    mustRecv(t, c, "in time")
+
+    //packets coming in don't keep the mapping alive
+    clock.Advance(2 * time.Second)
+    send(t, sc, "too late", mapped)
+    mustNotRecv(t, c, "Mapping expired")
+    if nat.Mappings() != 0 {
+        t.Fatalf("NAT has %d mappings after they expired", nat.Mappings())
+    }
+
+    send(t, c, "again", "198.51.100.1:1000")
+    if remapped := mustRecv(t, sc, "again").String(); remapped == mapped {
+        t.Fatalf("Expired mapping %s was reused", mapped)
+    }
+}
+
+func TestPreservePorts(t *testing.T) {
+    n, clock := newTestNetwork(t, Config {})
+    config := PortRestricted
+    config.Timeout = 30 * time.Second
+    config.PreservePorts = true
+    nat := mustNAT(t, n, "203.0.113.1", config)
+    h := addHost(t, nat.NewHost, "192.168.1.2")
+    s := addHost(t, n.NewHost, "198.51.100.1")
+    c, sc := listen(t, h, "0.0.0.0:0"), listen(t, s, ":1000")
+
+    send(t, c, "out", "198.51.100.1:1000")
+    mapped := mustRecv(t, sc, "out").(*net.UDPAddr)
+    if mapped.Port != c.LocalAddr().(*net.UDPAddr).Port {
+        t.Fatalf("Mapped to port %d instead of %s", mapped.Port, c.LocalAddr())
+    }
+
+    //a new mapping at the same port, which the remote host can't tell apart
+    clock.Advance(31 * time.Second)
+    send(t, c, "again", "198.51.100.1:1000")
+    if remapped := mustRecv(t, sc, "again").String(); remapped != mapped.String() {
+        t.Fatalf("Expired mapping %s came back as %s", mapped, remapped)
+    }
+}
+
+func TestHairpinning(t *testing.T) {
+    for _, hairpinning := range []bool { false, true } {
+        t.Run(fmt.Sprintf("hairpinning=%v", hairpinning), func(t *testing.T) {
+            n, _ := newTestNetwork(t, Config {})
+            config := FullCone
+            config.Hairpinning = hairpinning
+            nat := mustNAT(t, n, "203.0.113.1", config)
+            a := addHost(t, nat.NewHost, "192.168.1.2")
+            b := addHost(t, nat.NewHost, "192.168.1.3")
+            s := addHost(t, n.NewHost, "198.51.100.1")
+            ac, bc, sc := listen(t, a, "0.0.0.0:0"), listen(t, b, "0.0.0.0:0"), listen(t, s, ":1000")
+
+            send(t, ac, "out", "198.51.100.1:1000")
+            mapped := mustRecv(t, sc, "out").String()
+
+            send(t, bc, "hairpin", mapped)
+            if !hairpinning {
+                mustNotRecv(t, ac, "Without hairpinning")
+                return
+            }
+            from := mustRecv(t, ac, "hairpin").(*net.UDPAddr)
+            if !from.IP.Equal(nat.IP()) {
+                t.Fatalf("Hairpinned packet came from %v instead of the NAT", from)
+            }
+
+            //hosts behind the same NAT reach each other directly too
+            send(t, bc, "direct", ac.LocalAddr().String())
+            mustRecv(t, ac, "direct")
+        })
+    }
+}
+
+func TestTTL(t *testing.T) {
+    n, _ := newTestNetwork(t, Config {})
+    natA := mustNAT(t, n, "203.0.113.1", PortRestricted)
+    natB := mustNAT(t, n, "203.0.113.2", PortRestricted)
+    a := addHost(t, natA.NewHost, "192.168.1.2")
+    b := addHost(t, natB.NewHost, "192.168.1.2")
+    s := addHost(t, n.NewHost, "198.51.100.1")
+    ac, bc, sc := listen(t, a, "0.0.0.0:0"), listen(t, b, "0.0.0.0:0"), listen(t, s, ":1000")
+    sendTTL := func(c net.PacketConn, msg, to string, ttl int) {
+        t.Helper()
+        addr, _ := net.ResolveUDPAddr("udp4", to)
+        if _, err := c.(*Conn).WriteToTTL([]byte(msg), addr, ttl); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    //the NAT, then every router across the internet decrement it
+    sendTTL(ac, "short", "198.51.100.1:1000", internetHops + 1)
+    mustNotRecv(t, sc, "TTL ran out")
+    sendTTL(ac, "long", "198.51.100.1:1000", internetHops + 2)
+    mappedA := mustRecv(t, sc, "long").String()
+
+    send(t, bc, "out", "198.51.100.1:1000")
+    mappedB := mustRecv(t, sc, "out").String()
+
+    //a packet dying on the way opens the mapping for the answer
+    sendTTL(ac, "primer", mappedB, 2)
+    mustNotRecv(t, bc, "TTL ran out before the peer's NAT")
+    send(t, bc, "answer", mappedA)
+    mustRecv(t, ac, "answer")
+}
+
+//which of count packets sent one after the other arrive
+func delivered(t *testing.T, config Config, count int) map[int]bool {
+    n, clock := newTestNetwork(t, config)
+    a := addHost(t, n.NewHost, "198.51.100.1")
+    b := addHost(t, n.NewHost, "198.51.100.2")
+    ac, bc := listen(t, a, ":1000"), listen(t, b, ":1000")
+    for i := 0; i < count; i++ {
+        send(t, ac, fmt.Sprint(i), "198.51.100.2:1000")
+    }
+    clock.Advance(config.Latency + config.Jitter)
+
+    res := make(map[int]bool)
+    for {
+        msg, _, ok := recv(bc)
+        if !ok {
+            return res
+        }
+        var i int
+        fmt.Sscan(msg, &i)
+        res[i] = true
+    }
+}
+
+func TestLossIsDeterministic(t *testing.T) {
+    config := Config { Loss: 0.3, Jitter: 10 * time.Millisecond, Seed: 7 }
+    first := delivered(t, config, 500)
+    if lost := 500 - len(first); lost < 100 || lost > 200 {
+        t.Fatalf("Lost %d of 500 packets with 30%% loss", lost)
+    }
+    if again := delivered(t, config, 500); fmt.Sprint(again) != fmt.Sprint(first) {
+        t.Fatal("The same seed lost different packets")
+    }
+    config.Seed = 8
+    if other := delivered(t, config, 500); fmt.Sprint(other) == fmt.Sprint(first) {
+        t.Fatal("Different seeds lost the same packets")
+    }
+}
+
+func TestLatency(t *testing.T) {
+    n, clock := newTestNetwork(t, Config { Latency: 100 * time.Millisecond })
+    a := addHost(t, n.NewHost, "198.51.100.1")
+    b := addHost(t, n.NewHost, "198.51.100.2")
+    ac, bc := listen(t, a, ":1000"), listen(t, b, ":1000")
+
+    send(t, ac, "late", "198.51.100.2:1000")
+    clock.Advance(99 * time.Millisecond)
+    mustNotRecv(t, bc, "Before the latency passed")
+    clock.Advance(time.Millisecond)
+    mustRecv(t, bc, "late")
+}
+
+func TestStreams(t *testing.T) {
+    n, _ := newTestNetwork(t, Config {})
+    nat := mustNAT(t, n, "203.0.113.1", PortRestricted)
+    other := mustNAT(t, n, "203.0.113.2", PortRestricted)
+    h := addHost(t, nat.NewHost, "192.168.1.2")
+    //only reachable by hosts behind the same NAT
+    addHost(t, other.NewHost, "192.168.1.3")
+    s := addHost(t, n.NewHost, "198.51.100.1")
+
+    l, err := s.Listen("tcp4", ":80")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer l.Close()
+    go func() {
+        c, err := l.Accept()
+        if err != nil {
+            return
+        }
+        defer c.Close()
+        io.Copy(c, c)
+    }()
+
+    c, err := h.DialContext(context.Background(), "tcp4", "198.51.100.1:80")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer c.Close()
+    if _, err := c.Write([]byte("echo")); err != nil {
+        t.Fatal(err)
+    }
+    buf := make([]byte, 4)
+    if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "echo" {
+        t.Fatalf("Read '%s': %v", buf, err)
+    }
+
+    if _, err := h.DialContext(context.Background(), "tcp4", "192.168.1.3:80"); !errors.Is(err, syscall.EHOSTUNREACH) {
+        t.Fatalf("Reached a host behind another NAT: %v", err)
+    }
+    if _, err := s.DialContext(context.Background(), "tcp4", "198.51.100.1:81"); !errors.Is(err, syscall.ECONNREFUSED) {
+        t.Fatalf("Connected to a port nothing listens on: %v", err)
+    }
+}
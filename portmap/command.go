@@ -0,0 +1,91 @@
+package portmap
+
+import (
+    "context"
+    "flag"
+    "fmt"
+    "net"
+    "os"
+    "os/signal"
+    "strings"
+    "time"
+
+    "github.com/peterbourgon/ff/v3/ffcli"
+)
+
+var (
+    gatewayAddr string
+    localPort   int
+    lifetime    time.Duration
+    protocols   string
+)
+
+var fs = (func() *flag.FlagSet {
+    fs := flag.NewFlagSet("portmap", flag.ExitOnError)
+    fs.StringVar(&gatewayAddr, "gateway",   "",                                  "Gateway asked for the mapping, the default gateway if empty")
+    fs.IntVar(&localPort,      "port",      0,                                   "Local UDP port to map")
+    fs.DurationVar(&lifetime,  "lifetime",  DefaultLifetime,                     "How long the mapping lasts unless renewed")
+    fs.StringVar(&protocols,   "protocols", strings.Join(DefaultProtocols, ","), "Comma separated protocols to try, in order")
+    return fs
+})()
+
+func parseProtocols(list string) []string {
+    res := []string(nil)
+    for _, v := range strings.Split(list, ",") {
+        if v = strings.TrimSpace(v); v != "" {
+            res = append(res, v)
+        }
+    }
+    return res
+}
+
+func describe(m Mapping) string {
+    lifetime := "permanent"
+    if m.Lifetime > 0 {
+        lifetime = m.Lifetime.String()
+    }
+    return fmt.Sprintf("%s -> %s with %s (%s)", m.External, m.Internal, m.Protocol, lifetime)
+}
+
+var Command = &ffcli.Command {
+    Name:       "portmap",
+    ShortUsage: "portmap [flags]",
+    ShortHelp:  "Asks the gateway to forward a UDP port with PCP, NAT-PMP or UPnP-IGD",
+    LongHelp:   "Maps the port until interrupted, renewing the mapping and deleting it on exit.",
+    FlagSet:    fs,
+    Exec:       func(ctx context.Context, args []string) error {
+        if localPort <= 0 || localPort > 65535 {
+            return fmt.Errorf("A port between 1 and 65535 is needed")
+        }
+        config := Config {
+            Protocols: parseProtocols(protocols),
+            Lifetime:  lifetime,
+        }
+        if gatewayAddr != "" {
+            config.Gateway = net.ParseIP(gatewayAddr).To4()
+            if config.Gateway == nil {
+                return fmt.Errorf("Invalid IPv4 address '%s'", gatewayAddr)
+            }
+        }
+        pm, err := New(ctx, localPort, config)
+        if err != nil {
+            return err
+        }
+        fmt.Printf("Mapped %s\n", describe(pm.Mapping()))
+
+        interrupt := make(chan os.Signal, 1)
+        signal.Notify(interrupt, os.Interrupt)
+        for {
+            select {
+                case <-interrupt:
+                    if err := pm.Close(); err != nil {
+                        return fmt.Errorf("Unable to delete mapping: %w", err)
+                    }
+                    fmt.Printf("Deleted mapping\n")
+                    return nil
+                case err := <-pm.Errors():
+                    fmt.Printf("%v\n", err)
+            }
+        }
+    },
+}
@@ -0,0 +1,484 @@
+package portmap
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/binary"
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+//fakeConfig configures a fakeGateway
+type fakeConfig struct {
+    PCP           bool
+    NATPMP        bool
+    UPnP          bool
+    //PCP and NAT-PMP lifetimes are cut down to this, to test renewals
+    MaxLifetime   time.Duration
+    //UPnP mappings are refused unless permanent, like some gateways do
+    OnlyPermanent bool
+}
+
+//fakeGateway answers PCP, NAT-PMP and UPnP-IGD requests like a home router would,
+//without forwarding anything, to test port mapping without one
+type fakeGateway struct {
+    config fakeConfig
+    ip     net.IP
+    start  time.Time
+    pmp    *net.UDPConn
+    ssdp   *net.UDPConn
+    http   *http.Server
+    httpLn net.Listener
+
+    mu       sync.Mutex
+    mappings map[string]fakeMapping
+}
+
+type fakeMapping struct {
+    Mapping
+    expires time.Time
+}
+
+const (
+    fakeDescPath    = "/rootDesc.xml"
+    fakeControlPath = "/ctl/IPConn"
+    upnpNoSuchEntry = 714
+)
+
+const fakeDescription = `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+<specVersion><major>1</major><minor>0</minor></specVersion>
+<device>
+<deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType>
+<friendlyName>Fake gateway</friendlyName>
+<deviceList><device>
+<deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType>
+<deviceList><device>
+<deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType>
+<serviceList><service>
+<serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType>
+<serviceId>urn:upnp-org:serviceId:WANIPConn1</serviceId>
+<controlURL>` + fakeControlPath + `</controlURL>
+</service></serviceList>
+</device></deviceList>
+</device></deviceList>
+</device>
+</root>
+`
+
+//listens on ip for the protocols enabled in config
+func newFakeGateway(ip net.IP, config fakeConfig) (*fakeGateway, error) {
+    g := &fakeGateway {
+        config:   config,
+        ip:       ip,
+        start:    time.Now(),
+        mappings: make(map[string]fakeMapping),
+    }
+    if config.PCP || config.NATPMP {
+        conn, err := net.ListenUDP("udp4", &net.UDPAddr {
+            IP: ip,
+        })
+        if err != nil {
+            return nil, fmt.Errorf("Unable to listen for PCP and NAT-PMP: %w", err)
+        }
+        g.pmp = conn
+        go g.servePMP()
+    }
+    if config.UPnP {
+        ln, err := net.Listen("tcp4", net.JoinHostPort(ip.String(), "0"))
+        if err != nil {
+            g.Close()
+            return nil, fmt.Errorf("Unable to listen for UPnP control: %w", err)
+        }
+        g.httpLn = ln
+        mux := http.NewServeMux()
+        mux.HandleFunc(fakeDescPath, func(w http.ResponseWriter, r *http.Request) {
+            w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+            io.WriteString(w, fakeDescription)
+        })
+        mux.HandleFunc(fakeControlPath, g.serveControl)
+        g.http = &http.Server {
+            Handler: mux,
+        }
+        go g.http.Serve(ln)
+
+        conn, err := net.ListenUDP("udp4", &net.UDPAddr {
+            IP: ip,
+        })
+        if err != nil {
+            g.Close()
+            return nil, fmt.Errorf("Unable to listen for SSDP: %w", err)
+        }
+        g.ssdp = conn
+        go g.serveSSDP()
+    }
+    return g, nil
+}
+
+//a Config sending requests to the gateway
+func (g *fakeGateway) Config() Config {
+    config := Config {
+        Gateway: g.ip,
+    }
+    if g.pmp != nil {
+        config.PMPPort = g.pmp.LocalAddr().(*net.UDPAddr).Port
+    } else {
+        //nothing listens there, so both protocols fail at once
+        config.PMPPort = 1
+    }
+    if g.ssdp != nil {
+        config.SSDPAddr = g.ssdp.LocalAddr().String()
+    }
+    return config
+}
+
+//the mappings that haven't expired or been deleted
+func (g *fakeGateway) Mappings() []Mapping {
+    g.mu.Lock()
+    defer g.mu.Unlock()
+
+    now := time.Now()
+    ms := []Mapping(nil)
+    for key, m := range g.mappings {
+        if !m.expires.IsZero() && now.After(m.expires) {
+            delete(g.mappings, key)
+            continue
+        }
+        ms = append(ms, m.Mapping)
+    }
+    return ms
+}
+
+func (g *fakeGateway) Close() error {
+    if g.pmp != nil {
+        g.pmp.Close()
+    }
+    if g.ssdp != nil {
+        g.ssdp.Close()
+    }
+    if g.http != nil {
+        g.http.Close()
+    } else if g.httpLn != nil {
+        g.httpLn.Close()
+    }
+    return nil
+}
+
+func (g *fakeGateway) epoch() uint32 {
+    return uint32(time.Since(g.start) / time.Second)
+}
+
+func (g *fakeGateway) grant(lifetime time.Duration) time.Duration {
+    if g.config.MaxLifetime > 0 && lifetime > g.config.MaxLifetime {
+        return g.config.MaxLifetime
+    }
+    return lifetime
+}
+
+//records a mapping, deleting it when lifetime is 0. Returns false if another client has
+//the external port.
+func (g *fakeGateway) record(protocol string, internal, external *net.UDPAddr, lifetime time.Duration, permanent bool) bool {
+    g.mu.Lock()
+    defer g.mu.Unlock()
+
+    key := protocol + " " + external.String()
+    if m, ok := g.mappings[key]; ok && m.Internal.String() != internal.String() {
+        return false
+    }
+    if lifetime == 0 && !permanent {
+        delete(g.mappings, key)
+        return true
+    }
+    m := fakeMapping {
+        Mapping: Mapping {
+            Protocol: protocol,
+            Internal: internal,
+            External: external,
+            Lifetime: lifetime,
+        },
+    }
+    if !permanent {
+        m.expires = time.Now().Add(lifetime)
+    }
+    g.mappings[key] = m
+    return true
+}
+
+//the mapping of an internal address, to delete it without knowing the external port
+func (g *fakeGateway) find(protocol string, internal *net.UDPAddr) (*net.UDPAddr, bool) {
+    g.mu.Lock()
+    defer g.mu.Unlock()
+    for _, m := range g.mappings {
+        if m.Protocol == protocol && m.Internal.String() == internal.String() {
+            return m.External, true
+        }
+    }
+    return nil, false
+}
+
+func (g *fakeGateway) servePMP() {
+    buf := make([]byte, 1100)
+    for {
+        n, from, err := g.pmp.ReadFromUDP(buf)
+        if err != nil {
+            return
+        }
+        if n < 2 {
+            continue
+        }
+        var res []byte
+        switch buf[0] {
+            case natpmpVersion:
+                res = g.natpmp(buf[:n], from)
+            case pcpVersion:
+                res = g.pcp(buf[:n], from)
+        }
+        if res != nil {
+            g.pmp.WriteToUDP(res, from)
+        }
+    }
+}
+
+func (g *fakeGateway) natpmpHeader(op byte, result uint16, size int) []byte {
+    res := make([]byte, size)
+    res[0] = natpmpVersion
+    res[1] = op + natpmpOpResponse
+    binary.BigEndian.PutUint16(res[2:4], result)
+    binary.BigEndian.PutUint32(res[4:8], g.epoch())
+    return res
+}
+
+func (g *fakeGateway) natpmp(req []byte, from *net.UDPAddr) []byte {
+    op := req[1]
+    if !g.config.NATPMP {
+        return g.natpmpHeader(op, 1, 8)
+    }
+    switch {
+        case op == natpmpOpAddress:
+            res := g.natpmpHeader(op, 0, 12)
+            copy(res[8:12], from.IP.To4())
+            return res
+        case op == natpmpOpMapUDP && len(req) >= 12:
+            internalPort := int(binary.BigEndian.Uint16(req[4:6]))
+            suggested := int(binary.BigEndian.Uint16(req[6:8]))
+            lifetime := time.Duration(binary.BigEndian.Uint32(req[8:12])) * time.Second
+            internal := &net.UDPAddr {
+                IP:   from.IP,
+                Port: internalPort,
+            }
+
+            res := g.natpmpHeader(op, 0, 16)
+            binary.BigEndian.PutUint16(res[8:10], uint16(internalPort))
+            if lifetime == 0 {
+                if external, ok := g.find(ProtocolNATPMP, internal); ok {
+                    g.record(ProtocolNATPMP, internal, external, 0, false)
+                }
+                return res
+            }
+            if suggested == 0 {
+                suggested = internalPort
+            }
+            external := &net.UDPAddr {
+                IP:   from.IP.To4(),
+                Port: suggested,
+            }
+            lifetime = g.grant(lifetime)
+            if !g.record(ProtocolNATPMP, internal, external, lifetime, false) {
+                return g.natpmpHeader(op, 4, 8)
+            }
+            binary.BigEndian.PutUint16(res[10:12], uint16(external.Port))
+            binary.BigEndian.PutUint32(res[12:16], secondsOf(lifetime))
+            return res
+        default:
+            return g.natpmpHeader(op, 5, 8)
+    }
+}
+
+func (g *fakeGateway) pcp(req []byte, from *net.UDPAddr) []byte {
+    //a NAT-PMP gateway doesn't know the version
+    if !g.config.PCP {
+        return g.natpmpHeader(req[1], 1, 8)
+    }
+    if len(req) < pcpHeaderSize {
+        return nil
+    }
+    op := req[1]
+    res := make([]byte, pcpHeaderSize + pcpMapSize)
+    res[0] = pcpVersion
+    res[1] = op | pcpResponse
+    binary.BigEndian.PutUint32(res[8:12], g.epoch())
+    fail := func(code byte) []byte {
+        res[3] = code
+        if op == pcpOpMap && len(req) >= pcpHeaderSize + pcpMapSize {
+            copy(res[pcpHeaderSize:], req[pcpHeaderSize:])
+            return res
+        }
+        return res[:pcpHeaderSize]
+    }
+    if op != pcpOpMap {
+        return fail(4)
+    }
+    if len(req) < pcpHeaderSize + pcpMapSize {
+        return fail(3)
+    }
+    //the client has to know its own address, or a NAT sits between us
+    if !net.IP(req[8:24]).Equal(from.IP) {
+        return fail(12)
+    }
+    mapReq := req[pcpHeaderSize:]
+    if mapReq[12] != protocolUDP {
+        return fail(9)
+    }
+
+    lifetime := time.Duration(binary.BigEndian.Uint32(req[4:8])) * time.Second
+    internal := &net.UDPAddr {
+        IP:   from.IP,
+        Port: int(binary.BigEndian.Uint16(mapReq[16:18])),
+    }
+    mapRes := res[pcpHeaderSize:]
+    copy(mapRes, mapReq)
+    if lifetime == 0 {
+        if external, ok := g.find(ProtocolPCP, internal); ok {
+            g.record(ProtocolPCP, internal, external, 0, false)
+        }
+        return res
+    }
+
+    port := int(binary.BigEndian.Uint16(mapReq[18:20]))
+    if port == 0 {
+        port = internal.Port
+    }
+    external := &net.UDPAddr {
+        IP:   from.IP.To4(),
+        Port: port,
+    }
+    lifetime = g.grant(lifetime)
+    if !g.record(ProtocolPCP, internal, external, lifetime, false) {
+        return fail(8)
+    }
+    binary.BigEndian.PutUint32(res[4:8], secondsOf(lifetime))
+    binary.BigEndian.PutUint16(mapRes[18:20], uint16(external.Port))
+    putMapped(mapRes[20:36], external.IP)
+    return res
+}
+
+func (g *fakeGateway) serveSSDP() {
+    buf := make([]byte, 2048)
+    for {
+        n, from, err := g.ssdp.ReadFromUDP(buf)
+        if err != nil {
+            return
+        }
+        req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(buf[:n])))
+        if err != nil || req.Method != "M-SEARCH" {
+            continue
+        }
+        st := req.Header.Get("St")
+        if st != igdDeviceType && st != "ssdp:all" {
+            continue
+        }
+        location := fmt.Sprintf("http://%s%s", g.httpLn.Addr(), fakeDescPath)
+        res := fmt.Sprintf("HTTP/1.1 200 OK\r\nCACHE-CONTROL: max-age=120\r\nEXT:\r\nLOCATION: %s\r\nSERVER: fake/1.0 UPnP/1.1\r\nST: %s\r\nUSN: uuid:fake::%s\r\n\r\n",
+            location, igdDeviceType, igdDeviceType)
+        g.ssdp.WriteToUDP([]byte(res), from)
+    }
+}
+
+func soapFault(w http.ResponseWriter, code int, description string) {
+    w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+    w.WriteHeader(http.StatusInternalServerError)
+    fmt.Fprintf(w, `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><s:Fault>`+
+        `<faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring><detail>`+
+        `<UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>%d</errorCode><errorDescription>%s</errorDescription></UPnPError>`+
+        `</detail></s:Fault></s:Body></s:Envelope>`, code, description)
+}
+
+func soapResponse(w http.ResponseWriter, action string, values [][2]string) {
+    w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+    fmt.Fprintf(w, `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><u:%sResponse xmlns:u="%s">`,
+        action, igdServices[1])
+    for _, v := range values {
+        fmt.Fprintf(w, "<%s>%s</%s>", v[0], v[1], v[0])
+    }
+    fmt.Fprintf(w, "</u:%sResponse></s:Body></s:Envelope>", action)
+}
+
+func (g *fakeGateway) serveControl(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    host, _, err := net.SplitHostPort(r.RemoteAddr)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    from := net.ParseIP(host)
+    _, action, _ := strings.Cut(strings.Trim(r.Header.Get("SOAPAction"), `"`), "#")
+    values, err := soapValues(io.LimitReader(r.Body, 1 << 16))
+    if err != nil {
+        soapFault(w, 402, "Invalid Args")
+        return
+    }
+
+    switch action {
+        case "GetExternalIPAddress":
+            soapResponse(w, action, [][2]string {
+                { "NewExternalIPAddress", from.To4().String() },
+            })
+        case "AddPortMapping":
+            externalPort, err1 := strconv.Atoi(values["NewExternalPort"])
+            internalPort, err2 := strconv.Atoi(values["NewInternalPort"])
+            lease, err3 := strconv.Atoi(values["NewLeaseDuration"])
+            internalIP := net.ParseIP(values["NewInternalClient"])
+            if err1 != nil || err2 != nil || err3 != nil || internalIP == nil || values["NewProtocol"] != "UDP" {
+                soapFault(w, 402, "Invalid Args")
+                return
+            }
+            if g.config.OnlyPermanent && lease != 0 {
+                soapFault(w, upnpOnlyPermanent, "OnlyPermanentLeasesSupported")
+                return
+            }
+            internal := &net.UDPAddr {
+                IP:   internalIP,
+                Port: internalPort,
+            }
+            external := &net.UDPAddr {
+                IP:   from.To4(),
+                Port: externalPort,
+            }
+            lifetime := time.Duration(lease) * time.Second
+            if !g.record(ProtocolUPnP, internal, external, lifetime, lifetime == 0) {
+                soapFault(w, upnpConflict, "ConflictInMappingEntry")
+                return
+            }
+            soapResponse(w, action, nil)
+        case "DeletePortMapping":
+            externalPort, err := strconv.Atoi(values["NewExternalPort"])
+            if err != nil {
+                soapFault(w, 402, "Invalid Args")
+                return
+            }
+            key := ProtocolUPnP + " " + (&net.UDPAddr {
+                IP:   from.To4(),
+                Port: externalPort,
+            }).String()
+            g.mu.Lock()
+            _, ok := g.mappings[key]
+            delete(g.mappings, key)
+            g.mu.Unlock()
+            if !ok {
+                soapFault(w, upnpNoSuchEntry, "NoSuchEntryInArray")
+                return
+            }
+            soapResponse(w, action, nil)
+        default:
+            soapFault(w, 401, "Invalid Action")
+    }
+}
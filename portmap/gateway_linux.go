@@ -0,0 +1,53 @@
+//go:build linux
+
+package portmap
+
+import (
+    "bufio"
+    "encoding/binary"
+    "encoding/hex"
+    "fmt"
+    "net"
+    "os"
+    "strconv"
+    "strings"
+)
+
+//set on routes through a gateway
+const routeFlagGateway = 0x2
+
+//the gateway of the default IPv4 route, read from the routing table
+func defaultGateway() (net.IP, error) {
+    f, err := os.Open("/proc/net/route")
+    if err != nil {
+        return nil, fmt.Errorf("Unable to read routing table: %w", err)
+    }
+    defer f.Close()
+
+    scanner := bufio.NewScanner(f)
+    //the first line names the columns
+    scanner.Scan()
+    for scanner.Scan() {
+        //Iface Destination Gateway Flags ...
+        fields := strings.Fields(scanner.Text())
+        if len(fields) < 4 || fields[1] != "00000000" {
+            continue
+        }
+        flags, err := strconv.ParseUint(fields[3], 16, 16)
+        if err != nil || flags & routeFlagGateway == 0 {
+            continue
+        }
+        //in host order, little endian on the machines linux runs on
+        gw, err := hex.DecodeString(fields[2])
+        if err != nil || len(gw) != 4 {
+            continue
+        }
+        ip := make(net.IP, 4)
+        binary.BigEndian.PutUint32(ip, binary.LittleEndian.Uint32(gw))
+        return ip, nil
+    }
+    if err := scanner.Err(); err != nil {
+        return nil, fmt.Errorf("Unable to read routing table: %w", err)
+    }
+    return nil, fmt.Errorf("No default gateway, set one")
+}
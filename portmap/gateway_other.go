@@ -0,0 +1,12 @@
+//go:build !linux
+
+package portmap
+
+import (
+    "fmt"
+    "net"
+)
+
+func defaultGateway() (net.IP, error) {
+    return nil, fmt.Errorf("Finding the default gateway is only supported on linux, set one")
+}
@@ -0,0 +1,334 @@
+package portmap
+
+import (
+    "bytes"
+    "context"
+    "crypto/rand"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "net"
+    "syscall"
+    "time"
+)
+
+const (
+    //RFC 6886 asks for the interval between requests to start here and double
+    pmpInitialInterval    = 250 * time.Millisecond
+
+    natpmpVersion         = 0
+    natpmpOpAddress       = 0
+    natpmpOpMapUDP        = 1
+    //responses have the opcode of the request plus this
+    natpmpOpResponse      = 128
+
+    pcpVersion            = 2
+    pcpOpMap              = 1
+    pcpResponse           = 0x80
+    pcpHeaderSize         = 24
+    pcpMapSize            = 36
+    pcpNonceSize          = 12
+    pcpUnsupportedVersion = 1
+    protocolUDP           = 17
+)
+
+var natpmpResults = map[uint16]string {
+    1: "unsupported version",
+    2: "not authorized",
+    3: "network failure",
+    4: "out of resources",
+    5: "unsupported opcode",
+}
+
+var pcpResults = map[byte]string {
+    1:  "unsupported version",
+    2:  "not authorized",
+    3:  "malformed request",
+    4:  "unsupported opcode",
+    5:  "unsupported option",
+    6:  "malformed option",
+    7:  "network failure",
+    8:  "out of resources",
+    9:  "unsupported protocol",
+    10: "user exceeded quota",
+    11: "cannot provide external address",
+    12: "address mismatch",
+    13: "excessive remote peers",
+}
+
+//the gateway answered in a way that means it doesn't speak the protocol
+var errUnsupported = errors.New("Not supported by the gateway")
+
+//sends req to the gateway until accept takes a response, doubling the interval between
+//attempts
+func exchange(ctx context.Context, gateway *net.UDPAddr, timeout time.Duration, req []byte, accept func([]byte) bool) ([]byte, error) {
+    conn, err := net.DialUDP("udp4", nil, gateway)
+    if err != nil {
+        return nil, err
+    }
+    defer conn.Close()
+
+    ctx, cancel := context.WithTimeout(ctx, timeout)
+    defer cancel()
+    deadline, _ := ctx.Deadline()
+
+    buf := make([]byte, 1100)
+    interval := pmpInitialInterval
+    for {
+        if _, err := conn.Write(req); err != nil {
+            return nil, err
+        }
+        readDeadline := time.Now().Add(interval)
+        if deadline.Before(readDeadline) {
+            readDeadline = deadline
+        }
+        conn.SetReadDeadline(readDeadline)
+        for {
+            n, err := conn.Read(buf)
+            if err != nil {
+                if ne, ok := err.(net.Error); ok && ne.Timeout() {
+                    break
+                }
+                //nothing listens on the port
+                if errors.Is(err, syscall.ECONNREFUSED) {
+                    return nil, errUnsupported
+                }
+                return nil, err
+            }
+            if accept(buf[:n]) {
+                return buf[:n], nil
+            }
+        }
+        if err := ctx.Err(); err != nil {
+            if errors.Is(err, context.DeadlineExceeded) {
+                return nil, fmt.Errorf("No response from %s", gateway)
+            }
+            return nil, err
+        }
+        interval *= 2
+    }
+}
+
+func secondsOf(d time.Duration) uint32 {
+    return uint32((d + time.Second - 1) / time.Second)
+}
+
+type natpmp struct {
+    config Config
+}
+
+func (p *natpmp) gateway() *net.UDPAddr {
+    return &net.UDPAddr {
+        IP:   p.config.Gateway,
+        Port: p.config.PMPPort,
+    }
+}
+
+//whether res answers a request of op, and the error it carries
+func natpmpResult(res []byte, op byte, size int) (bool, error) {
+    if len(res) < 4 || res[0] != natpmpVersion || res[1] != op + natpmpOpResponse {
+        return false, nil
+    }
+    code := binary.BigEndian.Uint16(res[2:4])
+    if code != 0 {
+        if code == 1 || code == 5 {
+            return true, errUnsupported
+        }
+        reason, ok := natpmpResults[code]
+        if !ok {
+            reason = fmt.Sprintf("result %d", code)
+        }
+        return true, fmt.Errorf("Gateway refused: %s", reason)
+    }
+    if len(res) < size {
+        return false, nil
+    }
+    return true, nil
+}
+
+func (p *natpmp) externalIP(ctx context.Context) (net.IP, error) {
+    var resErr error
+    res, err := exchange(ctx, p.gateway(), p.config.Timeout, []byte { natpmpVersion, natpmpOpAddress }, func(res []byte) bool {
+        ok, err := natpmpResult(res, natpmpOpAddress, 12)
+        resErr = err
+        return ok
+    })
+    if err != nil {
+        return nil, err
+    }
+    if resErr != nil {
+        return nil, resErr
+    }
+    return net.IPv4(res[8], res[9], res[10], res[11]).To4(), nil
+}
+
+//maps internal to external, deleting the mapping when lifetime is 0
+func (p *natpmp) request(ctx context.Context, internal, external int, lifetime time.Duration) (int, time.Duration, error) {
+    req := make([]byte, 12)
+    req[0] = natpmpVersion
+    req[1] = natpmpOpMapUDP
+    binary.BigEndian.PutUint16(req[4:6], uint16(internal))
+    binary.BigEndian.PutUint16(req[6:8], uint16(external))
+    binary.BigEndian.PutUint32(req[8:12], secondsOf(lifetime))
+
+    var resErr error
+    res, err := exchange(ctx, p.gateway(), p.config.Timeout, req, func(res []byte) bool {
+        ok, err := natpmpResult(res, natpmpOpMapUDP, 16)
+        if ok && err == nil && binary.BigEndian.Uint16(res[8:10]) != uint16(internal) {
+            return false
+        }
+        resErr = err
+        return ok
+    })
+    if err != nil {
+        return 0, 0, err
+    }
+    if resErr != nil {
+        return 0, 0, resErr
+    }
+    port := int(binary.BigEndian.Uint16(res[10:12]))
+    granted := time.Duration(binary.BigEndian.Uint32(res[12:16])) * time.Second
+    return port, granted, nil
+}
+
+func (p *natpmp) mapPort(ctx context.Context, internal *net.UDPAddr, prev *Mapping, lifetime time.Duration) (Mapping, error) {
+    ip, err := p.externalIP(ctx)
+    if err != nil {
+        return Mapping {}, err
+    }
+    suggested := internal.Port
+    if prev != nil {
+        suggested = prev.External.Port
+    }
+    port, granted, err := p.request(ctx, internal.Port, suggested, lifetime)
+    if err != nil {
+        return Mapping {}, err
+    }
+    if granted == 0 {
+        return Mapping {}, fmt.Errorf("Gateway granted no lifetime")
+    }
+    return Mapping {
+        Protocol: ProtocolNATPMP,
+        Internal: internal,
+        External: &net.UDPAddr {
+            IP:   ip,
+            Port: port,
+        },
+        Lifetime: granted,
+    }, nil
+}
+
+func (p *natpmp) unmapPort(ctx context.Context, m Mapping) error {
+    _, _, err := p.request(ctx, m.Internal.Port, 0, 0)
+    return err
+}
+
+type pcp struct {
+    config Config
+    //identifies our mapping to the gateway, kept when renewing it
+    nonce  [pcpNonceSize]byte
+}
+
+func (p *pcp) gateway() *net.UDPAddr {
+    return &net.UDPAddr {
+        IP:   p.config.Gateway,
+        Port: p.config.PMPPort,
+    }
+}
+
+//IPv4 addresses are sent as IPv4-mapped IPv6 addresses
+func putMapped(b []byte, ip net.IP) {
+    copy(b, net.IPv4zero.To16())
+    if ip4 := ip.To4(); ip4 != nil {
+        copy(b, ip4.To16())
+    }
+}
+
+//sends a MAP request, deleting the mapping when lifetime is 0
+func (p *pcp) request(ctx context.Context, internal *net.UDPAddr, external *net.UDPAddr, lifetime time.Duration) (*net.UDPAddr, time.Duration, error) {
+    req := make([]byte, pcpHeaderSize + pcpMapSize)
+    req[0] = pcpVersion
+    req[1] = pcpOpMap
+    binary.BigEndian.PutUint32(req[4:8], secondsOf(lifetime))
+    putMapped(req[8:24], internal.IP)
+    op := req[pcpHeaderSize:]
+    copy(op[:pcpNonceSize], p.nonce[:])
+    op[12] = protocolUDP
+    binary.BigEndian.PutUint16(op[16:18], uint16(internal.Port))
+    if external != nil {
+        binary.BigEndian.PutUint16(op[18:20], uint16(external.Port))
+        putMapped(op[20:36], external.IP)
+    } else {
+        putMapped(op[20:36], nil)
+    }
+
+    var resErr error
+    res, err := exchange(ctx, p.gateway(), p.config.Timeout, req, func(res []byte) bool {
+        //a NAT-PMP gateway answers with its own version
+        if len(res) >= 4 && res[0] == natpmpVersion && binary.BigEndian.Uint16(res[2:4]) == 1 {
+            resErr = errUnsupported
+            return true
+        }
+        if len(res) < 4 || res[0] != pcpVersion || res[1] != pcpResponse | pcpOpMap {
+            return false
+        }
+        if code := res[3]; code != 0 {
+            if code == pcpUnsupportedVersion {
+                resErr = errUnsupported
+                return true
+            }
+            reason, ok := pcpResults[code]
+            if !ok {
+                reason = fmt.Sprintf("result %d", code)
+            }
+            resErr = fmt.Errorf("Gateway refused: %s", reason)
+            return true
+        }
+        return len(res) >= pcpHeaderSize + pcpMapSize && bytes.Equal(res[pcpHeaderSize:pcpHeaderSize + pcpNonceSize], p.nonce[:])
+    })
+    if err != nil {
+        return nil, 0, err
+    }
+    if resErr != nil {
+        return nil, 0, resErr
+    }
+    op = res[pcpHeaderSize:]
+    granted := time.Duration(binary.BigEndian.Uint32(res[4:8])) * time.Second
+    return &net.UDPAddr {
+        IP:   net.IP(append([]byte(nil), op[20:36]...)).To4(),
+        Port: int(binary.BigEndian.Uint16(op[18:20])),
+    }, granted, nil
+}
+
+func (p *pcp) mapPort(ctx context.Context, internal *net.UDPAddr, prev *Mapping, lifetime time.Duration) (Mapping, error) {
+    var suggested *net.UDPAddr
+    if prev != nil {
+        suggested = prev.External
+    } else {
+        if _, err := rand.Read(p.nonce[:]); err != nil {
+            return Mapping {}, err
+        }
+        suggested = &net.UDPAddr {
+            IP:   net.IPv4zero,
+            Port: internal.Port,
+        }
+    }
+    external, granted, err := p.request(ctx, internal, suggested, lifetime)
+    if err != nil {
+        return Mapping {}, err
+    }
+    if external.IP == nil || granted == 0 {
+        return Mapping {}, fmt.Errorf("Gateway returned an invalid mapping")
+    }
+    return Mapping {
+        Protocol: ProtocolPCP,
+        Internal: internal,
+        External: external,
+        Lifetime: granted,
+    }, nil
+}
+
+func (p *pcp) unmapPort(ctx context.Context, m Mapping) error {
+    _, _, err := p.request(ctx, m.Internal, nil, 0)
+    return err
+}
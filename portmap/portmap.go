@@ -0,0 +1,274 @@
+package portmap
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "net"
+    "strings"
+    "sync"
+    "time"
+)
+
+//asks the gateway to forward a port to us, so peers reach us without hole punching.
+//PCP (RFC 6887) and NAT-PMP (RFC 6886) share a UDP port on the gateway, UPnP-IGD is
+//found with SSDP and spoken to over HTTP.
+
+const (
+    ProtocolPCP    = "pcp"
+    ProtocolNATPMP = "nat-pmp"
+    ProtocolUPnP   = "upnp"
+
+    DefaultLifetime = time.Hour
+    DefaultTimeout  = 2 * time.Second
+    //where gateways listen for PCP and NAT-PMP requests
+    DefaultPMPPort  = 5351
+    DefaultSSDPAddr = "239.255.255.250:1900"
+    //errors waiting to be received from Errors before new ones are dropped
+    errorBuffer     = 16
+    //renewals are retried this often when the gateway doesn't answer
+    minRenewal      = 30 * time.Second
+)
+
+var DefaultProtocols = []string { ProtocolPCP, ProtocolNATPMP, ProtocolUPnP }
+
+//Config configures a PortMapper, zero values are replaced by the defaults
+type Config struct {
+    //asked for mappings, the default gateway by default
+    Gateway   net.IP
+    //port PCP and NAT-PMP requests are sent to
+    PMPPort   int
+    //where UPnP searches are sent, besides the gateway itself
+    SSDPAddr  string
+    //tried in order until one works
+    Protocols []string
+    //how long mappings last unless renewed
+    Lifetime  time.Duration
+    //how long each protocol has to answer
+    Timeout   time.Duration
+}
+
+//Mapping is a port forwarded by the gateway
+type Mapping struct {
+    Protocol string
+    Internal *net.UDPAddr
+    External *net.UDPAddr
+    //0 for mappings that last until deleted
+    Lifetime time.Duration
+}
+
+//a port mapping protocol
+type protocol interface {
+    //requests or renews a mapping, keeping the external port of prev if not nil
+    mapPort(ctx context.Context, internal *net.UDPAddr, prev *Mapping, lifetime time.Duration) (Mapping, error)
+    unmapPort(ctx context.Context, m Mapping) error
+}
+
+//PortMapper keeps a mapping of a local UDP port alive until closed, which deletes it
+type PortMapper struct {
+    config    Config
+    proto     protocol
+    errs      chan error
+    done      chan struct{}
+    closeOnce sync.Once
+    running   sync.WaitGroup
+
+    mu        sync.Mutex
+    mapping   Mapping
+}
+
+func newProtocol(name string, config Config) (protocol, error) {
+    switch name {
+        case ProtocolPCP:
+            return &pcp { config: config }, nil
+        case ProtocolNATPMP:
+            return &natpmp { config: config }, nil
+        case ProtocolUPnP:
+            return &upnp { config: config }, nil
+        default:
+            return nil, fmt.Errorf("Unknown port mapping protocol '%s'", name)
+    }
+}
+
+//maps the local UDP port, trying each protocol in turn. ctx only bounds the setup,
+//use Close to delete the mapping.
+func New(ctx context.Context, port int, config Config) (*PortMapper, error) {
+    if config.Gateway == nil {
+        gw, err := defaultGateway()
+        if err != nil {
+            return nil, err
+        }
+        config.Gateway = gw
+    }
+    if config.PMPPort == 0 {
+        config.PMPPort = DefaultPMPPort
+    }
+    if config.SSDPAddr == "" {
+        config.SSDPAddr = DefaultSSDPAddr
+    }
+    if len(config.Protocols) == 0 {
+        config.Protocols = DefaultProtocols
+    }
+    if config.Lifetime <= 0 {
+        config.Lifetime = DefaultLifetime
+    }
+    if config.Timeout <= 0 {
+        config.Timeout = DefaultTimeout
+    }
+
+    localIP, err := localAddrFor(config.Gateway)
+    if err != nil {
+        return nil, err
+    }
+    internal := &net.UDPAddr {
+        IP:   localIP,
+        Port: port,
+    }
+
+    errs := []string(nil)
+    for _, name := range config.Protocols {
+        proto, err := newProtocol(name, config)
+        if err != nil {
+            return nil, err
+        }
+        m, err := proto.mapPort(ctx, internal, nil, config.Lifetime)
+        if err != nil {
+            if ctx.Err() != nil {
+                return nil, fmt.Errorf("Failed to map port: %w", ctx.Err())
+            }
+            errs = append(errs, fmt.Sprintf("%s: %v", name, err))
+            continue
+        }
+
+        pm := &PortMapper {
+            config:  config,
+            proto:   proto,
+            errs:    make(chan error, errorBuffer),
+            done:    make(chan struct{}),
+            mapping: m,
+        }
+        pm.running.Add(1)
+        go pm.renewLoop()
+        go func() {
+            pm.running.Wait()
+            close(pm.errs)
+        }()
+        return pm, nil
+    }
+    return nil, fmt.Errorf("Failed to map port: %s", strings.Join(errs, ", "))
+}
+
+//the local address of the interface the gateway is reached through
+func localAddrFor(gateway net.IP) (net.IP, error) {
+    conn, err := net.DialUDP("udp4", nil, &net.UDPAddr {
+        IP:   gateway,
+        Port: DefaultPMPPort,
+    })
+    if err != nil {
+        return nil, fmt.Errorf("Unable to reach gateway %s: %w", gateway, err)
+    }
+    defer conn.Close()
+    return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+func (pm *PortMapper) reportError(err error) {
+    select {
+        case pm.errs <- err:
+        default:
+    }
+}
+
+//renews the mapping halfway through its lifetime, sooner if the gateway didn't answer
+func (pm *PortMapper) renewLoop() {
+    defer pm.running.Done()
+
+    for {
+        m := pm.Mapping()
+        //permanent mappings only need deleting
+        if m.Lifetime == 0 {
+            <-pm.done
+            return
+        }
+        wait := m.Lifetime / 2
+        for {
+            select {
+                case <-time.After(wait):
+                case <-pm.done:
+                    return
+            }
+            if err := pm.renew(); err != nil {
+                if errors.Is(err, net.ErrClosed) {
+                    return
+                }
+                pm.reportError(fmt.Errorf("Failed to renew %s port mapping: %w", m.Protocol, err))
+                floor := minRenewal
+                if m.Lifetime / 4 < floor {
+                    floor = m.Lifetime / 4
+                }
+                wait /= 2
+                if wait < floor {
+                    wait = floor
+                }
+                continue
+            }
+            break
+        }
+    }
+}
+
+//renews the mapping now, reporting a change of the external address as an error as
+//peers still use the old one
+func (pm *PortMapper) renew() error {
+    ctx, cancel := context.WithTimeout(context.Background(), pm.config.Timeout)
+    defer cancel()
+    go func() {
+        select {
+            case <-pm.done:
+                cancel()
+            case <-ctx.Done():
+        }
+    }()
+
+    prev := pm.Mapping()
+    m, err := pm.proto.mapPort(ctx, prev.Internal, &prev, pm.config.Lifetime)
+    if err != nil {
+        select {
+            case <-pm.done:
+                return net.ErrClosed
+            default:
+                return err
+        }
+    }
+    pm.mu.Lock()
+    pm.mapping = m
+    pm.mu.Unlock()
+    if m.External.String() != prev.External.String() {
+        pm.reportError(fmt.Errorf("Gateway moved the %s port mapping from %s to %s", m.Protocol, prev.External, m.External))
+    }
+    return nil
+}
+
+//the current mapping
+func (pm *PortMapper) Mapping() Mapping {
+    pm.mu.Lock()
+    defer pm.mu.Unlock()
+    return pm.mapping
+}
+
+//errors that didn't remove the mapping, like failed renewals. Closed once the mapper is.
+func (pm *PortMapper) Errors() <-chan error {
+    return pm.errs
+}
+
+//stops renewing the mapping and deletes it from the gateway
+func (pm *PortMapper) Close() error {
+    err := net.ErrClosed
+    pm.closeOnce.Do(func() {
+        close(pm.done)
+        pm.running.Wait()
+        ctx, cancel := context.WithTimeout(context.Background(), pm.config.Timeout)
+        defer cancel()
+        err = pm.proto.unmapPort(ctx, pm.Mapping())
+    })
+    return err
+}
@@ -0,0 +1,95 @@
+package portmap
+
+import (
+    "context"
+    "net"
+    "testing"
+    "time"
+)
+
+//a gateway speaking some of the protocols, and the one expected to map the port
+type fakeCase struct {
+    name     string
+    config   fakeConfig
+    expected string
+}
+
+//asked for by the tests, so renewals happen within seconds
+const fakeLifetime = 4 * time.Second
+
+var fakeCases = []fakeCase {
+    {
+        name:     "PCP",
+        config:   fakeConfig { PCP: true, NATPMP: true, UPnP: true, MaxLifetime: 2 * time.Second },
+        expected: ProtocolPCP,
+    },
+    {
+        name:     "NAT-PMP",
+        config:   fakeConfig { NATPMP: true, UPnP: true, MaxLifetime: 2 * time.Second },
+        expected: ProtocolNATPMP,
+    },
+    {
+        name:     "UPnP",
+        config:   fakeConfig { UPnP: true },
+        expected: ProtocolUPnP,
+    },
+    {
+        name:     "UPnP-permanent",
+        config:   fakeConfig { UPnP: true, OnlyPermanent: true },
+        expected: ProtocolUPnP,
+    },
+}
+
+//maps a port with a fake gateway on loopback, waits for a renewal and checks closing
+//deletes the mapping
+func TestMapping(t *testing.T) {
+    for _, c := range fakeCases {
+        c := c
+        t.Run(c.name, func(t *testing.T) {
+            t.Parallel()
+            gw, err := newFakeGateway(net.IPv4(127, 0, 0, 1), c.config)
+            if err != nil {
+                t.Fatal(err)
+            }
+            defer gw.Close()
+
+            conn, err := net.ListenUDP("udp4", &net.UDPAddr { IP: net.IPv4(127, 0, 0, 1) })
+            if err != nil {
+                t.Fatal(err)
+            }
+            defer conn.Close()
+
+            config := gw.Config()
+            config.Timeout = time.Second
+            config.Lifetime = fakeLifetime
+            pm, err := New(context.Background(), conn.LocalAddr().(*net.UDPAddr).Port, config)
+            if err != nil {
+                t.Fatal(err)
+            }
+            defer pm.Close()
+            m := pm.Mapping()
+            if m.Protocol != c.expected {
+                t.Fatalf("Mapped with %s instead of %s", m.Protocol, c.expected)
+            }
+            t.Logf("Mapped %s", describe(m))
+
+            if m.Lifetime > 0 {
+                //past the lifetime the fake gateway granted, so only a renewal keeps the mapping
+                time.Sleep(m.Lifetime + m.Lifetime / 2)
+                if len(gw.Mappings()) != 1 {
+                    t.Fatal("Mapping expired instead of being renewed")
+                }
+            }
+
+            if err := pm.Close(); err != nil {
+                t.Fatalf("Unable to delete mapping: %v", err)
+            }
+            if ms := gw.Mappings(); len(ms) != 0 {
+                t.Fatalf("Gateway still has %d mappings after closing", len(ms))
+            }
+            for err := range pm.Errors() {
+                t.Errorf("Mapper reported: %v", err)
+            }
+        })
+    }
+}
@@ -0,0 +1,341 @@
+package portmap
+
+import (
+    "bufio"
+    "bytes"
+    "context"
+    "encoding/xml"
+    "errors"
+    "fmt"
+    "io"
+    "math/rand"
+    "net"
+    "net/http"
+    "net/url"
+    "strconv"
+    "strings"
+    "time"
+)
+
+const (
+    //where gateways listen for SSDP searches sent to them directly
+    ssdpPort          = 1900
+    igdDeviceType     = "urn:schemas-upnp-org:device:InternetGatewayDevice:1"
+    //description shown by the gateway for our mappings
+    upnpDescription   = "nat-traversal"
+    //UPnP error codes
+    upnpConflict      = 718
+    upnpOnlyPermanent = 725
+    //external ports tried when the one asked for is taken
+    upnpAttempts      = 4
+)
+
+//the services port mappings can be added to, the same actions work on all of them
+var igdServices = []string {
+    "urn:schemas-upnp-org:service:WANIPConnection:2",
+    "urn:schemas-upnp-org:service:WANIPConnection:1",
+    "urn:schemas-upnp-org:service:WANPPPConnection:1",
+}
+
+type upnp struct {
+    config  Config
+    //found by the first mapping
+    control string
+    service string
+}
+
+type upnpDevice struct {
+    DeviceType string        `xml:"deviceType"`
+    Services   []upnpService `xml:"serviceList>service"`
+    Devices    []upnpDevice  `xml:"deviceList>device"`
+}
+
+type upnpService struct {
+    ServiceType string `xml:"serviceType"`
+    ControlURL  string `xml:"controlURL"`
+}
+
+type upnpRoot struct {
+    URLBase string     `xml:"URLBase"`
+    Device  upnpDevice `xml:"device"`
+}
+
+//the fault a gateway answered an action with
+type upnpError struct {
+    code        int
+    description string
+}
+
+func (e *upnpError) Error() string {
+    return fmt.Sprintf("UPnP error %d: %s", e.code, e.description)
+}
+
+//finds the control URL of the gateway's connection service: an SSDP search sent to
+//the multicast group and to the gateway, then the description of the first answer
+func (u *upnp) discover(ctx context.Context) error {
+    conn, err := net.ListenUDP("udp4", nil)
+    if err != nil {
+        return err
+    }
+    defer conn.Close()
+
+    targets := []*net.UDPAddr {
+        {
+            IP:   u.config.Gateway,
+            Port: ssdpPort,
+        },
+    }
+    if group, err := net.ResolveUDPAddr("udp4", u.config.SSDPAddr); err == nil {
+        targets = append(targets, group)
+    }
+    search := fmt.Sprintf("M-SEARCH * HTTP/1.1\r\nHOST: %s\r\nST: %s\r\nMAN: \"ssdp:discover\"\r\nMX: 1\r\n\r\n",
+        DefaultSSDPAddr, igdDeviceType)
+
+    ctx, cancel := context.WithTimeout(ctx, u.config.Timeout)
+    defer cancel()
+    deadline, _ := ctx.Deadline()
+
+    buf := make([]byte, 2048)
+    interval := pmpInitialInterval
+    for {
+        for _, t := range targets {
+            conn.WriteToUDP([]byte(search), t)
+        }
+        readDeadline := time.Now().Add(interval)
+        if deadline.Before(readDeadline) {
+            readDeadline = deadline
+        }
+        conn.SetReadDeadline(readDeadline)
+        for {
+            n, _, err := conn.ReadFromUDP(buf)
+            if err != nil {
+                break
+            }
+            res, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+            if err != nil || res.StatusCode != http.StatusOK {
+                continue
+            }
+            location := res.Header.Get("Location")
+            if location == "" {
+                continue
+            }
+            if err := u.describe(ctx, location); err != nil {
+                return err
+            }
+            return nil
+        }
+        if ctx.Err() != nil {
+            return fmt.Errorf("No UPnP gateway answered")
+        }
+        interval *= 2
+    }
+}
+
+//reads the description of the gateway to find its connection service
+func (u *upnp) describe(ctx context.Context, location string) error {
+    req, err := http.NewRequestWithContext(ctx, http.MethodGet, location, nil)
+    if err != nil {
+        return err
+    }
+    res, err := http.DefaultClient.Do(req)
+    if err != nil {
+        return fmt.Errorf("Unable to fetch gateway description: %w", err)
+    }
+    defer res.Body.Close()
+    if res.StatusCode != http.StatusOK {
+        return fmt.Errorf("Unable to fetch gateway description: %s", res.Status)
+    }
+
+    var root upnpRoot
+    if err := xml.NewDecoder(io.LimitReader(res.Body, 1 << 20)).Decode(&root); err != nil {
+        return fmt.Errorf("Malformed gateway description: %w", err)
+    }
+    base, err := url.Parse(location)
+    if err != nil {
+        return err
+    }
+    if root.URLBase != "" {
+        if b, err := url.Parse(root.URLBase); err == nil {
+            base = b
+        }
+    }
+
+    for _, service := range igdServices {
+        if s, ok := findService(root.Device, service); ok {
+            control, err := url.Parse(s.ControlURL)
+            if err != nil {
+                return fmt.Errorf("Malformed control URL: %w", err)
+            }
+            u.control = base.ResolveReference(control).String()
+            u.service = service
+            return nil
+        }
+    }
+    return fmt.Errorf("Gateway has no WAN connection service")
+}
+
+func findService(d upnpDevice, serviceType string) (upnpService, bool) {
+    for _, s := range d.Services {
+        if s.ServiceType == serviceType {
+            return s, true
+        }
+    }
+    for _, child := range d.Devices {
+        if s, ok := findService(child, serviceType); ok {
+            return s, true
+        }
+    }
+    return upnpService {}, false
+}
+
+//calls a SOAP action of the connection service, returning the values in the response
+func (u *upnp) call(ctx context.Context, action string, args [][2]string) (map[string]string, error) {
+    var body bytes.Buffer
+    body.WriteString(`<?xml version="1.0"?>`)
+    body.WriteString(`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>`)
+    fmt.Fprintf(&body, `<u:%s xmlns:u="%s">`, action, u.service)
+    for _, a := range args {
+        fmt.Fprintf(&body, "<%s>", a[0])
+        xml.EscapeText(&body, []byte(a[1]))
+        fmt.Fprintf(&body, "</%s>", a[0])
+    }
+    fmt.Fprintf(&body, `</u:%s></s:Body></s:Envelope>`, action)
+
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.control, &body)
+    if err != nil {
+        return nil, err
+    }
+    req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+    req.Header.Set("SOAPAction", fmt.Sprintf(`"%s#%s"`, u.service, action))
+    res, err := http.DefaultClient.Do(req)
+    if err != nil {
+        return nil, err
+    }
+    defer res.Body.Close()
+
+    values, err := soapValues(io.LimitReader(res.Body, 1 << 20))
+    if err != nil {
+        return nil, fmt.Errorf("Malformed response to %s: %w", action, err)
+    }
+    if res.StatusCode != http.StatusOK {
+        code, err := strconv.Atoi(values["errorCode"])
+        if err != nil {
+            return nil, fmt.Errorf("%s failed: %s", action, res.Status)
+        }
+        return nil, &upnpError {
+            code:        code,
+            description: values["errorDescription"],
+        }
+    }
+    return values, nil
+}
+
+//the text of every element without children, by local name
+func soapValues(r io.Reader) (map[string]string, error) {
+    values := make(map[string]string)
+    d := xml.NewDecoder(r)
+    name, text := "", ""
+    for {
+        tok, err := d.Token()
+        if errors.Is(err, io.EOF) {
+            return values, nil
+        }
+        if err != nil {
+            return nil, err
+        }
+        switch t := tok.(type) {
+            case xml.StartElement:
+                name, text = t.Name.Local, ""
+            case xml.CharData:
+                text += string(t)
+            case xml.EndElement:
+                if t.Name.Local == name {
+                    values[name] = strings.TrimSpace(text)
+                }
+                name = ""
+        }
+    }
+}
+
+func (u *upnp) externalIP(ctx context.Context) (net.IP, error) {
+    values, err := u.call(ctx, "GetExternalIPAddress", nil)
+    if err != nil {
+        return nil, err
+    }
+    ip := net.ParseIP(values["NewExternalIPAddress"]).To4()
+    if ip == nil || ip.IsUnspecified() {
+        return nil, fmt.Errorf("Gateway has no external IPv4 address")
+    }
+    return ip, nil
+}
+
+func (u *upnp) addMapping(ctx context.Context, internal *net.UDPAddr, external int, lifetime time.Duration) error {
+    _, err := u.call(ctx, "AddPortMapping", [][2]string {
+        { "NewRemoteHost",             "" },
+        { "NewExternalPort",           strconv.Itoa(external) },
+        { "NewProtocol",               "UDP" },
+        { "NewInternalPort",           strconv.Itoa(internal.Port) },
+        { "NewInternalClient",         internal.IP.String() },
+        { "NewEnabled",                "1" },
+        { "NewPortMappingDescription", upnpDescription },
+        { "NewLeaseDuration",          strconv.Itoa(int(secondsOf(lifetime))) },
+    })
+    return err
+}
+
+func (u *upnp) mapPort(ctx context.Context, internal *net.UDPAddr, prev *Mapping, lifetime time.Duration) (Mapping, error) {
+    ctx, cancel := context.WithTimeout(ctx, u.config.Timeout)
+    defer cancel()
+
+    if u.control == "" {
+        if err := u.discover(ctx); err != nil {
+            return Mapping {}, err
+        }
+    }
+    ip, err := u.externalIP(ctx)
+    if err != nil {
+        return Mapping {}, err
+    }
+
+    external := internal.Port
+    if prev != nil {
+        external = prev.External.Port
+    }
+    for attempt := 0; ; attempt++ {
+        err = u.addMapping(ctx, internal, external, lifetime)
+        var upnpErr *upnpError
+        if errors.As(err, &upnpErr) {
+            switch {
+                //some gateways only keep mappings until deleted
+                case upnpErr.code == upnpOnlyPermanent && lifetime != 0:
+                    lifetime = 0
+                    continue
+                case upnpErr.code == upnpConflict && prev == nil && attempt < upnpAttempts:
+                    external = 1024 + rand.Intn(65535 - 1024)
+                    continue
+            }
+        }
+        break
+    }
+    if err != nil {
+        return Mapping {}, err
+    }
+    return Mapping {
+        Protocol: ProtocolUPnP,
+        Internal: internal,
+        External: &net.UDPAddr {
+            IP:   ip,
+            Port: external,
+        },
+        Lifetime: lifetime,
+    }, nil
+}
+
+func (u *upnp) unmapPort(ctx context.Context, m Mapping) error {
+    _, err := u.call(ctx, "DeletePortMapping", [][2]string {
+        { "NewRemoteHost",   "" },
+        { "NewExternalPort", strconv.Itoa(m.External.Port) },
+        { "NewProtocol",     "UDP" },
+    })
+    return err
+}
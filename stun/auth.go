@@ -0,0 +1,286 @@
+package stun
+
+import (
+    "crypto/hmac"
+    "crypto/sha256"
+    "fmt"
+    "net"
+    "strings"
+    "sync"
+
+    "github.com/pion/stun"
+)
+
+const (
+    //RFC 8489, not known by the STUN library
+    attrMessageIntegritySHA256 = stun.AttrType(0x001C)
+    //MESSAGE-INTEGRITY-SHA256 may be truncated down to this size
+    minSHA256IntegritySize     = 16
+    //challenges answered before giving up, a second 401 means the password is wrong
+    maxAuthRetries             = 2
+)
+
+//Credentials authenticate binding requests. Servers using long-term credentials
+//(RFC 8489 section 9.2) answer the first request with a realm and nonce to sign the
+//next ones with, everything else uses short-term credentials (section 9.1), where the
+//key is the password itself.
+type Credentials struct {
+    Username string
+    Password string
+    //also signs with MESSAGE-INTEGRITY-SHA256, dropped for servers that don't know it
+    SHA256   bool
+}
+
+//the key messages are signed with, realm is empty for short-term credentials
+func (c *Credentials) key(realm string) []byte {
+    if realm == "" {
+        return []byte(c.Password)
+    }
+    return []byte(stun.NewLongTermIntegrity(c.Username, realm, c.Password))
+}
+
+//splits user:password@host:port into the server and the credentials used with it
+func parseServer(s string) (string, *Credentials) {
+    i := strings.LastIndex(s, "@")
+    if i < 0 {
+        return s, nil
+    }
+    user, pass, _ := strings.Cut(s[:i], ":")
+    return s[i + 1:], &Credentials {
+        Username: user,
+        Password: pass,
+        SHA256:   true,
+    }
+}
+
+//the MESSAGE-INTEGRITY-SHA256 attribute, keyed like MESSAGE-INTEGRITY
+type integritySHA256 []byte
+
+func (k integritySHA256) AddTo(m *stun.Message) error {
+    if m.Contains(stun.AttrFingerprint) {
+        return stun.ErrFingerprintBeforeIntegrity
+    }
+    //the length in the header covers the attribute being added
+    length := m.Length
+    m.Length += sha256.Size + 4
+    m.WriteLength()
+    mac := hmac.New(sha256.New, k)
+    mac.Write(m.Raw)
+    m.Length = length
+    m.Add(attrMessageIntegritySHA256, mac.Sum(nil))
+    return nil
+}
+
+func (k integritySHA256) Check(m *stun.Message) error {
+    v, err := m.Get(attrMessageIntegritySHA256)
+    if err != nil {
+        return err
+    }
+    if len(v) < minSHA256IntegritySize || len(v) > sha256.Size || len(v) % 4 != 0 {
+        return stun.ErrIntegrityMismatch
+    }
+    offset, after := attrOffset(m, attrMessageIntegritySHA256)
+    length := m.Length
+    m.Length -= uint32(after)
+    m.WriteLength()
+    mac := hmac.New(sha256.New, k)
+    mac.Write(m.Raw[:offset])
+    m.Length = length
+    m.WriteLength()
+    if !hmac.Equal(v, mac.Sum(nil)[:len(v)]) {
+        return stun.ErrIntegrityMismatch
+    }
+    return nil
+}
+
+//where an attribute starts in the raw message, and the size of the attributes after it
+func attrOffset(m *stun.Message, t stun.AttrType) (int, int) {
+    offset, after := 20, 0
+    found := false
+    for _, a := range m.Attributes {
+        size := 4 + (int(a.Length) + 3) &^ 3
+        switch {
+            case found:
+                after += size
+            case a.Type == t:
+                found = true
+            default:
+                offset += size
+        }
+    }
+    return offset, after
+}
+
+//checks the strongest integrity attribute of m, failing if it has none
+func checkIntegrity(m *stun.Message, key []byte) error {
+    if m.Contains(attrMessageIntegritySHA256) {
+        return integritySHA256(key).Check(m)
+    }
+    if m.Contains(stun.AttrMessageIntegrity) {
+        return stun.MessageIntegrity(key).Check(m)
+    }
+    return fmt.Errorf("Message not signed")
+}
+
+//checks a response signed with key, which must use MESSAGE-INTEGRITY-SHA256 if sha256 is
+//set: MESSAGE-INTEGRITY comes first, so it stays valid with the attributes after it
+//stripped off
+func checkResponse(m *stun.Message, key []byte, sha256 bool) error {
+    if sha256 && !m.Contains(attrMessageIntegritySHA256) {
+        return fmt.Errorf("Message not signed with MESSAGE-INTEGRITY-SHA256")
+    }
+    return checkIntegrity(m, key)
+}
+
+//data that looks like STUN but has a wrong fingerprint isn't STUN
+func checkFingerprint(m *stun.Message) bool {
+    return !m.Contains(stun.AttrFingerprint) || stun.Fingerprint.Check(m) == nil
+}
+
+//authenticates the requests sent to a server or peer
+type auth struct {
+    creds  Credentials
+
+    mu     sync.Mutex
+    //learned from the server's challenge, empty with short-term credentials
+    realm  string
+    nonce  string
+    sha256 bool
+    //set once the server answered with MESSAGE-INTEGRITY-SHA256, after which it can't
+    //be dropped anymore
+    pinned bool
+}
+
+func newAuth(creds Credentials) *auth {
+    return &auth {
+        creds:  creds,
+        sha256: creds.SHA256,
+    }
+}
+
+//the attributes authenticating a request, the key its response must be signed with
+//and whether it must be signed with MESSAGE-INTEGRITY-SHA256
+func (a *auth) setters() ([]stun.Setter, []byte, bool) {
+    a.mu.Lock()
+    defer a.mu.Unlock()
+
+    key := a.creds.key(a.realm)
+    setters := []stun.Setter { stun.NewUsername(a.creds.Username) }
+    if a.realm != "" {
+        setters = append(setters, stun.NewRealm(a.realm), stun.NewNonce(a.nonce))
+    }
+    setters = append(setters, stun.MessageIntegrity(key))
+    if a.sha256 {
+        setters = append(setters, integritySHA256(key))
+    }
+    return setters, key, a.pinned
+}
+
+//notes a successful response, which pins MESSAGE-INTEGRITY-SHA256 if it was signed with it
+func (a *auth) answered(res *stun.Message) {
+    a.mu.Lock()
+    defer a.mu.Unlock()
+    if a.sha256 && res.Contains(attrMessageIntegritySHA256) {
+        a.pinned = true
+    }
+}
+
+//learns from an error response how requests should be signed, returning whether the
+//request should be sent again
+func (a *auth) retry(res *stun.Message, code stun.ErrorCode) bool {
+    a.mu.Lock()
+    defer a.mu.Unlock()
+
+    switch code {
+        case stun.CodeUnauthorized, stun.CodeStaleNonce:
+            var realm stun.Realm
+            var nonce stun.Nonce
+            if err := realm.GetFrom(res); err != nil {
+                return false
+            }
+            if err := nonce.GetFrom(res); err != nil {
+                return false
+            }
+            a.realm, a.nonce = string(realm), string(nonce)
+            return true
+        case stun.CodeUnknownAttribute:
+            //servers only report unknown attributes once the request was authenticated,
+            //so an unsigned answer may be forged to make us fall back to MESSAGE-INTEGRITY
+            if !a.sha256 || a.pinned || checkIntegrity(res, a.creds.key(a.realm)) != nil {
+                return false
+            }
+            var unknown stun.UnknownAttributes
+            if err := unknown.GetFrom(res); err != nil {
+                return false
+            }
+            for _, t := range unknown {
+                if t == attrMessageIntegritySHA256 {
+                    a.sha256 = false
+                    return true
+                }
+            }
+    }
+    return false
+}
+
+//answers a binding request from a peer checking connectivity, once AnswerBindings
+//was called. Errors are sent unsigned, as the peer can't be trusted yet.
+func (s *StunSocket) answer(req *stun.Message, from *net.UDPAddr) {
+    s.mu.Lock()
+    lookup, checked := s.lookup, s.checked
+    s.mu.Unlock()
+    if lookup == nil || req.Type != stun.BindingRequest {
+        return
+    }
+
+    var username stun.Username
+    hasMI := req.Contains(stun.AttrMessageIntegrity)
+    hasSHA256 := req.Contains(attrMessageIntegritySHA256)
+    if err := username.GetFrom(req); err != nil || (!hasMI && !hasSHA256) {
+        s.reject(req, from, stun.CodeBadRequest)
+        return
+    }
+    creds, ok := lookup(username.String())
+    if !ok {
+        s.reject(req, from, stun.CodeUnauthorized)
+        return
+    }
+    key := creds.key("")
+    if err := checkIntegrity(req, key); err != nil {
+        s.reject(req, from, stun.CodeUnauthorized)
+        return
+    }
+
+    setters := []stun.Setter {
+        stun.NewTransactionIDSetter(req.TransactionID),
+        stun.BindingSuccess,
+        &stun.XORMappedAddress {
+            IP:   from.IP,
+            Port: from.Port,
+        },
+    }
+    if hasMI {
+        setters = append(setters, stun.MessageIntegrity(key))
+    }
+    if hasSHA256 {
+        setters = append(setters, integritySHA256(key))
+    }
+    setters = append(setters, stun.Fingerprint)
+    res, err := stun.Build(setters...)
+    if err != nil {
+        return
+    }
+    s.Conn.WriteTo(res.Raw, from)
+    if checked != nil {
+        checked(username.String(), from)
+    }
+}
+
+func (s *StunSocket) reject(req *stun.Message, from *net.UDPAddr, code stun.ErrorCode) {
+    res, err := stun.Build(stun.NewTransactionIDSetter(req.TransactionID),
+        stun.NewType(stun.MethodBinding, stun.ClassErrorResponse), code, stun.Fingerprint)
+    if err != nil {
+        return
+    }
+    s.Conn.WriteTo(res.Raw, from)
+}
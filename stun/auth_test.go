@@ -0,0 +1,310 @@
+package stun
+
+import (
+    "context"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/binary"
+    "net"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/natanbc/ssc0904-nat-traversal/netsim"
+    "github.com/pion/stun"
+)
+
+//the sample messages of RFC 5769
+var rfc5769 = []struct {
+    name  string
+    raw   string
+    creds Credentials
+    realm string
+} {
+    {
+        name:  "request",
+        raw:   "\x00\x01\x00\x58\x21\x12\xa4\x42\xb7\xe7\xa7\x01\xbc\x34\xd6\x86\xfa\x87\xdf\xae" +
+               "\x80\x22\x00\x10STUN test client" +
+               "\x00\x24\x00\x04\x6e\x00\x01\xff" +
+               "\x80\x29\x00\x08\x93\x2f\xf9\xb1\x51\x26\x3b\x36" +
+               "\x00\x06\x00\x09\x65\x76\x74\x6a\x3a\x68\x36\x76\x59\x20\x20\x20" +
+               "\x00\x08\x00\x14\x9a\xea\xa7\x0c\xbf\xd8\xcb\x56\x78\x1e\xf2\xb5\xb2\xd3\xf2\x49\xc1\xb5\x71\xa2" +
+               "\x80\x28\x00\x04\xe5\x7a\x3b\xcf",
+        creds: Credentials { Username: "evtj:h6vY", Password: "VOkJxbRl1RmTxUk/WvJxBt" },
+    },
+    {
+        name:  "IPv4 response",
+        raw:   "\x01\x01\x00\x3c\x21\x12\xa4\x42\xb7\xe7\xa7\x01\xbc\x34\xd6\x86\xfa\x87\xdf\xae" +
+               "\x80\x22\x00\x0b\x74\x65\x73\x74\x20\x76\x65\x63\x74\x6f\x72\x20" +
+               "\x00\x20\x00\x08\x00\x01\xa1\x47\xe1\x12\xa6\x43" +
+               "\x00\x08\x00\x14\x2b\x91\xf5\x99\xfd\x9e\x90\xc3\x8c\x74\x89\xf9\x2a\xf9\xba\x53\xf0\x6b\xe7\xd7" +
+               "\x80\x28\x00\x04\xc0\x7d\x4c\x96",
+        creds: Credentials { Password: "VOkJxbRl1RmTxUk/WvJxBt" },
+    },
+    {
+        name:  "IPv6 response",
+        raw:   "\x01\x01\x00\x48\x21\x12\xa4\x42\xb7\xe7\xa7\x01\xbc\x34\xd6\x86\xfa\x87\xdf\xae" +
+               "\x80\x22\x00\x0b\x74\x65\x73\x74\x20\x76\x65\x63\x74\x6f\x72\x20" +
+               "\x00\x20\x00\x14\x00\x02\xa1\x47\x01\x13\xa9\xfa\xa5\xd3\xf1\x79\xbc\x25\xf4\xb5\xbe\xd2\xb9\xd9" +
+               "\x00\x08\x00\x14\xa3\x82\x95\x4e\x4b\xe6\x7b\xf1\x17\x84\xc9\x7c\x82\x92\xc2\x75\xbf\xe3\xed\x41" +
+               "\x80\x28\x00\x04\xc8\xfb\x0b\x4c",
+        creds: Credentials { Password: "VOkJxbRl1RmTxUk/WvJxBt" },
+    },
+    {
+        name:  "long-term request",
+        raw:   "\x00\x01\x00\x60\x21\x12\xa4\x42\x78\xad\x34\x33\xc6\xad\x72\xc0\x29\xda\x41\x2e" +
+               "\x00\x06\x00\x12\xe3\x83\x9e\xe3\x83\x88\xe3\x83\xaa\xe3\x83\x83\xe3\x82\xaf\xe3\x82\xb9\x00\x00" +
+               "\x00\x15\x00\x1c\x66\x2f\x2f\x34\x39\x39\x6b\x39\x35\x34\x64\x36\x4f\x4c\x33\x34\x6f\x4c\x39\x46" +
+               "\x53\x54\x76\x79\x36\x34\x73\x41" +
+               "\x00\x14\x00\x0b\x65\x78\x61\x6d\x70\x6c\x65\x2e\x6f\x72\x67\x00" +
+               "\x00\x08\x00\x14\xf6\x70\x24\x65\x6d\xd6\x4a\x3e\x02\xb8\xe0\x71\x2e\x85\xc9\xa2\x8c\xa8\x96\x66",
+        //the password after SASLprep
+        creds: Credentials { Username: "マトリックス", Password: "TheMatrIX" },
+        realm: "example.org",
+    },
+}
+
+func decodeMessage(t *testing.T, raw []byte) *stun.Message {
+    t.Helper()
+    m := &stun.Message { Raw: append([]byte(nil), raw...) }
+    if err := m.Decode(); err != nil {
+        t.Fatal(err)
+    }
+    return m
+}
+
+func TestRFC5769(t *testing.T) {
+    for _, v := range rfc5769 {
+        key := v.creds.key(v.realm)
+        m := decodeMessage(t, []byte(v.raw))
+        if !checkFingerprint(m) {
+            t.Errorf("%s: fingerprint rejected", v.name)
+        }
+        if err := checkIntegrity(m, key); err != nil {
+            t.Errorf("%s: %v", v.name, err)
+        }
+
+        bad := v.creds
+        bad.Password += "x"
+        if err := checkIntegrity(m, bad.key(v.realm)); err == nil {
+            t.Errorf("%s: accepted with a bad key", v.name)
+        }
+        //not signed with MESSAGE-INTEGRITY-SHA256, so not accepted once it's required
+        if err := checkResponse(m, key, true); err == nil {
+            t.Errorf("%s: accepted without MESSAGE-INTEGRITY-SHA256", v.name)
+        }
+
+        //a byte changed after the header, covered by both
+        raw := []byte(v.raw)
+        raw[25] ^= 1
+        m = decodeMessage(t, raw)
+        if err := checkIntegrity(m, key); err == nil {
+            t.Errorf("%s: accepted after being modified", v.name)
+        }
+        if m.Contains(stun.AttrFingerprint) && checkFingerprint(m) {
+            t.Errorf("%s: fingerprint accepted after being modified", v.name)
+        }
+    }
+}
+
+//the RFC 5769 request signed with MESSAGE-INTEGRITY-SHA256 instead, checked against an
+//HMAC computed over the message as RFC 8489 section 14.6 describes
+func TestIntegritySHA256(t *testing.T) {
+    key := rfc5769[0].creds.key("")
+    vector := decodeMessage(t, []byte(rfc5769[0].raw))
+
+    build := func(mac stun.Setter) *stun.Message {
+        m, err := stun.Build(stun.NewTransactionIDSetter(vector.TransactionID), stun.BindingRequest,
+            stun.NewSoftware("STUN test client"), stun.NewUsername("evtj:h6vY"), mac, stun.Fingerprint)
+        if err != nil {
+            t.Fatal(err)
+        }
+        return decodeMessage(t, m.Raw)
+    }
+    m := build(integritySHA256(key))
+
+    offset, _ := attrOffset(m, attrMessageIntegritySHA256)
+    signed := append([]byte(nil), m.Raw[:offset]...)
+    binary.BigEndian.PutUint16(signed[2:4], uint16(offset - 20 + 4 + sha256.Size))
+    mac := hmac.New(sha256.New, key)
+    mac.Write(signed)
+    if v, _ := m.Get(attrMessageIntegritySHA256); !hmac.Equal(v, mac.Sum(nil)) {
+        t.Fatalf("Signed with %x instead of %x", v, mac.Sum(nil))
+    }
+    if err := checkIntegrity(m, key); err != nil {
+        t.Fatal(err)
+    }
+    if err := checkIntegrity(m, []byte("wrong")); err == nil {
+        t.Fatal("Accepted with a bad key")
+    }
+    raw := append([]byte(nil), m.Raw...)
+    raw[len(raw) - 1] ^= 1
+    if checkFingerprint(decodeMessage(t, raw)) {
+        t.Fatal("Bad fingerprint accepted")
+    }
+
+    //truncated to 16 bytes, the shortest allowed
+    truncated := build(stun.RawAttribute { Type: attrMessageIntegritySHA256, Length: 16, Value: make([]byte, 16) })
+    offset, _ = attrOffset(truncated, attrMessageIntegritySHA256)
+    signed = append([]byte(nil), truncated.Raw[:offset]...)
+    binary.BigEndian.PutUint16(signed[2:4], uint16(offset - 20 + 4 + 16))
+    mac = hmac.New(sha256.New, key)
+    mac.Write(signed)
+    copy(truncated.Raw[offset + 4:], mac.Sum(nil)[:16])
+    truncated = decodeMessage(t, truncated.Raw)
+    if err := checkIntegrity(truncated, key); err != nil {
+        t.Fatalf("Truncated MESSAGE-INTEGRITY-SHA256 rejected: %v", err)
+    }
+    short := build(stun.RawAttribute { Type: attrMessageIntegritySHA256, Length: 12, Value: mac.Sum(nil)[:12] })
+    if err := checkIntegrity(short, key); err == nil {
+        t.Fatal("MESSAGE-INTEGRITY-SHA256 shorter than 16 bytes accepted")
+    }
+
+    //both, as requests are signed: once SHA256 is required, stripping it off doesn't
+    //leave a message accepted with the MESSAGE-INTEGRITY before it
+    legacy := build(stun.MessageIntegrity(key))
+    both, err := stun.Build(stun.NewTransactionIDSetter(vector.TransactionID), stun.BindingRequest,
+        stun.NewUsername("evtj:h6vY"), stun.MessageIntegrity(key), integritySHA256(key))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := checkResponse(decodeMessage(t, both.Raw), key, true); err != nil {
+        t.Fatal(err)
+    }
+    if err := checkResponse(legacy, key, false); err != nil {
+        t.Fatal(err)
+    }
+    if err := checkResponse(legacy, key, true); err == nil {
+        t.Fatal("Accepted MESSAGE-INTEGRITY once MESSAGE-INTEGRITY-SHA256 was required")
+    }
+}
+
+//a 420 error answering a request signed with MESSAGE-INTEGRITY-SHA256, signed with
+//key if not nil
+func unknownSHA256(t *testing.T, key []byte) *stun.Message {
+    t.Helper()
+    setters := []stun.Setter {
+        stun.TransactionID,
+        stun.NewType(stun.MethodBinding, stun.ClassErrorResponse),
+        stun.CodeUnknownAttribute,
+        stun.UnknownAttributes { attrMessageIntegritySHA256 },
+    }
+    if key != nil {
+        setters = append(setters, stun.MessageIntegrity(key))
+    }
+    m, err := stun.Build(append(setters, stun.Fingerprint)...)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return decodeMessage(t, m.Raw)
+}
+
+func TestAuthDowngrade(t *testing.T) {
+    creds := Credentials { Username: "user", Password: "pass", SHA256: true }
+    key := creds.key("")
+
+    a := newAuth(creds)
+    for _, res := range []*stun.Message { unknownSHA256(t, nil), unknownSHA256(t, []byte("wrong")) } {
+        if a.retry(res, stun.CodeUnknownAttribute) || !a.sha256 {
+            t.Fatal("Dropped MESSAGE-INTEGRITY-SHA256 for an unauthenticated error")
+        }
+    }
+    if !a.retry(unknownSHA256(t, key), stun.CodeUnknownAttribute) || a.sha256 {
+        t.Fatal("Kept MESSAGE-INTEGRITY-SHA256 for a server that doesn't know it")
+    }
+    if _, _, sha256 := a.setters(); sha256 {
+        t.Fatal("Requires MESSAGE-INTEGRITY-SHA256 from a server that doesn't know it")
+    }
+
+    //pinned once the server answered with it
+    a = newAuth(creds)
+    res, err := stun.Build(stun.TransactionID, stun.BindingSuccess, integritySHA256(key))
+    if err != nil {
+        t.Fatal(err)
+    }
+    a.answered(res)
+    if a.retry(unknownSHA256(t, key), stun.CodeUnknownAttribute) || !a.sha256 {
+        t.Fatal("Dropped MESSAGE-INTEGRITY-SHA256 after the server answered with it")
+    }
+    if _, _, sha256 := a.setters(); !sha256 {
+        t.Fatal("Responses without MESSAGE-INTEGRITY-SHA256 still accepted")
+    }
+}
+
+//answers binding requests like a server that only knows MESSAGE-INTEGRITY, with the
+//password password, signing its errors if sign is set
+func serveLegacy(conn net.PacketConn, password string, sign bool) {
+    key := []byte(password)
+    buf := make([]byte, 1500)
+    for {
+        n, from, err := conn.ReadFrom(buf)
+        if err != nil {
+            return
+        }
+        req := &stun.Message { Raw: append([]byte(nil), buf[:n]...) }
+        if req.Decode() != nil || stun.MessageIntegrity(key).Check(req) != nil {
+            continue
+        }
+        setters := []stun.Setter { stun.NewTransactionIDSetter(req.TransactionID) }
+        if req.Contains(attrMessageIntegritySHA256) {
+            setters = append(setters, stun.NewType(stun.MethodBinding, stun.ClassErrorResponse),
+                stun.CodeUnknownAttribute, stun.UnknownAttributes { attrMessageIntegritySHA256 })
+            if sign {
+                setters = append(setters, stun.MessageIntegrity(key))
+            }
+        } else {
+            addr := from.(*net.UDPAddr)
+            setters = append(setters, stun.BindingSuccess, &stun.XORMappedAddress { IP: addr.IP, Port: addr.Port },
+                stun.MessageIntegrity(key))
+        }
+        res, err := stun.Build(append(setters, stun.Fingerprint)...)
+        if err != nil {
+            continue
+        }
+        conn.WriteTo(res.Raw, from)
+    }
+}
+
+//servers that don't know MESSAGE-INTEGRITY-SHA256 are only given MESSAGE-INTEGRITY if
+//they say so in a signed answer
+func TestLegacyServer(t *testing.T) {
+    for _, sign := range []bool { true, false } {
+        network := netsim.New(netsim.Config {})
+        h, err := network.NewHost("198.51.100.1")
+        if err != nil {
+            t.Fatal(err)
+        }
+        conn, err := h.ListenPacket("udp4", testServer)
+        if err != nil {
+            t.Fatal(err)
+        }
+        go serveLegacy(conn, "pass", sign)
+
+        client, err := network.NewHost("203.0.113.2")
+        if err != nil {
+            t.Fatal(err)
+        }
+        pc, err := client.ListenPacket("udp4", "0.0.0.0:0")
+        if err != nil {
+            t.Fatal(err)
+        }
+        s, err := NewWithContext(context.Background(), Config {
+            Servers:      []string { "user:pass@" + testServer },
+            Conn:         pc,
+            QueryTimeout: 200 * time.Millisecond,
+        })
+        switch {
+            case sign && err != nil:
+                t.Fatalf("Signed 420 not accepted: %v", err)
+            case !sign && err == nil:
+                t.Fatal("Fell back to MESSAGE-INTEGRITY for an unsigned 420")
+            case !sign && !strings.Contains(err.Error(), "420"):
+                t.Fatalf("Failed with %v instead of the 420", err)
+        }
+        if s != nil {
+            s.Close()
+        }
+        h.Close()
+        client.Close()
+    }
+}
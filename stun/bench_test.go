@@ -0,0 +1,146 @@
+package stun
+
+import (
+    "context"
+    "net"
+    "testing"
+    "time"
+)
+
+//payload of the packets, after the 128 byte header
+const benchSize = 1200
+
+//how long the receiver waits for packets still in flight before counting the rest as lost
+const benchDrainTimeout = time.Second
+
+//a STUN server on loopback, closed when the benchmark ends
+func serveLoopback(b *testing.B) string {
+    b.Helper()
+    addr, err := net.ResolveUDPAddr("udp4", "127.0.0.1:0")
+    if err != nil {
+        b.Fatal(err)
+    }
+    conn, err := net.ListenUDP("udp4", addr)
+    if err != nil {
+        b.Fatal(err)
+    }
+    b.Cleanup(func() {
+        conn.Close()
+    })
+    go Serve(conn)
+    return conn.LocalAddr().String()
+}
+
+//sends b.N packets over loopback with send, timing the sending. How many packets per
+//second arrived and how many were lost are reported too.
+func benchmarkSend(b *testing.B, gso bool, send func(s *StunSocket, ps []Packet) error) {
+    config := Config {
+        Servers:   []string { serveLoopback(b) },
+        LocalAddr: "127.0.0.1:0",
+    }
+    sender, err := NewWithContext(context.Background(), config)
+    if err != nil {
+        b.Fatal(err)
+    }
+    defer sender.Close()
+    receiver, err := NewWithContext(context.Background(), config)
+    if err != nil {
+        b.Fatal(err)
+    }
+    defer receiver.Close()
+    if !gso {
+        sender.mu.Lock()
+        sender.gso = false
+        sender.mu.Unlock()
+    }
+
+    //the magic of data packets, so they aren't mistaken for STUN
+    header := make([]byte, 128)
+    copy(header, "DATADATA")
+    payload := make([]byte, benchSize)
+    to := receiver.Conn.LocalAddr().(*net.UDPAddr)
+    batch := make([]Packet, batchSize)
+    for i := range batch {
+        batch[i] = Packet {
+            Buffers: [][]byte { header, payload },
+            Addr:    to,
+        }
+    }
+
+    type result struct {
+        received int
+        took     time.Duration
+    }
+    done := make(chan result, 1)
+    b.SetBytes(int64(len(header) + len(payload)))
+    b.ReportAllocs()
+    b.ResetTimer()
+    start := time.Now()
+    go func() {
+        res := result {}
+        last := start
+        timer := time.AfterFunc(benchDrainTimeout, func() {
+            receiver.Close()
+        })
+        for res.received < b.N {
+            if _, _, err := receiver.Read(); err != nil {
+                break
+            }
+            res.received++
+            last = time.Now()
+            timer.Reset(benchDrainTimeout)
+        }
+        timer.Stop()
+        res.took = last.Sub(start)
+        done <- res
+    }()
+
+    for sent := 0; sent < b.N; {
+        n := batchSize
+        if b.N - sent < n {
+            n = b.N - sent
+        }
+        if err := send(sender, batch[:n]); err != nil {
+            b.Fatal(err)
+        }
+        sent += n
+    }
+    b.StopTimer()
+
+    res := <-done
+    if res.took > 0 {
+        b.ReportMetric(float64(res.received) / res.took.Seconds(), "received/s")
+    }
+    b.ReportMetric(float64(b.N - res.received) / float64(b.N) * 100, "%lost")
+}
+
+//a packet built by copying the data after the header, then a system call per packet,
+//as the client sent them before batching
+func BenchmarkSendSingle(b *testing.B) {
+    benchmarkSend(b, false, func(s *StunSocket, ps []Packet) error {
+        for _, p := range ps {
+            buf := make([]byte, 0, p.len())
+            for _, v := range p.Buffers {
+                buf = append(buf, v...)
+            }
+            if _, err := s.WriteTo(buf, p.Addr); err != nil {
+                return err
+            }
+        }
+        return nil
+    })
+}
+
+func BenchmarkSendBatch(b *testing.B) {
+    benchmarkSend(b, false, func(s *StunSocket, ps []Packet) error {
+        _, err := s.WriteBatch(ps)
+        return err
+    })
+}
+
+func BenchmarkSendBatchGSO(b *testing.B) {
+    benchmarkSend(b, true, func(s *StunSocket, ps []Packet) error {
+        _, err := s.WriteBatch(ps)
+        return err
+    })
+}
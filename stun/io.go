@@ -0,0 +1,350 @@
+package stun
+
+import (
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "sync"
+    "syscall"
+
+    "github.com/pion/stun"
+    "golang.org/x/net/ipv4"
+)
+
+const (
+    //datagrams read or written by a single system call
+    batchSize    = 32
+    //batches received but not read yet before the socket stops reading
+    batchQueue   = 8
+    maxDatagram  = 65536
+    //send and receive buffers asked to the kernel
+    socketBuffer = 4 << 20
+    //the kernel won't split a datagram in more segments, nor send more than 64KiB at once
+    maxSegments  = 64
+    maxGSOBytes  = 65000
+)
+
+//batchConn reads and writes datagrams in batches, with a system call for each batch
+//on UDP sockets
+type batchConn interface {
+    ReadBatch(ms []ipv4.Message, flags int) (int, error)
+    WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+//packetBatcher reads and writes a datagram at a time, for sockets that aren't UDP ones
+//like simulated ones
+type packetBatcher struct {
+    conn net.PacketConn
+}
+
+func (b packetBatcher) ReadBatch(ms []ipv4.Message, flags int) (int, error) {
+    n, addr, err := b.conn.ReadFrom(ms[0].Buffers[0])
+    if err != nil {
+        return 0, err
+    }
+    ms[0].N, ms[0].NN, ms[0].Addr = n, 0, addr
+    return 1, nil
+}
+
+func (b packetBatcher) WriteBatch(ms []ipv4.Message, flags int) (int, error) {
+    for i, m := range ms {
+        data := m.Buffers[0]
+        if len(m.Buffers) > 1 {
+            data = nil
+            for _, v := range m.Buffers {
+                data = append(data, v...)
+            }
+        }
+        if _, err := b.conn.WriteTo(data, m.Addr); err != nil {
+            return i, err
+        }
+    }
+    return len(ms), nil
+}
+
+type message struct {
+    data []byte
+    addr *net.UDPAddr
+}
+
+//batch is the packets of the datagrams received by a system call, sharing buf
+type batch struct {
+    msgs []message
+    buf  *[]byte
+}
+
+//the buffers packets are copied to, given back once Read moves past their batch
+var readPool = sync.Pool {
+    New: func() interface{} {
+        b := []byte(nil)
+        return &b
+    },
+}
+
+//Packet is a datagram to send, made of its buffers written one after the other so
+//headers don't need to be copied in front of the data
+type Packet struct {
+    Buffers [][]byte
+    Addr    *net.UDPAddr
+}
+
+func (p *Packet) len() int {
+    n := 0
+    for _, b := range p.Buffers {
+        n += len(b)
+    }
+    return n
+}
+
+//reused by WriteBatch, as building the messages for the kernel allocates otherwise
+type writeScratch struct {
+    msgs    []ipv4.Message
+    //how many packets each message carries, more than one with GSO
+    packets []int
+    bufs    [][]byte
+    oob     []byte
+}
+
+var writePool = sync.Pool {
+    New: func() interface{} {
+        return &writeScratch {
+            msgs:    make([]ipv4.Message, 0, batchSize),
+            packets: make([]int, 0, batchSize),
+            oob:     make([]byte, batchSize * offloadOOBSize),
+        }
+    },
+}
+
+func (s *StunSocket) demultiplex() {
+    defer s.running.Done()
+    defer close(s.messages)
+
+    msgs := make([]ipv4.Message, batchSize)
+    for i := range msgs {
+        msgs[i].Buffers = [][]byte { make([]byte, maxDatagram) }
+        msgs[i].OOB = make([]byte, offloadOOBSize)
+    }
+    for {
+        n, err := s.pc.ReadBatch(msgs, 0)
+        if err != nil {
+            //closing the socket is how Close stops this loop
+            if errors.Is(err, net.ErrClosed) || s.isClosed() {
+                s.setReadErr(net.ErrClosed)
+                return
+            }
+            //ICMP errors for packets sent earlier, the socket still works
+            if ne, ok := err.(net.Error); (ok && ne.Timeout()) || errors.Is(err, syscall.ECONNREFUSED) {
+                s.reportError(fmt.Errorf("Failed to read from socket: %w", err))
+                continue
+            }
+            s.setReadErr(fmt.Errorf("Failed to read from socket: %w", err))
+            s.reportError(err)
+            return
+        }
+
+        b := s.split(msgs[:n])
+        if len(b.msgs) == 0 {
+            readPool.Put(b.buf)
+            continue
+        }
+        select {
+            case s.messages <- b:
+            case <-s.done:
+                s.setReadErr(net.ErrClosed)
+                return
+        }
+    }
+}
+
+//splits datagrams coalesced by GRO, hands STUN responses to their transaction and
+//copies everything else to a single pooled buffer, shared by the packets of the batch
+func (s *StunSocket) split(msgs []ipv4.Message) batch {
+    size := 0
+    for _, m := range msgs {
+        size += m.N
+    }
+    pooled := readPool.Get().(*[]byte)
+    if cap(*pooled) < size {
+        *pooled = make([]byte, 0, size)
+    }
+    buf := (*pooled)[:0]
+    res := make([]message, 0, len(msgs))
+
+    for _, m := range msgs {
+        addr, ok := m.Addr.(*net.UDPAddr)
+        if !ok {
+            continue
+        }
+        data := m.Buffers[0][:m.N]
+        segment := groSegmentSize(m.OOB[:m.NN])
+        if segment <= 0 {
+            segment = len(data)
+        }
+        for len(data) > 0 {
+            n := segment
+            if n > len(data) {
+                n = len(data)
+            }
+            d := data[:n]
+            data = data[n:]
+
+            if stun.IsMessage(d) {
+                s.onStunMessage(d, addr)
+                continue
+            }
+            start := len(buf)
+            buf = append(buf, d...)
+            res = append(res, message {
+                //capped so appending to it can't overwrite the next packet
+                data: buf[start:len(buf):len(buf)],
+                addr: addr,
+            })
+        }
+    }
+    return batch {
+        msgs: res,
+        buf:  pooled,
+    }
+}
+
+//returns the next packet received, or the error that stopped the socket. The data is
+//only valid until the next call, it must be copied to be kept longer.
+func (s *StunSocket) Read() ([]byte, *net.UDPAddr, error) {
+    s.readMu.Lock()
+    defer s.readMu.Unlock()
+
+    for len(s.unread) == 0 {
+        //the caller is done with the last packet of the batch
+        if s.unreadBuf != nil {
+            readPool.Put(s.unreadBuf)
+            s.unreadBuf = nil
+        }
+        b, ok := <-s.messages
+        if !ok {
+            s.mu.Lock()
+            defer s.mu.Unlock()
+            return nil, nil, s.readErr
+        }
+        s.unread, s.unreadBuf = b.msgs, b.buf
+    }
+    m := s.unread[0]
+    s.unread[0] = message{}
+    s.unread = s.unread[1:]
+    return m.data, m.addr, nil
+}
+
+func (s *StunSocket) WriteTo(data []byte, to net.Addr) (int, error) {
+    return s.Conn.WriteTo(data, to)
+}
+
+//sends a datagram that is dropped after ttl hops, so it can open the mapping of our own
+//NAT without reaching the peer's. The TTL is only limited on linux, and by sockets
+//that support it like simulated ones.
+func (s *StunSocket) WriteToTTL(data []byte, to *net.UDPAddr, ttl int) (int, error) {
+    switch conn := s.Conn.(type) {
+        case *net.UDPConn:
+            var oob [64]byte
+            n, _, err := conn.WriteMsgUDP(data, ttlControl(oob[:], ttl), to)
+            return n, err
+        case interface { WriteToTTL([]byte, *net.UDPAddr, int) (int, error) }:
+            return conn.WriteToTTL(data, to, ttl)
+        default:
+            return s.Conn.WriteTo(data, to)
+    }
+}
+
+//whether packets to the same address can be handed to the kernel as a single
+//datagram it splits: all but the last of the same size, the last not bigger
+func gsoRun(ps []Packet) int {
+    size := ps[0].len()
+    total := size
+    n := 1
+    for n < len(ps) && n < maxSegments {
+        l := ps[n].len()
+        if !sameAddr(ps[n].Addr, ps[0].Addr) || l > size || total + l > maxGSOBytes {
+            break
+        }
+        total += l
+        n++
+        if l < size {
+            break
+        }
+    }
+    return n
+}
+
+func sameAddr(a, b *net.UDPAddr) bool {
+    return a.Port == b.Port && a.IP.Equal(b.IP)
+}
+
+//sends the packets in as few system calls as possible, returning how many were sent
+func (s *StunSocket) WriteBatch(ps []Packet) (int, error) {
+    sc := writePool.Get().(*writeScratch)
+    defer writePool.Put(sc)
+
+    buffers := 0
+    for i := range ps {
+        buffers += len(ps[i].Buffers)
+    }
+    if cap(sc.bufs) < buffers {
+        sc.bufs = make([][]byte, 0, buffers)
+    }
+
+    sent := 0
+    for sent < len(ps) {
+        s.mu.Lock()
+        gso := s.gso
+        s.mu.Unlock()
+
+        sc.msgs, sc.packets, sc.bufs = sc.msgs[:0], sc.packets[:0], sc.bufs[:0]
+        for i := sent; i < len(ps) && len(sc.msgs) < batchSize; {
+            n := 1
+            if gso {
+                n = gsoRun(ps[i:])
+            }
+            start := len(sc.bufs)
+            for _, p := range ps[i:i + n] {
+                sc.bufs = append(sc.bufs, p.Buffers...)
+            }
+            msg := ipv4.Message {
+                Buffers: sc.bufs[start:len(sc.bufs):len(sc.bufs)],
+                Addr:    ps[i].Addr,
+            }
+            if n > 1 {
+                oob := sc.oob[len(sc.msgs) * offloadOOBSize:]
+                msg.OOB = gsoControl(oob, ps[i].len())
+            }
+            sc.msgs = append(sc.msgs, msg)
+            sc.packets = append(sc.packets, n)
+            i += n
+        }
+
+        n, err := s.pc.WriteBatch(sc.msgs, 0)
+        for _, v := range sc.packets[:n] {
+            sent += v
+        }
+        if n == 0 && err == nil {
+            return sent, io.ErrShortWrite
+        }
+        if err != nil {
+            //some drivers can't checksum segments, send them one by one from now on
+            if gso && (errors.Is(err, syscall.EIO) || errors.Is(err, syscall.EINVAL)) {
+                s.mu.Lock()
+                s.gso = false
+                s.mu.Unlock()
+                continue
+            }
+            return sent, err
+        }
+    }
+    return sent, nil
+}
+
+//whether the kernel splits datagrams written in batches (GSO) and coalesces those
+//received (GRO) for this socket
+func (s *StunSocket) Offload() (bool, bool) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.gso, s.gro
+}
@@ -0,0 +1,492 @@
+package stun
+
+import (
+    "context"
+    "encoding/binary"
+    "errors"
+    "flag"
+    "fmt"
+    "net"
+    "sort"
+    "sync"
+    "time"
+
+    "github.com/peterbourgon/ff/v3/ffcli"
+    "github.com/pion/stun"
+)
+
+var (
+    lifetimeServer     string
+    lifetimeMax        time.Duration
+    lifetimeResolution time.Duration
+)
+
+var lifetimeFs = (func() *flag.FlagSet {
+    fs := flag.NewFlagSet("nat-lifetime", flag.ExitOnError)
+    fs.StringVar(&lifetimeServer,       "server",     "stun.l.google.com:19302", "STUN server to measure with, ideally one supporting RESPONSE-PORT")
+    fs.DurationVar(&lifetimeMax,        "max",        DefaultMaxLifetime,        "Longest idle time tried")
+    fs.DurationVar(&lifetimeResolution, "resolution", DefaultLifetimeResolution, "Precision of the measurement")
+    return fs
+})()
+
+const (
+    //RFC 4787 asks NATs to keep idle mappings at least 2 minutes, and recommends 5
+    DefaultMaxLifetime        = 5 * time.Minute
+    DefaultLifetimeResolution = 5 * time.Second
+    //RFC 5780, asks the server to answer to another port of the same IP
+    attrResponsePort          = stun.AttrType(0x0027)
+    //idle times tried at once in each round after the first
+    lifetimeProbes            = 5
+
+    LifetimeResponsePort = "response-port"
+    LifetimeRebind       = "rebind"
+)
+
+var errResponsePort = errors.New("Server doesn't support RESPONSE-PORT")
+
+//LifetimeConfig configures MeasureLifetime, zero values are replaced by the defaults
+type LifetimeConfig struct {
+    //STUN server, as host:port or user:password@host:port
+    Server       string
+    //idle times longer than this aren't tried
+    Max          time.Duration
+    //the measurement stops once the lifetime is known this precisely
+    Resolution   time.Duration
+    QueryTimeout time.Duration
+    //called with the bounds of the lifetime after each round, may be nil
+    Progress     func(alive, expired time.Duration)
+    //opens the sockets mappings are created for, like ones of a simulated network,
+    //system UDP sockets if nil
+    Listen       func() (net.PacketConn, error)
+    //waits for mappings to idle, following the clock of a simulated network for
+    //example, time.After if nil
+    After        func(d time.Duration) <-chan time.Time
+}
+
+//LifetimeResult is how long the NAT keeps idle UDP mappings
+type LifetimeResult struct {
+    //the longest idle time a mapping survived
+    Lifetime time.Duration
+    //false if mappings survived Max, so the lifetime is at least that
+    Expired  bool
+    //LifetimeResponsePort or LifetimeRebind
+    Method   string
+}
+
+type responsePort uint16
+
+func (p responsePort) AddTo(m *stun.Message) error {
+    v := make([]byte, 4)
+    v[0], v[1] = byte(p >> 8), byte(p)
+    m.Add(attrResponsePort, v)
+    return nil
+}
+
+//measures how long mappings are kept idle, by letting mappings of new sockets idle
+//for different times and checking whether they still work. Several idle times are
+//tried at once, so this takes about twice the lifetime found (or Max).
+//
+//Servers supporting RESPONSE-PORT (RFC 5780 section 4.6) are asked, from a second
+//socket, to answer to the port of the idle mapping: the answer only arrives if the
+//mapping still exists. Other servers are asked again from the idle socket, a mapping
+//that expired gets a new port, which NATs reusing the same port hide, so the
+//lifetime may be overestimated then.
+func MeasureLifetime(ctx context.Context, config LifetimeConfig) (LifetimeResult, error) {
+    if config.Max <= 0 {
+        config.Max = DefaultMaxLifetime
+    }
+    if config.Resolution <= 0 {
+        config.Resolution = DefaultLifetimeResolution
+    }
+    if config.QueryTimeout <= 0 {
+        config.QueryTimeout = DefaultQueryTimeout
+    }
+    if config.Listen == nil {
+        config.Listen = func() (net.PacketConn, error) {
+            return net.ListenPacket("udp4", "0.0.0.0:0")
+        }
+    }
+    if config.After == nil {
+        config.After = time.After
+    }
+    hostport, creds := parseServer(config.Server)
+    addr, err := resolve(ctx, hostport)
+    if err != nil {
+        return LifetimeResult {}, fmt.Errorf("Unable to resolve IPv4 address of STUN server %s: %w", hostport, err)
+    }
+    p := &lifetimeProbe {
+        config: config,
+        server: addr,
+    }
+    if creds != nil {
+        p.auth = newAuth(*creds)
+    }
+
+    //an answer right away shows the server and NAT let RESPONSE-PORT work
+    p.method = LifetimeResponsePort
+    if alive, err := p.trial(ctx, 0); err != nil || !alive {
+        if ctx.Err() != nil {
+            return LifetimeResult {}, ctx.Err()
+        }
+        if err != nil && !errors.Is(err, errResponsePort) {
+            return LifetimeResult {}, err
+        }
+        p.method = LifetimeRebind
+    }
+
+    //first idle times doubling up to the maximum, then the range between the last
+    //surviving one and the first expired one split evenly
+    times := []time.Duration(nil)
+    for t := config.Resolution; t < config.Max; t *= 2 {
+        times = append(times, t)
+    }
+    times = append(times, config.Max)
+    alive, expired := time.Duration(0), time.Duration(0)
+    for {
+        a, e, err := p.round(ctx, times, alive)
+        if err != nil {
+            return LifetimeResult {}, err
+        }
+        alive = a
+        if e > 0 {
+            expired = e
+        }
+        if config.Progress != nil {
+            config.Progress(alive, expired)
+        }
+        if expired == 0 {
+            return LifetimeResult {
+                Lifetime: alive,
+                Method:   p.method,
+            }, nil
+        }
+        if expired - alive <= config.Resolution {
+            return LifetimeResult {
+                Lifetime: alive,
+                Expired:  true,
+                Method:   p.method,
+            }, nil
+        }
+        times = times[:0]
+        step := (expired - alive) / (lifetimeProbes + 1)
+        for i := 1; i <= lifetimeProbes; i++ {
+            t := alive + step * time.Duration(i)
+            if step >= time.Second {
+                t = t.Round(time.Second)
+            } else {
+                t = t.Round(time.Millisecond)
+            }
+            times = append(times, t)
+        }
+    }
+}
+
+type lifetimeProbe struct {
+    config LifetimeConfig
+    server *net.UDPAddr
+    //shared by every request, nil if the server doesn't need credentials
+    auth   *auth
+    method string
+}
+
+//tries every idle time at once, returning the longest one that survived along with
+//all the shorter ones, and the shortest one that expired, 0 if none did. Longer idle
+//times are abandoned once a shorter one expired.
+func (p *lifetimeProbe) round(ctx context.Context, times []time.Duration, alive time.Duration) (time.Duration, time.Duration, error) {
+    results := make([]bool, len(times))
+    errs := make([]error, len(times))
+    cancels := make([]context.CancelFunc, len(times))
+    var mu sync.Mutex
+    var wg sync.WaitGroup
+    for i, t := range times {
+        var trialCtx context.Context
+        trialCtx, cancels[i] = context.WithCancel(ctx)
+        defer cancels[i]()
+        wg.Add(1)
+        go func(i int, t time.Duration) {
+            defer wg.Done()
+            alive, err := p.trial(trialCtx, t)
+            mu.Lock()
+            defer mu.Unlock()
+            results[i], errs[i] = alive, err
+            if err == nil && !alive {
+                for j, other := range times {
+                    if other > t {
+                        cancels[j]()
+                    }
+                }
+            }
+        }(i, t)
+    }
+    wg.Wait()
+    if err := ctx.Err(); err != nil {
+        return 0, 0, err
+    }
+
+    idx := make([]int, len(times))
+    for i := range idx {
+        idx[i] = i
+    }
+    sort.Slice(idx, func(a, b int) bool {
+        return times[idx[a]] < times[idx[b]]
+    })
+    for _, i := range idx {
+        if errs[i] != nil {
+            return 0, 0, errs[i]
+        }
+        if !results[i] {
+            return alive, times[i], nil
+        }
+        alive = times[i]
+    }
+    return alive, 0, nil
+}
+
+//creates a mapping, lets it idle for t and checks whether it still exists
+func (p *lifetimeProbe) trial(ctx context.Context, t time.Duration) (bool, error) {
+    idle, err := p.config.Listen()
+    if err != nil {
+        return false, err
+    }
+    defer idle.Close()
+
+    res, err := p.request(ctx, idle, idle)
+    if err != nil {
+        return false, err
+    }
+    mapped, err := mappedAddr(res)
+    if err != nil {
+        return false, err
+    }
+
+    select {
+        case <-p.config.After(t):
+        case <-ctx.Done():
+            return false, ctx.Err()
+    }
+
+    if p.method == LifetimeRebind {
+        res, err := p.request(ctx, idle, idle)
+        if err != nil {
+            return false, err
+        }
+        now, err := mappedAddr(res)
+        if err != nil {
+            return false, err
+        }
+        return now.String() == mapped.String(), nil
+    }
+
+    other, err := p.config.Listen()
+    if err != nil {
+        return false, err
+    }
+    defer other.Close()
+    res, err = p.request(ctx, other, idle, responsePort(mapped.Port))
+    if err != nil {
+        var timeout *lifetimeTimeout
+        if errors.As(err, &timeout) {
+            return false, nil
+        }
+        return false, err
+    }
+    //the server ignored the attribute and answered the socket that asked
+    if res == nil {
+        return false, errResponsePort
+    }
+    return true, nil
+}
+
+//no answer arrived in time
+type lifetimeTimeout struct {
+    timeout time.Duration
+}
+
+func (e *lifetimeTimeout) Error() string {
+    return fmt.Sprintf("No response within %v", e.timeout)
+}
+
+func mappedAddr(res *stun.Message) (*net.UDPAddr, error) {
+    var xorAddr stun.XORMappedAddress
+    if err := xorAddr.GetFrom(res); err != nil {
+        return nil, err
+    }
+    return &net.UDPAddr {
+        IP:   xorAddr.IP,
+        Port: xorAddr.Port,
+    }, nil
+}
+
+//whether the UNKNOWN-ATTRIBUTES of an error lists t. Parsed here as this version of
+//pion reads the attribute with 4 bytes per type instead of 2.
+func listsAttr(res *stun.Message, t stun.AttrType) bool {
+    v, err := res.Get(stun.AttrUnknownAttributes)
+    if err != nil {
+        return false
+    }
+    for i := 0; i + 1 < len(v); i += 2 {
+        if stun.AttrType(binary.BigEndian.Uint16(v[i:])) == t {
+            return true
+        }
+    }
+    return false
+}
+
+//sends a binding request from conn, waiting for the answer on recv, answering
+//challenges like bind does. Returns a nil message if the answer arrived on conn
+//instead of recv.
+func (p *lifetimeProbe) request(ctx context.Context, conn, recv net.PacketConn, extra ...stun.Setter) (*stun.Message, error) {
+    a := p.auth
+    for retries := 0; ; retries++ {
+        setters := append([]stun.Setter { stun.TransactionID, stun.BindingRequest }, extra...)
+        var key []byte
+        var sha256 bool
+        if a != nil {
+            var authSetters []stun.Setter
+            authSetters, key, sha256 = a.setters()
+            setters = append(setters, authSetters...)
+        }
+        setters = append(setters, stun.Fingerprint)
+        req, err := stun.Build(setters...)
+        if err != nil {
+            return nil, err
+        }
+
+        res, own, err := p.exchange(ctx, req, conn, recv, key, sha256)
+        if err != nil {
+            return nil, err
+        }
+        if res.Type.Class == stun.ClassErrorResponse {
+            var code stun.ErrorCodeAttribute
+            if err := code.GetFrom(res); err != nil {
+                return nil, fmt.Errorf("Binding request failed")
+            }
+            if code.Code == stun.CodeUnknownAttribute && len(extra) > 0 && listsAttr(res, attrResponsePort) {
+                return nil, errResponsePort
+            }
+            if a != nil && retries < maxAuthRetries && a.retry(res, code.Code) {
+                continue
+            }
+            return nil, fmt.Errorf("Binding request failed: %d %s", code.Code, string(code.Reason))
+        }
+        if a != nil {
+            a.answered(res)
+        }
+        if own && conn != recv {
+            return nil, nil
+        }
+        return res, nil
+    }
+}
+
+//sends req from conn until the server answers on conn or recv, returning whether the
+//answer came to conn. Errors only come to conn, as they are sent where the request
+//came from.
+func (p *lifetimeProbe) exchange(ctx context.Context, req *stun.Message, conn, recv net.PacketConn, key []byte, sha256 bool) (*stun.Message, bool, error) {
+    type answer struct {
+        res *stun.Message
+        own bool
+    }
+    answers := make(chan answer, 2)
+    parent := ctx
+    ctx, cancel := context.WithTimeout(ctx, p.config.QueryTimeout)
+    defer cancel()
+
+    listen := func(c net.PacketConn, own bool) {
+        buf := make([]byte, 1500)
+        for ctx.Err() == nil {
+            c.SetReadDeadline(time.Now().Add(retransmitTimeout))
+            n, addr, err := c.ReadFrom(buf)
+            if err != nil {
+                if ne, ok := err.(net.Error); ok && ne.Timeout() {
+                    continue
+                }
+                return
+            }
+            from, ok := addr.(*net.UDPAddr)
+            if !ok || !from.IP.Equal(p.server.IP) || from.Port != p.server.Port {
+                continue
+            }
+            m := &stun.Message {
+                Raw: append([]byte(nil), buf[:n]...),
+            }
+            if m.Decode() != nil || m.TransactionID != req.TransactionID || !checkFingerprint(m) {
+                continue
+            }
+            if key != nil && m.Type.Class == stun.ClassSuccessResponse && checkResponse(m, key, sha256) != nil {
+                continue
+            }
+            select {
+                case answers <- answer { res: m, own: own }:
+                default:
+            }
+            return
+        }
+    }
+    var wg sync.WaitGroup
+    wg.Add(1)
+    go func() {
+        defer wg.Done()
+        listen(conn, true)
+    }()
+    if recv != conn {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            listen(recv, false)
+        }()
+    }
+    defer wg.Wait()
+    defer cancel()
+
+    retransmit := time.NewTicker(retransmitTimeout)
+    defer retransmit.Stop()
+    for {
+        if _, err := conn.WriteTo(req.Raw, p.server); err != nil {
+            return nil, false, err
+        }
+        select {
+            case a := <-answers:
+                return a.res, a.own, nil
+            case <-retransmit.C:
+            case <-ctx.Done():
+                if err := parent.Err(); err != nil {
+                    return nil, false, err
+                }
+                return nil, false, &lifetimeTimeout { timeout: p.config.QueryTimeout }
+        }
+    }
+}
+
+var LifetimeCommand = &ffcli.Command {
+    Name:       "nat-lifetime",
+    ShortUsage: "nat-lifetime [flags]",
+    ShortHelp:  "Measures how long the NAT keeps idle UDP mappings",
+    LongHelp:   "Measures how long the NAT keeps idle UDP mappings, which takes a bit longer than that " +
+                "lifetime, up to the -max idle time tried.",
+    FlagSet:    lifetimeFs,
+    Exec:       func(ctx context.Context, args []string) error {
+        start := time.Now()
+        res, err := MeasureLifetime(ctx, LifetimeConfig {
+            Server:     lifetimeServer,
+            Max:        lifetimeMax,
+            Resolution: lifetimeResolution,
+            Progress:   func(alive, expired time.Duration) {
+                if expired == 0 {
+                    fmt.Printf("%v: mappings survive %v\n", time.Since(start).Round(time.Second), alive)
+                } else {
+                    fmt.Printf("%v: mappings survive %v and expire by %v\n", time.Since(start).Round(time.Second), alive, expired)
+                }
+            },
+        })
+        if err != nil {
+            return err
+        }
+        if !res.Expired {
+            fmt.Printf("Mappings last at least %v (measured with %s)\n", res.Lifetime, res.Method)
+        } else {
+            fmt.Printf("Mappings last %v (measured with %s)\n", res.Lifetime, res.Method)
+        }
+        return nil
+    },
+}
@@ -0,0 +1,148 @@
+package stun
+
+import (
+    "context"
+    "net"
+    "testing"
+    "time"
+
+    "github.com/natanbc/ssc0904-nat-traversal/netsim"
+    "github.com/pion/stun"
+)
+
+const testServer = "198.51.100.1:3478"
+
+//measures the lifetime of mappings of a simulated NAT configured with config, asking
+//a server run by serve. The network runs on a manual clock moved far faster than the
+//system's, so idle times of seconds pass in milliseconds.
+func measureSimulated(t *testing.T, config netsim.NATConfig, serve func(net.PacketConn) error, max, resolution time.Duration) LifetimeResult {
+    t.Helper()
+    clock := netsim.NewManualClock(time.Unix(0, 0))
+    network := netsim.New(netsim.Config { Clock: clock })
+
+    server, err := network.NewHost("198.51.100.1")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer server.Close()
+    conn, err := server.ListenPacket("udp4", testServer)
+    if err != nil {
+        t.Fatal(err)
+    }
+    go serve(conn)
+
+    nat, err := network.NewNAT("203.0.113.2", config)
+    if err != nil {
+        t.Fatal(err)
+    }
+    h, err := nat.NewHost("192.168.1.2")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer h.Close()
+
+    done := make(chan struct{})
+    defer close(done)
+    go func() {
+        for {
+            select {
+                case <-done:
+                    return
+                case <-time.After(time.Millisecond):
+                    clock.Advance(10 * time.Millisecond)
+            }
+        }
+    }()
+
+    res, err := MeasureLifetime(context.Background(), LifetimeConfig {
+        Server:       testServer,
+        Max:          max,
+        Resolution:   resolution,
+        //answers arrive at once, expired mappings shouldn't hold rounds up for long
+        QueryTimeout: 200 * time.Millisecond,
+        Listen:       func() (net.PacketConn, error) {
+            return h.ListenPacket("udp4", "0.0.0.0:0")
+        },
+        After:        func(d time.Duration) <-chan time.Time {
+            ch := make(chan time.Time, 1)
+            clock.AfterFunc(d, func() {
+                ch <- clock.Now()
+            })
+            return ch
+        },
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    return res
+}
+
+//a port restricted NAT dropping mappings after timeout
+func natTimingOut(timeout time.Duration) netsim.NATConfig {
+    config := netsim.PortRestricted
+    config.Timeout = timeout
+    return config
+}
+
+//answers binding requests to the socket that sent them, ignoring RESPONSE-PORT
+func serveWithoutResponsePort(conn net.PacketConn) error {
+    buf := make([]byte, 1500)
+    for {
+        n, from, err := conn.ReadFrom(buf)
+        if err != nil {
+            return err
+        }
+        req := &stun.Message { Raw: append([]byte(nil), buf[:n]...) }
+        if req.Decode() != nil {
+            continue
+        }
+        addr := from.(*net.UDPAddr)
+        res, err := stun.Build(stun.NewTransactionIDSetter(req.TransactionID), stun.BindingSuccess,
+            &stun.XORMappedAddress { IP: addr.IP, Port: addr.Port }, stun.Fingerprint)
+        if err != nil {
+            continue
+        }
+        conn.WriteTo(res.Raw, from)
+    }
+}
+
+func TestMeasureLifetime(t *testing.T) {
+    timeout, resolution := 5 * time.Second, time.Second
+    res := measureSimulated(t, natTimingOut(timeout), Serve, 4 * timeout, resolution)
+    if res.Method != LifetimeResponsePort {
+        t.Fatalf("Measured with %s instead of %s", res.Method, LifetimeResponsePort)
+    }
+    if !res.Expired || res.Lifetime > timeout || res.Lifetime < timeout - resolution {
+        t.Fatalf("Measured %v (expired: %v) for a %v timeout", res.Lifetime, res.Expired, timeout)
+    }
+}
+
+func TestMeasureLifetimeOverMax(t *testing.T) {
+    max := 5 * time.Second
+    res := measureSimulated(t, natTimingOut(4 * max), Serve, max, time.Second)
+    if res.Expired || res.Lifetime != max {
+        t.Fatalf("Measured %v (expired: %v) with a maximum of %v", res.Lifetime, res.Expired, max)
+    }
+}
+
+//without RESPONSE-PORT, mappings are asked for again from their socket
+func TestMeasureLifetimeRebind(t *testing.T) {
+    timeout, resolution := 5 * time.Second, time.Second
+    res := measureSimulated(t, natTimingOut(timeout), serveWithoutResponsePort, 4 * timeout, resolution)
+    if res.Method != LifetimeRebind {
+        t.Fatalf("Measured with %s instead of %s", res.Method, LifetimeRebind)
+    }
+    if !res.Expired || res.Lifetime > timeout || res.Lifetime < timeout - resolution {
+        t.Fatalf("Measured %v (expired: %v) for a %v timeout", res.Lifetime, res.Expired, timeout)
+    }
+
+    //a mapping coming back at the same port looks like it never expired, which is
+    //why the result isn't trusted unless a mapping expired
+    config := natTimingOut(timeout)
+    config.PreservePorts = true
+    max := 4 * timeout
+    res = measureSimulated(t, config, serveWithoutResponsePort, max, resolution)
+    if res.Method != LifetimeRebind || res.Expired || res.Lifetime != max {
+        t.Fatalf("Measured %v (expired: %v) with %s behind a NAT preserving ports", res.Lifetime, res.Expired, res.Method)
+    }
+}
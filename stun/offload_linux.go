@@ -0,0 +1,80 @@
+//go:build linux
+
+package stun
+
+import (
+    "net"
+    "syscall"
+    "unsafe"
+)
+
+const (
+    solUDP     = 17
+    udpSegment = 103
+    udpGRO     = 104
+    solIP      = 0
+    ipTTL      = 2
+)
+
+//room for the control message with the segment size, an int for GRO and a uint16 for GSO
+var offloadOOBSize = syscall.CmsgSpace(4)
+
+//enables GRO, and checks whether the kernel knows about GSO
+func setupOffload(conn *net.UDPConn) (gso bool, gro bool) {
+    raw, err := conn.SyscallConn()
+    if err != nil {
+        return false, false
+    }
+    raw.Control(func(fd uintptr) {
+        _, err := syscall.GetsockoptInt(int(fd), solUDP, udpSegment)
+        gso = err == nil
+        gro = syscall.SetsockoptInt(int(fd), solUDP, udpGRO, 1) == nil
+    })
+    return gso, gro
+}
+
+//writes the control message asking the kernel to split a datagram in segments of
+//the given size into oob
+func gsoControl(oob []byte, size int) []byte {
+    oob = oob[:syscall.CmsgSpace(2)]
+    for i := range oob {
+        oob[i] = 0
+    }
+    h := (*syscall.Cmsghdr)(unsafe.Pointer(&oob[0]))
+    h.Level = solUDP
+    h.Type = udpSegment
+    h.SetLen(syscall.CmsgLen(2))
+    *(*uint16)(unsafe.Pointer(&oob[syscall.CmsgLen(0)])) = uint16(size)
+    return oob
+}
+
+//the size of the segments a datagram coalesced by GRO is made of, 0 if it wasn't
+func groSegmentSize(oob []byte) int {
+    if len(oob) == 0 {
+        return 0
+    }
+    msgs, err := syscall.ParseSocketControlMessage(oob)
+    if err != nil {
+        return 0
+    }
+    for _, m := range msgs {
+        if m.Header.Level == solUDP && m.Header.Type == udpGRO && len(m.Data) >= 4 {
+            return int(*(*int32)(unsafe.Pointer(&m.Data[0])))
+        }
+    }
+    return 0
+}
+
+//writes the control message setting the TTL of a single datagram into oob
+func ttlControl(oob []byte, ttl int) []byte {
+    oob = oob[:syscall.CmsgSpace(4)]
+    for i := range oob {
+        oob[i] = 0
+    }
+    h := (*syscall.Cmsghdr)(unsafe.Pointer(&oob[0]))
+    h.Level = solIP
+    h.Type = ipTTL
+    h.SetLen(syscall.CmsgLen(4))
+    *(*int32)(unsafe.Pointer(&oob[syscall.CmsgLen(0)])) = int32(ttl)
+    return oob
+}
@@ -0,0 +1,26 @@
+//go:build !linux
+
+package stun
+
+import (
+    "net"
+)
+
+const offloadOOBSize = 0
+
+func setupOffload(conn *net.UDPConn) (bool, bool) {
+    return false, false
+}
+
+func gsoControl(oob []byte, size int) []byte {
+    return nil
+}
+
+func groSegmentSize(oob []byte) int {
+    return 0
+}
+
+//datagrams are sent with the default TTL
+func ttlControl(oob []byte, ttl int) []byte {
+    return nil
+}
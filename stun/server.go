@@ -0,0 +1,45 @@
+package stun
+
+import (
+    "net"
+
+    "github.com/pion/stun"
+)
+
+//answers binding requests on conn until it's closed, so sockets can be created without
+//a real STUN server, like in benchmarks or on a simulated network. RESPONSE-PORT is
+//honored, so MeasureLifetime can use it.
+func Serve(conn net.PacketConn) error {
+    buf := make([]byte, 1500)
+    for {
+        n, from, err := conn.ReadFrom(buf)
+        if err != nil {
+            return err
+        }
+        addr, ok := from.(*net.UDPAddr)
+        if !ok {
+            continue
+        }
+        req := &stun.Message {
+            Raw: append([]byte(nil), buf[:n]...),
+        }
+        if err := req.Decode(); err != nil || req.Type != stun.BindingRequest || !checkFingerprint(req) {
+            continue
+        }
+        res, err := stun.Build(stun.NewTransactionIDSetter(req.TransactionID), stun.BindingSuccess, &stun.XORMappedAddress {
+            IP:   addr.IP,
+            Port: addr.Port,
+        }, stun.Fingerprint)
+        if err != nil {
+            continue
+        }
+        to := addr
+        if v, err := req.Get(attrResponsePort); err == nil && len(v) >= 2 {
+            to = &net.UDPAddr {
+                IP:   addr.IP,
+                Port: int(v[0]) << 8 | int(v[1]),
+            }
+        }
+        conn.WriteTo(res.Raw, to)
+    }
+}
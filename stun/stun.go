@@ -1,167 +1,586 @@
 package stun
 
 import (
+    "context"
+    "errors"
     "fmt"
-    "io"
     "net"
+    "strings"
+    "sync"
     "time"
 
     "github.com/pion/stun"
+    "golang.org/x/net/ipv4"
 )
 
-type message struct {
-    data []byte
+const (
+    DefaultQueryTimeout      = 3 * time.Second
+    DefaultKeepAliveInterval = 5 * time.Second
+    //binding requests are sent again at this interval until answered, as they may be lost
+    retransmitTimeout        = 500 * time.Millisecond
+    //errors waiting to be received from Errors before new ones are dropped
+    errorBuffer              = 16
+)
+
+//Config configures a StunSocket, zero values are replaced by the defaults
+type Config struct {
+    //STUN servers, queried at once, as host:port or user:password@host:port for those
+    //requiring credentials
+    Servers           []string
+    //local address to bind, any address and port by default
+    LocalAddr         string
+    //socket to use instead of binding LocalAddr, like one of a simulated network. It's
+    //closed along with the StunSocket.
+    Conn              net.PacketConn
+    //how long a STUN server has to answer a binding request
+    QueryTimeout      time.Duration
+    //how often the NAT mapping is refreshed
+    KeepAliveInterval time.Duration
+}
+
+//Result is the answer of a STUN server to a binding request
+type Result struct {
+    Server string
+    //the address the server saw our packets coming from, nil if it failed
+    Mapped *net.UDPAddr
+    RTT    time.Duration
+    Err    error
+}
+
+type server struct {
+    name string
     addr *net.UDPAddr
+    //nil for servers that don't need credentials
+    auth *auth
+}
+
+type transaction struct {
+    server *net.UDPAddr
+    //the key successful responses must be signed with, nil if the request wasn't
+    key    []byte
+    //whether they must be signed with MESSAGE-INTEGRITY-SHA256
+    sha256 bool
+    res    chan *stun.Message
 }
 
 type StunSocket struct {
-    Conn       *net.UDPConn
-    stun       *stun.Client
+    Conn       net.PacketConn
+    pc         batchConn
+    config     Config
+    servers    []server
+    //batches of packets received
+    messages   chan batch
+    errs       chan error
+    done       chan struct{}
+    //new keepalive intervals, picked up by keepAliveLoop
+    interval   chan time.Duration
+    closeOnce  sync.Once
+    //demultiplex and keepAlive, errs is closed once both returned
+    running    sync.WaitGroup
+
+    mu         sync.Mutex
     publicAddr net.UDPAddr
-    messages   chan message
+    results    []Result
+    symmetric  bool
+    //index in servers of the one receiving keepalives
+    keepAlive  int
+    pending    map[[stun.TransactionIDSize]byte]transaction
+    //credentials of the peers whose binding requests are answered
+    lookup     func(string) (Credentials, bool)
+    checked    func(string, *net.UDPAddr)
+    //why Read stopped returning packets
+    readErr    error
+    //whether the kernel splits and coalesces datagrams for us
+    gso        bool
+    gro        bool
+
+    readMu     sync.Mutex
+    //packets of the last batch not read yet, and the buffer they're in
+    unread     []message
+    unreadBuf  *[]byte
 }
 
-func demultiplex(conn *net.UDPConn, stunConn io.Writer, messages chan message) {
-    buf := make([]byte, 65536)
-    for {
-        n, raddr, err := conn.ReadFrom(buf)
+//reports an error that didn't stop the socket, dropping it if nobody is listening
+func (s *StunSocket) reportError(err error) {
+    select {
+        case s.errs <- err:
+        default:
+    }
+}
+
+func (s *StunSocket) setReadErr(err error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.readErr == nil {
+        s.readErr = err
+    }
+}
+
+func (s *StunSocket) isClosed() bool {
+    select {
+        case <-s.done:
+            return true
+        default:
+            return false
+    }
+}
+
+//hands responses to the transaction waiting for them
+func (s *StunSocket) onStunMessage(raw []byte, from *net.UDPAddr) {
+    m := &stun.Message {
+        Raw: append([]byte(nil), raw...),
+    }
+    if err := m.Decode(); err != nil || !checkFingerprint(m) {
+        return
+    }
+    if m.Type.Class == stun.ClassRequest {
+        s.answer(m, from)
+        return
+    }
+
+    s.mu.Lock()
+    t, ok := s.pending[m.TransactionID]
+    s.mu.Unlock()
+    //only the server the request was sent to may answer it
+    if !ok || !t.server.IP.Equal(from.IP) || t.server.Port != from.Port {
+        return
+    }
+    //a forged response is dropped, the real one may still come
+    if t.key != nil && m.Type.Class == stun.ClassSuccessResponse && checkResponse(m, t.key, t.sha256) != nil {
+        return
+    }
+    select {
+        case t.res <- m:
+        default:
+    }
+}
+
+//sends a binding request to addr, signed with a if not nil, answering the challenges
+//of servers using long-term credentials
+func (s *StunSocket) bind(ctx context.Context, addr *net.UDPAddr, a *auth) (*net.UDPAddr, time.Duration, error) {
+    for retries := 0; ; retries++ {
+        res, rtt, err := s.transact(ctx, addr, a)
         if err != nil {
-            if err != io.EOF {
-                panic(err)
-            }
-            return
+            return nil, 0, err
         }
-
-        if stun.IsMessage(buf[:n]) {
-            stunConn.Write(buf[:n])
-        } else {
-            d := make([]byte, n)
-            copy(d, buf[:n])
-            messages <- message {
-                data: d,
-                addr: raddr.(*net.UDPAddr),
+        if res.Type.Class == stun.ClassErrorResponse {
+            var code stun.ErrorCodeAttribute
+            if err := code.GetFrom(res); err != nil {
+                return nil, 0, fmt.Errorf("Binding request failed")
+            }
+            if a != nil && retries < maxAuthRetries && a.retry(res, code.Code) {
+                continue
             }
+            return nil, 0, fmt.Errorf("Binding request failed: %d %s", code.Code, string(code.Reason))
+        }
+        var xorAddr stun.XORMappedAddress
+        if err := xorAddr.GetFrom(res); err != nil {
+            return nil, 0, err
         }
+        if a != nil {
+            a.answered(res)
+        }
+        return &net.UDPAddr {
+            IP:   append(net.IP(nil), xorAddr.IP...),
+            Port: xorAddr.Port,
+        }, rtt, nil
     }
 }
 
-func multiplex(conn *net.UDPConn, stunConn io.Reader, stunAddr net.Addr) {
-    buf := make([]byte, 1024)
+//sends a binding request to addr, retransmitting it until answered, the query timeout
+//expires, ctx is done or the socket is closed
+func (s *StunSocket) transact(ctx context.Context, addr *net.UDPAddr, a *auth) (*stun.Message, time.Duration, error) {
+    setters := []stun.Setter { stun.TransactionID, stun.BindingRequest }
+    var key []byte
+    var sha256 bool
+    if a != nil {
+        var authSetters []stun.Setter
+        authSetters, key, sha256 = a.setters()
+        setters = append(setters, authSetters...)
+    }
+    setters = append(setters, stun.Fingerprint)
+    req, err := stun.Build(setters...)
+    if err != nil {
+        return nil, 0, err
+    }
+
+    t := transaction {
+        server: addr,
+        key:    key,
+        sha256: sha256,
+        res:    make(chan *stun.Message, 1),
+    }
+    s.mu.Lock()
+    s.pending[req.TransactionID] = t
+    s.mu.Unlock()
+    defer func() {
+        s.mu.Lock()
+        delete(s.pending, req.TransactionID)
+        s.mu.Unlock()
+    }()
+
+    start := time.Now()
+    deadline := time.NewTimer(s.config.QueryTimeout)
+    defer deadline.Stop()
+    retransmit := time.NewTicker(retransmitTimeout)
+    defer retransmit.Stop()
+
     for {
-        n, err := stunConn.Read(buf)
-        if err != nil {
-            if err != io.EOF {
-                panic(err)
+        if _, err := s.Conn.WriteTo(req.Raw, addr); err != nil {
+            return nil, 0, err
+        }
+        select {
+            case res := <-t.res:
+                return res, time.Since(start), nil
+            case <-retransmit.C:
+            case <-deadline.C:
+                return nil, 0, fmt.Errorf("No response within %v", s.config.QueryTimeout)
+            case <-ctx.Done():
+                return nil, 0, ctx.Err()
+            case <-s.done:
+                return nil, 0, net.ErrClosed
+        }
+    }
+}
+
+//queries every server at once
+func (s *StunSocket) queryAll(ctx context.Context) []Result {
+    results := make([]Result, len(s.servers))
+    var wg sync.WaitGroup
+    for i, srv := range s.servers {
+        wg.Add(1)
+        go func(i int, srv server) {
+            defer wg.Done()
+            mapped, rtt, err := s.bind(ctx, srv.addr, srv.auth)
+            results[i] = Result {
+                Server: srv.name,
+                Mapped: mapped,
+                RTT:    rtt,
+                Err:    err,
             }
-            return
+        }(i, srv)
+    }
+    wg.Wait()
+    return results
+}
+
+//picks the mapping reported by most servers, ties going to the one listed first. A
+//NAT that maps the socket to different addresses depending on the destination is
+//symmetric, and peers won't be able to reach us through the address we advertise.
+func consensus(results []Result) (*net.UDPAddr, int, bool) {
+    votes := make(map[string]int)
+    for _, r := range results {
+        if r.Mapped != nil {
+            votes[r.Mapped.String()]++
+        }
+    }
+    //counted first, so the index is of the first server reporting the address
+    var best *net.UDPAddr
+    bestIdx := -1
+    for i, r := range results {
+        if r.Mapped == nil {
+            continue
+        }
+        if best == nil || votes[r.Mapped.String()] > votes[best.String()] {
+            best, bestIdx = r.Mapped, i
         }
-        conn.WriteTo(buf[:n], stunAddr)
     }
+    return best, bestIdx, len(votes) > 1
 }
 
-func keepAlive(c *stun.Client) {
-    t := time.NewTicker(5 * time.Second)
-    defer t.Stop()
+func New(stunServers ...string) (*StunSocket, error) {
+    return NewWithContext(context.Background(), Config {
+        Servers: stunServers,
+    })
+}
 
-    for range t.C {
-        var stunErr error
-        err := c.Do(stun.MustBuild(stun.TransactionID, stun.BindingRequest), func(res stun.Event) {
-            stunErr = res.Error
-        })
+//creates a socket and learns its public address from the STUN servers. ctx only
+//bounds the setup, use Close to stop the socket.
+func NewWithContext(ctx context.Context, config Config) (*StunSocket, error) {
+    if len(config.Servers) == 0 {
+        return nil, fmt.Errorf("No STUN server given")
+    }
+    if config.LocalAddr == "" {
+        config.LocalAddr = "0.0.0.0:0"
+    }
+    if config.QueryTimeout <= 0 {
+        config.QueryTimeout = DefaultQueryTimeout
+    }
+    if config.KeepAliveInterval <= 0 {
+        config.KeepAliveInterval = DefaultKeepAliveInterval
+    }
 
-        if stunErr != nil || err != nil {
-            return
+    servers := []server(nil)
+    var resolveErr error
+    for _, v := range config.Servers {
+        hostport, creds := parseServer(v)
+        addr, err := resolve(ctx, hostport)
+        if err != nil {
+            resolveErr = fmt.Errorf("Unable to resolve IPv4 address of STUN server %s: %w", hostport, err)
+            continue
+        }
+        srv := server {
+            name: hostport,
+            addr: addr,
+        }
+        if creds != nil {
+            srv.auth = newAuth(*creds)
         }
+        servers = append(servers, srv)
+    }
+    if len(servers) == 0 {
+        return nil, resolveErr
     }
-}
 
-func New(stunServer string) (*StunSocket, error) {
-    //if your network does NAT on ipv6 you have serious problems
-    stunServerAddr, err := net.ResolveUDPAddr("udp4", stunServer)
-    if err != nil {
-        return nil, fmt.Errorf("Unable to resolve IPv4 address of STUN server: %w", err)
+    conn := config.Conn
+    if conn == nil {
+        addr, err := net.ResolveUDPAddr("udp4", config.LocalAddr)
+        if err != nil {
+            return nil, fmt.Errorf("Invalid local address: %w", err)
+        }
+        udp, err := net.ListenUDP("udp4", addr)
+        if err != nil {
+            return nil, fmt.Errorf("Unable to create UDP socket: %w", err)
+        }
+        conn = udp
     }
 
-    stunL, stunR := net.Pipe()
+    s := &StunSocket {
+        Conn:     conn,
+        pc:       packetBatcher { conn },
+        config:   config,
+        servers:  servers,
+        messages: make(chan batch, batchQueue),
+        errs:     make(chan error, errorBuffer),
+        done:     make(chan struct{}),
+        interval: make(chan time.Duration, 1),
+        pending:  make(map[[stun.TransactionIDSize]byte]transaction),
+    }
+    if udp, ok := conn.(*net.UDPConn); ok {
+        //bursts are read in batches, but may still arrive faster than that
+        udp.SetReadBuffer(socketBuffer)
+        udp.SetWriteBuffer(socketBuffer)
+        s.pc = ipv4.NewPacketConn(udp)
+        s.gso, s.gro = setupOffload(udp)
+    }
+    //demultiplex and keepAliveLoop, which only starts once the public address is known
+    s.running.Add(2)
+    go func() {
+        s.running.Wait()
+        close(s.errs)
+    }()
+    go s.demultiplex()
 
-    c, err := stun.NewClient(stunR)
-    if err != nil {
-        return nil, fmt.Errorf("Unable to create STUN client: %w", err)
+    results := s.queryAll(ctx)
+    mapped, idx, symmetric := consensus(results)
+    if mapped == nil {
+        s.running.Done()
+        s.Close()
+        if err := ctx.Err(); err != nil {
+            return nil, fmt.Errorf("Failed to obtain public IP via STUN: %w", err)
+        }
+        errs := []string(nil)
+        for _, r := range results {
+            errs = append(errs, fmt.Sprintf("%s: %v", r.Server, r.Err))
+        }
+        return nil, fmt.Errorf("Failed to obtain public IP via STUN: %s", strings.Join(errs, ", "))
     }
 
-    addr, err := net.ResolveUDPAddr("udp4", "0.0.0.0:0")
+    s.publicAddr = *mapped
+    s.results = results
+    s.symmetric = symmetric
+    s.keepAlive = idx
+
+    go s.keepAliveLoop()
+
+    return s, nil
+}
+
+//resolves host:port, the port defaulting to the STUN one
+func resolve(ctx context.Context, hostport string) (*net.UDPAddr, error) {
+    host, port, err := net.SplitHostPort(hostport)
     if err != nil {
-        panic(err)
+        host, port = hostport, "3478"
     }
-
-    conn, err := net.ListenUDP("udp4", addr)
+    p, err := net.DefaultResolver.LookupPort(ctx, "udp", port)
     if err != nil {
-        return nil, fmt.Errorf("Unable to create UDP socket: %w", err)
+        return nil, err
     }
+    //if your network does NAT on ipv6 you have serious problems
+    addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip4", host)
+    if err != nil {
+        return nil, err
+    }
+    if len(addrs) == 0 {
+        return nil, fmt.Errorf("No IPv4 address for %s", host)
+    }
+    return &net.UDPAddr {
+        IP:   addrs[0].Unmap().AsSlice(),
+        Port: p,
+    }, nil
+}
+
+//keeps the NAT mapping alive by querying a server that agreed with the public
+//address, moving on to the next one that answers when it stops answering. Behind a
+//symmetric NAT every server sees its own mapping, so each is compared with that.
+func (s *StunSocket) keepAliveLoop() {
+    defer s.running.Done()
 
-    messages := make(chan message)
+    t := time.NewTicker(s.config.KeepAliveInterval)
+    defer t.Stop()
+
+    for {
+        select {
+            case <-t.C:
+            case d := <-s.interval:
+                t.Reset(d)
+                continue
+            case <-s.done:
+                return
+        }
 
-    go demultiplex(conn, stunL, messages)
-    go multiplex(conn, stunL, stunServerAddr)
+        s.mu.Lock()
+        idx := s.keepAlive
+        s.mu.Unlock()
 
-    var stunAddr stun.XORMappedAddress
-    var stunErr  error
-    if err = c.Do(stun.MustBuild(stun.TransactionID, stun.BindingRequest), func(res stun.Event) {
-        if res.Error != nil {
-            stunErr = res.Error
-            return
+        answered, moved := false, false
+        current := idx
+        for i := 0; i < len(s.servers) && !answered; i++ {
+            current = (idx + i) % len(s.servers)
+            srv := s.servers[current]
+            mapped, _, err := s.bind(context.Background(), srv.addr, srv.auth)
+            if errors.Is(err, net.ErrClosed) {
+                return
+            }
+            if err != nil {
+                s.reportError(fmt.Errorf("STUN server %s failed: %w", srv.name, err))
+                continue
+            }
+            answered = true
+
+            s.mu.Lock()
+            s.keepAlive = current
+            expected := &s.publicAddr
+            if s.symmetric && current < len(s.results) {
+                if s.results[current].Mapped == nil {
+                    //it didn't answer when the address was learned
+                    s.results[current].Mapped, s.results[current].Err = mapped, nil
+                }
+                expected = s.results[current].Mapped
+            }
+            moved = mapped.String() != expected.String()
+            s.mu.Unlock()
         }
+        if !answered {
+            s.reportError(fmt.Errorf("No STUN server answered, the NAT mapping may expire"))
+        }
+        if moved {
+            s.rediscover(current)
+        }
+    }
+}
 
-        var xorAddr stun.XORMappedAddress
-        if err := xorAddr.GetFrom(res.Message); err != nil {
-            stunErr = err
-            return
-        }
-
-        stunAddr.IP = append(stunAddr.IP, xorAddr.IP...)
-        stunAddr.Port = xorAddr.Port
-    }); err != nil {
-        conn.Close()
-        c.Close()
-        return nil, fmt.Errorf("Failed to obtain public IP via STUN: %w", err)
-    }
-    if stunErr != nil {
-        conn.Close()
-        c.Close()
-        return nil, fmt.Errorf("Failed to obtain public IP via STUN: %w", stunErr)
-    }
-
-    go keepAlive(c)
-
-    return &StunSocket {
-        Conn:       conn,
-        stun:       c,
-        publicAddr: net.UDPAddr {
-            IP:   stunAddr.IP,
-            Port: stunAddr.Port,
-        },
-        messages:   messages,
-    }, nil
+//asks every server for the public address again, after the keepalive server saw a
+//different one: the NAT dropped the mapping and made a new one. Keepalives stay with
+//that server while it answers, the ones it took over from just failed.
+func (s *StunSocket) rediscover(current int) {
+    results := s.queryAll(context.Background())
+    mapped, idx, symmetric := consensus(results)
+    if mapped == nil {
+        return
+    }
+    s.mu.Lock()
+    old := s.publicAddr
+    s.publicAddr = *mapped
+    s.results = results
+    s.symmetric = symmetric
+    if results[current].Mapped != nil {
+        s.keepAlive = current
+    } else {
+        s.keepAlive = idx
+    }
+    s.mu.Unlock()
+    if mapped.String() != old.String() {
+        s.reportError(fmt.Errorf("Public address changed from %s to %s", old.String(), mapped.String()))
+    }
+}
+
+//changes how often the NAT mapping is refreshed, like once its lifetime is known
+func (s *StunSocket) SetKeepAliveInterval(d time.Duration) {
+    if d <= 0 {
+        return
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    //only the latest interval matters, and with the old one dropped there is room
+    select {
+        case <-s.interval:
+        default:
+    }
+    s.interval <- d
+}
+
+//answers binding requests from peers signed with the short-term credentials lookup
+//returns for their username, like ICE connectivity checks, calling checked if not nil
+//with the username and address of each request answered. Both are called by the
+//goroutine reading the socket, so they must not block. Requests are ignored until
+//this is called.
+func (s *StunSocket) AnswerBindings(lookup func(username string) (Credentials, bool), checked func(username string, from *net.UDPAddr)) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.lookup = lookup
+    s.checked = checked
+}
+
+//sends a binding request signed with creds to a peer answering them, returning the
+//address the peer saw it coming from
+func (s *StunSocket) Check(ctx context.Context, addr *net.UDPAddr, creds Credentials) (*net.UDPAddr, time.Duration, error) {
+    return s.bind(ctx, addr, newAuth(creds))
 }
 
+//stops the socket: Read returns net.ErrClosed once the packets already received
+//were read, and Errors is closed
 func (s *StunSocket) Close() error {
-    s.stun.Close()
-    return s.Conn.Close()
+    err := net.ErrClosed
+    s.closeOnce.Do(func() {
+        close(s.done)
+        err = s.Conn.Close()
+    })
+    return err
 }
 
+//errors that didn't stop the socket, like STUN servers not answering. Closed once
+//the socket is.
+func (s *StunSocket) Errors() <-chan error {
+    return s.errs
+}
+
+//the public address most STUN servers agreed on, last time they were asked
 func (s *StunSocket) PublicAddr() *net.UDPAddr {
-    return &s.publicAddr
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    addr := s.publicAddr
+    return &addr
 }
 
-func (s *StunSocket) Read() ([]byte, *net.UDPAddr, error) {
-    m, ok := <-s.messages
-    if !ok {
-        return nil, nil, io.EOF
-    }
-    return m.data, m.addr, nil
+//the answers of each STUN server when the socket was created, or when the public
+//address was last discovered again
+func (s *StunSocket) Results() []Result {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return append([]Result(nil), s.results...)
 }
 
-func (s *StunSocket) WriteTo(data []byte, to net.Addr) (int, error) {
-    return s.Conn.WriteTo(data, to)
+//whether STUN servers saw different addresses, meaning the NAT is symmetric
+func (s *StunSocket) SymmetricNAT() bool {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.symmetric
 }
 
+//the STUN server currently receiving keepalives
+func (s *StunSocket) KeepAliveServer() string {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.servers[s.keepAlive].name
+}
@@ -0,0 +1,273 @@
+package stun
+
+import (
+    "context"
+    "errors"
+    "net"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/natanbc/ssc0904-nat-traversal/netsim"
+)
+
+func TestKeepAliveFollowsNewMapping(t *testing.T) {
+    clock := netsim.NewManualClock(time.Unix(0, 0))
+    network := netsim.New(netsim.Config { Clock: clock })
+    server, err := network.NewHost("198.51.100.1")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer server.Close()
+    conn, err := server.ListenPacket("udp4", testServer)
+    if err != nil {
+        t.Fatal(err)
+    }
+    go Serve(conn)
+
+    config := netsim.PortRestricted
+    config.Timeout = 30 * time.Second
+    nat, err := network.NewNAT("203.0.113.2", config)
+    if err != nil {
+        t.Fatal(err)
+    }
+    h, err := nat.NewHost("192.168.1.2")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer h.Close()
+    pc, err := h.ListenPacket("udp4", "0.0.0.0:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    s, err := NewWithContext(context.Background(), Config {
+        Servers:           []string { testServer },
+        Conn:              pc,
+        KeepAliveInterval: 20 * time.Millisecond,
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    before := s.PublicAddr().String()
+
+    //the mapping expires between keepalives, the next one gets a new port
+    clock.Advance(time.Minute)
+    select {
+        case err := <-s.Errors():
+            if !strings.Contains(err.Error(), "Public address changed") {
+                t.Fatalf("Unexpected error: %v", err)
+            }
+        case <-time.After(5 * time.Second):
+            t.Fatal("New mapping not noticed")
+    }
+    if after := s.PublicAddr().String(); after == before {
+        t.Fatalf("Public address still %s", after)
+    }
+    if s.SymmetricNAT() {
+        t.Fatal("A new mapping was taken for a symmetric NAT")
+    }
+
+    s.Close()
+    for range s.Errors() {
+    }
+}
+
+func TestConsensus(t *testing.T) {
+    a := &net.UDPAddr { IP: net.IPv4(203, 0, 113, 2).To4(), Port: 1000 }
+    b := &net.UDPAddr { IP: net.IPv4(203, 0, 113, 2).To4(), Port: 2000 }
+    failed := errors.New("timeout")
+    cases := []struct {
+        name      string
+        mapped    []*net.UDPAddr
+        want      *net.UDPAddr
+        idx       int
+        symmetric bool
+    } {
+        { "agreeing", []*net.UDPAddr { a, a, a }, a, 0, false },
+        { "majority", []*net.UDPAddr { a, b, b }, b, 1, true },
+        { "tie", []*net.UDPAddr { b, a, a, b }, b, 0, true },
+        { "failures skipped", []*net.UDPAddr { nil, a, nil }, a, 1, false },
+        { "all failed", []*net.UDPAddr { nil, nil }, nil, -1, false },
+    }
+    for _, c := range cases {
+        results := []Result(nil)
+        for _, m := range c.mapped {
+            r := Result { Mapped: m }
+            if m == nil {
+                r.Err = failed
+            }
+            results = append(results, r)
+        }
+        mapped, idx, symmetric := consensus(results)
+        if mapped.String() != c.want.String() || idx != c.idx || symmetric != c.symmetric {
+            t.Errorf("%s: got %v from %d, symmetric %v", c.name, mapped, idx, symmetric)
+        }
+    }
+}
+
+//STUN servers on hosts of network at ips, and the sockets they serve, closed to stop them
+func startServers(t *testing.T, network *netsim.Network, ips ...string) ([]string, []net.PacketConn) {
+    t.Helper()
+    servers := []string(nil)
+    conns := []net.PacketConn(nil)
+    for _, ip := range ips {
+        h, err := network.NewHost(ip)
+        if err != nil {
+            t.Fatal(err)
+        }
+        t.Cleanup(func() {
+            h.Close()
+        })
+        addr := ip + ":3478"
+        conn, err := h.ListenPacket("udp4", addr)
+        if err != nil {
+            t.Fatal(err)
+        }
+        go Serve(conn)
+        servers = append(servers, addr)
+        conns = append(conns, conn)
+    }
+    return servers, conns
+}
+
+//a socket behind a NAT of network configured with nat
+func natSocket(t *testing.T, network *netsim.Network, nat netsim.NATConfig, config Config) *StunSocket {
+    t.Helper()
+    n, err := network.NewNAT("203.0.113.2", nat)
+    if err != nil {
+        t.Fatal(err)
+    }
+    h, err := n.NewHost("192.168.1.2")
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() {
+        h.Close()
+    })
+    config.Conn, err = h.ListenPacket("udp4", "0.0.0.0:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    s, err := NewWithContext(context.Background(), config)
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() {
+        s.Close()
+    })
+    return s
+}
+
+func TestSymmetricNATDetected(t *testing.T) {
+    for _, c := range []struct {
+        name      string
+        nat       netsim.NATConfig
+        symmetric bool
+    } {
+        { "port restricted", netsim.PortRestricted, false },
+        { "symmetric", netsim.Symmetric, true },
+    } {
+        network := netsim.New(netsim.Config {})
+        servers, _ := startServers(t, network, "198.51.100.1", "198.51.100.2")
+        s := natSocket(t, network, c.nat, Config { Servers: servers })
+        if s.SymmetricNAT() != c.symmetric {
+            t.Errorf("%s NAT detected as symmetric: %v", c.name, s.SymmetricNAT())
+        }
+        if results := s.Results(); len(results) != 2 || results[0].Mapped == nil || results[1].Mapped == nil {
+            t.Errorf("%s NAT results: %v", c.name, results)
+        }
+    }
+}
+
+//keepalives move on to the next server when the one receiving them stops answering
+func TestKeepAliveFailover(t *testing.T) {
+    network := netsim.New(netsim.Config {})
+    servers, conns := startServers(t, network, "198.51.100.1", "198.51.100.2")
+    s := natSocket(t, network, netsim.PortRestricted, Config {
+        Servers:           servers,
+        QueryTimeout:      100 * time.Millisecond,
+        KeepAliveInterval: 20 * time.Millisecond,
+    })
+    if got := s.KeepAliveServer(); got != servers[0] {
+        t.Fatalf("Keepalives sent to %s instead of the first server", got)
+    }
+    before := s.PublicAddr().String()
+
+    conns[0].Close()
+    reported := false
+    deadline := time.After(5 * time.Second)
+    for s.KeepAliveServer() != servers[1] {
+        select {
+            case err := <-s.Errors():
+                reported = reported || strings.Contains(err.Error(), servers[0])
+            case <-time.After(10 * time.Millisecond):
+            case <-deadline:
+                t.Fatal("Keepalives still sent to the silent server")
+        }
+    }
+    if !reported {
+        select {
+            case err := <-s.Errors():
+                reported = strings.Contains(err.Error(), servers[0])
+            case <-time.After(time.Second):
+        }
+    }
+    if !reported {
+        t.Error("Silent server not reported")
+    }
+    if after := s.PublicAddr().String(); after != before {
+        t.Fatalf("Public address changed from %s to %s", before, after)
+    }
+}
+
+//behind a symmetric NAT the next server sees a mapping of its own, which isn't the
+//public address moving, so keepalives stay with it instead of going back to the
+//silent server to rediscover the address every time
+func TestKeepAliveFailoverSymmetric(t *testing.T) {
+    network := netsim.New(netsim.Config {})
+    servers, conns := startServers(t, network, "198.51.100.1", "198.51.100.2")
+    s := natSocket(t, network, netsim.Symmetric, Config {
+        Servers:           servers,
+        QueryTimeout:      100 * time.Millisecond,
+        KeepAliveInterval: 20 * time.Millisecond,
+    })
+    if !s.SymmetricNAT() || s.KeepAliveServer() != servers[0] {
+        t.Fatalf("Symmetric: %v, keepalives sent to %s", s.SymmetricNAT(), s.KeepAliveServer())
+    }
+    before := s.PublicAddr().String()
+
+    conns[0].Close()
+    deadline := time.After(5 * time.Second)
+    for s.KeepAliveServer() != servers[1] {
+        select {
+            case <-time.After(10 * time.Millisecond):
+            case <-deadline:
+                t.Fatal("Keepalives still sent to the silent server")
+        }
+    }
+    //long enough for several keepalives, and for the silent server to time out again
+    //if they went back to it
+    timeout := time.After(500 * time.Millisecond)
+    failures := 0
+    for done := false; !done; {
+        select {
+            case err := <-s.Errors():
+                //the failure that made it move on may still be queued
+                if strings.Contains(err.Error(), servers[0]) {
+                    failures++
+                }
+                if failures > 1 || strings.Contains(err.Error(), "changed") {
+                    t.Fatalf("Reported %v after failing over", err)
+                }
+            case <-timeout:
+                done = true
+        }
+        if got := s.KeepAliveServer(); got != servers[1] {
+            t.Fatalf("Keepalives sent to %s after failing over", got)
+        }
+    }
+    if after := s.PublicAddr().String(); after != before {
+        t.Fatalf("Public address changed from %s to %s", before, after)
+    }
+}